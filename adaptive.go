@@ -0,0 +1,44 @@
+package swnat
+
+// timeoutPressure returns where the number of connections of the table lies
+// between the adaptive watermarks, from 0 at or below AdaptiveLowWatermark
+// to 1 at or above AdaptiveHighWatermark. It is 0 without AdaptiveTimeouts.
+func (t *Table[IP]) timeoutPressure() float64 {
+	if !t.AdaptiveTimeouts || t.AdaptiveHighWatermark <= 0 {
+		return 0
+	}
+	n := 0
+	for _, p := range t.pairs() {
+		n += p.len()
+	}
+	low, high := t.AdaptiveLowWatermark, t.AdaptiveHighWatermark
+	switch {
+	case n >= high:
+		return 1
+	case n <= low || low >= high:
+		return 0
+	}
+	return float64(n-low) / float64(high-low)
+}
+
+// adaptTimeout shortens timeout toward AdaptiveMinTimeout by pressure, as
+// returned by timeoutPressure
+func (t *Table[IP]) adaptTimeout(timeout int64, pressure float64) int64 {
+	if pressure <= 0 || timeout <= t.AdaptiveMinTimeout {
+		return timeout
+	}
+	return timeout - int64(float64(timeout-t.AdaptiveMinTimeout)*pressure)
+}
+
+// adaptStates is adaptTimeout for TCP timeouts by state
+func (t *Table[IP]) adaptStates(s *stateTimeouts, pressure float64) *stateTimeouts {
+	if s == nil || pressure <= 0 {
+		return s
+	}
+	return &stateTimeouts{
+		synSent:     t.adaptTimeout(s.synSent, pressure),
+		established: t.adaptTimeout(s.established, pressure),
+		closing:     t.adaptTimeout(s.closing, pressure),
+		timeWait:    t.adaptTimeout(s.timeWait, pressure),
+	}
+}
@@ -239,4 +239,195 @@ func BenchmarkTableOperations(b *testing.B) {
 			ipv4Table.AddDropRule(ProtocolTCP, uint16(1000+i%100))
 		}
 	})
-}
\ No newline at end of file
+}
+
+func BenchmarkConnChurn(b *testing.B) {
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+	templates := make([][]byte, 1000)
+	for i := range templates {
+		templates[i] = CreateIPv4UDPPacket(client, server, uint16(10000+i), 53, nil)
+	}
+
+	for _, reuse := range []bool{false, true} {
+		b.Run(fmt.Sprintf("reuse-%v", reuse), func(b *testing.B) {
+			table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+			// Every new flow evicts the previous one
+			table.MaxConnPerNamespace = 1
+			table.ReuseConns = reuse
+			packet := make([]byte, len(templates[0]))
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				copy(packet, templates[i%len(templates)])
+				table.HandleOutboundPacket(packet, 1)
+			}
+		})
+	}
+}
+
+// BenchmarkHandleOutboundPacketParsed measures translation when the caller
+// already parsed the IP header, to compare with BenchmarkHandleOutboundPacket
+func BenchmarkHandleOutboundPacketParsed(b *testing.B) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+
+	packets := make([][]byte, 100)
+	for i := range packets {
+		srcIP := IPv4{192, 168, 1, byte(i)}
+		dstIP := IPv4{8, 8, 8, 8}
+		packets[i] = CreateIPv4UDPPacket(srcIP, dstIP, uint16(10000+i), 53, nil)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		packet := make([]byte, len(packets[i%100]))
+		copy(packet, packets[i%100])
+		ipHeader, _ := ParseIPv4Header(packet) // done by the caller for routing
+		table.HandleOutboundPacketParsed(packet, ipHeader, uintptr(i%10))
+	}
+}
+
+// BenchmarkAdversarialKeys compares lookups of flows whose tuples differ in
+// a single low-entropy field, as an attacker choosing source ports would
+// produce, with random tuples. Go seeds the hash of each map randomly, so
+// both should perform alike, see TestAdversarialKeys.
+func BenchmarkAdversarialKeys(b *testing.B) {
+	server := IPv4{8, 8, 8, 8}
+	for _, pattern := range []struct {
+		name   string
+		packet func(i int) []byte
+	}{
+		{"source-port-sweep", func(i int) []byte {
+			return CreateIPv4UDPPacket(IPv4{192, 168, 1, 1}, server, uint16(1024+i), 53, nil)
+		}},
+		{"random", func(i int) []byte {
+			src := IPv4{10, byte(rand.Intn(256)), byte(rand.Intn(256)), byte(rand.Intn(256))}
+			return CreateIPv4UDPPacket(src, server, uint16(rand.Intn(60000)+1024), 53, nil)
+		}},
+	} {
+		b.Run(pattern.name, func(b *testing.B) {
+			table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+			table.MaxConnPerNamespace = 0
+			packets := make([][]byte, 10000)
+			for i := range packets {
+				packets[i] = pattern.packet(i)
+				table.HandleOutboundPacket(append([]byte(nil), packets[i]...), 1)
+			}
+			buf := make([]byte, len(packets[0]))
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				copy(buf, packets[i%len(packets)])
+				table.HandleOutboundPacket(buf, 1)
+			}
+		})
+	}
+}
+
+// TestAdversarialKeys fails when flows whose tuples differ in a single
+// field, as an attacker choosing source ports produces, are looked up much
+// slower than random ones, as colliding hashes would make them. The bound
+// is loose: a collision attack turns each lookup into a scan of the table.
+// Being a timing comparison, it is skipped in short mode and under the race
+// detector, BenchmarkAdversarialKeys measuring the same lookups.
+func TestAdversarialKeys(t *testing.T) {
+	if testing.Short() || raceEnabled {
+		t.Skip("timing comparison, skipped in short mode and under the race detector")
+	}
+	const flows = 10000
+	server := IPv4{8, 8, 8, 8}
+	lookups := func(key func(i int) InternalKey[IPv4]) time.Duration {
+		table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+		table.MaxConnPerNamespace = 0
+		keys := make([]InternalKey[IPv4], flows)
+		for i := range keys {
+			keys[i] = key(i)
+			packet := CreateIPv4UDPPacket(keys[i].SrcIP, server, keys[i].SrcPort, 53, nil)
+			if err := table.HandleOutboundPacket(packet, 1); err != nil {
+				t.Fatalf("HandleOutboundPacket failed: %v", err)
+			}
+		}
+
+		// the best of a few rounds, to leave out scheduling noise
+		best := time.Duration(1<<63 - 1)
+		for round := 0; round < 5; round++ {
+			start := time.Now()
+			for _, k := range keys {
+				if table.UDP.lookupOutbound(k) == nil {
+					t.Fatalf("Flow %+v not found", k)
+				}
+			}
+			best = min(best, time.Since(start))
+		}
+		return best
+	}
+
+	sweep := lookups(func(i int) InternalKey[IPv4] {
+		return InternalKey[IPv4]{SrcIP: IPv4{192, 168, 1, 1}, DstIP: server, SrcPort: uint16(1024 + i), DstPort: 53, Namespace: 1}
+	})
+	r := rand.New(rand.NewSource(1))
+	random := lookups(func(i int) InternalKey[IPv4] {
+		src := IPv4{10, byte(i >> 8), byte(i), byte(r.Intn(256))}
+		return InternalKey[IPv4]{SrcIP: src, DstIP: server, SrcPort: uint16(r.Intn(60000) + 1024), DstPort: 53, Namespace: 1}
+	})
+	if sweep > 10*random {
+		t.Errorf("Lookups of a source port sweep took %v, %v for random flows", sweep, random)
+	}
+}
+
+// BenchmarkFlowCacheSkewed looks up 10000 flows, 90% of the lookups going
+// to 8 hot flows, from parallel goroutines, with and without
+// EnableFlowCache
+func BenchmarkFlowCacheSkewed(b *testing.B) {
+	server := IPv4{8, 8, 8, 8}
+	keys := make([]InternalKey[IPv4], 10000)
+	for _, size := range []int{0, 64} {
+		b.Run(fmt.Sprintf("cache-%d", size), func(b *testing.B) {
+			table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+			table.MaxConnPerNamespace = 0
+			table.EnableFlowCache(size)
+			for i := range keys {
+				src := IPv4{192, 168, byte(i >> 8), byte(i)}
+				keys[i] = InternalKey[IPv4]{SrcIP: src, DstIP: server, SrcPort: 5000, DstPort: 53, Namespace: 1}
+				table.HandleOutboundPacket(CreateIPv4UDPPacket(src, server, 5000, 53, nil), 1)
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				rng := rand.New(rand.NewSource(rand.Int63()))
+				for pb.Next() {
+					i := rng.Intn(8)
+					if rng.Intn(10) == 0 {
+						i = rng.Intn(len(keys))
+					}
+					if table.UDP.lookupOutbound(keys[i]) == nil {
+						b.Fatal("flow not found")
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkDropRules(b *testing.B) {
+	for _, n := range []int{1, 500} {
+		b.Run(fmt.Sprintf("rules-%d", n), func(b *testing.B) {
+			table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+			for i := 0; i < n; i++ {
+				table.AddDropRule(ProtocolUDP, uint16(1000+i))
+				table.AddRedirectRule(ProtocolUDP, IPv4{10, 0, byte(i >> 8), byte(i)}, 53, IPv4{10, 1, 0, 1}, 53)
+			}
+			orig := CreateIPv4UDPPacket(IPv4{192, 168, 1, 100}, IPv4{8, 8, 8, 8}, 5000, 53, nil)
+			packet := make([]byte, len(orig))
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				copy(packet, orig)
+				if err := table.HandleOutboundPacket(packet, 1); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package swnat
+
+import "time"
+
+// Clock is a time source for the table, see Table.SetClock
+type Clock interface {
+	Now() int64     // Unix time in seconds
+	NowNano() int64 // Unix time in nanoseconds
+}
+
+// systemClock is the Clock of the system time
+type systemClock struct{}
+
+func (systemClock) Now() int64     { return time.Now().Unix() }
+func (systemClock) NowNano() int64 { return time.Now().UnixNano() }
+
+// SetClock makes c the time source of the table, for timestamps in seconds
+// (it replaces Now) and in nanoseconds alike. A nil clock restores the
+// system time.
+func (t *Table[IP]) SetClock(c Clock) {
+	if c == nil {
+		c = systemClock{}
+	}
+	t.clock = c
+	t.Now = c.Now
+}
+
+// nowNano returns the current time in Unix nanoseconds from the clock set
+// by SetClock, or the system time. Setting Now alone doesn't change it.
+func (t *Table[IP]) nowNano() int64 {
+	if t.clock == nil {
+		return time.Now().UnixNano()
+	}
+	return t.clock.NowNano()
+}
@@ -0,0 +1,304 @@
+package swnat
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Config holds the settings of a table. Zero values select the defaults
+// used by NewIPv4.
+type Config struct {
+	ExternalIP net.IP
+
+	// OwnedExternalPrefix, when set, is passed to SetOwnedExternalPrefix
+	OwnedExternalPrefix *net.IPNet
+
+	// Outside ports allocated to TCP and UDP connections, defaults to
+	// 49152-65535
+	PortRangeStart uint16
+	PortRangeEnd   uint16
+
+	// MaxConnPerNamespace defaults to 200, a negative value disables the
+	// limit
+	MaxConnPerNamespace int
+
+	// MaxHalfOpenPerNamespace caps unanswered outbound SYNs, 0 disables it
+	MaxHalfOpenPerNamespace int
+
+	// MaxTotalConn caps the connections of each protocol, 0 disables it.
+	// GlobalEvictionPolicy picks whom to evict once it is reached.
+	MaxTotalConn         int
+	GlobalEvictionPolicy GlobalEvictionPolicy
+
+	// MaxPortsPerInternalIP caps the ports of each internal host, 0
+	// disables it
+	MaxPortsPerInternalIP int
+
+	// MaxICMPToDestination caps the echo flows of a namespace to a single
+	// destination, 0 disables it
+	MaxICMPToDestination int
+
+	// Protocol timeouts in seconds
+	TCPTimeout  int64
+	UDPTimeout  int64
+	ICMPTimeout int64
+	DCCPTimeout int64
+	ESPTimeout  int64
+
+	// UnknownProtocolTimeout defaults to 600
+	UnknownProtocolTimeout int64
+
+	// TCP timeouts by state, see Table.TCPClosingTimeout. TCPSynTimeout
+	// defaults to 120.
+	TCPSynTimeout         int64
+	TCPEstablishedTimeout int64
+	TCPClosingTimeout     int64
+	TCPTimeWaitTimeout    int64
+
+	// MaxConnAge caps the lifetime of connections in seconds, 0 disables it
+	MaxConnAge int64
+
+	// DrainGracePeriod bounds the life of connections on a drained port,
+	// in seconds, 0 leaves them to expire normally
+	DrainGracePeriod int64
+
+	// PortReuseDelay keeps released ports out of the pool for that many
+	// seconds, 0 disables it
+	PortReuseDelay int64
+
+	// AdaptiveTimeouts shrinks idle timeouts down to AdaptiveMinTimeout
+	// seconds as the table grows from AdaptiveLowWatermark to
+	// AdaptiveHighWatermark connections
+	AdaptiveTimeouts      bool
+	AdaptiveLowWatermark  int
+	AdaptiveHighWatermark int
+	AdaptiveMinTimeout    int64
+
+	DropMartians       bool
+	AdoptExistingFlows bool
+	EnableQUICALG      bool
+	QUICPort           uint16 // defaults to 443
+	PortLowWatermark   int
+	PriorityEviction   bool
+	ReuseConns         bool
+	SkipChecksums      bool
+	CoupledPorts       bool
+
+	// PreserveICMPID keeps the identifier of echo requests when it is free
+	PreserveICMPID bool
+
+	// ZeroIDForDF clears the IP Identification of outbound atomic datagrams
+	ZeroIDForDF bool
+
+	// RecordModifications enables Table.LastModification
+	RecordModifications bool
+
+	// StrictInternalSource drops outbound packets from outside the prefixes
+	// registered for their namespace
+	StrictInternalSource bool
+
+	// SelfHeal checks inbound lookups against the internal key, see
+	// Table.SelfHealRepairs
+	SelfHeal bool
+
+	// CapturePayloadBytes is how much outbound payload is kept per
+	// connection, 0 disables the capture
+	CapturePayloadBytes int
+
+	// NoMatchPortLimit bounds the ports counted by Table.NoMatchPortStats
+	NoMatchPortLimit int
+
+	// MeasureSetupLatency has Stats report connection setup times
+	MeasureSetupLatency bool
+
+	// SweepBehavior selects whether connections closed by a FIN or RST
+	// translate packets until the next maintenance
+	SweepBehavior SweepBehavior
+
+	UnknownProtocolPolicy UnknownProtocolPolicy
+
+	// Clock, when set, is the time source of the table, see Table.SetClock
+	Clock Clock
+
+	// Protocols lists the protocols the table translates. It is reported
+	// by Table.Config and ignored by NewIPv4WithConfig.
+	Protocols []uint8
+}
+
+// NewIPv4WithConfig returns a new IPv4 NAT table configured from cfg
+func NewIPv4WithConfig(cfg Config) (NAT, error) {
+	ip4 := cfg.ExternalIP.To4()
+	if ip4 == nil {
+		return nil, errors.New("external IP is not a valid IPv4 address")
+	}
+	t, err := newTable[IPv4](cfg)
+	if err != nil {
+		return nil, err
+	}
+	copy(t.externalIP[:], ip4)
+
+	if cfg.OwnedExternalPrefix != nil {
+		if err := t.SetOwnedExternalPrefix(*cfg.OwnedExternalPrefix); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// newTable returns a table configured from cfg, without its external IP
+func newTable[IP comparable](cfg Config) (*Table[IP], error) {
+	start, end := cfg.PortRangeStart, cfg.PortRangeEnd
+	if start == 0 {
+		start = 49152
+	}
+	if end == 0 {
+		end = 65535
+	}
+	if start >= end {
+		return nil, fmt.Errorf("invalid port range %d-%d", start, end)
+	}
+
+	t := &Table[IP]{
+		nextPort:            uint32(start),
+		maxPort:             uint32(end),
+		MaxConnPerNamespace: orDefault(cfg.MaxConnPerNamespace, 200),
+		TCPTimeout:          orDefault(cfg.TCPTimeout, 86400),  // 24 hours
+		UDPTimeout:          orDefault(cfg.UDPTimeout, 180),    // 3 minutes
+		ICMPTimeout:         orDefault(cfg.ICMPTimeout, 30),    // 30 seconds
+		DCCPTimeout:         orDefault(cfg.DCCPTimeout, 86400), // 24 hours
+		ESPTimeout:          orDefault(cfg.ESPTimeout, 600),    // 10 minutes
+		MaxConnAge:          cfg.MaxConnAge,
+		DropMartians:        cfg.DropMartians,
+		AdoptExistingFlows:  cfg.AdoptExistingFlows,
+		EnableQUICALG:       cfg.EnableQUICALG,
+		QUICPort:            orDefault(cfg.QUICPort, 443),
+		PortLowWatermark:    cfg.PortLowWatermark,
+		PriorityEviction:    cfg.PriorityEviction,
+		ReuseConns:          cfg.ReuseConns,
+		SkipChecksums:       cfg.SkipChecksums,
+		CoupledPorts:        cfg.CoupledPorts,
+		DrainGracePeriod:    cfg.DrainGracePeriod,
+		PreserveICMPID:      cfg.PreserveICMPID,
+		PortReuseDelay:      cfg.PortReuseDelay,
+		ZeroIDForDF:         cfg.ZeroIDForDF,
+		RecordModifications: cfg.RecordModifications,
+		SelfHeal:            cfg.SelfHeal,
+		CapturePayloadBytes: cfg.CapturePayloadBytes,
+		NoMatchPortLimit:    cfg.NoMatchPortLimit,
+		MeasureSetupLatency: cfg.MeasureSetupLatency,
+		SweepBehavior:       cfg.SweepBehavior,
+
+		MaxHalfOpenPerNamespace: cfg.MaxHalfOpenPerNamespace,
+		MaxTotalConn:            cfg.MaxTotalConn,
+		GlobalEvictionPolicy:    cfg.GlobalEvictionPolicy,
+		MaxPortsPerInternalIP:   cfg.MaxPortsPerInternalIP,
+		StrictInternalSource:    cfg.StrictInternalSource,
+		MaxICMPToDestination:    cfg.MaxICMPToDestination,
+
+		AdaptiveTimeouts:      cfg.AdaptiveTimeouts,
+		AdaptiveLowWatermark:  cfg.AdaptiveLowWatermark,
+		AdaptiveHighWatermark: cfg.AdaptiveHighWatermark,
+		AdaptiveMinTimeout:    cfg.AdaptiveMinTimeout,
+
+		TCPSynTimeout:         orDefault(cfg.TCPSynTimeout, 120), // 2 minutes
+		TCPEstablishedTimeout: cfg.TCPEstablishedTimeout,
+		TCPClosingTimeout:     cfg.TCPClosingTimeout,
+		TCPTimeWaitTimeout:    cfg.TCPTimeWaitTimeout,
+
+		UnknownProtocolPolicy:  cfg.UnknownProtocolPolicy,
+		UnknownProtocolTimeout: orDefault(cfg.UnknownProtocolTimeout, 600), // 10 minutes
+	}
+	t.init()
+	if cfg.Clock != nil {
+		t.SetClock(cfg.Clock)
+	}
+	return t, nil
+}
+
+// Config returns the effective configuration of the table, including
+// changes made to its fields after construction
+func (t *Table[IP]) Config() Config {
+	external := t.externalIP
+	cfg := Config{
+		ExternalIP:          net.IP(append([]byte(nil), ipBytes(&external)...)),
+		PortRangeStart:      uint16(t.nextPort),
+		PortRangeEnd:        uint16(t.maxPort),
+		MaxConnPerNamespace: t.MaxConnPerNamespace,
+		TCPTimeout:          t.TCPTimeout,
+		UDPTimeout:          t.UDPTimeout,
+		ICMPTimeout:         t.ICMPTimeout,
+		DCCPTimeout:         t.DCCPTimeout,
+		ESPTimeout:          t.ESPTimeout,
+		MaxConnAge:          t.MaxConnAge,
+		DropMartians:        t.DropMartians,
+		AdoptExistingFlows:  t.AdoptExistingFlows,
+		EnableQUICALG:       t.EnableQUICALG,
+		QUICPort:            t.QUICPort,
+		PortLowWatermark:    t.PortLowWatermark,
+		PriorityEviction:    t.PriorityEviction,
+		ReuseConns:          t.ReuseConns,
+		SkipChecksums:       t.SkipChecksums,
+		CoupledPorts:        t.CoupledPorts,
+		DrainGracePeriod:    t.DrainGracePeriod,
+		PreserveICMPID:      t.PreserveICMPID,
+		PortReuseDelay:      t.PortReuseDelay,
+		ZeroIDForDF:         t.ZeroIDForDF,
+		RecordModifications: t.RecordModifications,
+		SelfHeal:            t.SelfHeal,
+		CapturePayloadBytes: t.CapturePayloadBytes,
+		NoMatchPortLimit:    t.NoMatchPortLimit,
+		MeasureSetupLatency: t.MeasureSetupLatency,
+		SweepBehavior:       t.SweepBehavior,
+		Protocols:           t.protocols(),
+
+		MaxHalfOpenPerNamespace: t.MaxHalfOpenPerNamespace,
+		MaxTotalConn:            t.MaxTotalConn,
+		GlobalEvictionPolicy:    t.GlobalEvictionPolicy,
+		MaxPortsPerInternalIP:   t.MaxPortsPerInternalIP,
+		StrictInternalSource:    t.StrictInternalSource,
+		MaxICMPToDestination:    t.MaxICMPToDestination,
+
+		AdaptiveTimeouts:      t.AdaptiveTimeouts,
+		AdaptiveLowWatermark:  t.AdaptiveLowWatermark,
+		AdaptiveHighWatermark: t.AdaptiveHighWatermark,
+		AdaptiveMinTimeout:    t.AdaptiveMinTimeout,
+
+		TCPSynTimeout:         t.TCPSynTimeout,
+		TCPEstablishedTimeout: t.TCPEstablishedTimeout,
+		TCPClosingTimeout:     t.TCPClosingTimeout,
+		TCPTimeWaitTimeout:    t.TCPTimeWaitTimeout,
+
+		UnknownProtocolPolicy:  t.UnknownProtocolPolicy,
+		UnknownProtocolTimeout: t.UnknownProtocolTimeout,
+
+		Clock: t.clock,
+	}
+	if cfg.MaxConnPerNamespace == 0 {
+		// zero means unlimited on the table itself
+		cfg.MaxConnPerNamespace = -1
+	}
+	if owned := t.owned.Load(); owned != nil {
+		network := *owned.network
+		cfg.OwnedExternalPrefix = &network
+	}
+	return cfg
+}
+
+// protocols returns the protocols the table translates, which depend on
+// its address family
+func (t *Table[IP]) protocols() []uint8 {
+	if _, v6 := any(t.externalIP).(IPv6); v6 {
+		return []uint8{ProtocolICMPv6, ProtocolTCP, ProtocolUDP}
+	}
+	return []uint8{ProtocolICMP, ProtocolTCP, ProtocolUDP, ProtocolDCCP, ProtocolESP}
+}
+
+// orDefault returns v, or def if v is the zero value
+func orDefault[T comparable](v, def T) T {
+	var zero T
+	if v == zero {
+		return def
+	}
+	return v
+}
@@ -0,0 +1,300 @@
+package swnat
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// DCCP packet types
+const (
+	DCCPTypeRequest  = 0
+	DCCPTypeResponse = 1
+	DCCPTypeData     = 2
+	DCCPTypeAck      = 3
+	DCCPTypeDataAck  = 4
+	DCCPTypeCloseReq = 5
+	DCCPTypeClose    = 6
+	DCCPTypeReset    = 7
+	DCCPTypeSync     = 8
+	DCCPTypeSyncAck  = 9
+)
+
+// DCCPHeader holds the fields of the DCCP generic header (RFC 4340) the NAT
+// cares about
+type DCCPHeader struct {
+	SourcePort      uint16
+	DestinationPort uint16
+	DataOffset      uint8 // header length in 32-bit words
+	CCVal           uint8
+	CsCov           uint8 // checksum coverage, 0 for the whole packet
+	Checksum        uint16
+	Type            uint8
+	X               bool // extended sequence numbers
+}
+
+func ParseDCCPHeader(packet []byte, offset int) (*DCCPHeader, error) {
+	if len(packet) < offset+12 {
+		return nil, fmt.Errorf("packet too short for DCCP header")
+	}
+
+	h := &DCCPHeader{}
+	h.SourcePort = binary.BigEndian.Uint16(packet[offset : offset+2])
+	h.DestinationPort = binary.BigEndian.Uint16(packet[offset+2 : offset+4])
+	h.DataOffset = packet[offset+4]
+	h.CCVal = packet[offset+5] >> 4
+	h.CsCov = packet[offset+5] & 0x0f
+	h.Checksum = binary.BigEndian.Uint16(packet[offset+6 : offset+8])
+	h.Type = (packet[offset+8] >> 1) & 0x0f
+	h.X = packet[offset+8]&0x01 != 0
+
+	if int(h.DataOffset)*4 < 12 || len(packet) < offset+int(h.DataOffset)*4 {
+		return nil, fmt.Errorf("invalid DCCP data offset %d", h.DataOffset)
+	}
+	return h, nil
+}
+
+func (h *DCCPHeader) Marshal(packet []byte, offset int) {
+	binary.BigEndian.PutUint16(packet[offset:offset+2], h.SourcePort)
+	binary.BigEndian.PutUint16(packet[offset+2:offset+4], h.DestinationPort)
+	packet[offset+4] = h.DataOffset
+	packet[offset+5] = h.CCVal<<4 | h.CsCov&0x0f
+	binary.BigEndian.PutUint16(packet[offset+6:offset+8], h.Checksum)
+	packet[offset+8] = packet[offset+8]&0xe0 | (h.Type&0x0f)<<1
+	if h.X {
+		packet[offset+8] |= 0x01
+	}
+}
+
+// calculateDCCPChecksum computes the checksum of a DCCP packet. Unlike UDP
+// and TCP, the sender may restrict it to the header and the first
+// (CsCov-1)*4 bytes of application data, while the pseudo-header always
+// carries the full length.
+func calculateDCCPChecksum(srcIP, dstIP IPv4, dccpData []byte) uint16 {
+	pseudoHeader := make([]byte, 12)
+	copy(pseudoHeader[0:4], srcIP[:])
+	copy(pseudoHeader[4:8], dstIP[:])
+	pseudoHeader[9] = ProtocolDCCP
+	binary.BigEndian.PutUint16(pseudoHeader[10:12], uint16(len(dccpData)))
+
+	covered := dccpData
+	if csCov := int(dccpData[5] & 0x0f); csCov > 0 {
+		n := int(dccpData[4])*4 + (csCov-1)*4
+		if n < len(covered) {
+			covered = covered[:n]
+		}
+	}
+
+	sum := uint32(0)
+	for i := 0; i < len(pseudoHeader); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(pseudoHeader[i : i+2]))
+	}
+
+	for i := 0; i < len(covered); i += 2 {
+		if i+1 < len(covered) {
+			sum += uint32(binary.BigEndian.Uint16(covered[i : i+2]))
+		} else {
+			sum += uint32(covered[i]) << 8
+		}
+	}
+
+	for (sum >> 16) > 0 {
+		sum = (sum & 0xFFFF) + (sum >> 16)
+	}
+	return uint16(^sum)
+}
+
+// dccpPacket returns the DCCP packet as bounded by the IP total length, as
+// DCCP has no length field of its own
+func dccpPacket(packet []byte, ipHeader *IPv4Header, ipHeaderLen int) ([]byte, error) {
+	end := int(ipHeader.TotalLength)
+	if end < ipHeaderLen+12 || end > len(packet) {
+		return nil, fmt.Errorf("invalid IP total length %d for DCCP", ipHeader.TotalLength)
+	}
+	return packet[ipHeaderLen:end], nil
+}
+
+func (t *Table[IP]) handleOutboundDCCP(packet []byte, ipHeader *IPv4Header, ipHeaderLen int, namespace uintptr, now int64, res *OutboundResult[IP]) error {
+	dccpData, err := dccpPacket(packet, ipHeader, ipHeaderLen)
+	if err != nil {
+		return err
+	}
+	dccpHeader, err := ParseDCCPHeader(dccpData, 0)
+	if err != nil {
+		return fmt.Errorf("failed to parse DCCP header: %w", err)
+	}
+
+	// Check drop rules
+	if t.DCCP.checkDropRule(dccpHeader.DestinationPort) {
+		return ErrDropPacket
+	}
+
+	// Create internal key for lookup
+	internalKey := InternalKey[IP]{
+		SrcIP:     any(ipHeader.SourceIP).(IP),
+		DstIP:     any(ipHeader.DestinationIP).(IP),
+		SrcPort:   dccpHeader.SourcePort,
+		DstPort:   dccpHeader.DestinationPort,
+		Namespace: namespace,
+	}
+
+	// Check if connection already exists
+	conn := t.unlessSwept(&t.DCCP, t.DCCP.lookupOutbound(internalKey))
+	created := conn == nil
+	if conn == nil {
+		// Only a Request opens a new flow, unless mid-stream flows are adopted
+		if dccpHeader.Type != DCCPTypeRequest && !t.AdoptExistingFlows {
+			return ErrDropPacket
+		}
+
+		// Check redirect rules
+		targetDstIP := any(ipHeader.DestinationIP).(IP)
+		targetDstPort := dccpHeader.DestinationPort
+		rule, shouldRedirect := t.DCCP.checkRedirectRule(targetDstIP, targetDstPort)
+
+		if shouldRedirect {
+			targetDstIP = rule.NewDstIP
+			targetDstPort = rule.NewDstPort
+		}
+
+		if isLoop(internalKey.SrcIP, internalKey.SrcPort, targetDstIP, targetDstPort) {
+			return ErrLoopDetected
+		}
+
+		// Create new connection, keeping the original source for pure DNAT
+		outsideIP, outsidePort := internalKey.SrcIP, internalKey.SrcPort
+		if !rule.PreserveSource {
+			if err := t.checkPortWatermark(&t.DCCP, namespace); err != nil {
+				return err
+			}
+			if err := t.checkSourcePorts(&t.DCCP, internalKey.SrcIP); err != nil {
+				return err
+			}
+			outsideIP, outsidePort, err = t.allocateExternal(&t.DCCP, ProtocolDCCP, internalKey, targetDstIP, targetDstPort)
+			if err != nil {
+				return err
+			}
+		}
+		conn = t.newConn(&t.DCCP, Conn[IP]{
+			LastSeen:           now,
+			CreatedAt:          now,
+			LastOutbound:       now,
+			PacketsOut:         1,
+			BytesOut:           uint64(len(packet)),
+			DSCP:               ipHeader.DSCP(),
+			Protocol:           ProtocolDCCP,
+			Namespace:          namespace,
+			LocalSrcIP:         any(ipHeader.SourceIP).(IP),
+			LocalSrcPort:       dccpHeader.SourcePort,
+			LocalDstIp:         any(ipHeader.DestinationIP).(IP),
+			LocalDstPort:       dccpHeader.DestinationPort,
+			OutsideSrcIP:       outsideIP,
+			OutsideSrcPort:     outsidePort,
+			OutsideDstIP:       targetDstIP,
+			OutsideDstPort:     targetDstPort,
+			RewriteDestination: shouldRedirect,
+			PreserveSource:     rule.PreserveSource,
+			InboundInitiated:   rule.PreserveSource,
+			allocator:          t.portAllocator(),
+		})
+		if err := t.admitConn(&t.DCCP, conn); err != nil {
+			return err
+		}
+		if err := t.addConn(&t.DCCP, conn); err != nil {
+			return err
+		}
+	} else {
+		t.DCCP.updateLastOutbound(conn, now, ipHeader.DSCP(), len(packet))
+	}
+	t.capturePayload(&t.DCCP, conn, dccpData, int(dccpHeader.DataOffset)*4, len(dccpData))
+
+	// Rewrite packet
+	ipHeader.SourceIP = any(conn.OutsideSrcIP).(IPv4)
+	dccpHeader.SourcePort = conn.OutsideSrcPort
+
+	// If destination should be rewritten, do it
+	if conn.RewriteDestination {
+		ipHeader.DestinationIP = any(conn.OutsideDstIP).(IPv4)
+		dccpHeader.DestinationPort = conn.OutsideDstPort
+	}
+
+	// Update headers in packet
+	ipHeader.Marshal(packet)
+	dccpHeader.Marshal(dccpData, 0)
+
+	// Recalculate DCCP checksum
+	binary.BigEndian.PutUint16(dccpData[6:8], 0) // Clear checksum
+	if !t.SkipChecksums {
+		checksum := calculateDCCPChecksum(ipHeader.SourceIP, ipHeader.DestinationIP, dccpData)
+		binary.BigEndian.PutUint16(dccpData[6:8], checksum)
+	}
+
+	// Check if this is a connection termination
+	if dccpHeader.Type == DCCPTypeClose || dccpHeader.Type == DCCPTypeReset {
+		t.DCCP.markForSweep(conn)
+	}
+
+	res.set(conn, created)
+	return nil
+}
+
+func (t *Table[IP]) handleInboundDCCP(packet []byte, ipHeader *IPv4Header, ipHeaderLen int, now int64) (uintptr, error) {
+	dccpData, err := dccpPacket(packet, ipHeader, ipHeaderLen)
+	if err != nil {
+		return 0, err
+	}
+	dccpHeader, err := ParseDCCPHeader(dccpData, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse DCCP header: %w", err)
+	}
+
+	// Create external key for lookup
+	externalKey := ExternalKey[IP]{
+		SrcIP:   any(ipHeader.SourceIP).(IP),
+		DstIP:   any(ipHeader.DestinationIP).(IP),
+		SrcPort: dccpHeader.SourcePort,
+		DstPort: dccpHeader.DestinationPort,
+	}
+	externalKey.DstIP = t.inboundDst(&t.DCCP, externalKey)
+
+	// Look up connection
+	conn, err := t.lookupInbound(&t.DCCP, externalKey)
+	if err != nil {
+		return 0, err
+	}
+	if conn == nil {
+		// No matching connection, drop packet
+		t.countNoMatch(dccpHeader.DestinationPort)
+		return 0, ErrDropPacket
+	}
+
+	// Update last seen
+	t.DCCP.updateLastInbound(conn, now, len(packet))
+
+	// Rewrite packet to restore original addresses
+	ipHeader.DestinationIP = any(conn.LocalSrcIP).(IPv4)
+	dccpHeader.DestinationPort = conn.LocalSrcPort
+
+	// If this was a redirected connection, restore source to what client expects
+	if conn.RewriteDestination {
+		ipHeader.SourceIP = any(conn.LocalDstIp).(IPv4)
+		dccpHeader.SourcePort = conn.LocalDstPort
+	}
+
+	// Update headers in packet
+	ipHeader.Marshal(packet)
+	dccpHeader.Marshal(dccpData, 0)
+
+	// Recalculate DCCP checksum
+	binary.BigEndian.PutUint16(dccpData[6:8], 0) // Clear checksum
+	if !t.SkipChecksums {
+		checksum := calculateDCCPChecksum(ipHeader.SourceIP, ipHeader.DestinationIP, dccpData)
+		binary.BigEndian.PutUint16(dccpData[6:8], checksum)
+	}
+
+	// Check if this is a connection termination
+	if dccpHeader.Type == DCCPTypeClose || dccpHeader.Type == DCCPTypeReset {
+		t.DCCP.markForSweep(conn)
+	}
+
+	return conn.Namespace, nil
+}
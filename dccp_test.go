@@ -0,0 +1,119 @@
+package swnat
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// createIPv4DCCPPacket creates a DCCP packet with extended sequence numbers
+// and the given checksum coverage
+func createIPv4DCCPPacket(srcIP, dstIP IPv4, srcPort, dstPort uint16, pktType, csCov uint8, data []byte) []byte {
+	totalLen := 20 + 16 + len(data)
+	packet := make([]byte, totalLen)
+
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:4], uint16(totalLen))
+	packet[8] = 64
+	packet[9] = ProtocolDCCP
+	copy(packet[12:16], srcIP[:])
+	copy(packet[16:20], dstIP[:])
+	binary.BigEndian.PutUint16(packet[10:12], calculateIPv4Checksum(packet[:20]))
+
+	h := &DCCPHeader{
+		SourcePort:      srcPort,
+		DestinationPort: dstPort,
+		DataOffset:      4,
+		CsCov:           csCov,
+		Type:            pktType,
+		X:               true,
+	}
+	h.Marshal(packet, 20)
+	copy(packet[36:], data)
+	binary.BigEndian.PutUint16(packet[26:28], calculateDCCPChecksum(srcIP, dstIP, packet[20:]))
+	return packet
+}
+
+func verifyDCCPChecksum(packet []byte) bool {
+	src := IPv4{packet[12], packet[13], packet[14], packet[15]}
+	dst := IPv4{packet[16], packet[17], packet[18], packet[19]}
+	return calculateDCCPChecksum(src, dst, packet[20:]) == 0
+}
+
+func TestDCCPHeaderRoundTrip(t *testing.T) {
+	packet := createIPv4DCCPPacket(IPv4{1, 1, 1, 1}, IPv4{2, 2, 2, 2}, 5004, 6000, DCCPTypeDataAck, 3, []byte("covered!uncovered"))
+	h, err := ParseDCCPHeader(packet, 20)
+	if err != nil {
+		t.Fatalf("ParseDCCPHeader failed: %v", err)
+	}
+	if h.SourcePort != 5004 || h.DestinationPort != 6000 || h.Type != DCCPTypeDataAck || !h.X || h.CsCov != 3 || h.DataOffset != 4 {
+		t.Errorf("Unexpected header %+v", h)
+	}
+	if !verifyDCCPChecksum(packet) {
+		t.Error("Invalid checksum")
+	}
+
+	// Data beyond the coverage isn't checksummed
+	packet[len(packet)-1] ^= 0xff
+	if !verifyDCCPChecksum(packet) {
+		t.Error("Checksum covers bytes outside CsCov")
+	}
+	packet[36] ^= 0xff
+	if verifyDCCPChecksum(packet) {
+		t.Error("Checksum doesn't cover the first data word")
+	}
+}
+
+func TestIPv4TableDCCP(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	// Only a Request opens a flow
+	data := createIPv4DCCPPacket(client, server, 5004, 6000, DCCPTypeData, 0, nil)
+	if err := table.HandleOutboundPacket(data, 1); err != ErrDropPacket {
+		t.Errorf("Expected ErrDropPacket for Data without a flow, got %v", err)
+	}
+
+	request := createIPv4DCCPPacket(client, server, 5004, 6000, DCCPTypeRequest, 0, []byte("service"))
+	if err := table.HandleOutboundPacket(request, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	header, _ := ParseIPv4Header(request)
+	dccp, _ := ParseDCCPHeader(request, 20)
+	if header.SourceIP != table.externalIP || dccp.SourcePort == 5004 {
+		t.Errorf("Request not translated: %s:%d", header.SourceIP, dccp.SourcePort)
+	}
+	if dccp.Type != DCCPTypeRequest || !dccp.X {
+		t.Errorf("Request type bits changed: %+v", dccp)
+	}
+	if !verifyDCCPChecksum(request) {
+		t.Error("Invalid DCCP checksum on outbound Request")
+	}
+
+	response := createIPv4DCCPPacket(server, table.externalIP, 6000, dccp.SourcePort, DCCPTypeResponse, 2, []byte("accepted"))
+	namespace, err := table.HandleInboundPacket(response)
+	if err != nil {
+		t.Fatalf("HandleInboundPacket failed: %v", err)
+	}
+	if namespace != 1 {
+		t.Errorf("Expected namespace 1, got %d", namespace)
+	}
+	header, _ = ParseIPv4Header(response)
+	dccp, _ = ParseDCCPHeader(response, 20)
+	if header.DestinationIP != client || dccp.DestinationPort != 5004 {
+		t.Errorf("Response not translated back: %s:%d", header.DestinationIP, dccp.DestinationPort)
+	}
+	if !verifyDCCPChecksum(response) {
+		t.Error("Invalid DCCP checksum on inbound Response")
+	}
+
+	// Close marks the flow for removal
+	closing := createIPv4DCCPPacket(client, server, 5004, 6000, DCCPTypeClose, 0, nil)
+	table.HandleOutboundPacket(closing, 1)
+	table.RunMaintenance(table.Now())
+	if n := table.DCCP.len(); n != 0 {
+		t.Errorf("Expected closed flow to be swept, %d left", n)
+	}
+}
@@ -3,5 +3,15 @@ package swnat
 import "errors"
 
 var (
-	ErrDropPacket = errors.New("packet should be dropped")
+	ErrDropPacket         = errors.New("packet should be dropped")
+	ErrLoopDetected       = errors.New("packet loop detected")
+	ErrPortsLow           = errors.New("free ports below low watermark")
+	ErrPortExhausted      = errors.New("no external port left for the flow")
+	ErrConnRefused        = errors.New("connection refused by AllowConn")
+	ErrUnknownDirection   = errors.New("packet direction can't be inferred")
+	ErrSynFlood           = errors.New("too many half-open connections")
+	ErrTooManyPorts       = errors.New("internal host holds too many external ports")
+	ErrSpoofedSource      = errors.New("source address outside the namespace prefixes")
+	ErrICMPFlood          = errors.New("too many ICMP flows to the destination")
+	ErrWrongAddressFamily = errors.New("packet IP version doesn't match the table's address family")
 )
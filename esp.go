@@ -0,0 +1,120 @@
+package swnat
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ESP carries no ports, only the SPI of the security association, which is
+// chosen by the receiver and so differs between directions. Connections are
+// therefore keyed on the addresses alone: an ESP peer can only be reached
+// through a given external IP by one internal host at a time, the usual
+// limitation of IPsec passthrough. Hosts needing more use NAT-T, which wraps
+// ESP in UDP.
+//
+// The SPI of inbound packets is learned from the first one and packets with
+// another SPI are dropped, until the internal host starts sending with a
+// new SPI, after a rekey, and the next inbound SPI is learned again.
+
+// espSPI returns the SPI of the ESP packet following the IP header
+func espSPI(packet []byte, ipHeader *IPv4Header, ipHeaderLen int) (uint32, error) {
+	if int(ipHeader.TotalLength) < ipHeaderLen+8 {
+		return 0, fmt.Errorf("packet too short for ESP header")
+	}
+	spi := binary.BigEndian.Uint32(packet[ipHeaderLen : ipHeaderLen+4])
+	if spi == 0 {
+		// reserved, never sent on the wire
+		return 0, fmt.Errorf("invalid ESP SPI 0")
+	}
+	return spi, nil
+}
+
+func (t *Table[IP]) handleOutboundESP(packet []byte, ipHeader *IPv4Header, ipHeaderLen int, namespace uintptr, now int64, res *OutboundResult[IP]) error {
+	spi, err := espSPI(packet, ipHeader, ipHeaderLen)
+	if err != nil {
+		return err
+	}
+
+	internalKey := InternalKey[IP]{
+		SrcIP:     any(ipHeader.SourceIP).(IP),
+		DstIP:     any(ipHeader.DestinationIP).(IP),
+		Namespace: namespace,
+	}
+
+	conn := t.ESP.lookupOutbound(internalKey)
+	created := conn == nil
+	if conn == nil {
+		outsideIP := t.pickExternalIP(ProtocolESP)
+		peerKey := ExternalKey[IP]{SrcIP: internalKey.DstIP, DstIP: outsideIP}
+		if t.ESP.lookupInbound(peerKey) != nil {
+			// another internal host already talks to this peer
+			return ErrDropPacket
+		}
+		conn = t.newConn(&t.ESP, Conn[IP]{
+			LastSeen:     now,
+			CreatedAt:    now,
+			LastOutbound: now,
+			PacketsOut:   1,
+			BytesOut:     uint64(len(packet)),
+			DSCP:         ipHeader.DSCP(),
+			Protocol:     ProtocolESP,
+			Namespace:    namespace,
+			LocalSrcIP:   internalKey.SrcIP,
+			LocalDstIp:   internalKey.DstIP,
+			OutsideSrcIP: outsideIP,
+			OutsideDstIP: internalKey.DstIP,
+		})
+		if err := t.admitConn(&t.ESP, conn); err != nil {
+			return err
+		}
+		if err := t.addConn(&t.ESP, conn); err != nil {
+			return err
+		}
+	} else {
+		t.ESP.updateLastOutbound(conn, now, ipHeader.DSCP(), len(packet))
+	}
+	if conn.espSPIOut != spi {
+		// new security association, the peer's SPI will change too
+		conn.espSPIOut = spi
+		conn.espSPIIn = 0
+	}
+
+	ipHeader.SourceIP = any(conn.OutsideSrcIP).(IPv4)
+	ipHeader.Marshal(packet)
+
+	res.set(conn, created)
+	return nil
+}
+
+func (t *Table[IP]) handleInboundESP(packet []byte, ipHeader *IPv4Header, ipHeaderLen int, now int64) (uintptr, error) {
+	spi, err := espSPI(packet, ipHeader, ipHeaderLen)
+	if err != nil {
+		return 0, err
+	}
+
+	externalKey := ExternalKey[IP]{
+		SrcIP: any(ipHeader.SourceIP).(IP),
+		DstIP: any(ipHeader.DestinationIP).(IP),
+	}
+	externalKey.DstIP = t.inboundDst(&t.ESP, externalKey)
+
+	conn, err := t.lookupInbound(&t.ESP, externalKey)
+	if err != nil {
+		return 0, err
+	}
+	if conn == nil {
+		return 0, ErrDropPacket
+	}
+	if conn.espSPIIn == 0 {
+		conn.espSPIIn = spi
+	} else if conn.espSPIIn != spi {
+		return 0, ErrDropPacket
+	}
+
+	t.ESP.updateLastInbound(conn, now, len(packet))
+
+	ipHeader.DestinationIP = any(conn.LocalSrcIP).(IPv4)
+	ipHeader.Marshal(packet)
+
+	return conn.Namespace, nil
+}
@@ -46,7 +46,7 @@ func ExampleTable() {
 	fmt.Printf("Return packet belongs to namespace: %d\n", returnNamespace)
 }
 
-func ExampleTable_Cleanup() {
+func ExampleTable_RunMaintenance() {
 	// Create a new IPv4 NAT table
 	externalIP := net.ParseIP("192.168.1.1")
 	nat := swnat.NewIPv4(externalIP)
@@ -89,7 +89,7 @@ func ExampleTable_MaxConnPerNamespace() {
 	// When this limit is reached, the oldest connection will be evicted
 }
 
-func ExampleTable_FilteringAndRedirection() {
+func ExampleTable_AddRedirectRule() {
 	// Create a new IPv4 NAT table
 	externalIP := net.ParseIP("192.168.1.1")
 	nat := swnat.NewIPv4(externalIP)
@@ -0,0 +1,236 @@
+package swnat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Binary export format
+//
+// A stream starts with a 6 bytes header made of the magic "SWNC", the format
+// version and the size in bytes of the IP addresses it carries (4 or 16). It
+// is followed by any number of records, each prefixed by its length as a
+// big-endian uint16 so readers can skip trailing fields added by newer
+// versions. Records can be appended to an existing stream at any time.
+//
+// A record contains, in order: protocol (1 byte), flags (1 byte), namespace
+// (8 bytes), last seen timestamp (8 bytes), then the local source, local
+// destination, outside source and outside destination as IP followed by a
+// 2 bytes port. Fields appended later, which readers must treat as optional:
+// last outbound and last inbound timestamps (8 bytes each), DSCP (1 byte),
+// creation timestamp (8 bytes), TCP state (1 byte), outbound and inbound
+// packet counts then outbound and inbound byte counts (8 bytes each).
+const (
+	binaryExportMagic   = "SWNC"
+	binaryExportVersion = 1
+
+	binaryFlagRewriteDestination = 0x01
+	binaryFlagPendingSweep       = 0x02
+	binaryFlagPreserveSource     = 0x04
+	binaryFlagInboundInitiated   = 0x08
+)
+
+// ExportBinary writes every connection of the table to w using a compact,
+// versioned record stream suitable for shipping to a collector.
+func (t *Table[IP]) ExportBinary(w io.Writer) error {
+	var zero IP
+	ipLen := len(ipBytes(&zero))
+	if ipLen == 0 {
+		return errors.New("unsupported IP type for binary export")
+	}
+
+	header := append([]byte(binaryExportMagic), binaryExportVersion, byte(ipLen))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	recLen := 18 + 4*(ipLen+2) + 58
+	buf := make([]byte, 2+recLen)
+
+	for _, p := range t.pairs() {
+		for _, c := range p.snapshot() {
+			binary.BigEndian.PutUint16(buf[0:2], uint16(recLen))
+			buf[2] = c.Protocol
+			buf[3] = 0
+			if c.RewriteDestination {
+				buf[3] |= binaryFlagRewriteDestination
+			}
+			if c.PendingSweep {
+				buf[3] |= binaryFlagPendingSweep
+			}
+			if c.PreserveSource {
+				buf[3] |= binaryFlagPreserveSource
+			}
+			if c.InboundInitiated {
+				buf[3] |= binaryFlagInboundInitiated
+			}
+			binary.BigEndian.PutUint64(buf[4:12], uint64(c.Namespace))
+			binary.BigEndian.PutUint64(buf[12:20], uint64(c.LastSeen))
+
+			pos := 20
+			for _, ep := range []struct {
+				ip   *IP
+				port uint16
+			}{
+				{&c.LocalSrcIP, c.LocalSrcPort},
+				{&c.LocalDstIP, c.LocalDstPort},
+				{&c.OutsideSrcIP, c.OutsideSrcPort},
+				{&c.OutsideDstIP, c.OutsideDstPort},
+			} {
+				copy(buf[pos:pos+ipLen], ipBytes(ep.ip))
+				binary.BigEndian.PutUint16(buf[pos+ipLen:pos+ipLen+2], ep.port)
+				pos += ipLen + 2
+			}
+			binary.BigEndian.PutUint64(buf[pos:pos+8], uint64(c.LastOutbound))
+			binary.BigEndian.PutUint64(buf[pos+8:pos+16], uint64(c.LastInbound))
+			buf[pos+16] = c.DSCP
+			binary.BigEndian.PutUint64(buf[pos+17:pos+25], uint64(c.CreatedAt))
+			buf[pos+25] = byte(c.State)
+			binary.BigEndian.PutUint64(buf[pos+26:pos+34], c.PacketsOut)
+			binary.BigEndian.PutUint64(buf[pos+34:pos+42], c.PacketsIn)
+			binary.BigEndian.PutUint64(buf[pos+42:pos+50], c.BytesOut)
+			binary.BigEndian.PutUint64(buf[pos+50:pos+58], c.BytesIn)
+
+			if _, err := w.Write(buf); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// MergePolicy decides which connection ImportBinaryMerge keeps when an
+// imported connection collides with a live one on either its internal or its
+// external tuple
+type MergePolicy int
+
+const (
+	MergePreferImported MergePolicy = iota // replace the live connections
+	MergeKeepExisting                      // drop the imported connection
+	MergeKeepNewer                         // keep the one seen last, the live one on a tie
+)
+
+// ImportBinary reads a stream written by ExportBinary and installs the
+// connections it contains in the table, replacing live connections they
+// collide with. Namespace limits are not applied to imported connections.
+func (t *Table[IP]) ImportBinary(r io.Reader) error {
+	return t.ImportBinaryMerge(r, MergePreferImported)
+}
+
+// ImportBinaryMerge is ImportBinary for a table that already has live
+// connections, such as when taking over the flows of a failover peer. An
+// imported connection sharing its internal or external tuple with live
+// ones is resolved by policy, so both lookups keep pointing at the same
+// connection. Imported connections take their outside port from the pool.
+func (t *Table[IP]) ImportBinaryMerge(r io.Reader, policy MergePolicy) error {
+	var zero IP
+	ipLen := len(ipBytes(&zero))
+
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("failed to read binary export header: %w", noEOF(err))
+	}
+	if string(header[:4]) != binaryExportMagic {
+		return errors.New("invalid binary export magic")
+	}
+	if header[4] != binaryExportVersion {
+		return fmt.Errorf("unsupported binary export version %d", header[4])
+	}
+	if int(header[5]) != ipLen {
+		return fmt.Errorf("binary export carries %d bytes addresses, table uses %d", header[5], ipLen)
+	}
+
+	minLen := 18 + 4*(ipLen+2)
+	var lenBuf [2]byte
+	var buf []byte
+
+	for {
+		if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+			if err == io.EOF {
+				// clean end of stream
+				return nil
+			}
+			return fmt.Errorf("failed to read record length: %w", noEOF(err))
+		}
+		recLen := int(binary.BigEndian.Uint16(lenBuf[:]))
+		if recLen < minLen {
+			return fmt.Errorf("binary export record too short (%d bytes)", recLen)
+		}
+		if cap(buf) < recLen {
+			buf = make([]byte, recLen)
+		}
+		buf = buf[:recLen]
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return fmt.Errorf("truncated binary export record: %w", noEOF(err))
+		}
+
+		conn := &Conn[IP]{
+			Protocol:           buf[0],
+			RewriteDestination: buf[1]&binaryFlagRewriteDestination != 0,
+			PendingSweep:       buf[1]&binaryFlagPendingSweep != 0,
+			PreserveSource:     buf[1]&binaryFlagPreserveSource != 0,
+			InboundInitiated:   buf[1]&binaryFlagInboundInitiated != 0,
+			Namespace:          uintptr(binary.BigEndian.Uint64(buf[2:10])),
+			LastSeen:           int64(binary.BigEndian.Uint64(buf[10:18])),
+		}
+		pos := 18
+		for _, ep := range []struct {
+			ip   *IP
+			port *uint16
+		}{
+			{&conn.LocalSrcIP, &conn.LocalSrcPort},
+			{&conn.LocalDstIp, &conn.LocalDstPort},
+			{&conn.OutsideSrcIP, &conn.OutsideSrcPort},
+			{&conn.OutsideDstIP, &conn.OutsideDstPort},
+		} {
+			copy(ipBytes(ep.ip), buf[pos:pos+ipLen])
+			*ep.port = binary.BigEndian.Uint16(buf[pos+ipLen : pos+ipLen+2])
+			pos += ipLen + 2
+		}
+		if recLen >= pos+16 {
+			conn.LastOutbound = int64(binary.BigEndian.Uint64(buf[pos : pos+8]))
+			conn.LastInbound = int64(binary.BigEndian.Uint64(buf[pos+8 : pos+16]))
+			conn.Assured = conn.LastOutbound != 0 && conn.LastInbound != 0
+		}
+		if recLen >= pos+17 {
+			conn.DSCP = buf[pos+16]
+		}
+		if recLen >= pos+25 {
+			conn.CreatedAt = int64(binary.BigEndian.Uint64(buf[pos+17 : pos+25]))
+		} else {
+			// older streams don't carry it, start counting now
+			conn.CreatedAt = t.Now()
+		}
+		if recLen >= pos+26 {
+			conn.State = TCPState(buf[pos+25])
+			// only the side that sent the SYN has been seen
+			conn.synDir = finOutbound
+			if conn.LastOutbound == 0 {
+				conn.synDir = finInbound
+			}
+		}
+		if recLen >= pos+58 {
+			conn.PacketsOut = binary.BigEndian.Uint64(buf[pos+26 : pos+34])
+			conn.PacketsIn = binary.BigEndian.Uint64(buf[pos+34 : pos+42])
+			conn.BytesOut = binary.BigEndian.Uint64(buf[pos+42 : pos+50])
+			conn.BytesIn = binary.BigEndian.Uint64(buf[pos+50 : pos+58])
+		}
+
+		p := t.trackingPair(conn.Protocol)
+		if p == nil {
+			return fmt.Errorf("binary export record has unsupported protocol %d", conn.Protocol)
+		}
+		p.mergeConnection(conn, policy)
+	}
+}
+
+// noEOF turns a bare io.EOF into io.ErrUnexpectedEOF, for places where the
+// stream isn't allowed to end
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
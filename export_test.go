@@ -0,0 +1,229 @@
+package swnat
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestExportBinaryRoundTrip(t *testing.T) {
+	src := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	src.AddRedirectRule(ProtocolTCP, server, 80, IPv4{10, 0, 0, 1}, 8080)
+
+	packets := [][]byte{
+		CreateIPv4UDPPacket(client, server, 5000, 53, []byte("test")),
+		CreateIPv4TCPPacket(client, server, 45000, 80, TCPFlagSYN),
+		CreateIPv4ICMPPacket(client, server, ICMPTypeEchoRequest, 0, 1234, 1),
+	}
+	for i, packet := range packets {
+		if err := src.HandleOutboundPacket(packet, uintptr(i+1)); err != nil {
+			t.Fatalf("HandleOutboundPacket failed: %v", err)
+		}
+	}
+
+	// A reply so the UDP mapping has counters in both directions
+	header, _ := ParseIPv4Header(packets[0])
+	udp, _ := ParseUDPHeader(packets[0], 20)
+	answer := CreateIPv4UDPPacket(server, header.SourceIP, 53, udp.SourcePort, []byte("answer"))
+	if _, err := src.HandleInboundPacket(answer); err != nil {
+		t.Fatalf("HandleInboundPacket failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := src.ExportBinary(&buf); err != nil {
+		t.Fatalf("ExportBinary failed: %v", err)
+	}
+
+	dst := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	if err := dst.ImportBinary(&buf); err != nil {
+		t.Fatalf("ImportBinary failed: %v", err)
+	}
+
+	info, ok := dst.LookupByExternalPort(ProtocolUDP, udp.SourcePort)
+	if !ok {
+		t.Fatal("Imported UDP mapping not found")
+	}
+	if info.PacketsOut != 1 || info.PacketsIn != 1 || info.BytesOut != uint64(len(packets[0])) || info.BytesIn != uint64(len(answer)) {
+		t.Errorf("Counters not carried over: %d/%d packets, %d/%d bytes", info.PacketsOut, info.PacketsIn, info.BytesOut, info.BytesIn)
+	}
+
+	want := make(map[ConnInfo[IPv4]]bool)
+	for _, p := range src.pairs() {
+		for _, c := range p.snapshot() {
+			want[c] = true
+		}
+	}
+	got := 0
+	for _, p := range dst.pairs() {
+		for _, c := range p.snapshot() {
+			if !want[c] {
+				t.Errorf("Unexpected imported connection %+v", c)
+			}
+			got++
+		}
+	}
+	if got != len(want) {
+		t.Errorf("Imported %d connections, want %d", got, len(want))
+	}
+
+	// The imported UDP mapping must be usable for return traffic
+	reply := CreateIPv4UDPPacket(server, header.SourceIP, 53, udp.SourcePort, []byte("reply"))
+	namespace, err := dst.HandleInboundPacket(reply)
+	if err != nil {
+		t.Fatalf("HandleInboundPacket on imported table failed: %v", err)
+	}
+	if namespace != 1 {
+		t.Errorf("Expected namespace 1, got %d", namespace)
+	}
+}
+
+func TestImportBinaryTruncated(t *testing.T) {
+	src := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	packet := CreateIPv4UDPPacket(IPv4{192, 168, 1, 100}, IPv4{8, 8, 8, 8}, 5000, 53, nil)
+	if err := src.HandleOutboundPacket(packet, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := src.ExportBinary(&buf); err != nil {
+		t.Fatalf("ExportBinary failed: %v", err)
+	}
+	data := buf.Bytes()
+
+	// Every strict prefix except the bare header is invalid
+	for n := 0; n < len(data); n++ {
+		if n == 6 {
+			continue
+		}
+		dst := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+		err := dst.ImportBinary(bytes.NewReader(data[:n]))
+		if err == nil {
+			t.Fatalf("ImportBinary accepted input truncated to %d bytes", n)
+		}
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("Truncated to %d bytes: expected io.ErrUnexpectedEOF, got %v", n, err)
+		}
+	}
+}
+
+func TestImportBinaryMerge(t *testing.T) {
+	a := IPv4{192, 168, 1, 100}
+	b := IPv4{192, 168, 1, 200}
+	server := IPv4{8, 8, 8, 8}
+
+	// The peer maps a:5000 to the first port
+	peer := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	peer.Now = func() int64 { return 1000 }
+	peer.HandleOutboundPacket(CreateIPv4UDPPacket(a, server, 5000, 53, nil), 1)
+	var state bytes.Buffer
+	if err := peer.ExportBinary(&state); err != nil {
+		t.Fatalf("ExportBinary failed: %v", err)
+	}
+
+	// The live table gave the first port to b, and a second one to a, so the
+	// imported flow collides with b in the in map and with a in the out map
+	live := func(seen int64) *Table[IPv4] {
+		table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+		table.Now = func() int64 { return seen }
+		table.HandleOutboundPacket(CreateIPv4UDPPacket(b, server, 6000, 53, nil), 2)
+		table.HandleOutboundPacket(CreateIPv4UDPPacket(a, server, 5000, 53, nil), 1)
+		return table
+	}
+	keyA := InternalKey[IPv4]{SrcIP: a, DstIP: server, SrcPort: 5000, DstPort: 53, Namespace: 1}
+
+	for _, tc := range []struct {
+		name     string
+		policy   MergePolicy
+		seen     int64
+		imported bool
+	}{
+		{"prefer imported", MergePreferImported, 2000, true},
+		{"keep existing", MergeKeepExisting, 500, false},
+		{"keep newer, live newer", MergeKeepNewer, 2000, false},
+		{"keep newer, imported newer", MergeKeepNewer, 500, true},
+	} {
+		table := live(tc.seen)
+		if err := table.ImportBinaryMerge(bytes.NewReader(state.Bytes()), tc.policy); err != nil {
+			t.Fatalf("%s: ImportBinaryMerge failed: %v", tc.name, err)
+		}
+
+		wantPort, wantOwner, wantConns := uint16(49153), b, 2
+		if tc.imported {
+			wantPort, wantOwner, wantConns = 49152, a, 1
+		}
+		if conn := table.UDP.lookupOutbound(keyA); conn == nil || conn.OutsideSrcPort != wantPort {
+			t.Errorf("%s: expected a mapped to port %d, got %+v", tc.name, wantPort, conn)
+		}
+		if info, ok := table.LookupByExternalPort(ProtocolUDP, 49152); !ok || info.LocalSrcIP != wantOwner {
+			t.Errorf("%s: expected port 49152 owned by %v, got %+v", tc.name, wantOwner, info)
+		}
+		if n := table.UDP.len(); n != wantConns {
+			t.Errorf("%s: expected %d connections, got %d", tc.name, wantConns, n)
+		}
+		if !table.UDP.ports.inUse(49152) {
+			t.Errorf("%s: port 49152 left free", tc.name)
+		}
+	}
+}
+
+func TestImportBinaryMergeHeldPort(t *testing.T) {
+	a := IPv4{192, 168, 1, 100}
+	c := IPv4{192, 168, 1, 50}
+	server := IPv4{8, 8, 8, 8}
+
+	// The peer maps a:5000 to the first port, last seen at 1000
+	peer := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	peer.Now = func() int64 { return 1000 }
+	peer.HandleOutboundPacket(CreateIPv4UDPPacket(a, server, 5000, 53, nil), 1)
+	var state bytes.Buffer
+	if err := peer.ExportBinary(&state); err != nil {
+		t.Fatalf("ExportBinary failed: %v", err)
+	}
+
+	// The live table released the first port at released, it is held until
+	// the reuse delay passes
+	live := func(released int64) *Table[IPv4] {
+		table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+		table.PortReuseDelay = 3600
+		now := int64(100)
+		table.Now = func() int64 { return now }
+		table.HandleOutboundPacket(CreateIPv4UDPPacket(c, server, 7000, 53, nil), 2)
+		now = released
+		table.RunMaintenance(now)
+		if _, held := table.UDP.ports.heldSince(49152); !held {
+			t.Fatal("Expected port 49152 held")
+		}
+		return table
+	}
+
+	for _, tc := range []struct {
+		name     string
+		policy   MergePolicy
+		released int64
+		imported bool
+	}{
+		{"prefer imported", MergePreferImported, 2000, true},
+		{"keep existing", MergeKeepExisting, 500, false},
+		{"keep newer, released later", MergeKeepNewer, 2000, false},
+		{"keep newer, imported newer", MergeKeepNewer, 500, true},
+	} {
+		table := live(tc.released)
+		if err := table.ImportBinaryMerge(bytes.NewReader(state.Bytes()), tc.policy); err != nil {
+			t.Fatalf("%s: ImportBinaryMerge failed: %v", tc.name, err)
+		}
+
+		_, held := table.UDP.ports.heldSince(49152)
+		if n := table.UDP.len(); tc.imported != (n == 1) || held == tc.imported {
+			t.Errorf("%s: expected imported %v, got %d connections, port held %v", tc.name, tc.imported, n, held)
+		}
+		if !table.UDP.ports.inUse(49152) {
+			t.Errorf("%s: port 49152 left free", tc.name)
+		}
+	}
+}
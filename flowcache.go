@@ -0,0 +1,111 @@
+package swnat
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// flowCache is a small direct-mapped cache of recent lookups in front of the
+// maps of a pair, read without taking its lock, see Table.EnableFlowCache.
+// Entries are only stored while holding the read lock, and dropped by
+// anything changing the maps under the write lock, so a hit is never staler
+// than the maps themselves.
+type flowCache[IP comparable] struct {
+	mask uint32
+	out  []atomic.Pointer[flowEntry[InternalKey[IP], IP]]
+	in   []atomic.Pointer[flowEntry[ExternalKey[IP], IP]]
+}
+
+// flowEntry is a cached lookup of key
+type flowEntry[K comparable, IP comparable] struct {
+	key  K
+	conn *Conn[IP]
+}
+
+// newFlowCache returns a cache of size entries per direction, rounded up to
+// a power of two
+func newFlowCache[IP comparable](size int) *flowCache[IP] {
+	n := 1
+	for n < size {
+		n <<= 1
+	}
+	return &flowCache[IP]{
+		mask: uint32(n - 1),
+		out:  make([]atomic.Pointer[flowEntry[InternalKey[IP], IP]], n),
+		in:   make([]atomic.Pointer[flowEntry[ExternalKey[IP], IP]], n),
+	}
+}
+
+// flowHash mixes the fields of a key into a slot index. Only the low bits
+// of IPv6 addresses are used: collisions are caught by comparing keys on
+// lookup.
+func flowHash[IP comparable](srcIP, dstIP IP, srcPort, dstPort uint16, namespace uintptr) uint32 {
+	h := uint32(srcPort)<<16 | uint32(dstPort)
+	h ^= uint32(namespace) * 0x9e3779b9
+	h ^= ipHash(srcIP)*0x85ebca6b ^ ipHash(dstIP)*0xc2b2ae35
+	h *= 0x85ebca6b
+	return h ^ h>>15
+}
+
+// ipHash returns the last 32 bits of ip
+func ipHash[IP comparable](ip IP) uint32 {
+	switch v := any(ip).(type) {
+	case IPv4:
+		return binary.BigEndian.Uint32(v[:])
+	case IPv6:
+		return binary.BigEndian.Uint32(v[12:])
+	}
+	return 0
+}
+
+func (c *flowCache[IP]) outSlot(key InternalKey[IP]) *atomic.Pointer[flowEntry[InternalKey[IP], IP]] {
+	return &c.out[flowHash(key.SrcIP, key.DstIP, key.SrcPort, key.DstPort, key.Namespace)&c.mask]
+}
+
+func (c *flowCache[IP]) inSlot(key ExternalKey[IP]) *atomic.Pointer[flowEntry[ExternalKey[IP], IP]] {
+	return &c.in[flowHash(key.SrcIP, key.DstIP, key.SrcPort, key.DstPort, 0)&c.mask]
+}
+
+// forgetOut drops the cached lookup of key, if any. The caller must hold
+// the write lock of the pair.
+func (c *flowCache[IP]) forgetOut(key InternalKey[IP]) {
+	slot := c.outSlot(key)
+	if e := slot.Load(); e != nil && e.key == key {
+		slot.Store(nil)
+	}
+}
+
+// forgetIn drops the cached lookup of key, if any. The caller must hold the
+// write lock of the pair.
+func (c *flowCache[IP]) forgetIn(key ExternalKey[IP]) {
+	slot := c.inSlot(key)
+	if e := slot.Load(); e != nil && e.key == key {
+		slot.Store(nil)
+	}
+}
+
+// forgetCachedLocked drops the cached lookups of both keys of conn. The
+// caller must hold the write lock.
+func (p *Pair[IP]) forgetCachedLocked(conn *Conn[IP]) {
+	if c := p.cache.Load(); c != nil {
+		c.forgetOut(conn.internalKey())
+		c.forgetIn(conn.externalKey())
+	}
+}
+
+// EnableFlowCache puts a cache of the last size lookups per direction and
+// protocol in front of the connection maps, rounded up to a power of two,
+// so packets of hot flows are matched without taking the table locks. It
+// pays off when traffic concentrates on a few flows. A size of 0 disables
+// it.
+func (t *Table[IP]) EnableFlowCache(size int) {
+	for _, p := range t.pairs() {
+		var c *flowCache[IP]
+		if size > 0 {
+			c = newFlowCache[IP](size)
+		}
+		p.mutex.Lock()
+		p.cache.Store(c)
+		p.mutex.Unlock()
+	}
+}
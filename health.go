@@ -0,0 +1,78 @@
+package swnat
+
+import (
+	"errors"
+	"fmt"
+)
+
+// pendingSweepGrace is how long, in seconds, a closed connection may wait
+// for maintenance to remove it before HealthCheck reports it
+const pendingSweepGrace = 600
+
+// HealthCheck verifies the internal invariants of the table and returns an
+// error describing the first violation found. It takes read locks only,
+// besides the port pool locks, and doesn't modify the table, so it is meant
+// for liveness probes: a failure reveals a bug, such as a connection
+// orphaned in one of the maps.
+func (t *Table[IP]) HealthCheck() error {
+	if t.nextPort == 0 || t.nextPort > t.maxPort || t.maxPort > 65535 {
+		return fmt.Errorf("invalid port range %d-%d", t.nextPort, t.maxPort)
+	}
+
+	now := t.Now()
+	var errs []error
+	for _, p := range t.pairs() {
+		if err := p.healthCheck(now); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// healthCheck verifies the consistency of the maps of p
+func (p *Pair[IP]) healthCheck(now int64) error {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	for key, conn := range p.out {
+		if conn == nil {
+			return fmt.Errorf("nil connection in out map for %+v", key)
+		}
+		if conn.internalKey() != key {
+			return fmt.Errorf("connection %d:%d stored under out key %+v", conn.Protocol, conn.OutsideSrcPort, key)
+		}
+		if p.in[conn.externalKey()] != conn {
+			return fmt.Errorf("connection %d:%d missing from in map", conn.Protocol, conn.OutsideSrcPort)
+		}
+		if conn.PendingSweep && now-conn.LastSeen > pendingSweepGrace {
+			return fmt.Errorf("connection %d:%d closed %d seconds ago but not swept", conn.Protocol, conn.OutsideSrcPort, now-conn.LastSeen)
+		}
+		if p.ports != nil && !conn.PreserveSource && conn.allocator == nil {
+			if p.ports.contains(conn.OutsideSrcPort) && !p.ports.marked(conn.OutsideSrcPort) {
+				return fmt.Errorf("connection %d:%d uses a port the pool considers free", conn.Protocol, conn.OutsideSrcPort)
+			}
+		}
+	}
+	for key, conn := range p.in {
+		if conn == nil || conn.externalKey() != key {
+			return fmt.Errorf("in map entry %+v doesn't match its connection", key)
+		}
+		if p.out[conn.internalKey()] != conn {
+			return fmt.Errorf("in map entry %+v has no out map entry", key)
+		}
+	}
+
+	indexed := 0
+	for port, conns := range p.byPort {
+		for _, conn := range conns {
+			if conn.OutsideSrcPort != port || p.out[conn.internalKey()] != conn {
+				return fmt.Errorf("stale port index entry for port %d", port)
+			}
+		}
+		indexed += len(conns)
+	}
+	if indexed != len(p.out) {
+		return fmt.Errorf("port index holds %d connections, out map %d", indexed, len(p.out))
+	}
+	return nil
+}
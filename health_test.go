@@ -0,0 +1,102 @@
+package swnat
+
+import (
+	"net"
+	"testing"
+)
+
+func TestHealthCheck(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	now := int64(1000)
+	table.Now = func() int64 { return now }
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+	for i := 0; i < 5; i++ {
+		table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, uint16(5000+i), 53, nil), 1)
+	}
+	table.HandleOutboundPacket(CreateIPv4TCPPacket(client, server, 45000, 80, TCPFlagSYN), 1)
+	table.AddPortRangeForward(ProtocolUDP, 60000, 60010, client, 1)
+	table.HandleInboundPacket(CreateIPv4UDPPacket(server, table.externalIP, 53, 60005, nil))
+
+	if err := table.HealthCheck(); err != nil {
+		t.Fatalf("HealthCheck failed on a healthy table: %v", err)
+	}
+
+	var victim *Conn[IPv4]
+	for _, c := range table.UDP.out {
+		if c.LocalSrcPort == 5000 {
+			victim = c
+		}
+	}
+
+	// Orphan a connection in the out map
+	delete(table.UDP.in, victim.externalKey())
+	if err := table.HealthCheck(); err == nil {
+		t.Error("HealthCheck missed a connection absent from the in map")
+	}
+	table.UDP.in[victim.externalKey()] = victim
+
+	// Point the in map at another connection
+	other := *victim
+	table.UDP.in[victim.externalKey()] = &other
+	if err := table.HealthCheck(); err == nil {
+		t.Error("HealthCheck missed in and out maps pointing to different connections")
+	}
+	table.UDP.in[victim.externalKey()] = victim
+
+	// A port freed while still in use
+	table.UDP.ports.release(victim.OutsideSrcPort)
+	if err := table.HealthCheck(); err == nil {
+		t.Error("HealthCheck missed a connection on a free port")
+	}
+	pool := table.UDP.ports
+	pool.free = pool.free[:len(pool.free)-1]
+	pool.setUsed(victim.OutsideSrcPort, true)
+
+	if err := table.HealthCheck(); err != nil {
+		t.Fatalf("HealthCheck failed after restoring the maps: %v", err)
+	}
+
+	// A closed connection maintenance never removed
+	victim.PendingSweep = true
+	now += pendingSweepGrace + 1
+	if err := table.HealthCheck(); err == nil {
+		t.Error("HealthCheck missed a lingering closed connection")
+	}
+}
+
+func TestHealthCheckLeavesPoolUntouched(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	now := int64(1000)
+	table.Now = func() int64 { return now }
+	table.PortReuseDelay = 60
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+	for _, port := range []uint16{5000, 5001} {
+		if err := table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, port, 53, nil), 1); err != nil {
+			t.Fatalf("HandleOutboundPacket failed: %v", err)
+		}
+	}
+
+	// Only the flow from port 5001 stays active, so HealthCheck checks its
+	// port in the pool
+	now += table.UDPTimeout + 1
+	if err := table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, 5001, 53, nil), 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	table.RunMaintenance(now)
+	if len(table.UDP.ports.held) != 1 {
+		t.Fatalf("Expected the port held after reaping, got %d held", len(table.UDP.ports.held))
+	}
+
+	// The delay ran out, but only allocations free the port
+	now += table.PortReuseDelay + 1
+	if err := table.HealthCheck(); err != nil {
+		t.Fatalf("HealthCheck failed: %v", err)
+	}
+	if len(table.UDP.ports.held) != 1 {
+		t.Errorf("HealthCheck freed held ports, %d left", len(table.UDP.ports.held))
+	}
+}
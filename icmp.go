@@ -0,0 +1,365 @@
+package swnat
+
+import "encoding/binary"
+
+// maxICMPErrorLen is the largest ICMP error we generate, including its IP
+// header, as recommended by RFC 1812 section 4.3.2.3
+const maxICMPErrorLen = 576
+
+// BuildICMPError builds an ICMPv4 error about orig, a packet received from
+// the inside and not yet translated, for a caller refusing it itself, e.g.
+// because it exceeds the MTU of the outside link or its TTL ran out. The
+// error is sourced from the external IP and addressed to the sender of orig,
+// quoting its IP header and as much of its payload as fits in
+// maxICMPErrorLen so the sender can match it to its own socket. mtu is only
+// used for Fragmentation Needed errors.
+//
+// It returns nil if orig isn't a valid IPv4 packet or the table isn't IPv4.
+func (t *Table[IP]) BuildICMPError(orig []byte, icmpType, code uint8, mtu uint16) []byte {
+	external, ok := any(t.externalIP).(IPv4)
+	if !ok {
+		return nil
+	}
+	origHeader, err := ParseIPv4Header(orig)
+	if err != nil {
+		return nil
+	}
+
+	quoteLen := len(orig)
+	if int(origHeader.TotalLength) >= int(origHeader.IHL)*4 && int(origHeader.TotalLength) < quoteLen {
+		quoteLen = int(origHeader.TotalLength)
+	}
+	if quoteLen > maxICMPErrorLen-28 {
+		quoteLen = maxICMPErrorLen - 28
+	}
+
+	packet := make([]byte, 28+quoteLen)
+	ipHeader := &IPv4Header{
+		Version:       4,
+		IHL:           5,
+		TotalLength:   uint16(len(packet)),
+		TTL:           64,
+		Protocol:      ProtocolICMP,
+		SourceIP:      external,
+		DestinationIP: origHeader.SourceIP,
+	}
+	ipHeader.Marshal(packet)
+
+	icmp := packet[20:]
+	icmp[0] = icmpType
+	icmp[1] = code
+	if icmpType == ICMPTypeDestinationUnreachable && code == ICMPCodeFragmentationNeeded {
+		binary.BigEndian.PutUint16(icmp[6:8], mtu)
+	}
+	copy(icmp[8:], orig[:quoteLen])
+	binary.BigEndian.PutUint16(icmp[2:4], calculateICMPChecksum(icmp))
+
+	return packet
+}
+
+// isICMPError reports whether icmpType is an ICMPv4 error quoting the
+// datagram that caused it
+func isICMPError(icmpType uint8) bool {
+	return icmpType == ICMPTypeDestinationUnreachable || icmpType == ICMPTypeTimeExceeded
+}
+
+// icmpQuote is the datagram quoted by an ICMP or ICMPv6 error, from its IP
+// header on. Routers often quote no more than the 8 bytes of transport
+// header required by RFC 792, so its checksums are updated rather than
+// recomputed.
+type icmpQuote struct {
+	data     []byte
+	l4       int   // offset of the transport header in data
+	protocol uint8 // ProtocolTCP, ProtocolUDP, ProtocolICMP or ProtocolICMPv6
+	addrLen  int   // 4 for IPv4, 16 for IPv6
+}
+
+// parseICMPQuote returns the datagram quoted by the ICMP error icmp, which
+// must be a TCP, UDP or ICMP echo packet
+func parseICMPQuote(icmp []byte) (icmpQuote, bool) {
+	if len(icmp) < 8+20 || icmp[8]>>4 != 4 {
+		return icmpQuote{}, false
+	}
+	q := icmpQuote{data: icmp[8:], l4: int(icmp[8]&0x0f) * 4, protocol: icmp[8+9], addrLen: 4}
+	if q.l4 < 20 {
+		return icmpQuote{}, false
+	}
+	return q, q.valid()
+}
+
+// parseICMPv6Quote returns the datagram quoted by the ICMPv6 error icmp,
+// which must be a TCP, UDP or ICMPv6 echo packet
+func parseICMPv6Quote(icmp []byte) (icmpQuote, bool) {
+	if len(icmp) < 8+40 || icmp[8]>>4 != 6 {
+		return icmpQuote{}, false
+	}
+	protocol, l4, err := skipIPv6Extensions(icmp[8:], 40, icmp[8+6])
+	if err != nil {
+		return icmpQuote{}, false
+	}
+	q := icmpQuote{data: icmp[8:], l4: l4, protocol: protocol, addrLen: 16}
+	return q, q.valid()
+}
+
+// valid reports whether the quote holds a transport header the NAT tracks
+func (q icmpQuote) valid() bool {
+	if len(q.data) < q.l4+8 {
+		return false
+	}
+	switch q.protocol {
+	case ProtocolTCP, ProtocolUDP:
+		return true
+	case ProtocolICMP, ProtocolICMPv6:
+		return q.isEchoRequest() || q.isEchoReply()
+	}
+	return false
+}
+
+func (q icmpQuote) isEchoRequest() bool {
+	t := q.data[q.l4]
+	return q.protocol == ProtocolICMP && t == ICMPTypeEchoRequest || q.protocol == ProtocolICMPv6 && t == ICMPv6TypeEchoRequest
+}
+
+func (q icmpQuote) isEchoReply() bool {
+	t := q.data[q.l4]
+	return q.protocol == ProtocolICMP && t == ICMPTypeEchoReply || q.protocol == ProtocolICMPv6 && t == ICMPv6TypeEchoReply
+}
+
+// isEcho reports whether the quote is an ICMP or ICMPv6 echo, whose
+// identifier stands for the ports
+func (q icmpQuote) isEcho() bool {
+	return q.protocol == ProtocolICMP || q.protocol == ProtocolICMPv6
+}
+
+// srcAddr and dstAddr return the addresses of the quoted datagram
+func (q icmpQuote) srcAddr() []byte {
+	if q.addrLen == 16 {
+		return q.data[8:24]
+	}
+	return q.data[12:16]
+}
+
+func (q icmpQuote) dstAddr() []byte {
+	if q.addrLen == 16 {
+		return q.data[24:40]
+	}
+	return q.data[16:20]
+}
+
+// quoteIP returns the address b of a quote as an IP
+func quoteIP[IP comparable](b []byte) IP {
+	var ip IP
+	copy(ipBytes(&ip), b)
+	return ip
+}
+
+// ports returns the ports of the quoted datagram. An echo identifier is the
+// source port of requests and the destination port of replies, matching
+// the keys of Table.ICMP in both directions.
+func (q icmpQuote) ports() (src, dst uint16) {
+	l4 := q.data[q.l4:]
+	if !q.isEcho() {
+		return binary.BigEndian.Uint16(l4[0:2]), binary.BigEndian.Uint16(l4[2:4])
+	}
+	id := binary.BigEndian.Uint16(l4[4:6])
+	if q.isEchoRequest() {
+		return id, 0
+	}
+	return 0, id
+}
+
+// setSource rewrites the source address and port of the quoted datagram
+func (q icmpQuote) setSource(ip []byte, port uint16) {
+	q.rewrite(q.srcAddr(), ip, port, !q.isEcho() || q.isEchoRequest(), 0)
+}
+
+// setDestination rewrites the destination address and port of the quoted
+// datagram
+func (q icmpQuote) setDestination(ip []byte, port uint16) {
+	q.rewrite(q.dstAddr(), ip, port, !q.isEcho() || q.isEchoReply(), 2)
+}
+
+// rewrite replaces the address at addr by ip and, if withPort, the port at
+// portOffset of the transport header by port, updating the checksums of
+// the quote that are within it
+func (q icmpQuote) rewrite(addr, ip []byte, port uint16, withPort bool, portOffset int) {
+	l4 := q.data[q.l4:]
+	sumOffset := 16
+	switch q.protocol {
+	case ProtocolUDP:
+		sumOffset = 6
+	case ProtocolICMP, ProtocolICMPv6:
+		// the echo identifier takes the place of the port
+		sumOffset, portOffset = 2, 4
+	}
+	var portField []byte
+	if withPort {
+		portField = l4[portOffset : portOffset+2]
+	}
+
+	if len(l4) >= sumOffset+2 {
+		sum := binary.BigEndian.Uint16(l4[sumOffset : sumOffset+2])
+		// a zero UDP checksum means there is none
+		if q.protocol != ProtocolUDP || sum != 0 {
+			// only the ICMPv4 checksum doesn't cover addresses
+			if q.protocol != ProtocolICMP {
+				sum = updateChecksum(sum, addr, ip)
+			}
+			if portField != nil {
+				sum = updateChecksum(sum, portField, binary.BigEndian.AppendUint16(nil, port))
+			}
+			if q.protocol == ProtocolUDP && sum == 0 {
+				sum = 0xFFFF
+			}
+			binary.BigEndian.PutUint16(l4[sumOffset:sumOffset+2], sum)
+		}
+	}
+
+	copy(addr, ip)
+	if portField != nil {
+		binary.BigEndian.PutUint16(portField, port)
+	}
+	if q.addrLen == 4 {
+		binary.BigEndian.PutUint16(q.data[10:12], 0)
+		binary.BigEndian.PutUint16(q.data[10:12], calculateIPv4Checksum(q.data[:q.l4]))
+	}
+}
+
+// updateChecksum returns the Internet checksum sum adjusted for the
+// replacement of old by new, fields of the same even length, as described
+// in RFC 1624
+func updateChecksum(sum uint16, old, new []byte) uint16 {
+	acc := uint32(^sum)
+	for i := 0; i+1 < len(old); i += 2 {
+		acc += uint32(^binary.BigEndian.Uint16(old[i:]))
+		acc += uint32(binary.BigEndian.Uint16(new[i:]))
+	}
+	for (acc >> 16) > 0 {
+		acc = (acc & 0xFFFF) + (acc >> 16)
+	}
+	return ^uint16(acc)
+}
+
+// setICMPChecksum recomputes the checksum of the ICMP message of packet
+func setICMPChecksum(packet []byte, ipHeader *IPv4Header, ipHeaderLen int) {
+	icmp := packet[ipHeaderLen:ipHeader.TotalLength]
+	binary.BigEndian.PutUint16(icmp[2:4], 0)
+	binary.BigEndian.PutUint16(icmp[2:4], calculateICMPChecksum(icmp))
+}
+
+// handleInboundICMPError translates an ICMP error about a packet sent out
+// on a connection, such as Destination Unreachable for path MTU discovery or
+// Time Exceeded for traceroute. The quoted packet carries the outside
+// addresses of the connection, which is looked up from it reversed. Both
+// the error and its quote are then restored to the addresses the internal
+// host knows. Errors do not refresh the connection.
+func (t *Table[IP]) handleInboundICMPError(packet []byte, ipHeader *IPv4Header, ipHeaderLen int) (uintptr, error) {
+	q, ok := parseICMPQuote(packet[ipHeaderLen:ipHeader.TotalLength])
+	if !ok {
+		return 0, ErrDropPacket
+	}
+	conn, err := t.inboundQuote(q)
+	if err != nil {
+		return 0, err
+	}
+
+	ipHeader.DestinationIP = any(conn.LocalSrcIP).(IPv4)
+	// the error may come from the redirect target itself
+	if conn.RewriteDestination && any(ipHeader.SourceIP).(IP) == conn.OutsideDstIP {
+		ipHeader.SourceIP = any(conn.LocalDstIp).(IPv4)
+	}
+
+	ipHeader.Marshal(packet)
+	setICMPChecksum(packet, ipHeader, ipHeaderLen)
+
+	return conn.Namespace, nil
+}
+
+// handleOutboundICMPError translates an ICMP error sent by an internal host
+// about a packet it received on a connection, the mirror image of
+// handleInboundICMPError. Errors matching no connection are dropped, as they
+// would leak the internal address of their sender.
+func (t *Table[IP]) handleOutboundICMPError(packet []byte, ipHeader *IPv4Header, ipHeaderLen int, namespace uintptr, res *OutboundResult[IP]) error {
+	q, ok := parseICMPQuote(packet[ipHeaderLen:ipHeader.TotalLength])
+	if !ok {
+		return ErrDropPacket
+	}
+	conn := t.outboundQuote(q, namespace)
+	if conn == nil {
+		return ErrDropPacket
+	}
+
+	ipHeader.SourceIP = any(conn.OutsideSrcIP).(IPv4)
+	if conn.RewriteDestination && any(ipHeader.DestinationIP).(IP) == conn.LocalDstIp {
+		ipHeader.DestinationIP = any(conn.OutsideDstIP).(IPv4)
+	}
+
+	ipHeader.Marshal(packet)
+	setICMPChecksum(packet, ipHeader, ipHeaderLen)
+
+	res.set(conn, false)
+	return nil
+}
+
+// quotePair returns the pair tracking the datagram quoted by an error, ICMPv6
+// echo flows being tracked along with ICMPv4 ones
+func (t *Table[IP]) quotePair(q icmpQuote) *Pair[IP] {
+	if q.isEcho() {
+		return &t.ICMP
+	}
+	return t.pair(q.protocol)
+}
+
+// inboundQuote looks up the connection of the datagram quoted by an inbound
+// error, which carries its outside addresses, from the quote reversed. The
+// quote is restored to the addresses the internal host knows.
+func (t *Table[IP]) inboundQuote(q icmpQuote) (*Conn[IP], error) {
+	p := t.quotePair(q)
+	srcPort, dstPort := q.ports()
+	externalKey := ExternalKey[IP]{
+		SrcIP:   quoteIP[IP](q.dstAddr()),
+		DstIP:   quoteIP[IP](q.srcAddr()),
+		SrcPort: dstPort,
+		DstPort: srcPort,
+	}
+	externalKey.DstIP = t.inboundDst(p, externalKey)
+
+	conn, err := t.lookupInbound(p, externalKey)
+	if err != nil {
+		return nil, err
+	}
+	if conn == nil {
+		return nil, ErrDropPacket
+	}
+
+	q.setSource(ipBytes(&conn.LocalSrcIP), conn.LocalSrcPort)
+	if conn.RewriteDestination {
+		q.setDestination(ipBytes(&conn.LocalDstIp), conn.LocalDstPort)
+	}
+	return conn, nil
+}
+
+// outboundQuote is inboundQuote for an error sent by an internal host,
+// returning nil when no connection matches the quote
+func (t *Table[IP]) outboundQuote(q icmpQuote, namespace uintptr) *Conn[IP] {
+	srcPort, dstPort := q.ports()
+	internalKey := InternalKey[IP]{
+		SrcIP:     quoteIP[IP](q.dstAddr()),
+		DstIP:     quoteIP[IP](q.srcAddr()),
+		SrcPort:   dstPort,
+		DstPort:   srcPort,
+		Namespace: namespace,
+	}
+
+	p := t.quotePair(q)
+	conn := t.unlessSwept(p, p.lookupOutbound(internalKey))
+	if conn == nil {
+		return nil
+	}
+
+	q.setDestination(ipBytes(&conn.OutsideSrcIP), conn.OutsideSrcPort)
+	if conn.RewriteDestination {
+		q.setSource(ipBytes(&conn.OutsideDstIP), conn.OutsideDstPort)
+	}
+	return conn
+}
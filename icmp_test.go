@@ -0,0 +1,306 @@
+package swnat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestBuildICMPError(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	small := CreateIPv4UDPPacket(client, server, 5000, 53, []byte("query"))
+	large := CreateIPv4UDPPacket(client, server, 5000, 53, make([]byte, 1400))
+
+	tests := []struct {
+		name     string
+		orig     []byte
+		icmpType uint8
+		code     uint8
+		mtu      uint16
+		quoteLen int
+	}{
+		{"time exceeded", small, ICMPTypeTimeExceeded, 0, 0, len(small)},
+		{"port unreachable", small, ICMPTypeDestinationUnreachable, ICMPCodePortUnreachable, 0, len(small)},
+		{"fragmentation needed", large, ICMPTypeDestinationUnreachable, ICMPCodeFragmentationNeeded, 1280, maxICMPErrorLen - 28},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet := table.BuildICMPError(tt.orig, tt.icmpType, tt.code, tt.mtu)
+			if packet == nil {
+				t.Fatal("BuildICMPError returned nil")
+			}
+			if len(packet) != 28+tt.quoteLen {
+				t.Fatalf("Packet length %d, want %d", len(packet), 28+tt.quoteLen)
+			}
+
+			header, err := ParseIPv4Header(packet)
+			if err != nil {
+				t.Fatalf("Generated IP header invalid: %v", err)
+			}
+			if !VerifyIPv4Checksum(packet) {
+				t.Error("Invalid IP checksum")
+			}
+			if int(header.TotalLength) != len(packet) {
+				t.Errorf("TotalLength %d, want %d", header.TotalLength, len(packet))
+			}
+			if header.Protocol != ProtocolICMP {
+				t.Errorf("Protocol %d, want ICMP", header.Protocol)
+			}
+			if header.SourceIP != table.externalIP || header.DestinationIP != client {
+				t.Errorf("Addressed %v -> %v, want %v -> %v", header.SourceIP, header.DestinationIP, table.externalIP, client)
+			}
+
+			icmp := packet[20:]
+			if calculateICMPChecksum(icmp) != 0 {
+				t.Error("Invalid ICMP checksum")
+			}
+			if icmp[0] != tt.icmpType || icmp[1] != tt.code {
+				t.Errorf("Type/code %d/%d, want %d/%d", icmp[0], icmp[1], tt.icmpType, tt.code)
+			}
+			if mtu := binary.BigEndian.Uint16(icmp[6:8]); mtu != tt.mtu {
+				t.Errorf("Next-hop MTU %d, want %d", mtu, tt.mtu)
+			}
+			if !bytes.Equal(icmp[8:], tt.orig[:tt.quoteLen]) {
+				t.Error("Quoted packet doesn't match the original")
+			}
+		})
+	}
+
+	if table.BuildICMPError([]byte{0x45, 0x00}, ICMPTypeTimeExceeded, 0, 0) != nil {
+		t.Error("Expected nil for a truncated original packet")
+	}
+}
+
+// icmpError builds an ICMP error from src to dst quoting quote as is
+func icmpError(src, dst IPv4, icmpType, code uint8, quote []byte) []byte {
+	packet := make([]byte, 28+len(quote))
+	header := &IPv4Header{Version: 4, IHL: 5, TotalLength: uint16(len(packet)), TTL: 64, Protocol: ProtocolICMP, SourceIP: src, DestinationIP: dst}
+	header.Marshal(packet)
+	packet[20], packet[21] = icmpType, code
+	copy(packet[28:], quote)
+	setICMPChecksum(packet, header, 20)
+	return packet
+}
+
+func TestIPv4TableInboundICMPError(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+	router := IPv4{9, 9, 9, 9}
+
+	udp := CreateIPv4UDPPacket(client, server, 5000, 53, []byte("query"))
+	tcp := CreateIPv4TCPPacket(client, server, 40000, 80, TCPFlagSYN)
+	ping := CreateIPv4ICMPPacket(client, server, ICMPTypeEchoRequest, 0, 1234, 1)
+	for _, packet := range [][]byte{udp, tcp, ping} {
+		if err := table.HandleOutboundPacket(packet, 1); err != nil {
+			t.Fatalf("HandleOutboundPacket failed: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		orig  []byte
+		quote int // bytes of the translated packet quoted
+		typ   uint8
+		code  uint8
+		port  uint16 // original source port or echo identifier
+	}{
+		{"udp time exceeded, full quote", udp, len(udp), ICMPTypeTimeExceeded, 0, 5000},
+		{"tcp fragmentation needed, truncated quote", tcp, 28, ICMPTypeDestinationUnreachable, ICMPCodeFragmentationNeeded, 40000},
+		{"echo time exceeded", ping, 28, ICMPTypeTimeExceeded, 0, 1234},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet := icmpError(router, IPv4{1, 2, 3, 4}, tt.typ, tt.code, tt.orig[:tt.quote])
+			binary.BigEndian.PutUint16(packet[26:28], 1280) // next-hop MTU
+			setICMPChecksum(packet, &IPv4Header{TotalLength: uint16(len(packet))}, 20)
+
+			namespace, err := table.HandleInboundPacket(packet)
+			if err != nil {
+				t.Fatalf("HandleInboundPacket failed: %v", err)
+			}
+			header, _ := ParseIPv4Header(packet)
+			if namespace != 1 || header.SourceIP != router || header.DestinationIP != client {
+				t.Errorf("Error routed %v -> %v in namespace %d", header.SourceIP, header.DestinationIP, namespace)
+			}
+			if !VerifyIPv4Checksum(packet) || calculateICMPChecksum(packet[20:]) != 0 {
+				t.Error("Invalid outer checksums")
+			}
+			if binary.BigEndian.Uint16(packet[26:28]) != 1280 {
+				t.Error("Next-hop MTU was not preserved")
+			}
+
+			quote := packet[28:]
+			if calculateIPv4Checksum(quote[:20]) != 0 {
+				t.Error("Invalid quoted IP checksum")
+			}
+			q, _ := parseICMPQuote(packet[20:])
+			qsrc, qdst := quoteIP[IPv4](q.srcAddr()), quoteIP[IPv4](q.dstAddr())
+			if src, _ := q.ports(); qsrc != client || qdst != server || src != tt.port {
+				t.Errorf("Quote from %v:%d to %v, want %v:%d to %v", qsrc, src, qdst, client, tt.port, server)
+			}
+
+			// the quoted transport checksum is updated as if the client
+			// had sent the quoted bytes itself
+			orig := CreateIPv4UDPPacket(client, server, 5000, 53, []byte("query"))
+			switch tt.orig[9] {
+			case ProtocolTCP:
+				orig = CreateIPv4TCPPacket(client, server, 40000, 80, TCPFlagSYN)
+			case ProtocolICMP:
+				orig = CreateIPv4ICMPPacket(client, server, ICMPTypeEchoRequest, 0, 1234, 1)
+			}
+			if !bytes.Equal(quote[20:], orig[20:tt.quote]) {
+				t.Errorf("Quoted transport header %x, want %x", quote[20:], orig[20:tt.quote])
+			}
+		})
+	}
+
+	// Errors quoting packets of unknown flows are dropped
+	stray := CreateIPv4UDPPacket(IPv4{1, 2, 3, 4}, server, 60000, 53, nil)
+	if _, err := table.HandleInboundPacket(icmpError(router, IPv4{1, 2, 3, 4}, ICMPTypeTimeExceeded, 0, stray[:28])); err != ErrDropPacket {
+		t.Errorf("Expected ErrDropPacket for an unknown flow, got %v", err)
+	}
+	if _, err := table.HandleInboundPacket(icmpError(router, IPv4{1, 2, 3, 4}, ICMPTypeTimeExceeded, 0, stray[:24])); err != ErrDropPacket {
+		t.Errorf("Expected ErrDropPacket for a short quote, got %v", err)
+	}
+}
+
+func TestIPv4TableOutboundICMPError(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	if err := table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, 5000, 53, nil), 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	reply := CreateIPv4UDPPacket(server, IPv4{1, 2, 3, 4}, 53, 49152, []byte("late answer"))
+	if _, err := table.HandleInboundPacket(reply); err != nil {
+		t.Fatalf("HandleInboundPacket failed: %v", err)
+	}
+
+	// The client closed its socket and reports the reply it got
+	packet := icmpError(client, server, ICMPTypeDestinationUnreachable, ICMPCodePortUnreachable, reply)
+	res, err := table.ProcessOutbound(packet, 1)
+	if err != nil || !res.Modified || res.ExternalPort != 49152 {
+		t.Fatalf("ProcessOutbound: got %+v (%v)", res, err)
+	}
+	header, _ := ParseIPv4Header(packet)
+	if header.SourceIP != (IPv4{1, 2, 3, 4}) || header.DestinationIP != server {
+		t.Errorf("Error sent %v -> %v", header.SourceIP, header.DestinationIP)
+	}
+	if !VerifyIPv4Checksum(packet) || calculateICMPChecksum(packet[20:]) != 0 {
+		t.Error("Invalid outer checksums")
+	}
+
+	// the server sees its own packet quoted, checksums included
+	orig := CreateIPv4UDPPacket(server, IPv4{1, 2, 3, 4}, 53, 49152, []byte("late answer"))
+	if !bytes.Equal(packet[28:], orig) || !VerifyUDPChecksum(packet[28:]) {
+		t.Errorf("Quoted packet %x, want %x", packet[28:], orig)
+	}
+
+	// an error about a flow the table doesn't know would leak the client
+	stray := CreateIPv4UDPPacket(server, IPv4{1, 2, 3, 4}, 53, 49999, nil)
+	if _, err := table.ProcessOutbound(icmpError(client, server, ICMPTypeDestinationUnreachable, ICMPCodePortUnreachable, stray), 1); err != ErrDropPacket {
+		t.Errorf("Expected ErrDropPacket for an unmatched error, got %v", err)
+	}
+}
+
+// icmpv6Error builds an ICMPv6 error from src to dst with the given 4 bytes
+// after its checksum, quoting quote as is
+func icmpv6Error(src, dst IPv6, icmpType uint8, rest uint32, quote []byte) []byte {
+	l4 := make([]byte, 8+len(quote))
+	l4[0] = icmpType
+	binary.BigEndian.PutUint32(l4[4:8], rest)
+	copy(l4[8:], quote)
+	return createIPv6Packet(src, dst, ProtocolICMPv6, l4, 2)
+}
+
+func TestIPv6TableICMPv6Error(t *testing.T) {
+	table := NewIPv6(net.ParseIP("2001:db8::1")).(*Table[IPv6])
+	client, _ := ParseIPv6("fd00::100")
+	server, _ := ParseIPv6("2001:db8:53::53")
+	router, _ := ParseIPv6("2001:db8:9::9")
+	external, _ := ParseIPv6("2001:db8::1")
+
+	udp := CreateIPv6UDPPacket(client, server, 5000, 53, []byte("query"))
+	tcp := CreateIPv6TCPPacket(client, server, 40000, 80, TCPFlagSYN)
+	ping := CreateIPv6ICMPPacket(client, server, ICMPv6TypeEchoRequest, 0, 1234, 1)
+	originals := [][]byte{slices.Clone(udp), slices.Clone(tcp), slices.Clone(ping)}
+	for _, packet := range [][]byte{udp, tcp, ping} {
+		if err := table.HandleOutboundPacket(packet, 1); err != nil {
+			t.Fatalf("HandleOutboundPacket failed: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		i     int // index of the quoted packet
+		quote int // bytes of the translated packet quoted
+		typ   uint8
+	}{
+		{"udp packet too big, full quote", 0, len(udp), ICMPv6TypePacketTooBig},
+		{"tcp unreachable, truncated quote", 1, 48, ICMPv6TypeDestinationUnreachable},
+		{"echo time exceeded", 2, 48, ICMPv6TypeTimeExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			translated := [][]byte{udp, tcp, ping}[tt.i]
+			packet := icmpv6Error(router, external, tt.typ, 1280, translated[:tt.quote])
+
+			namespace, err := table.HandleInboundPacket(packet)
+			if err != nil {
+				t.Fatalf("HandleInboundPacket failed: %v", err)
+			}
+			header, _ := ParseIPv6Header(packet)
+			if namespace != 1 || header.SourceIP != router || header.DestinationIP != client {
+				t.Errorf("Error routed %v -> %v in namespace %d", header.SourceIP, header.DestinationIP, namespace)
+			}
+			if !VerifyIPv6Checksum(packet) {
+				t.Error("Invalid ICMPv6 checksum")
+			}
+			if binary.BigEndian.Uint32(packet[44:48]) != 1280 {
+				t.Error("MTU was not preserved")
+			}
+			// the client sees its own packet quoted, checksums included
+			if orig := originals[tt.i]; !bytes.Equal(packet[48:], orig[:tt.quote]) {
+				t.Errorf("Quoted packet %x, want %x", packet[48:], orig[:tt.quote])
+			}
+		})
+	}
+
+	stray := CreateIPv6UDPPacket(external, server, 60000, 53, nil)
+	if _, err := table.HandleInboundPacket(icmpv6Error(router, external, ICMPv6TypePacketTooBig, 1280, stray)); err != ErrDropPacket {
+		t.Errorf("Expected ErrDropPacket for an unknown flow, got %v", err)
+	}
+
+	// The client closed its socket and reports the reply it got
+	reply := CreateIPv6UDPPacket(server, external, 53, binary.BigEndian.Uint16(udp[40:42]), []byte("late answer"))
+	orig := slices.Clone(reply)
+	if _, err := table.HandleInboundPacket(reply); err != nil {
+		t.Fatalf("HandleInboundPacket failed: %v", err)
+	}
+	packet := icmpv6Error(client, server, ICMPv6TypeDestinationUnreachable, 0, reply)
+	if err := table.HandleOutboundPacket(packet, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	header, _ := ParseIPv6Header(packet)
+	if header.SourceIP != external || header.DestinationIP != server || !VerifyIPv6Checksum(packet) {
+		t.Errorf("Error sent %v -> %v", header.SourceIP, header.DestinationIP)
+	}
+	if !bytes.Equal(packet[48:], orig) {
+		t.Errorf("Quoted packet %x, want %x", packet[48:], orig)
+	}
+
+	// Errors about unknown flows would leak the internal address
+	unknown := CreateIPv6UDPPacket(server, external, 53, 60000, nil)
+	if err := table.HandleOutboundPacket(icmpv6Error(client, server, ICMPv6TypeDestinationUnreachable, 0, unknown), 1); err != ErrDropPacket {
+		t.Errorf("Expected ErrDropPacket for an unknown flow, got %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package swnat_test
 
 import (
+	"errors"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -260,23 +261,28 @@ func TestConnectionExpiry(t *testing.T) {
 
 func TestPortExhaustion(t *testing.T) {
 	publicIP := net.ParseIP("1.2.3.4")
-	table := swnat.NewIPv4(publicIP)
+	table, err := swnat.NewIPv4WithConfig(swnat.Config{ExternalIP: publicIP, PortRangeStart: 50000, PortRangeEnd: 50099})
+	if err != nil {
+		t.Fatalf("NewIPv4WithConfig failed: %v", err)
+	}
 	
 	client := swnat.IPv4{192, 168, 1, 100}
+	server := swnat.IPv4{10, 0, 0, 1}
 	
 	// Track allocated ports
 	allocatedPorts := make(map[uint16]bool)
 	var mu sync.Mutex
 	
-	// Try to exhaust port space (this test is limited to prevent long runtime)
+	// Exhaust the 100 ports of the range with flows to the same server
 	maxAttempts := 1000
 	for i := 0; i < maxAttempts; i++ {
-		server := swnat.IPv4{10, 0, byte(i >> 8), byte(i & 0xFF)}
-		packet := swnat.CreateIPv4UDPPacket(client, server, 5000, 80, nil)
+		packet := swnat.CreateIPv4UDPPacket(client, server, uint16(5000+i), 80, nil)
 		
 		err := table.HandleOutboundPacket(packet, 1)
 		if err != nil {
-			t.Logf("Port allocation failed at attempt %d: %v", i, err)
+			if !errors.Is(err, swnat.ErrPortExhausted) {
+				t.Errorf("Expected ErrPortExhausted at attempt %d, got %v", i, err)
+			}
 			break
 		}
 		
@@ -286,11 +292,16 @@ func TestPortExhaustion(t *testing.T) {
 		if allocatedPorts[udp.SourcePort] {
 			t.Errorf("Port %d allocated twice", udp.SourcePort)
 		}
+		if udp.SourcePort < 50000 || udp.SourcePort > 50099 {
+			t.Errorf("Port %d allocated outside the range", udp.SourcePort)
+		}
 		allocatedPorts[udp.SourcePort] = true
 		mu.Unlock()
 	}
 	
-	t.Logf("Successfully allocated %d unique ports", len(allocatedPorts))
+	if len(allocatedPorts) != 100 {
+		t.Errorf("Expected 100 unique ports before exhaustion, got %d", len(allocatedPorts))
+	}
 }
 
 func TestComplexScenario(t *testing.T) {
@@ -373,4 +384,173 @@ func TestChecksumValidation(t *testing.T) {
 			break
 		}
 	}
-}
\ No newline at end of file
+}
+func TestEndToEndUDPSessionIPv6(t *testing.T) {
+	table := swnat.NewIPv6(net.ParseIP("2001:db8::1"))
+
+	client1, _ := swnat.ParseIPv6("fd00::100")
+	client2, _ := swnat.ParseIPv6("fd00::101")
+	server, _ := swnat.ParseIPv6("2001:4860:4860::8888")
+	external, _ := swnat.ParseIPv6("2001:db8::1")
+
+	req1 := swnat.CreateIPv6UDPPacket(client1, server, 5000, 53, []byte("query1"))
+	if err := table.HandleOutboundPacket(req1, 1); err != nil {
+		t.Fatalf("Client1 outbound failed: %v", err)
+	}
+	req2 := swnat.CreateIPv6UDPPacket(client2, server, 5000, 53, []byte("query2"))
+	if err := table.HandleOutboundPacket(req2, 2); err != nil {
+		t.Fatalf("Client2 outbound failed: %v", err)
+	}
+
+	header1, _ := swnat.ParseIPv6Header(req1)
+	udp1, _ := swnat.ParseUDPHeader(req1, 40)
+	udp2, _ := swnat.ParseUDPHeader(req2, 40)
+	if header1.SourceIP != external || header1.DestinationIP != server {
+		t.Errorf("Expected %v -> %v, got %v -> %v", external, server, header1.SourceIP, header1.DestinationIP)
+	}
+	if udp1.SourcePort == udp2.SourcePort {
+		t.Error("Clients should have different NAT ports")
+	}
+	if !swnat.VerifyIPv6Checksum(req1) || !swnat.VerifyIPv6Checksum(req2) {
+		t.Error("Invalid UDP checksum on outbound packets")
+	}
+
+	for _, c := range []struct {
+		port      uint16
+		client    swnat.IPv6
+		namespace uintptr
+	}{{udp1.SourcePort, client1, 1}, {udp2.SourcePort, client2, 2}} {
+		resp := swnat.CreateIPv6UDPPacket(server, external, 53, c.port, []byte("response"))
+		namespace, err := table.HandleInboundPacket(resp)
+		if err != nil {
+			t.Fatalf("Response to %v failed: %v", c.client, err)
+		}
+		header, _ := swnat.ParseIPv6Header(resp)
+		udp, _ := swnat.ParseUDPHeader(resp, 40)
+		if namespace != c.namespace || header.DestinationIP != c.client || udp.DestinationPort != 5000 {
+			t.Errorf("Response routed to %v:%d in namespace %d, want %v:5000 in %d", header.DestinationIP, udp.DestinationPort, namespace, c.client, c.namespace)
+		}
+		if !swnat.VerifyIPv6Checksum(resp) {
+			t.Error("Invalid UDP checksum on inbound packet")
+		}
+	}
+
+	// Unknown flows are dropped
+	stray := swnat.CreateIPv6UDPPacket(server, external, 53, 1234, nil)
+	if _, err := table.HandleInboundPacket(stray); err != swnat.ErrDropPacket {
+		t.Errorf("Expected ErrDropPacket for an unknown flow, got %v", err)
+	}
+}
+
+func TestEndToEndTCPSessionIPv6(t *testing.T) {
+	table := swnat.NewIPv6(net.ParseIP("2001:db8::1"))
+
+	client, _ := swnat.ParseIPv6("fd00::100")
+	server, _ := swnat.ParseIPv6("2001:db8:80::80")
+	external, _ := swnat.ParseIPv6("2001:db8::1")
+
+	// A segment without SYN can't open a flow
+	if err := table.HandleOutboundPacket(swnat.CreateIPv6TCPPacket(client, server, 40000, 80, swnat.TCPFlagACK), 1); err != swnat.ErrDropPacket {
+		t.Errorf("Expected ErrDropPacket for a mid-stream segment, got %v", err)
+	}
+
+	syn := swnat.CreateIPv6TCPPacket(client, server, 40000, 80, swnat.TCPFlagSYN)
+	if err := table.HandleOutboundPacket(syn, 1); err != nil {
+		t.Fatalf("SYN failed: %v", err)
+	}
+	header, _ := swnat.ParseIPv6Header(syn)
+	tcp, _ := swnat.ParseTCPHeader(syn, 40)
+	if header.SourceIP != external || !swnat.VerifyIPv6Checksum(syn) {
+		t.Errorf("Expected a valid SYN from %v, got %v", external, header.SourceIP)
+	}
+	port := tcp.SourcePort
+
+	synAck := swnat.CreateIPv6TCPPacket(server, external, 80, port, swnat.TCPFlagSYN|swnat.TCPFlagACK)
+	namespace, err := table.HandleInboundPacket(synAck)
+	if err != nil {
+		t.Fatalf("SYN-ACK failed: %v", err)
+	}
+	header, _ = swnat.ParseIPv6Header(synAck)
+	tcp, _ = swnat.ParseTCPHeader(synAck, 40)
+	if namespace != 1 || header.DestinationIP != client || tcp.DestinationPort != 40000 || !swnat.VerifyIPv6Checksum(synAck) {
+		t.Errorf("SYN-ACK routed to %v:%d in namespace %d", header.DestinationIP, tcp.DestinationPort, namespace)
+	}
+
+	ack := swnat.CreateIPv6TCPPacket(client, server, 40000, 80, swnat.TCPFlagACK)
+	if err := table.HandleOutboundPacket(ack, 1); err != nil {
+		t.Fatalf("ACK failed: %v", err)
+	}
+	if tcp, _ := swnat.ParseTCPHeader(ack, 40); tcp.SourcePort != port {
+		t.Errorf("Expected the same NAT port %d, got %d", port, tcp.SourcePort)
+	}
+
+	// A RST closes the connection at the next maintenance
+	rst := swnat.CreateIPv6TCPPacket(server, external, 80, port, swnat.TCPFlagRST)
+	if _, err := table.HandleInboundPacket(rst); err != nil {
+		t.Fatalf("RST failed: %v", err)
+	}
+	table.RunMaintenance(time.Now().Unix())
+	late := swnat.CreateIPv6TCPPacket(server, external, 80, port, swnat.TCPFlagACK)
+	if _, err := table.HandleInboundPacket(late); err != swnat.ErrDropPacket {
+		t.Errorf("Expected ErrDropPacket after the RST, got %v", err)
+	}
+}
+
+func TestEndToEndPortForward(t *testing.T) {
+	table := swnat.NewIPv4(net.ParseIP("1.2.3.4"))
+	ipv4Table := table.(*swnat.Table[swnat.IPv4])
+
+	server := swnat.IPv4{192, 168, 1, 50}
+	client := swnat.IPv4{203, 0, 113, 9}
+	external := swnat.IPv4{1, 2, 3, 4}
+	ipv4Table.AddPortForward(swnat.ProtocolTCP, 8080, server, 80, 3)
+	ipv4Table.AddPortForward(swnat.ProtocolUDP, 5353, server, 53, 3)
+
+	// An unsolicited SYN reaches the internal web server
+	syn := swnat.CreateIPv4TCPPacket(client, external, 51000, 8080, swnat.TCPFlagSYN)
+	namespace, err := table.HandleInboundPacket(syn)
+	if err != nil {
+		t.Fatalf("Forwarded SYN failed: %v", err)
+	}
+	ipHeader, _ := swnat.ParseIPv4Header(syn)
+	tcpHeader, _ := swnat.ParseTCPHeader(syn, 20)
+	if namespace != 3 || ipHeader.DestinationIP != server || tcpHeader.DestinationPort != 80 {
+		t.Errorf("SYN forwarded to %v:%d in namespace %d", ipHeader.DestinationIP, tcpHeader.DestinationPort, namespace)
+	}
+	if !swnat.VerifyIPv4Checksum(syn) || !swnat.VerifyTCPChecksum(syn) {
+		t.Error("Invalid checksums on the forwarded SYN")
+	}
+
+	// and its answer leaves from the forwarded port
+	synAck := swnat.CreateIPv4TCPPacket(server, client, 80, 51000, swnat.TCPFlagSYN|swnat.TCPFlagACK)
+	if err := table.HandleOutboundPacket(synAck, 3); err != nil {
+		t.Fatalf("SYN-ACK failed: %v", err)
+	}
+	ipHeader, _ = swnat.ParseIPv4Header(synAck)
+	tcpHeader, _ = swnat.ParseTCPHeader(synAck, 20)
+	if ipHeader.SourceIP != external || tcpHeader.SourcePort != 8080 || ipHeader.DestinationIP != client {
+		t.Errorf("SYN-ACK sent from %v:%d to %v", ipHeader.SourceIP, tcpHeader.SourcePort, ipHeader.DestinationIP)
+	}
+
+	query := swnat.CreateIPv4UDPPacket(client, external, 40000, 5353, []byte("query"))
+	if namespace, err := table.HandleInboundPacket(query); err != nil || namespace != 3 {
+		t.Fatalf("Forwarded UDP failed: namespace %d, %v", namespace, err)
+	}
+	udpHeader, _ := swnat.ParseUDPHeader(query, 20)
+	if udpHeader.DestinationPort != 53 {
+		t.Errorf("UDP forwarded to port %d", udpHeader.DestinationPort)
+	}
+	answer := swnat.CreateIPv4UDPPacket(server, client, 53, 40000, []byte("answer"))
+	if err := table.HandleOutboundPacket(answer, 3); err != nil {
+		t.Fatalf("UDP answer failed: %v", err)
+	}
+	if udpHeader, _ := swnat.ParseUDPHeader(answer, 20); udpHeader.SourcePort != 5353 || !swnat.VerifyUDPChecksum(answer) {
+		t.Errorf("UDP answer sent from port %d", udpHeader.SourcePort)
+	}
+
+	// Other ports stay closed
+	probe := swnat.CreateIPv4TCPPacket(client, external, 51001, 8081, swnat.TCPFlagSYN)
+	if _, err := table.HandleInboundPacket(probe); err != swnat.ErrDropPacket {
+		t.Errorf("Expected ErrDropPacket for an unforwarded port, got %v", err)
+	}
+}
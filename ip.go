@@ -20,6 +20,20 @@ func (ip IPv4) IsZero() bool {
 	return ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] == 0
 }
 
+// IsMulticast reports whether the address is in 224.0.0.0/4
+func (ip IPv4) IsMulticast() bool {
+	return ip[0]&0xf0 == 0xe0
+}
+
+// ipv4Broadcast is the IPv4 limited broadcast address
+var ipv4Broadcast = IPv4{255, 255, 255, 255}
+
+// IsBroadcast reports whether the address is the limited broadcast address
+// 255.255.255.255
+func (ip IPv4) IsBroadcast() bool {
+	return ip == ipv4Broadcast
+}
+
 // ParseIPv4 parses a string representation of an IPv4 address
 func ParseIPv4(s string) (IPv4, error) {
 	netIP := net.ParseIP(s)
@@ -62,6 +76,11 @@ func (ip IPv6) IsZero() bool {
 	return true
 }
 
+// IsMulticast reports whether the address is in ff00::/8
+func (ip IPv6) IsMulticast() bool {
+	return ip[0] == 0xff
+}
+
 // ParseIPv6 parses a string representation of an IPv6 address
 func ParseIPv6(s string) (IPv6, error) {
 	netIP := net.ParseIP(s)
@@ -83,3 +102,33 @@ func ParseIPv6(s string) (IPv6, error) {
 	copy(ip[:], ipv6)
 	return ip, nil
 }
+
+// ipBytes returns a slice aliasing the raw bytes of ip, or nil if IP is
+// neither IPv4 nor IPv6
+func ipBytes[IP comparable](ip *IP) []byte {
+	switch v := any(ip).(type) {
+	case *IPv4:
+		return v[:]
+	case *IPv6:
+		return v[:]
+	}
+	return nil
+}
+
+// isMulticast reports whether ip is a multicast address
+func isMulticast[IP comparable](ip IP) bool {
+	switch v := any(ip).(type) {
+	case IPv4:
+		return v.IsMulticast()
+	case IPv6:
+		return v.IsMulticast()
+	}
+	return false
+}
+
+// isBroadcast reports whether ip is the IPv4 limited broadcast address, IPv6
+// having no broadcast
+func isBroadcast[IP comparable](ip IP) bool {
+	v, ok := any(ip).(IPv4)
+	return ok && v.IsBroadcast()
+}
@@ -0,0 +1,585 @@
+package swnat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// NewIPv6 returns a new NAT66 table masquerading internal hosts behind
+// externalIP, with the defaults of NewIPv4.
+//
+// IPv6 packets are translated for TCP, UDP and ICMPv6 echo, with the same
+// connection tracking, limits, drop and redirect rules and port forwards as
+// IPv4. Other ICMPv6 messages, such as neighbor discovery, are passed
+// through untouched outbound and dropped inbound. Features parsing packets
+// themselves, the ALGs, DCCP, ESP and the other protocols, are IPv4 only.
+func NewIPv6(externalIP net.IP) NAT {
+	ip := externalIP.To16()
+	if ip == nil || externalIP.To4() != nil {
+		panic("NewIPv6: provided IP is not a valid IPv6 address")
+	}
+	t, err := newTable[IPv6](Config{})
+	if err != nil {
+		panic("NewIPv6: " + err.Error())
+	}
+	copy(t.externalIP[:], ip)
+	return t
+}
+
+// isIPv6Packet reports whether packet starts with an IPv6 header
+func isIPv6Packet(packet []byte) bool {
+	return len(packet) > 0 && packet[0]>>4 == 6
+}
+
+func (t *Table[IP]) handleOutbound6(packet []byte, namespace uintptr, now int64, res *OutboundResult[IP]) error {
+	ipHeader, err := ParseIPv6Header(packet)
+	if err != nil {
+		return fmt.Errorf("failed to parse IP header: %w", err)
+	}
+
+	if t.translatedHairpin(namespace, any(ipHeader.SourceIP).(IP), any(ipHeader.DestinationIP).(IP)) {
+		return ErrLoopDetected
+	}
+
+	if t.StrictInternalSource && !t.sourceAllowed(namespace, any(ipHeader.SourceIP).(IP)) {
+		return ErrSpoofedSource
+	}
+
+	switch ipHeader.Protocol {
+	case ProtocolTCP:
+		return t.handleOutboundTCP6(packet, ipHeader, namespace, now, res)
+	case ProtocolUDP:
+		return t.handleOutboundUDP6(packet, ipHeader, namespace, now, res)
+	case ProtocolICMPv6:
+		return t.handleOutboundICMPv6(packet, ipHeader, namespace, now, res)
+	default:
+		// Unsupported protocol, drop the packet
+		return ErrDropPacket
+	}
+}
+
+// outboundConn6 updates conn, the connection of p matching key found for an
+// outbound IPv6 packet of protocol, or creates it when nil. It reports
+// whether it was created.
+func (t *Table[IP]) outboundConn6(p *Pair[IP], protocol uint8, key InternalKey[IP], conn *Conn[IP], dscp uint8, size int, now int64) (*Conn[IP], bool, error) {
+	if conn != nil {
+		p.updateLastOutbound(conn, now, dscp, size)
+		return conn, false, nil
+	}
+
+	// Check redirect rules
+	targetDstIP, targetDstPort := key.DstIP, key.DstPort
+	rule, shouldRedirect := p.checkRedirectRule(targetDstIP, targetDstPort)
+	if shouldRedirect {
+		targetDstIP = rule.NewDstIP
+		targetDstPort = rule.NewDstPort
+	}
+
+	if isLoop(key.SrcIP, key.SrcPort, targetDstIP, targetDstPort) {
+		return nil, false, ErrLoopDetected
+	}
+
+	// Create new connection, keeping the original source for pure DNAT
+	outsideIP, outsidePort := key.SrcIP, key.SrcPort
+	if !rule.PreserveSource {
+		if err := t.checkPortWatermark(p, key.Namespace); err != nil {
+			return nil, false, err
+		}
+		if err := t.checkSourcePorts(p, key.SrcIP); err != nil {
+			return nil, false, err
+		}
+		var err error
+		outsideIP, outsidePort, err = t.allocateOutside(p, protocol, key, targetDstIP, targetDstPort)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	conn = t.newConn(p, Conn[IP]{
+		LastSeen:           now,
+		CreatedAt:          now,
+		LastOutbound:       now,
+		PacketsOut:         1,
+		BytesOut:           uint64(size),
+		DSCP:               dscp,
+		Protocol:           protocol,
+		Namespace:          key.Namespace,
+		LocalSrcIP:         key.SrcIP,
+		LocalSrcPort:       key.SrcPort,
+		LocalDstIp:         key.DstIP,
+		LocalDstPort:       key.DstPort,
+		OutsideSrcIP:       outsideIP,
+		OutsideSrcPort:     outsidePort,
+		OutsideDstIP:       targetDstIP,
+		OutsideDstPort:     targetDstPort,
+		RewriteDestination: shouldRedirect,
+		PreserveSource:     rule.PreserveSource,
+		InboundInitiated:   rule.PreserveSource,
+		allocator:          t.portAllocator(),
+	})
+	if err := t.admitConn(p, conn); err != nil {
+		return nil, false, err
+	}
+	if err := t.addConn(p, conn); err != nil {
+		return nil, false, err
+	}
+	return conn, true, nil
+}
+
+func (t *Table[IP]) handleOutboundTCP6(packet []byte, ipHeader *IPv6Header, namespace uintptr, now int64, res *OutboundResult[IP]) error {
+	tcpData, err := ipHeader.upperLayer(packet)
+	if err != nil {
+		return err
+	}
+	tcpHeader, err := ParseTCPHeader(packet, ipHeader.HeaderLen)
+	if err != nil {
+		return fmt.Errorf("failed to parse TCP header: %w", err)
+	}
+
+	// Check drop rules
+	if t.TCP.checkDropRule(tcpHeader.DestinationPort) {
+		return ErrDropPacket
+	}
+
+	internalKey := InternalKey[IP]{
+		SrcIP:     any(ipHeader.SourceIP).(IP),
+		DstIP:     any(ipHeader.DestinationIP).(IP),
+		SrcPort:   tcpHeader.SourcePort,
+		DstPort:   tcpHeader.DestinationPort,
+		Namespace: namespace,
+	}
+
+	// Same rules as handleOutboundTCP for opening flows
+	conn := t.unlessSwept(&t.TCP, t.TCP.lookupOutbound(internalKey))
+	if conn != nil && (conn.PendingSweep || conn.State == TCPStateTimeWait) && tcpHeader.Flags&(TCPFlagSYN|TCPFlagACK) == TCPFlagSYN {
+		t.TCP.removeConnection(conn)
+		conn = nil
+	}
+	if conn == nil {
+		if tcpHeader.Flags&TCPFlagSYN == 0 && !t.AdoptExistingFlows {
+			return ErrDropPacket
+		}
+		if t.MaxHalfOpenPerNamespace > 0 && tcpHeader.Flags&(TCPFlagSYN|TCPFlagACK) == TCPFlagSYN &&
+			t.TCP.countHalfOpen(namespace) >= t.MaxHalfOpenPerNamespace {
+			return ErrSynFlood
+		}
+	}
+	conn, created, err := t.outboundConn6(&t.TCP, ProtocolTCP, internalKey, conn, ipHeader.DSCP(), len(packet), now)
+	if err != nil {
+		return err
+	}
+	t.capturePayload(&t.TCP, conn, tcpData, int(tcpHeader.DataOffset)*4, len(tcpData))
+
+	// Rewrite packet
+	ipHeader.SourceIP = any(conn.OutsideSrcIP).(IPv6)
+	tcpHeader.SourcePort = conn.OutsideSrcPort
+	if conn.RewriteDestination {
+		ipHeader.DestinationIP = any(conn.OutsideDstIP).(IPv6)
+		tcpHeader.DestinationPort = conn.OutsideDstPort
+	}
+
+	t.TCP.fixSequence(conn, tcpHeader, true)
+
+	ipHeader.Marshal(packet)
+	tcpHeader.Marshal(packet, ipHeader.HeaderLen)
+	t.setChecksum6(ipHeader, ProtocolTCP, tcpData, 16)
+
+	t.trackTCPState(conn, tcpHeader.Flags, finOutbound, created)
+
+	res.set(conn, created)
+	return nil
+}
+
+func (t *Table[IP]) handleOutboundUDP6(packet []byte, ipHeader *IPv6Header, namespace uintptr, now int64, res *OutboundResult[IP]) error {
+	udpHeader, err := ParseUDPHeader(packet, ipHeader.HeaderLen)
+	if err != nil {
+		return fmt.Errorf("failed to parse UDP header: %w", err)
+	}
+	udpData, err := udpHeader.datagram(packet, ipHeader.HeaderLen)
+	if err != nil {
+		return err
+	}
+
+	// Check drop rules
+	if t.UDP.checkDropRule(udpHeader.DestinationPort) {
+		return ErrDropPacket
+	}
+
+	internalKey := InternalKey[IP]{
+		SrcIP:     any(ipHeader.SourceIP).(IP),
+		DstIP:     any(ipHeader.DestinationIP).(IP),
+		SrcPort:   udpHeader.SourcePort,
+		DstPort:   udpHeader.DestinationPort,
+		Namespace: namespace,
+	}
+	conn, created, err := t.outboundConn6(&t.UDP, ProtocolUDP, internalKey, t.UDP.lookupOutbound(internalKey), ipHeader.DSCP(), len(packet), now)
+	if err != nil {
+		return err
+	}
+	t.capturePayload(&t.UDP, conn, udpData, 8, len(udpData))
+
+	// Rewrite packet
+	ipHeader.SourceIP = any(conn.OutsideSrcIP).(IPv6)
+	udpHeader.SourcePort = conn.OutsideSrcPort
+	if conn.RewriteDestination {
+		ipHeader.DestinationIP = any(conn.OutsideDstIP).(IPv6)
+		udpHeader.DestinationPort = conn.OutsideDstPort
+	}
+
+	ipHeader.Marshal(packet)
+	udpHeader.Marshal(packet, ipHeader.HeaderLen)
+	t.setChecksum6(ipHeader, ProtocolUDP, udpData, 6)
+
+	res.set(conn, created)
+	return nil
+}
+
+func (t *Table[IP]) handleOutboundICMPv6(packet []byte, ipHeader *IPv6Header, namespace uintptr, now int64, res *OutboundResult[IP]) error {
+	icmpData, err := ipHeader.upperLayer(packet)
+	if err != nil {
+		return err
+	}
+	if len(icmpData) < 8 {
+		return fmt.Errorf("ICMPv6 packet too small")
+	}
+
+	// Errors are translated through the connection they quote, echo opens
+	// flows of its own. Other messages such as neighbor discovery are
+	// link-local and never meant to cross the NAT.
+	if isICMPv6Error(icmpData[0]) {
+		return t.handleOutboundICMPv6Error(packet, ipHeader, icmpData, namespace, res)
+	}
+	if icmpData[0] != ICMPv6TypeEchoRequest && icmpData[0] != ICMPv6TypeEchoReply {
+		return ErrDropPacket
+	}
+	icmpHeader, err := ParseICMPHeader(packet, ipHeader.HeaderLen)
+	if err != nil {
+		return fmt.Errorf("failed to parse ICMPv6 header: %w", err)
+	}
+
+	internalKey := InternalKey[IP]{
+		SrcIP:     any(ipHeader.SourceIP).(IP),
+		DstIP:     any(ipHeader.DestinationIP).(IP),
+		SrcPort:   icmpHeader.ID,
+		Namespace: namespace,
+	}
+
+	conn := t.ICMP.lookupOutbound(internalKey)
+	created := conn == nil
+	if conn == nil {
+		// Check redirect rules for ICMP (using port 0)
+		targetDstIP := internalKey.DstIP
+		rule, shouldRedirect := t.ICMP.checkRedirectRule(targetDstIP, 0)
+		if shouldRedirect {
+			targetDstIP = rule.NewDstIP
+		}
+
+		if isLoop(internalKey.SrcIP, 0, targetDstIP, 0) {
+			return ErrLoopDetected
+		}
+
+		if limit := t.MaxICMPToDestination; limit > 0 && t.ICMP.countToDestination(namespace, internalKey.DstIP) >= limit {
+			return ErrICMPFlood
+		}
+
+		outsideID, ok := icmpHeader.ID, t.PreserveICMPID && t.ICMP.ports.take(icmpHeader.ID)
+		if !ok {
+			outsideID, ok = t.ICMP.ports.allocate()
+		}
+		if !ok {
+			return ErrPortExhausted
+		}
+		conn = t.newConn(&t.ICMP, Conn[IP]{
+			LastSeen:           now,
+			CreatedAt:          now,
+			LastOutbound:       now,
+			PacketsOut:         1,
+			BytesOut:           uint64(len(packet)),
+			DSCP:               ipHeader.DSCP(),
+			Protocol:           ProtocolICMP, // tracked along with ICMPv4
+			Namespace:          namespace,
+			LocalSrcIP:         internalKey.SrcIP,
+			LocalSrcPort:       icmpHeader.ID,
+			LocalDstIp:         internalKey.DstIP,
+			OutsideSrcIP:       t.pickExternalIP(ProtocolICMP),
+			OutsideSrcPort:     outsideID,
+			OutsideDstIP:       targetDstIP,
+			RewriteDestination: shouldRedirect,
+		})
+		if err := t.admitConn(&t.ICMP, conn); err != nil {
+			return err
+		}
+		if err := t.addConn(&t.ICMP, conn); err != nil {
+			return err
+		}
+	} else {
+		t.ICMP.updateLastOutbound(conn, now, ipHeader.DSCP(), len(packet))
+	}
+
+	// Rewrite packet
+	ipHeader.SourceIP = any(conn.OutsideSrcIP).(IPv6)
+	icmpHeader.ID = conn.OutsideSrcPort
+	if conn.RewriteDestination {
+		ipHeader.DestinationIP = any(conn.OutsideDstIP).(IPv6)
+	}
+
+	ipHeader.Marshal(packet)
+	icmpHeader.Marshal(packet, ipHeader.HeaderLen)
+	t.setICMPv6Checksum(ipHeader, icmpData)
+
+	res.set(conn, created)
+	return nil
+}
+
+func (t *Table[IP]) handleInbound6(packet []byte, now int64) (uintptr, error) {
+	ipHeader, err := ParseIPv6Header(packet)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse IP header: %w", err)
+	}
+
+	if t.DropMartians && t.isMartian(any(ipHeader.SourceIP).(IP)) {
+		return 0, ErrDropPacket
+	}
+
+	switch ipHeader.Protocol {
+	case ProtocolTCP:
+		return t.handleInboundTCP6(packet, ipHeader, now)
+	case ProtocolUDP:
+		return t.handleInboundUDP6(packet, ipHeader, now)
+	case ProtocolICMPv6:
+		return t.handleInboundICMPv6(packet, ipHeader, now)
+	default:
+		// Unsupported protocol, drop the packet
+		return 0, ErrDropPacket
+	}
+}
+
+// inboundConn6 returns the connection of p, tracking protocol, for an
+// inbound IPv6 packet matching key, from a port forward when it opens a new
+// flow and open is set, and whether it was created
+func (t *Table[IP]) inboundConn6(p *Pair[IP], protocol uint8, key ExternalKey[IP], open bool, dscp uint8, size int, now int64) (*Conn[IP], bool, error) {
+	conn, err := t.lookupInbound(p, key)
+	if err != nil {
+		return nil, false, err
+	}
+	if conn == nil {
+		conn = t.lookupReplyFrom(p, key)
+	}
+	created := false
+	if conn == nil && open {
+		conn = t.forwardInbound(p, protocol, key, dscp, now)
+		created = conn != nil
+	}
+	if conn == nil {
+		// No matching connection, drop packet
+		t.countNoMatch(key.DstPort)
+		return nil, false, ErrDropPacket
+	}
+	p.updateLastInbound(conn, now, size)
+	return conn, created, nil
+}
+
+func (t *Table[IP]) handleInboundTCP6(packet []byte, ipHeader *IPv6Header, now int64) (uintptr, error) {
+	tcpData, err := ipHeader.upperLayer(packet)
+	if err != nil {
+		return 0, err
+	}
+	tcpHeader, err := ParseTCPHeader(packet, ipHeader.HeaderLen)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse TCP header: %w", err)
+	}
+
+	externalKey := ExternalKey[IP]{
+		SrcIP:   any(ipHeader.SourceIP).(IP),
+		DstIP:   any(ipHeader.DestinationIP).(IP),
+		SrcPort: tcpHeader.SourcePort,
+		DstPort: tcpHeader.DestinationPort,
+	}
+	externalKey.DstIP = t.inboundDst(&t.TCP, externalKey)
+	open := tcpHeader.Flags&TCPFlagSYN != 0 || t.AdoptExistingFlows
+	conn, created, err := t.inboundConn6(&t.TCP, ProtocolTCP, externalKey, open, ipHeader.DSCP(), len(packet), now)
+	if err != nil {
+		return 0, err
+	}
+
+	// Rewrite packet to restore original addresses
+	ipHeader.DestinationIP = any(conn.LocalSrcIP).(IPv6)
+	tcpHeader.DestinationPort = conn.LocalSrcPort
+	if conn.RewriteDestination {
+		ipHeader.SourceIP = any(conn.LocalDstIp).(IPv6)
+		tcpHeader.SourcePort = conn.LocalDstPort
+	}
+
+	t.TCP.fixSequence(conn, tcpHeader, false)
+
+	ipHeader.Marshal(packet)
+	tcpHeader.Marshal(packet, ipHeader.HeaderLen)
+	t.setChecksum6(ipHeader, ProtocolTCP, tcpData, 16)
+
+	t.trackTCPState(conn, tcpHeader.Flags, finInbound, created)
+
+	return conn.Namespace, nil
+}
+
+func (t *Table[IP]) handleInboundUDP6(packet []byte, ipHeader *IPv6Header, now int64) (uintptr, error) {
+	udpHeader, err := ParseUDPHeader(packet, ipHeader.HeaderLen)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse UDP header: %w", err)
+	}
+	udpData, err := udpHeader.datagram(packet, ipHeader.HeaderLen)
+	if err != nil {
+		return 0, err
+	}
+
+	externalKey := ExternalKey[IP]{
+		SrcIP:   any(ipHeader.SourceIP).(IP),
+		DstIP:   any(ipHeader.DestinationIP).(IP),
+		SrcPort: udpHeader.SourcePort,
+		DstPort: udpHeader.DestinationPort,
+	}
+	externalKey.DstIP = t.inboundDst(&t.UDP, externalKey)
+	conn, _, err := t.inboundConn6(&t.UDP, ProtocolUDP, externalKey, true, ipHeader.DSCP(), len(packet), now)
+	if err != nil {
+		return 0, err
+	}
+
+	// Rewrite packet to restore original addresses
+	ipHeader.DestinationIP = any(conn.LocalSrcIP).(IPv6)
+	udpHeader.DestinationPort = conn.LocalSrcPort
+	if conn.RewriteDestination {
+		ipHeader.SourceIP = any(conn.LocalDstIp).(IPv6)
+		udpHeader.SourcePort = conn.LocalDstPort
+	}
+
+	ipHeader.Marshal(packet)
+	udpHeader.Marshal(packet, ipHeader.HeaderLen)
+	t.setChecksum6(ipHeader, ProtocolUDP, udpData, 6)
+
+	return conn.Namespace, nil
+}
+
+func (t *Table[IP]) handleInboundICMPv6(packet []byte, ipHeader *IPv6Header, now int64) (uintptr, error) {
+	icmpData, err := ipHeader.upperLayer(packet)
+	if err != nil {
+		return 0, err
+	}
+	if len(icmpData) < 8 {
+		return 0, fmt.Errorf("ICMPv6 packet too small")
+	}
+	if isICMPv6Error(icmpData[0]) {
+		return t.handleInboundICMPv6Error(packet, ipHeader, icmpData)
+	}
+	if icmpData[0] != ICMPv6TypeEchoRequest && icmpData[0] != ICMPv6TypeEchoReply {
+		// Unsupported ICMPv6 type
+		return 0, ErrDropPacket
+	}
+	icmpHeader, err := ParseICMPHeader(packet, ipHeader.HeaderLen)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse ICMPv6 header: %w", err)
+	}
+
+	externalKey := ExternalKey[IP]{
+		SrcIP:   any(ipHeader.SourceIP).(IP),
+		DstIP:   any(ipHeader.DestinationIP).(IP),
+		DstPort: icmpHeader.ID,
+	}
+	externalKey.DstIP = t.inboundDst(&t.ICMP, externalKey)
+	conn, err := t.lookupInbound(&t.ICMP, externalKey)
+	if err != nil {
+		return 0, err
+	}
+	// Only the host the request was sent to may answer it
+	if conn == nil || externalKey.SrcIP != conn.OutsideDstIP {
+		return 0, ErrDropPacket
+	}
+	t.ICMP.updateLastInbound(conn, now, len(packet))
+
+	// Rewrite packet to restore original addresses and ID
+	ipHeader.DestinationIP = any(conn.LocalSrcIP).(IPv6)
+	icmpHeader.ID = conn.LocalSrcPort
+	if conn.RewriteDestination {
+		ipHeader.SourceIP = any(conn.LocalDstIp).(IPv6)
+	}
+
+	ipHeader.Marshal(packet)
+	icmpHeader.Marshal(packet, ipHeader.HeaderLen)
+	t.setICMPv6Checksum(ipHeader, icmpData)
+
+	return conn.Namespace, nil
+}
+
+// isICMPv6Error reports whether icmpType is an ICMPv6 error quoting the
+// packet that caused it
+func isICMPv6Error(icmpType uint8) bool {
+	return icmpType >= ICMPv6TypeDestinationUnreachable && icmpType <= ICMPv6TypeParameterProblem
+}
+
+// handleInboundICMPv6Error is handleInboundICMPError for IPv6, where Packet
+// Too Big errors carry path MTU discovery
+func (t *Table[IP]) handleInboundICMPv6Error(packet []byte, ipHeader *IPv6Header, icmpData []byte) (uintptr, error) {
+	q, ok := parseICMPv6Quote(icmpData)
+	if !ok {
+		return 0, ErrDropPacket
+	}
+	conn, err := t.inboundQuote(q)
+	if err != nil {
+		return 0, err
+	}
+
+	ipHeader.DestinationIP = any(conn.LocalSrcIP).(IPv6)
+	if conn.RewriteDestination && any(ipHeader.SourceIP).(IP) == conn.OutsideDstIP {
+		ipHeader.SourceIP = any(conn.LocalDstIp).(IPv6)
+	}
+
+	ipHeader.Marshal(packet)
+	t.setICMPv6Checksum(ipHeader, icmpData)
+
+	return conn.Namespace, nil
+}
+
+// handleOutboundICMPv6Error is handleOutboundICMPError for IPv6. Errors
+// matching no connection are dropped, as they would leak the internal
+// address of their sender.
+func (t *Table[IP]) handleOutboundICMPv6Error(packet []byte, ipHeader *IPv6Header, icmpData []byte, namespace uintptr, res *OutboundResult[IP]) error {
+	q, ok := parseICMPv6Quote(icmpData)
+	if !ok {
+		return ErrDropPacket
+	}
+	conn := t.outboundQuote(q, namespace)
+	if conn == nil {
+		return ErrDropPacket
+	}
+
+	ipHeader.SourceIP = any(conn.OutsideSrcIP).(IPv6)
+	if conn.RewriteDestination && any(ipHeader.DestinationIP).(IP) == conn.LocalDstIp {
+		ipHeader.DestinationIP = any(conn.OutsideDstIP).(IPv6)
+	}
+
+	ipHeader.Marshal(packet)
+	t.setICMPv6Checksum(ipHeader, icmpData)
+
+	res.set(conn, false)
+	return nil
+}
+
+// setChecksum6 recomputes the TCP or UDP checksum, at offset in data, of a
+// translated IPv6 packet, or clears it with SkipChecksums
+func (t *Table[IP]) setChecksum6(ipHeader *IPv6Header, protocol uint8, data []byte, offset int) {
+	binary.BigEndian.PutUint16(data[offset:offset+2], 0)
+	if !t.SkipChecksums {
+		checksum := calculateIPv6Checksum(ipHeader.SourceIP, ipHeader.DestinationIP, protocol, data)
+		if checksum == 0 && protocol == ProtocolUDP {
+			// a zero UDP checksum means none, which IPv6 doesn't allow
+			checksum = 0xFFFF
+		}
+		binary.BigEndian.PutUint16(data[offset:offset+2], checksum)
+	}
+}
+
+// setICMPv6Checksum recomputes the checksum of a translated ICMPv6 message,
+// which unlike ICMPv4 covers a pseudo-header and is always computed
+func (t *Table[IP]) setICMPv6Checksum(ipHeader *IPv6Header, data []byte) {
+	binary.BigEndian.PutUint16(data[2:4], 0)
+	checksum := calculateIPv6Checksum(ipHeader.SourceIP, ipHeader.DestinationIP, ProtocolICMPv6, data)
+	binary.BigEndian.PutUint16(data[2:4], checksum)
+}
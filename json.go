@@ -0,0 +1,173 @@
+package swnat
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+)
+
+// jsonTable is the document written by Table.MarshalJSON
+type jsonTable struct {
+	ExternalIP  string                   `json:"external_ip"`
+	Now         int64                    `json:"now"`
+	Connections []jsonConn               `json:"connections"`
+	Rules       []jsonRule               `json:"rules"`
+	Namespaces  map[string]jsonNamespace `json:"namespaces"`
+}
+
+type jsonNamespace struct {
+	Connections int    `json:"connections"`
+	PacketsOut  uint64 `json:"packets_out"`
+	PacketsIn   uint64 `json:"packets_in"`
+	BytesOut    uint64 `json:"bytes_out"`
+	BytesIn     uint64 `json:"bytes_in"`
+	Drops       uint64 `json:"drops"`
+	Evictions   uint64 `json:"evictions"`
+}
+
+type jsonConn struct {
+	Protocol   string  `json:"protocol"`
+	Namespace  uintptr `json:"namespace"`
+	LocalSrc   string  `json:"local_src"`
+	LocalDst   string  `json:"local_dst"`
+	OutsideSrc string  `json:"outside_src"`
+	OutsideDst string  `json:"outside_dst"`
+	Age        int64   `json:"age"`  // seconds since creation
+	Idle       int64   `json:"idle"` // seconds since the last packet
+	DSCP       uint8   `json:"dscp,omitempty"`
+	TCPState   string  `json:"tcp_state,omitempty"`
+
+	RewriteDestination bool `json:"rewrite_destination,omitempty"`
+	PreserveSource     bool `json:"preserve_source,omitempty"`
+	PendingSweep       bool `json:"pending_sweep,omitempty"`
+	Draining           bool `json:"draining,omitempty"`
+	InboundInitiated   bool `json:"inbound_initiated,omitempty"`
+	Assured            bool `json:"assured,omitempty"`
+}
+
+type jsonRule struct {
+	Protocol string `json:"protocol"`
+	Kind     string `json:"kind"`
+	Hits     uint64 `json:"hits"`
+
+	DstPort        uint16  `json:"dst_port,omitempty"`
+	Dst            string  `json:"dst,omitempty"`
+	NewDst         string  `json:"new_dst,omitempty"`
+	PreserveSource bool    `json:"preserve_source,omitempty"`
+	ExtStart       uint16  `json:"ext_start,omitempty"`
+	ExtEnd         uint16  `json:"ext_end,omitempty"`
+	InternalIP     string  `json:"internal_ip,omitempty"`
+	InternalPort   uint16  `json:"internal_port,omitempty"`
+	Namespace      uintptr `json:"namespace,omitempty"`
+}
+
+// MarshalJSON describes the table as JSON for inspection, e.g. from an admin
+// endpoint: its connections with readable tuples and ages, its rules with
+// their hit counts and the counters of each namespace. It isn't meant to be
+// read back, see ExportBinary for persistence.
+func (t *Table[IP]) MarshalJSON() ([]byte, error) {
+	now := t.Now()
+	doc := jsonTable{
+		ExternalIP:  fmt.Sprint(t.externalIP),
+		Now:         now,
+		Connections: []jsonConn{},
+		Rules:       []jsonRule{},
+		Namespaces:  make(map[string]jsonNamespace),
+	}
+
+	var conns []ConnInfo[IP]
+	for _, p := range t.pairs() {
+		conns = append(conns, p.snapshot()...)
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		if conns[i].Protocol != conns[j].Protocol {
+			return conns[i].Protocol < conns[j].Protocol
+		}
+		return conns[i].CreatedAt < conns[j].CreatedAt
+	})
+
+	namespaces := make(map[uintptr]bool)
+	for _, c := range conns {
+		namespaces[c.Namespace] = true
+		var state string
+		if c.Protocol == ProtocolTCP {
+			state = c.State.String()
+		}
+		doc.Connections = append(doc.Connections, jsonConn{
+			Protocol:           protocolName(c.Protocol),
+			Namespace:          c.Namespace,
+			LocalSrc:           hostPort(c.LocalSrcIP, c.LocalSrcPort),
+			LocalDst:           hostPort(c.LocalDstIP, c.LocalDstPort),
+			OutsideSrc:         hostPort(c.OutsideSrcIP, c.OutsideSrcPort),
+			OutsideDst:         hostPort(c.OutsideDstIP, c.OutsideDstPort),
+			Age:                now - c.CreatedAt,
+			Idle:               now - c.LastSeen,
+			DSCP:               c.DSCP,
+			TCPState:           state,
+			RewriteDestination: c.RewriteDestination,
+			PreserveSource:     c.PreserveSource,
+			PendingSweep:       c.PendingSweep,
+			Draining:           c.Draining,
+			InboundInitiated:   c.InboundInitiated,
+			Assured:            c.Assured,
+		})
+	}
+
+	for _, r := range t.ListRules() {
+		rule := jsonRule{Protocol: protocolName(r.Protocol), Kind: r.Kind, Hits: r.Hits}
+		switch r.Kind {
+		case RuleDrop:
+			rule.DstPort = r.Drop.DstPort
+		case RuleRedirect:
+			rule.Dst = hostPort(r.Redirect.DstIP, r.Redirect.DstPort)
+			rule.NewDst = hostPort(r.Redirect.NewDstIP, r.Redirect.NewDstPort)
+			rule.PreserveSource = r.Redirect.PreserveSource
+		case RuleForward:
+			rule.ExtStart, rule.ExtEnd = r.Forward.ExtStart, r.Forward.ExtEnd
+			rule.InternalIP = fmt.Sprint(r.Forward.InternalIP)
+			rule.InternalPort = r.Forward.InternalPort
+			rule.Namespace = r.Forward.Namespace
+		}
+		doc.Rules = append(doc.Rules, rule)
+	}
+
+	t.nsMutex.RLock()
+	for ns := range t.namespaces {
+		namespaces[ns] = true
+	}
+	t.nsMutex.RUnlock()
+	t.nsStats.Range(func(ns, _ any) bool {
+		namespaces[ns.(uintptr)] = true
+		return true
+	})
+	for ns := range namespaces {
+		stats := t.NamespaceStats(ns)
+		doc.Namespaces[strconv.FormatUint(uint64(ns), 10)] = jsonNamespace(stats)
+	}
+
+	return json.Marshal(doc)
+}
+
+// protocolName returns the lowercase name of a protocol, or its number
+func protocolName(protocol uint8) string {
+	switch protocol {
+	case ProtocolTCP:
+		return "tcp"
+	case ProtocolUDP:
+		return "udp"
+	case ProtocolICMP:
+		return "icmp"
+	case ProtocolDCCP:
+		return "dccp"
+	case ProtocolESP:
+		return "esp"
+	}
+	return strconv.Itoa(int(protocol))
+}
+
+// hostPort formats an address and port, bracketing IPv6 addresses
+func hostPort[IP comparable](ip IP, port uint16) string {
+	return net.JoinHostPort(fmt.Sprint(ip), strconv.Itoa(int(port)))
+}
@@ -0,0 +1,72 @@
+package swnat
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestTableMarshalJSON(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	now := int64(1000)
+	table.Now = func() int64 { return now }
+	table.AddDropRule(ProtocolTCP, 23)
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+	packet := CreateIPv4UDPPacket(client, server, 5000, 53, nil)
+	if err := table.HandleOutboundPacket(packet, 7); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	udp, _ := ParseUDPHeader(packet, 20)
+	now += 30
+
+	data, err := json.Marshal(table)
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %v", err)
+	}
+
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("Output isn't valid JSON: %v\n%s", err, data)
+	}
+	if doc["external_ip"] != "1.2.3.4" {
+		t.Errorf("Expected external_ip 1.2.3.4, got %v", doc["external_ip"])
+	}
+
+	conns, _ := doc["connections"].([]any)
+	if len(conns) != 1 {
+		t.Fatalf("Expected 1 connection, got %v", doc["connections"])
+	}
+	conn := conns[0].(map[string]any)
+	want := map[string]any{
+		"protocol":    "udp",
+		"namespace":   float64(7),
+		"local_src":   "192.168.1.100:5000",
+		"local_dst":   "8.8.8.8:53",
+		"outside_src": "1.2.3.4:" + strconv.Itoa(int(udp.SourcePort)),
+		"outside_dst": "8.8.8.8:53",
+		"age":         float64(30),
+		"idle":        float64(30),
+	}
+	for k, v := range want {
+		if conn[k] != v {
+			t.Errorf("Connection %s = %v, want %v", k, conn[k], v)
+		}
+	}
+
+	rules, _ := doc["rules"].([]any)
+	if len(rules) != 1 {
+		t.Fatalf("Expected 1 rule, got %v", doc["rules"])
+	}
+	if rule := rules[0].(map[string]any); rule["kind"] != "drop" || rule["protocol"] != "tcp" || rule["dst_port"] != float64(23) {
+		t.Errorf("Unexpected rule %v", rule)
+	}
+
+	ns, _ := doc["namespaces"].(map[string]any)
+	stats, _ := ns["7"].(map[string]any)
+	if stats["connections"] != float64(1) || stats["packets_out"] != float64(1) {
+		t.Errorf("Unexpected namespace stats %v", ns)
+	}
+}
@@ -0,0 +1,187 @@
+package swnat
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Reasons packets are dropped for, as reported by WritePrometheus
+const (
+	dropReasonFiltered      = iota // ErrDropPacket: rules, martians, no matching connection
+	dropReasonLoop                 // ErrLoopDetected
+	dropReasonPortsLow             // ErrPortsLow
+	dropReasonPortExhausted        // ErrPortExhausted
+	dropReasonRefused              // ErrConnRefused
+	dropReasonSynFlood             // ErrSynFlood
+	dropReasonTooManyPorts         // ErrTooManyPorts
+	dropReasonSpoofed              // ErrSpoofedSource
+	dropReasonICMPFlood            // ErrICMPFlood
+	dropReasonInvalid              // malformed or unsupported packets
+	numDropReasons
+)
+
+var dropReasonNames = [numDropReasons]string{"filtered", "loop", "ports_low", "port_exhausted", "refused", "syn_flood", "too_many_ports", "spoofed", "icmp_flood", "invalid"}
+
+// dropCounters count dropped packets by direction (outbound first) and reason
+type dropCounters [2][numDropReasons]atomic.Uint64
+
+// add counts a packet dropped with err
+func (d *dropCounters) add(outbound bool, err error) {
+	dir := 1
+	if outbound {
+		dir = 0
+	}
+	reason := dropReasonInvalid
+	switch {
+	case errors.Is(err, ErrDropPacket):
+		reason = dropReasonFiltered
+	case errors.Is(err, ErrLoopDetected):
+		reason = dropReasonLoop
+	case errors.Is(err, ErrPortsLow):
+		reason = dropReasonPortsLow
+	case errors.Is(err, ErrPortExhausted):
+		reason = dropReasonPortExhausted
+	case errors.Is(err, ErrConnRefused):
+		reason = dropReasonRefused
+	case errors.Is(err, ErrSynFlood):
+		reason = dropReasonSynFlood
+	case errors.Is(err, ErrTooManyPorts):
+		reason = dropReasonTooManyPorts
+	case errors.Is(err, ErrSpoofedSource):
+		reason = dropReasonSpoofed
+	case errors.Is(err, ErrICMPFlood):
+		reason = dropReasonICMPFlood
+	}
+	d[dir][reason].Add(1)
+}
+
+// WritePrometheus writes the table's metrics to w in the Prometheus text
+// exposition format, adding labels to every sample: connections and free
+// ports per protocol, translated packets and bytes, drops by direction and
+// reason, evictions and connections removed by maintenance.
+func (t *Table[IP]) WritePrometheus(w io.Writer, labels map[string]string) error {
+	m := &promWriter{w: w, labels: formatLabels(labels)}
+
+	var packets, bytes [2]uint64
+	var evictions uint64
+	t.nsStats.Range(func(_, v any) bool {
+		c := v.(*nsCounters)
+		packets[0] += c.packetsOut.Load()
+		packets[1] += c.packetsIn.Load()
+		bytes[0] += c.bytesOut.Load()
+		bytes[1] += c.bytesIn.Load()
+		evictions += c.evictions.Load()
+		return true
+	})
+
+	protocols := []struct {
+		name string
+		p    *Pair[IP]
+	}{
+		{protocolName(ProtocolTCP), &t.TCP},
+		{protocolName(ProtocolUDP), &t.UDP},
+		{protocolName(ProtocolICMP), &t.ICMP},
+		{protocolName(ProtocolDCCP), &t.DCCP},
+		{protocolName(ProtocolESP), &t.ESP},
+		{"other", &t.Other},
+	}
+
+	m.header("swnat_connections", "gauge", "Connections currently tracked.")
+	for _, proto := range protocols {
+		m.sample("swnat_connections", uint64(proto.p.len()), "protocol", proto.name)
+	}
+	m.header("swnat_ports_free", "gauge", "External ports (ICMP identifiers for icmp) that can still be allocated.")
+	for _, proto := range protocols {
+		if proto.p.ports != nil {
+			m.sample("swnat_ports_free", uint64(proto.p.ports.available()), "protocol", proto.name)
+		}
+	}
+
+	directions := [2]string{"outbound", "inbound"}
+	m.header("swnat_packets_total", "counter", "Packets translated.")
+	for dir, name := range directions {
+		m.sample("swnat_packets_total", packets[dir], "direction", name)
+	}
+	m.header("swnat_bytes_total", "counter", "Bytes of translated packets.")
+	for dir, name := range directions {
+		m.sample("swnat_bytes_total", bytes[dir], "direction", name)
+	}
+	m.header("swnat_drops_total", "counter", "Packets dropped, by reason.")
+	for dir, name := range directions {
+		for reason, reasonName := range dropReasonNames {
+			m.sample("swnat_drops_total", t.drops[dir][reason].Load(), "direction", name, "reason", reasonName)
+		}
+	}
+
+	m.header("swnat_evictions_total", "counter", "Connections evicted by connection limits.")
+	m.sample("swnat_evictions_total", evictions)
+
+	m.header("swnat_reaped_total", "counter", "Connections removed by maintenance, by reason.")
+	for _, proto := range protocols {
+		proto.p.mutex.RLock()
+		reaps := proto.p.reaps
+		proto.p.mutex.RUnlock()
+		m.sample("swnat_reaped_total", reaps.Swept.total(), "protocol", proto.name, "reason", "closed")
+		m.sample("swnat_reaped_total", reaps.Expired.total(), "protocol", proto.name, "reason", "expired")
+	}
+	return m.err
+}
+
+// promWriter writes samples in the Prometheus text format, keeping the first
+// write error
+type promWriter struct {
+	w      io.Writer
+	labels string // formatted constant labels
+	err    error
+}
+
+func (m *promWriter) header(name, typ, help string) {
+	if m.err == nil {
+		_, m.err = fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+}
+
+// sample writes a sample with the constant labels followed by the given
+// label name and value pairs
+func (m *promWriter) sample(name string, value uint64, labels ...string) {
+	if m.err != nil {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(m.labels)
+	for i := 0; i+1 < len(labels); i += 2 {
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+	}
+	if b.Len() > 0 {
+		_, m.err = fmt.Fprintf(m.w, "%s{%s} %d\n", name, b.String(), value)
+	} else {
+		_, m.err = fmt.Fprintf(m.w, "%s %d\n", name, value)
+	}
+}
+
+// formatLabels formats labels sorted by name, without braces
+func formatLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s=\"%s\"", name, escapeLabel(labels[name]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// escapeLabel escapes a label value for the text exposition format
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
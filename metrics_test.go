@@ -0,0 +1,64 @@
+package swnat
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	table.AddDropRule(ProtocolUDP, 137)
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	packet := CreateIPv4UDPPacket(client, server, 5000, 53, []byte("query"))
+	if err := table.HandleOutboundPacket(packet, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	ip, _ := ParseIPv4Header(packet)
+	udp, _ := ParseUDPHeader(packet, 20)
+	reply := CreateIPv4UDPPacket(server, ip.SourceIP, 53, udp.SourcePort, []byte("answer!"))
+	if _, err := table.HandleInboundPacket(reply); err != nil {
+		t.Fatalf("HandleInboundPacket failed: %v", err)
+	}
+	table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, 5001, 137, nil), 1)
+	table.HandleInboundPacket(CreateIPv4UDPPacket(server, ip.SourceIP, 53, 1, nil))
+	table.HandleInboundPacket([]byte{0x45})
+
+	var buf bytes.Buffer
+	if err := table.WritePrometheus(&buf, map[string]string{"site": "par1", "host": `nat"1`}); err != nil {
+		t.Fatalf("WritePrometheus failed: %v", err)
+	}
+	out := buf.String()
+
+	for _, line := range []string{
+		"# TYPE swnat_connections gauge",
+		`swnat_connections{host="nat\"1",site="par1",protocol="udp"} 1`,
+		`swnat_connections{host="nat\"1",site="par1",protocol="tcp"} 0`,
+		`swnat_ports_free{host="nat\"1",site="par1",protocol="udp"} 16383`,
+		"# TYPE swnat_packets_total counter",
+		`swnat_packets_total{host="nat\"1",site="par1",direction="outbound"} 1`,
+		`swnat_packets_total{host="nat\"1",site="par1",direction="inbound"} 1`,
+		`swnat_bytes_total{host="nat\"1",site="par1",direction="outbound"} 33`,
+		`swnat_bytes_total{host="nat\"1",site="par1",direction="inbound"} 35`,
+		`swnat_drops_total{host="nat\"1",site="par1",direction="outbound",reason="filtered"} 1`,
+		`swnat_drops_total{host="nat\"1",site="par1",direction="inbound",reason="filtered"} 1`,
+		`swnat_drops_total{host="nat\"1",site="par1",direction="inbound",reason="invalid"} 1`,
+		`swnat_drops_total{host="nat\"1",site="par1",direction="outbound",reason="loop"} 0`,
+		`swnat_evictions_total{host="nat\"1",site="par1"} 0`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Missing line %q in output:\n%s", line, out)
+		}
+	}
+
+	// Without labels, samples have no braces unless they have their own
+	buf.Reset()
+	table.WritePrometheus(&buf, nil)
+	if !strings.Contains(buf.String(), "\nswnat_evictions_total 0\n") {
+		t.Errorf("Unexpected unlabelled output:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,224 @@
+package swnat
+
+import (
+	"hash/fnv"
+	"strings"
+)
+
+// ModField is a set of header fields, or other parts, of a packet that a
+// translation changed. For IPv6 packets, ModTOS is the traffic class,
+// ModTotalLength the payload length, ModTTL the hop limit, ModProtocol the
+// next header and ModIPOptions the extension headers.
+type ModField uint32
+
+const (
+	ModTOS            ModField = 1 << iota // DSCP and ECN
+	ModTotalLength                         // IP total length
+	ModIdentification                      // IP identification
+	ModFragment                            // IP flags and fragment offset
+	ModTTL
+	ModProtocol
+	ModIPChecksum
+	ModSrcIP
+	ModDstIP
+	ModIPOptions
+	ModSrcPort        // TCP, UDP or DCCP source port
+	ModDstPort        // TCP, UDP or DCCP destination port
+	ModICMPID         // ICMP or ICMPv6 echo identifier
+	ModSequence       // TCP sequence number
+	ModAcknowledgment // TCP acknowledgment number
+	ModL4Checksum
+	ModL4Header // any other transport header byte
+	ModPayload
+	ModLength    // the packet grew or shrank
+	ModFlowLabel // IPv6 flow label
+)
+
+var modFieldNames = []string{
+	"tos", "total_length", "identification", "fragment", "ttl", "protocol",
+	"ip_checksum", "src_ip", "dst_ip", "ip_options", "src_port", "dst_port",
+	"icmp_id", "sequence", "acknowledgment", "l4_checksum", "l4_header",
+	"payload", "length", "flow_label",
+}
+
+// String returns the names of the fields in f separated by "|"
+func (f ModField) String() string {
+	var names []string
+	for i, name := range modFieldNames {
+		if f&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// ModRecord describes what translating a packet changed, see
+// Table.RecordModifications
+type ModRecord struct {
+	Outbound  bool
+	Namespace uintptr
+	Before    uint64 // FNV-1a hash of the packet as given
+	After     uint64 // FNV-1a hash of the translated packet
+	Fields    ModField
+	Time      int64 // when the packet was translated, in Unix nanoseconds
+}
+
+// modRange maps bytes of a packet to the field they belong to
+type modRange struct {
+	start, end int
+	field      ModField
+}
+
+var ipv4ModRanges = []modRange{
+	{1, 2, ModTOS},
+	{2, 4, ModTotalLength},
+	{4, 6, ModIdentification},
+	{6, 8, ModFragment},
+	{8, 9, ModTTL},
+	{9, 10, ModProtocol},
+	{10, 12, ModIPChecksum},
+	{12, 16, ModSrcIP},
+	{16, 20, ModDstIP},
+}
+
+// ipv6ModRanges are the fixed IPv6 header fields. Byte 1 holds both the end
+// of the traffic class and the start of the flow label, it counts as ModTOS.
+var ipv6ModRanges = []modRange{
+	{0, 2, ModTOS},
+	{2, 4, ModFlowLabel},
+	{4, 6, ModTotalLength},
+	{6, 7, ModProtocol},
+	{7, 8, ModTTL},
+	{8, 24, ModSrcIP},
+	{24, 40, ModDstIP},
+}
+
+// recordModification records the changes between packet as it was given,
+// before, and as translated
+func (t *Table[IP]) recordModification(before, packet []byte, outbound bool, namespace uintptr) {
+	t.lastMod.Store(&ModRecord{
+		Outbound:  outbound,
+		Namespace: namespace,
+		Before:    hashPacket(before),
+		After:     hashPacket(packet),
+		Fields:    diffPacket(before, packet),
+		Time:      t.nowNano(),
+	})
+}
+
+// LastModification returns the record of the last packet translated while
+// RecordModifications was set, or a zero record if there is none
+func (t *Table[IP]) LastModification() ModRecord {
+	if rec := t.lastMod.Load(); rec != nil {
+		return *rec
+	}
+	return ModRecord{}
+}
+
+func hashPacket(packet []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(packet)
+	return h.Sum64()
+}
+
+// diffPacket returns the fields that differ between two versions of an IPv4
+// or IPv6 packet, laid out according to the first one
+func diffPacket(before, after []byte) ModField {
+	var fields ModField
+	if len(before) != len(after) {
+		fields |= ModLength
+	}
+	n := min(len(before), len(after))
+	ranges := ipModRanges(before)
+	if ranges == nil {
+		if string(before[:n]) != string(after[:n]) {
+			fields |= ModPayload
+		}
+		return fields
+	}
+
+	for i := 0; i < n; i++ {
+		if before[i] == after[i] {
+			continue
+		}
+		field := ModPayload
+		for _, r := range ranges {
+			if i >= r.start && i < r.end {
+				field = r.field
+				break
+			}
+		}
+		fields |= field
+	}
+	return fields
+}
+
+// ipModRanges returns the byte ranges of the headers of packet, nil if it
+// is too short to hold an IP header
+func ipModRanges(packet []byte) []modRange {
+	if isIPv6Packet(packet) {
+		if len(packet) < 40 {
+			return nil
+		}
+		ranges := append([]modRange(nil), ipv6ModRanges...)
+		protocol, offset, err := skipIPv6Extensions(packet, 40, packet[6])
+		if err != nil {
+			return ranges
+		}
+		ranges = append(ranges, modRange{40, offset, ModIPOptions})
+		return append(ranges, l4ModRanges(packet, offset, protocol)...)
+	}
+
+	if len(packet) < 20 {
+		return nil
+	}
+	ranges := append([]modRange(nil), ipv4ModRanges...)
+	ipHeaderLen := int(packet[0]&0x0f) * 4
+	ranges = append(ranges, modRange{20, ipHeaderLen, ModIPOptions})
+	return append(ranges, l4ModRanges(packet, ipHeaderLen, packet[9])...)
+}
+
+// l4ModRanges returns the byte ranges of the transport header of packet
+// starting at offset. Bytes of the header not listed are ModL4Header.
+func l4ModRanges(packet []byte, offset int, protocol uint8) []modRange {
+	at := func(start, end int, field ModField) modRange {
+		return modRange{offset + start, offset + end, field}
+	}
+	var ranges []modRange
+	headerLen := 0
+	switch protocol {
+	case ProtocolTCP:
+		headerLen = 20
+		if len(packet) >= offset+13 {
+			headerLen = max(headerLen, int(packet[offset+12]>>4)*4)
+		}
+		ranges = []modRange{
+			at(0, 2, ModSrcPort), at(2, 4, ModDstPort), at(4, 8, ModSequence),
+			at(8, 12, ModAcknowledgment), at(16, 18, ModL4Checksum),
+		}
+	case ProtocolUDP:
+		headerLen = 8
+		ranges = []modRange{at(0, 2, ModSrcPort), at(2, 4, ModDstPort), at(6, 8, ModL4Checksum)}
+	case ProtocolDCCP:
+		headerLen = 12
+		if len(packet) >= offset+5 {
+			headerLen = max(headerLen, int(packet[offset+4])*4)
+		}
+		ranges = []modRange{at(0, 2, ModSrcPort), at(2, 4, ModDstPort), at(6, 8, ModL4Checksum)}
+	case ProtocolICMP:
+		headerLen = 8
+		ranges = []modRange{at(2, 4, ModL4Checksum)}
+		if len(packet) > offset && (packet[offset] == ICMPTypeEchoRequest || packet[offset] == ICMPTypeEchoReply) {
+			ranges = append(ranges, at(4, 6, ModICMPID))
+		}
+	case ProtocolICMPv6:
+		headerLen = 8
+		ranges = []modRange{at(2, 4, ModL4Checksum)}
+		if len(packet) > offset && (packet[offset] == ICMPv6TypeEchoRequest || packet[offset] == ICMPv6TypeEchoReply) {
+			ranges = append(ranges, at(4, 6, ModICMPID))
+		}
+	default:
+		return nil
+	}
+	return append(ranges, at(0, headerLen, ModL4Header))
+}
@@ -0,0 +1,78 @@
+package swnat
+
+import (
+	"errors"
+	"slices"
+)
+
+// JoinMulticast registers the interest of a namespace in a multicast group,
+// for a relay subscribed to the group on behalf of its internal clients.
+// HandleInboundPacketMulticast delivers packets to the group to every
+// namespace that joined it.
+func (t *Table[IP]) JoinMulticast(group IP, namespace uintptr) error {
+	if !isMulticast(group) {
+		return errors.New("not a multicast group address")
+	}
+
+	t.mcastMutex.Lock()
+	defer t.mcastMutex.Unlock()
+	members := t.mcastGroups[group]
+	if i, found := slices.BinarySearch(members, namespace); !found {
+		if t.mcastGroups == nil {
+			t.mcastGroups = make(map[IP][]uintptr)
+		}
+		t.mcastGroups[group] = slices.Insert(members, i, namespace)
+	}
+	return nil
+}
+
+// LeaveMulticast removes the interest of a namespace in a multicast group
+func (t *Table[IP]) LeaveMulticast(group IP, namespace uintptr) {
+	t.mcastMutex.Lock()
+	defer t.mcastMutex.Unlock()
+	members := t.mcastGroups[group]
+	if i, found := slices.BinarySearch(members, namespace); found {
+		members = slices.Delete(members, i, i+1)
+		if len(members) == 0 {
+			delete(t.mcastGroups, group)
+		} else {
+			t.mcastGroups[group] = members
+		}
+	}
+}
+
+// multicastMembers returns the namespaces that joined group, in ascending
+// order
+func (t *Table[IP]) multicastMembers(group IP) []uintptr {
+	t.mcastMutex.RLock()
+	defer t.mcastMutex.RUnlock()
+	return slices.Clone(t.mcastGroups[group])
+}
+
+// HandleInboundPacketMulticast is HandleInboundPacket for packets that may
+// be addressed to a multicast group. Those are left untouched and returned
+// with every namespace that joined the group, each to get a copy, or
+// dropped when there is none. Other packets are translated by
+// HandleInboundPacket and returned with their single namespace.
+func (t *Table[IP]) HandleInboundPacketMulticast(packet []byte) ([]uintptr, error) {
+	_, dst, err := t.packetAddresses(packet)
+	if err != nil || !isMulticast(dst) {
+		namespace, err := t.HandleInboundPacket(packet)
+		if err != nil {
+			return nil, err
+		}
+		return []uintptr{namespace}, nil
+	}
+
+	members := t.multicastMembers(dst)
+	if len(members) == 0 {
+		t.drops.add(false, ErrDropPacket)
+		return nil, ErrDropPacket
+	}
+	for _, namespace := range members {
+		counters := t.activeNSCounters(namespace)
+		counters.packetsIn.Add(1)
+		counters.bytesIn.Add(uint64(len(packet)))
+	}
+	return members, nil
+}
@@ -0,0 +1,166 @@
+package swnat
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// namespaceConfig holds per-namespace settings
+type namespaceConfig struct {
+	priority int
+	prefixes []*net.IPNet // see RegisterNamespacePrefix
+}
+
+// nsCounters are the traffic counters of a namespace, kept in Table.nsStats
+// and updated in the packet path without locking
+type nsCounters struct {
+	packetsOut atomic.Uint64
+	packetsIn  atomic.Uint64
+	bytesOut   atomic.Uint64
+	bytesIn    atomic.Uint64
+	drops      atomic.Uint64
+	evictions  atomic.Uint64
+}
+
+// NamespaceStats is a snapshot of the activity of a namespace
+type NamespaceStats struct {
+	Connections int    // active connections across protocols
+	PacketsOut  uint64 // outbound packets translated
+	PacketsIn   uint64 // inbound packets translated
+	BytesOut    uint64
+	BytesIn     uint64
+	Drops       uint64 // outbound packets refused, for any reason, once the namespace had a connection
+	Evictions   uint64 // connections evicted by MaxConnPerNamespace or MaxTotalConn
+}
+
+// namespaceLocked returns the settings of a namespace, creating them if needed.
+// The caller must hold nsMutex for writing.
+func (t *Table[IP]) namespaceLocked(namespace uintptr) *namespaceConfig {
+	if t.namespaces == nil {
+		t.namespaces = make(map[uintptr]*namespaceConfig)
+	}
+	ns := t.namespaces[namespace]
+	if ns == nil {
+		ns = &namespaceConfig{}
+		t.namespaces[namespace] = ns
+	}
+	return ns
+}
+
+// SetNamespacePriority sets the priority of a namespace. Namespaces with a
+// positive priority may still open connections once free ports dropped
+// below PortLowWatermark. The default priority is 0.
+func (t *Table[IP]) SetNamespacePriority(namespace uintptr, priority int) {
+	t.nsMutex.Lock()
+	defer t.nsMutex.Unlock()
+	t.namespaceLocked(namespace).priority = priority
+}
+
+// namespacePriority returns the priority of a namespace
+func (t *Table[IP]) namespacePriority(namespace uintptr) int {
+	t.nsMutex.RLock()
+	defer t.nsMutex.RUnlock()
+	if ns := t.namespaces[namespace]; ns != nil {
+		return ns.priority
+	}
+	return 0
+}
+
+// RegisterNamespacePrefix declares prefix as an internal network of
+// namespace, which StrictInternalSource holds the namespace's outbound
+// packets to. It is also registered with RegisterInternalPrefix. It can be
+// called several times to register more prefixes.
+func (t *Table[IP]) RegisterNamespacePrefix(namespace uintptr, prefix net.IPNet) error {
+	if err := t.RegisterInternalPrefix(prefix); err != nil {
+		return err
+	}
+	network, _ := familyPrefix[IP](prefix)
+
+	t.nsMutex.Lock()
+	defer t.nsMutex.Unlock()
+	ns := t.namespaceLocked(namespace)
+	ns.prefixes = append(ns.prefixes, network)
+	return nil
+}
+
+// sourceAllowed reports whether ip belongs to the prefixes registered for
+// namespace, or the namespace has none
+func (t *Table[IP]) sourceAllowed(namespace uintptr, ip IP) bool {
+	t.nsMutex.RLock()
+	defer t.nsMutex.RUnlock()
+
+	ns := t.namespaces[namespace]
+	if ns == nil || len(ns.prefixes) == 0 {
+		return true
+	}
+	raw := net.IP(ipBytes(&ip))
+	for _, network := range ns.prefixes {
+		if network.Contains(raw) {
+			return true
+		}
+	}
+	return false
+}
+
+// internalTo reports whether ip is an internal host of namespace: in one of
+// its prefixes, or when it has none, in a registered internal prefix
+func (t *Table[IP]) internalTo(namespace uintptr, ip IP) bool {
+	t.nsMutex.RLock()
+	var prefixes []*net.IPNet
+	if ns := t.namespaces[namespace]; ns != nil {
+		prefixes = ns.prefixes
+	}
+	t.nsMutex.RUnlock()
+	if len(prefixes) == 0 {
+		return t.isInternal(ip)
+	}
+
+	raw := net.IP(ipBytes(&ip))
+	for _, network := range prefixes {
+		if network.Contains(raw) {
+			return true
+		}
+	}
+	return false
+}
+
+// nsCounters returns the counters of a namespace, or nil if it never had a
+// connection. Packets refused for namespaces the table never saw, such as
+// spoofed ones, thus don't create entries.
+func (t *Table[IP]) nsCounters(namespace uintptr) *nsCounters {
+	if c, ok := t.nsStats.Load(namespace); ok {
+		return c.(*nsCounters)
+	}
+	return nil
+}
+
+// activeNSCounters returns the counters of a namespace, creating them if
+// needed. It is only called for a namespace with a connection, or members
+// of a multicast group.
+func (t *Table[IP]) activeNSCounters(namespace uintptr) *nsCounters {
+	if c := t.nsCounters(namespace); c != nil {
+		return c
+	}
+	c, _ := t.nsStats.LoadOrStore(namespace, &nsCounters{})
+	return c.(*nsCounters)
+}
+
+// NamespaceStats returns the activity counters of a namespace since the
+// table was created, along with its current number of connections
+func (t *Table[IP]) NamespaceStats(namespace uintptr) NamespaceStats {
+	var stats NamespaceStats
+
+	if c := t.nsCounters(namespace); c != nil {
+		stats.PacketsOut = c.packetsOut.Load()
+		stats.PacketsIn = c.packetsIn.Load()
+		stats.BytesOut = c.bytesOut.Load()
+		stats.BytesIn = c.bytesIn.Load()
+		stats.Drops = c.drops.Load()
+		stats.Evictions = c.evictions.Load()
+	}
+
+	for _, p := range t.pairs() {
+		stats.Connections += p.countNamespace(namespace)
+	}
+	return stats
+}
@@ -0,0 +1,7 @@
+//go:build !race
+
+package swnat
+
+// raceEnabled reports whether tests run under the race detector, which
+// slows code too unevenly for timing comparisons
+const raceEnabled = false
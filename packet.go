@@ -9,6 +9,15 @@ const (
 	ProtocolICMP = 1
 	ProtocolTCP  = 6
 	ProtocolUDP  = 17
+	ProtocolDCCP = 33
+	ProtocolESP  = 50
+
+	ProtocolICMPv6 = 58
+
+	// ProtocolAny installs a rule for every protocol the table tracks, drop
+	// rules only for those with ports. It uses the IANA reserved protocol
+	// number and never appears in packets.
+	ProtocolAny = 255
 
 	// TCP flags
 	TCPFlagFIN = 0x01
@@ -17,11 +26,31 @@ const (
 	TCPFlagPSH = 0x08
 	TCPFlagACK = 0x10
 	TCPFlagURG = 0x20
+	TCPFlagECE = 0x40 // ECN-Echo, RFC 3168
+	TCPFlagCWR = 0x80 // Congestion Window Reduced, RFC 3168
+
+	// IPv4 flags, as found in IPv4Header.Flags
+	IPv4FlagMoreFragments = 0x01
+	IPv4FlagDontFragment  = 0x02
+	IPv4FlagReserved      = 0x04 // RFC 3514 "evil bit"
 
 	// ICMP types
 	ICMPTypeEchoReply              = 0
 	ICMPTypeDestinationUnreachable = 3
 	ICMPTypeEchoRequest            = 8
+	ICMPTypeTimeExceeded           = 11
+
+	// ICMPv6 types
+	ICMPv6TypeDestinationUnreachable = 1
+	ICMPv6TypePacketTooBig           = 2
+	ICMPv6TypeTimeExceeded           = 3
+	ICMPv6TypeParameterProblem       = 4
+	ICMPv6TypeEchoRequest            = 128
+	ICMPv6TypeEchoReply              = 129
+
+	// ICMP codes for ICMPTypeDestinationUnreachable
+	ICMPCodePortUnreachable     = 3
+	ICMPCodeFragmentationNeeded = 4
 )
 
 type IPv4Header struct {
@@ -37,6 +66,11 @@ type IPv4Header struct {
 	Checksum       uint16
 	SourceIP       IPv4
 	DestinationIP  IPv4
+
+	// Options holds the option bytes between the fixed header and IHL*4,
+	// including any NOP and End of Options padding. ParseIPv4Header sets it
+	// to a slice of the packet.
+	Options []byte
 }
 
 func ParseIPv4Header(packet []byte) (*IPv4Header, error) {
@@ -59,6 +93,9 @@ func ParseIPv4Header(packet []byte) (*IPv4Header, error) {
 
 	h.TypeOfService = packet[1]
 	h.TotalLength = binary.BigEndian.Uint16(packet[2:4])
+	if int(h.TotalLength) < headerLen || int(h.TotalLength) > len(packet) {
+		return nil, fmt.Errorf("invalid total length %d for header length %d and packet length %d", h.TotalLength, headerLen, len(packet))
+	}
 	h.Identification = binary.BigEndian.Uint16(packet[4:6])
 	flagsAndOffset := binary.BigEndian.Uint16(packet[6:8])
 	h.Flags = uint8(flagsAndOffset >> 13)
@@ -68,10 +105,31 @@ func ParseIPv4Header(packet []byte) (*IPv4Header, error) {
 	h.Checksum = binary.BigEndian.Uint16(packet[10:12])
 	copy(h.SourceIP[:], packet[12:16])
 	copy(h.DestinationIP[:], packet[16:20])
+	if headerLen > 20 {
+		h.Options = packet[20:headerLen]
+	}
 
 	return h, nil
 }
 
+// DSCP returns the Differentiated Services Code Point of the packet
+func (h *IPv4Header) DSCP() uint8 {
+	return h.TypeOfService >> 2
+}
+
+// ReservedFlag reports whether the reserved (evil) bit of the header is set.
+// Marshal preserves it as-is.
+func (h *IPv4Header) ReservedFlag() bool {
+	return h.Flags&IPv4FlagReserved != 0
+}
+
+// IsAtomic reports whether the packet is an atomic datagram as defined by
+// RFC 6864: Don't Fragment set and not a fragment, so its Identification
+// serves no purpose
+func (h *IPv4Header) IsAtomic() bool {
+	return h.Flags&IPv4FlagDontFragment != 0 && h.Flags&IPv4FlagMoreFragments == 0 && h.FragmentOffset == 0
+}
+
 func (h *IPv4Header) Marshal(packet []byte) {
 	packet[0] = (h.Version << 4) | h.IHL
 	packet[1] = h.TypeOfService
@@ -84,6 +142,13 @@ func (h *IPv4Header) Marshal(packet []byte) {
 	copy(packet[12:16], h.SourceIP[:])
 	copy(packet[16:20], h.DestinationIP[:])
 
+	// Write options back, padding with End of Options up to IHL
+	headerLen := int(h.IHL) * 4
+	if headerLen > 20 {
+		n := copy(packet[20:headerLen], h.Options)
+		clear(packet[20+n : headerLen])
+	}
+
 	// Calculate and set checksum
 	h.Checksum = calculateIPv4Checksum(packet[:h.IHL*4])
 	binary.BigEndian.PutUint16(packet[10:12], h.Checksum)
@@ -104,6 +169,119 @@ func calculateIPv4Checksum(header []byte) uint16 {
 	return uint16(^sum)
 }
 
+// IPv6 extension headers walked by ParseIPv6Header
+const (
+	IPv6HeaderHopByHop    = 0
+	IPv6HeaderRouting     = 43
+	IPv6HeaderFragment    = 44
+	IPv6HeaderAuth        = 51
+	IPv6HeaderDestOptions = 60
+)
+
+type IPv6Header struct {
+	Version       uint8
+	TrafficClass  uint8
+	FlowLabel     uint32
+	PayloadLength uint16
+	NextHeader    uint8
+	HopLimit      uint8
+	SourceIP      IPv6
+	DestinationIP IPv6
+
+	// Protocol is the upper-layer protocol found by following the Next
+	// Header chain through any extension headers, and HeaderLen the offset
+	// of its header in the packet
+	Protocol  uint8
+	HeaderLen int
+}
+
+func ParseIPv6Header(packet []byte) (*IPv6Header, error) {
+	if len(packet) < 40 {
+		return nil, fmt.Errorf("packet too short for IPv6 header")
+	}
+
+	h := &IPv6Header{}
+	h.Version = packet[0] >> 4
+	if h.Version != 6 {
+		return nil, fmt.Errorf("not an IPv6 packet")
+	}
+
+	h.TrafficClass = packet[0]<<4 | packet[1]>>4
+	h.FlowLabel = binary.BigEndian.Uint32(packet[0:4]) & 0xFFFFF
+	h.PayloadLength = binary.BigEndian.Uint16(packet[4:6])
+	h.NextHeader = packet[6]
+	h.HopLimit = packet[7]
+	copy(h.SourceIP[:], packet[8:24])
+	copy(h.DestinationIP[:], packet[24:40])
+
+	if 40+int(h.PayloadLength) > len(packet) {
+		return nil, fmt.Errorf("invalid payload length %d for packet length %d", h.PayloadLength, len(packet))
+	}
+
+	var err error
+	h.Protocol, h.HeaderLen, err = skipIPv6Extensions(packet, 40, h.NextHeader)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// skipIPv6Extensions walks the extension headers of packet starting at
+// offset, next being the type of the first, and returns the upper-layer
+// protocol and the offset of its header
+func skipIPv6Extensions(packet []byte, offset int, next uint8) (uint8, int, error) {
+	for {
+		var size int
+		switch next {
+		case IPv6HeaderHopByHop, IPv6HeaderRouting, IPv6HeaderDestOptions:
+			if len(packet) < offset+2 {
+				return 0, 0, fmt.Errorf("truncated IPv6 extension header %d", next)
+			}
+			size = (int(packet[offset+1]) + 1) * 8
+		case IPv6HeaderFragment:
+			size = 8
+		case IPv6HeaderAuth:
+			if len(packet) < offset+2 {
+				return 0, 0, fmt.Errorf("truncated IPv6 extension header %d", next)
+			}
+			size = (int(packet[offset+1]) + 2) * 4
+		default:
+			return next, offset, nil
+		}
+		if len(packet) < offset+size {
+			return 0, 0, fmt.Errorf("truncated IPv6 extension header %d", next)
+		}
+		next = packet[offset]
+		offset += size
+	}
+}
+
+// DSCP returns the Differentiated Services Code Point of the packet
+func (h *IPv6Header) DSCP() uint8 {
+	return h.TrafficClass >> 2
+}
+
+// upperLayer returns the upper-layer header and payload of the packet,
+// which IPv6 checksums cover
+func (h *IPv6Header) upperLayer(packet []byte) ([]byte, error) {
+	end := 40 + int(h.PayloadLength)
+	if h.HeaderLen > end {
+		return nil, fmt.Errorf("invalid payload length %d", h.PayloadLength)
+	}
+	return packet[h.HeaderLen:end], nil
+}
+
+// Marshal writes the fixed header to packet, leaving any extension headers
+// that follow it untouched. IPv6 has no header checksum.
+func (h *IPv6Header) Marshal(packet []byte) {
+	binary.BigEndian.PutUint32(packet[0:4], uint32(h.Version)<<28|uint32(h.TrafficClass)<<20|h.FlowLabel&0xFFFFF)
+	binary.BigEndian.PutUint16(packet[4:6], h.PayloadLength)
+	packet[6] = h.NextHeader
+	packet[7] = h.HopLimit
+	copy(packet[8:24], h.SourceIP[:])
+	copy(packet[24:40], h.DestinationIP[:])
+}
+
 type TCPHeader struct {
 	SourcePort      uint16
 	DestinationPort uint16
@@ -168,6 +346,15 @@ func ParseUDPHeader(packet []byte, offset int) (*UDPHeader, error) {
 	return h, nil
 }
 
+// datagram returns the UDP header and payload as bounded by the Length
+// field, ignoring any trailing bytes in the buffer
+func (h *UDPHeader) datagram(packet []byte, offset int) ([]byte, error) {
+	if h.Length < 8 || offset+int(h.Length) > len(packet) {
+		return nil, fmt.Errorf("invalid UDP length %d", h.Length)
+	}
+	return packet[offset : offset+int(h.Length)], nil
+}
+
 func (h *UDPHeader) Marshal(packet []byte, offset int) {
 	binary.BigEndian.PutUint16(packet[offset:offset+2], h.SourcePort)
 	binary.BigEndian.PutUint16(packet[offset+2:offset+4], h.DestinationPort)
@@ -232,6 +419,34 @@ func calculateTCPChecksum(srcIP, dstIP IPv4, tcpData []byte) uint16 {
 	return uint16(^sum)
 }
 
+// calculateIPv6Checksum returns the TCP, UDP or ICMPv6 checksum of data,
+// including the IPv6 pseudo-header, RFC 8200 section 8.1
+func calculateIPv6Checksum(srcIP, dstIP IPv6, protocol uint8, data []byte) uint16 {
+	var pseudoHeader [40]byte
+	copy(pseudoHeader[0:16], srcIP[:])
+	copy(pseudoHeader[16:32], dstIP[:])
+	binary.BigEndian.PutUint32(pseudoHeader[32:36], uint32(len(data)))
+	pseudoHeader[39] = protocol
+
+	sum := uint32(0)
+	for i := 0; i < len(pseudoHeader); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(pseudoHeader[i : i+2]))
+	}
+
+	for i := 0; i < len(data); i += 2 {
+		if i+1 < len(data) {
+			sum += uint32(binary.BigEndian.Uint16(data[i : i+2]))
+		} else {
+			sum += uint32(data[i]) << 8
+		}
+	}
+
+	for (sum >> 16) > 0 {
+		sum = (sum & 0xFFFF) + (sum >> 16)
+	}
+	return uint16(^sum)
+}
+
 func calculateUDPChecksum(srcIP, dstIP IPv4, udpData []byte) uint16 {
 	pseudoHeader := make([]byte, 12)
 	copy(pseudoHeader[0:4], srcIP[:])
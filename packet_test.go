@@ -1,7 +1,9 @@
 package swnat
 
 import (
+	"bytes"
 	"encoding/binary"
+	"net"
 	"testing"
 )
 
@@ -14,13 +16,13 @@ func TestParseIPv4Header(t *testing.T) {
 	}{
 		{
 			name: "valid IPv4 packet",
-			packet: []byte{
+			packet: append([]byte{
 				0x45, 0x00, 0x00, 0x3c, // Version/IHL, TOS, Total Length
 				0x1c, 0x46, 0x40, 0x00, // ID, Flags/Fragment
 				0x40, 0x06, 0xb1, 0xe6, // TTL, Protocol, Checksum
 				0xc0, 0xa8, 0x00, 0x01, // Source IP
 				0xc0, 0xa8, 0x00, 0x02, // Dest IP
-			},
+			}, make([]byte, 40)...), // payload up to Total Length
 			want: &IPv4Header{
 				Version:        4,
 				IHL:            5,
@@ -361,4 +363,221 @@ func TestUDPHeaderMarshal(t *testing.T) {
 	if parsed.Length != h.Length {
 		t.Errorf("Length mismatch: got %d, want %d", parsed.Length, h.Length)
 	}
-}
\ No newline at end of file
+}
+func TestIPv4HeaderReservedFlag(t *testing.T) {
+	packet := CreateIPv4UDPPacket(IPv4{192, 168, 1, 100}, IPv4{8, 8, 8, 8}, 5000, 53, []byte("evil"))
+	// Reserved bit plus DF, with a non-zero fragment offset to catch shifts
+	binary.BigEndian.PutUint16(packet[6:8], 0xC000|0x0123)
+	binary.BigEndian.PutUint16(packet[10:12], 0)
+	binary.BigEndian.PutUint16(packet[10:12], calculateIPv4Checksum(packet[:20]))
+
+	original := make([]byte, len(packet))
+	copy(original, packet)
+
+	h, err := ParseIPv4Header(packet)
+	if err != nil {
+		t.Fatalf("ParseIPv4Header failed: %v", err)
+	}
+	if !h.ReservedFlag() {
+		t.Error("ReservedFlag() = false, want true")
+	}
+	if h.Flags&IPv4FlagDontFragment == 0 {
+		t.Error("DF flag not decoded")
+	}
+
+	h.Marshal(packet)
+	if !bytes.Equal(packet, original) {
+		t.Errorf("Parse/Marshal round trip changed the packet:\ngot  %x\nwant %x", packet, original)
+	}
+
+	// Translation must not clear the bit either
+	table := NewIPv4(net.ParseIP("1.2.3.4"))
+	if err := table.HandleOutboundPacket(packet, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	if binary.BigEndian.Uint16(packet[6:8]) != 0xC000|0x0123 {
+		t.Errorf("Flags/offset changed by translation: %#04x", binary.BigEndian.Uint16(packet[6:8]))
+	}
+}
+
+func TestIPv4HeaderOptions(t *testing.T) {
+	// UDP packet with 8 bytes of options: Router Alert (4 bytes), two NOPs,
+	// End of Options and padding
+	options := []byte{0x94, 0x04, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00}
+	udp := CreateIPv4UDPPacket(IPv4{192, 168, 1, 100}, IPv4{8, 8, 8, 8}, 5000, 53, []byte("query"))
+	packet := make([]byte, 0, len(udp)+len(options))
+	packet = append(packet, udp[:20]...)
+	packet = append(packet, options...)
+	packet = append(packet, udp[20:]...)
+	packet[0] = 0x47 // IHL 7
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	binary.BigEndian.PutUint16(packet[10:12], 0)
+	binary.BigEndian.PutUint16(packet[10:12], calculateIPv4Checksum(packet[:28]))
+
+	h, err := ParseIPv4Header(packet)
+	if err != nil {
+		t.Fatalf("ParseIPv4Header failed: %v", err)
+	}
+	if !bytes.Equal(h.Options, options) {
+		t.Errorf("Options = %x, want %x", h.Options, options)
+	}
+
+	// Translation keeps the options and finds the UDP header after them
+	table := NewIPv4(net.ParseIP("1.2.3.4"))
+	if err := table.HandleOutboundPacket(packet, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	if !bytes.Equal(packet[20:28], options) {
+		t.Errorf("Options rewritten to %x", packet[20:28])
+	}
+	if calculateIPv4Checksum(packet[:28]) != 0 {
+		t.Error("Invalid IPv4 checksum after translation")
+	}
+	udpHeader, _ := ParseUDPHeader(packet, 28)
+	if udpHeader.DestinationPort != 53 {
+		t.Errorf("UDP header not found after options, destination port %d", udpHeader.DestinationPort)
+	}
+
+	// Marshal pads short options with End of Options
+	out := make([]byte, 28)
+	for i := range out {
+		out[i] = 0xff
+	}
+	h.Options = []byte{0x01, 0x01}
+	h.Marshal(out)
+	if !bytes.Equal(out[20:28], []byte{0x01, 0x01, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("Short options marshalled as %x", out[20:28])
+	}
+}
+
+func TestParseIPv4HeaderTotalLength(t *testing.T) {
+	packet := CreateIPv4UDPPacket(IPv4{192, 168, 1, 100}, IPv4{8, 8, 8, 8}, 5000, 53, nil)
+
+	// IHL beyond Total Length
+	bad := append([]byte(nil), packet...)
+	bad = append(bad, make([]byte, 40)...)
+	bad[0] = 0x4f // IHL 15, 60 bytes, Total Length stays 28
+	if _, err := ParseIPv4Header(bad); err == nil {
+		t.Error("Expected an error for IHL exceeding Total Length")
+	}
+
+	// Total Length beyond the packet
+	bad = append([]byte(nil), packet...)
+	binary.BigEndian.PutUint16(bad[2:4], uint16(len(bad)+1))
+	if _, err := ParseIPv4Header(bad); err == nil {
+		t.Error("Expected an error for Total Length exceeding the packet")
+	}
+
+	// Trailing bytes after Total Length are accepted
+	padded := append(append([]byte(nil), packet...), 0, 0)
+	if _, err := ParseIPv4Header(padded); err != nil {
+		t.Errorf("Unexpected error with trailing bytes: %v", err)
+	}
+}
+
+// ipv6Packet builds an IPv6 packet with the given extension headers
+// followed by payload. The first byte of each extension header is its own
+// type; it is replaced by the type of the header that follows.
+func ipv6Packet(src, dst IPv6, protocol uint8, exts [][]byte, payload []byte) []byte {
+	packet := make([]byte, 40)
+	packet[0] = 0x60
+	packet[7] = 64
+	copy(packet[8:24], src[:])
+	copy(packet[24:40], dst[:])
+
+	next := 6 // offset of the Next Header field to fill
+	for _, ext := range exts {
+		packet[next] = ext[0]
+		next = len(packet)
+		packet = append(packet, ext...)
+	}
+	packet[next] = protocol
+	packet = append(packet, payload...)
+	binary.BigEndian.PutUint16(packet[4:6], uint16(len(packet)-40))
+	return packet
+}
+
+func TestParseIPv6HeaderExtensions(t *testing.T) {
+	src, _ := ParseIPv6("fd00::10")
+	dst, _ := ParseIPv6("2001:db8::53")
+
+	udp := make([]byte, 8)
+	binary.BigEndian.PutUint16(udp[0:2], 5000)
+	binary.BigEndian.PutUint16(udp[2:4], 53)
+	binary.BigEndian.PutUint16(udp[4:6], 8)
+
+	// Hop-by-Hop with a Router Alert option and padding
+	hopByHop := []byte{IPv6HeaderHopByHop, 0, 0x05, 0x02, 0x00, 0x00, 0x01, 0x00}
+	packet := ipv6Packet(src, dst, ProtocolUDP, [][]byte{hopByHop}, udp)
+
+	h, err := ParseIPv6Header(packet)
+	if err != nil {
+		t.Fatalf("ParseIPv6Header failed: %v", err)
+	}
+	if h.NextHeader != IPv6HeaderHopByHop || h.Protocol != ProtocolUDP || h.HeaderLen != 48 {
+		t.Fatalf("Got next header %d, protocol %d at %d, want 0, 17 at 48", h.NextHeader, h.Protocol, h.HeaderLen)
+	}
+
+	// Rewrite the source address and port past the extension header
+	h.SourceIP, _ = ParseIPv6("2001:db8::1")
+	h.Marshal(packet)
+	udpHeader, err := ParseUDPHeader(packet, h.HeaderLen)
+	if err != nil {
+		t.Fatalf("ParseUDPHeader failed: %v", err)
+	}
+	if udpHeader.SourcePort != 5000 || udpHeader.DestinationPort != 53 {
+		t.Errorf("UDP header misread at offset %d: %+v", h.HeaderLen, udpHeader)
+	}
+	udpHeader.SourcePort = 40000
+	udpHeader.Marshal(packet, h.HeaderLen)
+
+	again, err := ParseIPv6Header(packet)
+	if err != nil {
+		t.Fatalf("ParseIPv6Header after rewrite failed: %v", err)
+	}
+	if again.SourceIP != h.SourceIP || again.DestinationIP != dst || again.HopLimit != 64 {
+		t.Errorf("Fixed header not preserved: %+v", again)
+	}
+	if !bytes.Equal(packet[40:48], []byte{ProtocolUDP, 0, 0x05, 0x02, 0x00, 0x00, 0x01, 0x00}) {
+		t.Errorf("Hop-by-Hop header changed: %x", packet[40:48])
+	}
+	if port := binary.BigEndian.Uint16(packet[48:50]); port != 40000 {
+		t.Errorf("Expected source port 40000 after the extension header, got %d", port)
+	}
+
+	// A longer chain: Hop-by-Hop, Destination Options (16 bytes), Fragment
+	destOpts := make([]byte, 16)
+	destOpts[0], destOpts[1] = IPv6HeaderDestOptions, 1
+	fragment := []byte{IPv6HeaderFragment, 0, 0, 0, 0, 0, 0, 1}
+	packet = ipv6Packet(src, dst, ProtocolTCP, [][]byte{hopByHop, destOpts, fragment}, make([]byte, 20))
+	h, err = ParseIPv6Header(packet)
+	if err != nil {
+		t.Fatalf("ParseIPv6Header (chain) failed: %v", err)
+	}
+	if h.Protocol != ProtocolTCP || h.HeaderLen != 40+8+16+8 {
+		t.Errorf("Got protocol %d at %d, want 6 at 72", h.Protocol, h.HeaderLen)
+	}
+
+	// Truncated extension header
+	packet = ipv6Packet(src, dst, ProtocolUDP, [][]byte{destOpts}, nil)
+	packet = packet[:50]
+	binary.BigEndian.PutUint16(packet[4:6], 10)
+	if _, err := ParseIPv6Header(packet); err == nil {
+		t.Error("Expected an error for a truncated extension header")
+	}
+}
+
+func TestCalculateIPv6Checksum(t *testing.T) {
+	src, _ := ParseIPv6("2001:db8::1")
+	dst, _ := ParseIPv6("2001:db8::2")
+	udp := []byte{0x04, 0xd2, 0x00, 0x35, 0x00, 0x0a, 0x00, 0x00, 'h', 'i'}
+
+	// computed over the 40-byte pseudo-header of RFC 8200
+	if got := calculateIPv6Checksum(src, dst, ProtocolUDP, udp); got != 0x36f5 {
+		t.Errorf("Expected checksum 0x36f5, got %#04x", got)
+	}
+	binary.BigEndian.PutUint16(udp[6:8], 0x36f5)
+	if got := calculateIPv6Checksum(src, dst, ProtocolUDP, udp); got != 0 {
+		t.Errorf("Expected a valid checksum to verify to 0, got %#04x", got)
+	}
+}
@@ -1,132 +1,796 @@
 package swnat
 
+import (
+	"context"
+	"net"
+	"sync/atomic"
+)
+
+// internalKey returns the key of the connection in the out map
+func (c *Conn[IP]) internalKey() InternalKey[IP] {
+	return InternalKey[IP]{
+		SrcIP:     c.LocalSrcIP,
+		DstIP:     c.LocalDstIp,
+		SrcPort:   c.LocalSrcPort,
+		DstPort:   c.LocalDstPort,
+		Namespace: c.Namespace,
+	}
+}
+
+// externalKey returns the key of the connection in the in map, as seen on
+// packets coming back from the remote host
+func (c *Conn[IP]) externalKey() ExternalKey[IP] {
+	return ExternalKey[IP]{
+		SrcIP:   c.OutsideDstIP,
+		DstIP:   c.OutsideSrcIP,
+		SrcPort: c.OutsideDstPort,
+		DstPort: c.OutsideSrcPort,
+	}
+}
+
 func (p *Pair[IP]) init() {
 	p.in = make(map[ExternalKey[IP]]*Conn[IP])
 	p.out = make(map[InternalKey[IP]]*Conn[IP])
+	p.byPort = make(map[uint16][]*Conn[IP])
+}
+
+// sourcePort is an outside address and port used by an internal source
+type sourcePort[IP comparable] struct {
+	internal IP
+	ip       IP
+	port     uint16
+}
+
+// countSourceLocked adds delta to the connections of the internal source of
+// conn using its outside port, if it was allocated one. A port counts once
+// towards the ports held by the source, however many of its connections
+// share it. The caller must hold the write lock.
+func (p *Pair[IP]) countSourceLocked(conn *Conn[IP], delta int) {
+	if conn.PreserveSource {
+		return
+	}
+	if p.srcPorts == nil {
+		p.srcPorts = make(map[IP]int)
+		p.srcPortRefs = make(map[sourcePort[IP]]int)
+	}
+	key := sourcePort[IP]{conn.LocalSrcIP, conn.OutsideSrcIP, conn.OutsideSrcPort}
+	refs := p.srcPortRefs[key] + delta
+	if refs > 0 {
+		p.srcPortRefs[key] = refs
+	} else {
+		delete(p.srcPortRefs, key)
+	}
+	if (delta > 0 && refs > delta) || (delta < 0 && refs > 0) {
+		// the source already held the port, or still does
+		return
+	}
+	if n := p.srcPorts[conn.LocalSrcIP] + delta; n > 0 {
+		p.srcPorts[conn.LocalSrcIP] = n
+	} else {
+		delete(p.srcPorts, conn.LocalSrcIP)
+	}
+}
+
+// sourcePorts returns the number of outside ports held by an internal host
+func (p *Pair[IP]) sourcePorts(ip IP) int {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.srcPorts[ip]
+}
+
+// len returns the number of connections in the pair
+func (p *Pair[IP]) len() int {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return len(p.out)
+}
+
+// countNamespace returns the number of connections of a namespace
+func (p *Pair[IP]) countNamespace(namespace uintptr) int {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	n := 0
+	for key := range p.out {
+		if key.Namespace == namespace {
+			n++
+		}
+	}
+	return n
+}
+
+// isHalfOpen tells whether c is in TCPStateSynSent after an outbound SYN,
+// the connections TCPSynTimeout and MaxHalfOpenPerNamespace apply to
+func (c *Conn[IP]) isHalfOpen() bool {
+	return c.State == TCPStateSynSent && c.synDir == finOutbound
+}
+
+// countHalfOpenLocked adds delta to the half-open connections of the
+// namespace of conn, if conn is half-open. The caller must hold the write
+// lock.
+func (p *Pair[IP]) countHalfOpenLocked(conn *Conn[IP], delta int) {
+	if !conn.isHalfOpen() {
+		return
+	}
+	if p.halfOpen == nil {
+		p.halfOpen = make(map[uintptr]int)
+	}
+	if n := p.halfOpen[conn.Namespace] + delta; n > 0 {
+		p.halfOpen[conn.Namespace] = n
+	} else {
+		delete(p.halfOpen, conn.Namespace)
+	}
+}
+
+// setTCPState moves conn to state, synDir being the direction of its SYN,
+// keeping the half-open count of its namespace current while conn is in
+// the pair
+func (p *Pair[IP]) setTCPState(conn *Conn[IP], state TCPState, synDir uint8) {
+	if conn.State == state && conn.synDir == synDir {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	tracked := p.out[conn.internalKey()] == conn
+	if tracked {
+		p.countHalfOpenLocked(conn, -1)
+	}
+	conn.State, conn.synDir = state, synDir
+	if tracked {
+		p.countHalfOpenLocked(conn, 1)
+	}
+}
+
+// countHalfOpen returns the number of half-open connections of a namespace
+func (p *Pair[IP]) countHalfOpen(namespace uintptr) int {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.halfOpen[namespace]
+}
+
+// destination is a destination of the connections of a namespace, as sent
+// by the internal host
+type destination[IP comparable] struct {
+	namespace uintptr
+	ip        IP
+}
+
+// countDestinationLocked adds delta to the connections of the namespace of
+// conn to its destination. The caller must hold the write lock.
+func (p *Pair[IP]) countDestinationLocked(conn *Conn[IP], delta int) {
+	if p.toDest == nil {
+		p.toDest = make(map[destination[IP]]int)
+	}
+	dst := destination[IP]{conn.Namespace, conn.LocalDstIp}
+	if n := p.toDest[dst] + delta; n > 0 {
+		p.toDest[dst] = n
+	} else {
+		delete(p.toDest, dst)
+	}
+}
+
+// countToDestination returns the number of connections of a namespace to
+// the destination dst, as sent by the internal host
+func (p *Pair[IP]) countToDestination(namespace uintptr, dst IP) int {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.toDest[destination[IP]{namespace, dst}]
 }
 
 func (p *Pair[IP]) lookupOutbound(key InternalKey[IP]) *Conn[IP] {
+	c := p.cache.Load()
+	if c != nil {
+		if e := c.outSlot(key).Load(); e != nil && e.key == key {
+			return e.conn
+		}
+	}
+
 	p.mutex.RLock()
 	defer p.mutex.RUnlock()
-	return p.out[key]
+	conn := p.out[key]
+	if conn != nil && c != nil {
+		c.outSlot(key).Store(&flowEntry[InternalKey[IP], IP]{key, conn})
+	}
+	return conn
 }
 
 func (p *Pair[IP]) lookupInbound(key ExternalKey[IP]) *Conn[IP] {
+	c := p.cache.Load()
+	if c != nil {
+		if e := c.inSlot(key).Load(); e != nil && e.key == key {
+			return e.conn
+		}
+	}
+
 	p.mutex.RLock()
 	defer p.mutex.RUnlock()
-	return p.in[key]
+	conn := p.in[key]
+	if conn != nil && c != nil {
+		c.inSlot(key).Store(&flowEntry[ExternalKey[IP], IP]{key, conn})
+	}
+	return conn
+}
+
+// lookupInboundHealing is lookupInbound checking that the connection found
+// is also the one its out key maps to. If it isn't, the in entry is stale:
+// it is removed and lookupInboundHealing returns nil and true.
+func (p *Pair[IP]) lookupInboundHealing(key ExternalKey[IP]) (*Conn[IP], bool) {
+	p.mutex.RLock()
+	conn := p.in[key]
+	if conn == nil || p.out[conn.internalKey()] == conn {
+		p.mutex.RUnlock()
+		return conn, false
+	}
+	p.mutex.RUnlock()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	conn = p.in[key]
+	if conn == nil || p.out[conn.internalKey()] == conn {
+		// repaired or replaced meanwhile
+		return conn, false
+	}
+	delete(p.in, key)
+	if c := p.cache.Load(); c != nil {
+		c.forgetIn(key)
+	}
+	return nil, true
+}
+
+// maintenanceCheckInterval is how many connections cleanupExpiredCtx scans
+// between checks of its context
+const maintenanceCheckInterval = 1024
+
+// evictPolicy controls how addConnection makes room in a full namespace or
+// table
+type evictPolicy struct {
+	maxPerNamespace int  // 0 means unlimited
+	maxTotal        int  // 0 means unlimited
+	byPriority      bool // evict lower DSCP classes before falling back to LRU
+	global          GlobalEvictionPolicy
+}
+
+// eviction describes a connection evicted by addConnection
+type eviction[IP comparable] struct {
+	victim ConnInfo[IP]
+	reason string // EvictReason*
+	count  int    // connections of the namespace, or of the pair for the global limit
+}
+
+// isBetterVictim reports whether a should be evicted before b. One-way flows
+// go before assured ones, the least recently seen first.
+func isBetterVictim[IP comparable](policy evictPolicy, a, b *Conn[IP]) bool {
+	if policy.byPriority && a.DSCP>>3 != b.DSCP>>3 {
+		return a.DSCP>>3 < b.DSCP>>3
+	}
+	if a.Assured != b.Assured {
+		return b.Assured
+	}
+	return a.LastSeen < b.LastSeen
 }
 
-func (p *Pair[IP]) addConnection(conn *Conn[IP], maxPerNamespace int) {
+// addConnection inserts conn in the maps, first evicting a connection if its
+// namespace or the pair is full. It returns what was evicted, if anything.
+// A shared outside port may have been given to another connection to the
+// same endpoint since it was allocated; conn is then refused with
+// ErrPortExhausted, as both would get the same replies.
+func (p *Pair[IP]) addConnection(conn *Conn[IP], policy evictPolicy) (ev eviction[IP], evicted bool, err error) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
+	internalKey := conn.internalKey()
+	if c := p.in[conn.externalKey()]; c != nil && c != p.out[internalKey] {
+		return ev, false, ErrPortExhausted
+	}
+
 	// Check if we need to evict old connections from this namespace
-	if maxPerNamespace > 0 {
+	if policy.maxPerNamespace > 0 {
 		count := 0
 		var oldest *Conn[IP]
-		var oldestKey InternalKey[IP]
 
-		// Count connections in this namespace and find oldest
+		// Count connections in this namespace and find the victim
 		for key, c := range p.out {
 			if key.Namespace == conn.Namespace && !c.PendingSweep {
 				count++
-				if oldest == nil || c.LastSeen < oldest.LastSeen {
+				if oldest == nil || isBetterVictim(policy, c, oldest) {
 					oldest = c
-					oldestKey = key
 				}
 			}
 		}
 
-		// If we're at the limit, remove the oldest connection
-		if count >= maxPerNamespace && oldest != nil {
-			externalKey := ExternalKey[IP]{
-				SrcIP:   oldest.OutsideDstIP,
-				DstIP:   oldest.OutsideSrcIP,
-				SrcPort: oldest.OutsideDstPort,
-				DstPort: oldest.OutsideSrcPort,
-			}
-			delete(p.out, oldestKey)
-			delete(p.in, externalKey)
+		// If we're at the limit, remove the victim
+		if count >= policy.maxPerNamespace && oldest != nil {
+			ev, evicted = eviction[IP]{oldest.info(), EvictReasonNamespaceLimit, count}, true
+			p.deleteLocked(oldest)
 		}
 	}
 
-	// Create keys
-	internalKey := InternalKey[IP]{
-		SrcIP:     conn.LocalSrcIP,
-		DstIP:     conn.LocalDstIp,
-		SrcPort:   conn.LocalSrcPort,
-		DstPort:   conn.LocalDstPort,
-		Namespace: conn.Namespace,
+	// Then whether the whole pair is full
+	if !evicted && policy.maxTotal > 0 && len(p.out) >= policy.maxTotal {
+		if victim := p.globalVictimLocked(conn.Namespace, policy); victim != nil {
+			ev, evicted = eviction[IP]{victim.info(), EvictReasonGlobalLimit, len(p.out)}, true
+			p.deleteLocked(victim)
+		}
 	}
 
-	externalKey := ExternalKey[IP]{
-		SrcIP:   conn.OutsideDstIP,
-		DstIP:   conn.OutsideSrcIP,
-		SrcPort: conn.OutsideDstPort,
-		DstPort: conn.OutsideSrcPort,
+	// Replace any connection already using this key rather than leaving it
+	// half-referenced
+	if existing := p.out[internalKey]; existing != nil {
+		p.deleteLocked(existing)
 	}
 
 	p.out[internalKey] = conn
-	p.in[externalKey] = conn
+	p.in[conn.externalKey()] = conn
+	p.forgetCachedLocked(conn)
+	p.byPort[conn.OutsideSrcPort] = append(p.byPort[conn.OutsideSrcPort], conn)
+	p.countSourceLocked(conn, 1)
+	p.countHalfOpenLocked(conn, 1)
+	p.countDestinationLocked(conn, 1)
+	return ev, evicted, nil
+}
+
+// mergeConnection inserts an imported connection, resolving collisions with
+// live connections on either key according to policy. An outside port held
+// by PortReuseDelay collides with the flow that released it, last seen when
+// it did. It reports whether conn was inserted.
+func (p *Pair[IP]) mergeConnection(conn *Conn[IP], policy MergePolicy) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	pooled := p.ports != nil && !conn.PreserveSource
+	if pooled {
+		if released, held := p.ports.heldSince(conn.OutsideSrcPort); held {
+			switch policy {
+			case MergeKeepExisting:
+				return false
+			case MergeKeepNewer:
+				if conn.LastSeen <= released {
+					return false
+				}
+			}
+		}
+	}
+
+	var conflicts []*Conn[IP]
+	if c := p.out[conn.internalKey()]; c != nil {
+		conflicts = append(conflicts, c)
+	}
+	if c := p.in[conn.externalKey()]; c != nil && (len(conflicts) == 0 || c != conflicts[0]) {
+		conflicts = append(conflicts, c)
+	}
+	for _, c := range conflicts {
+		switch policy {
+		case MergeKeepExisting:
+			return false
+		case MergeKeepNewer:
+			if conn.LastSeen <= c.LastSeen {
+				return false
+			}
+		}
+	}
+	for _, c := range conflicts {
+		p.deleteLocked(c)
+	}
+
+	// A port that can't be taken is shared with live connections, reserved,
+	// outside the pool, or held, conn having won it over the flow that
+	// released it
+	if pooled && !p.ports.take(conn.OutsideSrcPort) {
+		p.ports.unhold(conn.OutsideSrcPort)
+	}
+	p.out[conn.internalKey()] = conn
+	p.in[conn.externalKey()] = conn
+	p.forgetCachedLocked(conn)
+	p.byPort[conn.OutsideSrcPort] = append(p.byPort[conn.OutsideSrcPort], conn)
+	p.countSourceLocked(conn, 1)
+	p.countHalfOpenLocked(conn, 1)
+	p.countDestinationLocked(conn, 1)
+	return true
+}
+
+// globalVictimLocked picks the connection to evict when the pair is full,
+// from the namespace selected by the global policy, falling back to any
+// namespace. The caller must hold the write lock.
+func (p *Pair[IP]) globalVictimLocked(namespace uintptr, policy evictPolicy) *Conn[IP] {
+	counts := make(map[uintptr]int)
+	victims := make(map[uintptr]*Conn[IP])
+	var fallback *Conn[IP]
+	for key, c := range p.out {
+		if c.PendingSweep {
+			continue
+		}
+		counts[key.Namespace]++
+		if v := victims[key.Namespace]; v == nil || isBetterVictim(policy, c, v) {
+			victims[key.Namespace] = c
+		}
+		if fallback == nil || isBetterVictim(policy, c, fallback) {
+			fallback = c
+		}
+	}
+
+	if policy.global == EvictLargestNamespace {
+		largest, most := namespace, -1
+		for ns, n := range counts {
+			if n > most || (n == most && ns < largest) {
+				largest, most = ns, n
+			}
+		}
+		namespace = largest
+	}
+	if v := victims[namespace]; v != nil {
+		return v
+	}
+	return fallback
 }
 
+// removeConnection removes conn, unless another packet already did
 func (p *Pair[IP]) removeConnection(conn *Conn[IP]) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
+	if p.out[conn.internalKey()] == conn {
+		p.deleteLocked(conn)
+	}
+}
+
+// deleteLocked removes a connection from both maps and releases its outside
+// port. The caller must hold the write lock.
+func (p *Pair[IP]) deleteLocked(conn *Conn[IP]) {
+	delete(p.out, conn.internalKey())
+	delete(p.in, conn.externalKey())
+	p.forgetCachedLocked(conn)
 
-	// Create keys
-	internalKey := InternalKey[IP]{
-		SrcIP:     conn.LocalSrcIP,
-		DstIP:     conn.LocalDstIp,
-		SrcPort:   conn.LocalSrcPort,
-		DstPort:   conn.LocalDstPort,
-		Namespace: conn.Namespace,
+	conns := p.byPort[conn.OutsideSrcPort]
+	for i, c := range conns {
+		if c == conn {
+			conns = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(conns) == 0 {
+		delete(p.byPort, conn.OutsideSrcPort)
+	} else {
+		p.byPort[conn.OutsideSrcPort] = conns
 	}
+	p.countSourceLocked(conn, -1)
+	p.countHalfOpenLocked(conn, -1)
+	p.countDestinationLocked(conn, -1)
+	p.forgetQUICLocked(conn)
+	p.recycle(conn)
+}
 
-	externalKey := ExternalKey[IP]{
-		SrcIP:   conn.OutsideDstIP,
-		DstIP:   conn.OutsideSrcIP,
-		SrcPort: conn.OutsideDstPort,
-		DstPort: conn.OutsideSrcPort,
+// recycle releases the outside port of a connection no longer in the maps,
+// to the PortAllocator it came from if any, and returns the connection to
+// the pool if it came from there. A port of the pool still shared with
+// other connections stays allocated. The caller must hold the lock.
+func (p *Pair[IP]) recycle(conn *Conn[IP]) {
+	switch {
+	case conn.PreserveSource:
+	case conn.allocator != nil:
+		conn.allocator.Release(conn.Namespace, conn.Protocol, conn.OutsideSrcIP, conn.OutsideSrcPort)
+	case p.ports != nil && !p.poolPortUsedLocked(conn.OutsideSrcPort):
+		p.ports.release(conn.OutsideSrcPort)
+	}
+	if conn.pooled {
+		// zero it so no tuple leaks into the next flow
+		*conn = Conn[IP]{}
+		p.connPool.Put(conn)
+	}
+}
+
+// poolPortUsedLocked reports whether a connection holds port from the pool of
+// p. The caller must hold the lock.
+func (p *Pair[IP]) poolPortUsedLocked(port uint16) bool {
+	for _, c := range p.byPort[port] {
+		if !c.PreserveSource && c.allocator == nil {
+			return true
+		}
 	}
+	return false
+}
+
+// mapsEndpoint reports whether a connection of p receives replies from
+// dstIP:dstPort on port of ip
+func (p *Pair[IP]) mapsEndpoint(ip IP, port uint16, dstIP IP, dstPort uint16) bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	_, ok := p.in[ExternalKey[IP]{SrcIP: dstIP, DstIP: ip, SrcPort: dstPort, DstPort: port}]
+	return ok
+}
 
-	delete(p.out, internalKey)
-	delete(p.in, externalKey)
+// stateTimeouts are the idle timeouts of TCP connections by state
+type stateTimeouts struct {
+	synSent, established, closing, timeWait int64
 }
 
-func (p *Pair[IP]) cleanupExpired(now int64, timeout int64) {
+// forState returns the timeout for connections in state, or def if s is nil
+func (s *stateTimeouts) forState(state TCPState, def int64) int64 {
+	if s == nil {
+		return def
+	}
+	switch state {
+	case TCPStateSynSent:
+		return s.synSent
+	case TCPStateClosed:
+		// swept anyway
+		return 0
+	case TCPStateClosing:
+		return s.closing
+	case TCPStateTimeWait:
+		return s.timeWait
+	}
+	return s.established
+}
+
+// cleanupExpired removes closed connections, those idle for longer than
+// timeout, or the timeout of their state when states is set, and those older
+// than maxAge when it is positive
+func (p *Pair[IP]) cleanupExpired(now int64, timeout int64, maxAge int64, states *stateTimeouts) {
+	p.cleanupExpiredCtx(context.Background(), now, timeout, maxAge, states, nil)
+}
+
+// cleanupExpiredCtx is cleanupExpired, stopping the scan early when ctx is
+// done. The connections found until then are still removed. It returns how
+// many were removed, and appends their snapshots to reaped if it is set.
+func (p *Pair[IP]) cleanupExpiredCtx(ctx context.Context, now int64, timeout int64, maxAge int64, states *stateTimeouts, reaped *[]ConnInfo[IP]) (int, error) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
 	// Collect connections to remove
 	var toRemove []*Conn[IP]
+	var err error
+	n := 0
 	for _, conn := range p.out {
-		if conn.PendingSweep || (now-conn.LastSeen > timeout) {
+		if n++; n%maintenanceCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				break
+			}
+		}
+		if conn.PendingSweep || (now-conn.LastSeen > states.forState(conn.State, timeout)) ||
+			(conn.drainDeadline != 0 && now >= conn.drainDeadline) ||
+			(maxAge > 0 && now-conn.CreatedAt > maxAge) {
 			toRemove = append(toRemove, conn)
 		}
 	}
 
 	// Remove expired connections
 	for _, conn := range toRemove {
-		internalKey := InternalKey[IP]{
-			SrcIP:     conn.LocalSrcIP,
-			DstIP:     conn.LocalDstIp,
-			SrcPort:   conn.LocalSrcPort,
-			DstPort:   conn.LocalDstPort,
-			Namespace: conn.Namespace,
+		if conn.PendingSweep {
+			p.reaps.Swept.add(now - conn.LastSeen)
+		} else {
+			p.reaps.Expired.add(now - conn.LastSeen)
+		}
+		if reaped != nil {
+			*reaped = append(*reaped, conn.info())
+		}
+		p.deleteLocked(conn)
+	}
+	return len(toRemove), err
+}
+
+// compact rebuilds the maps at their current size, releasing the buckets
+// left over from when they held more connections
+func (p *Pair[IP]) compact() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	in := make(map[ExternalKey[IP]]*Conn[IP], len(p.in))
+	for k, conn := range p.in {
+		in[k] = conn
+	}
+	out := make(map[InternalKey[IP]]*Conn[IP], len(p.out))
+	for k, conn := range p.out {
+		out[k] = conn
+	}
+	byPort := make(map[uint16][]*Conn[IP], len(p.byPort))
+	for port, conns := range p.byPort {
+		byPort[port] = append([]*Conn[IP](nil), conns...)
+	}
+	srcPorts := make(map[IP]int, len(p.srcPorts))
+	for ip, n := range p.srcPorts {
+		srcPorts[ip] = n
+	}
+	srcPortRefs := make(map[sourcePort[IP]]int, len(p.srcPortRefs))
+	for key, n := range p.srcPortRefs {
+		srcPortRefs[key] = n
+	}
+	halfOpen := make(map[uintptr]int, len(p.halfOpen))
+	for ns, n := range p.halfOpen {
+		halfOpen[ns] = n
+	}
+	toDest := make(map[destination[IP]]int, len(p.toDest))
+	for dst, n := range p.toDest {
+		toDest[dst] = n
+	}
+	p.in, p.out, p.byPort = in, out, byPort
+	p.srcPorts, p.srcPortRefs = srcPorts, srcPortRefs
+	p.halfOpen, p.toDest = halfOpen, toDest
+
+	if p.quic != nil {
+		quic := make(map[string]*Conn[IP], len(p.quic))
+		for id, conn := range p.quic {
+			quic[id] = conn
+		}
+		p.quic = quic
+	}
+}
+
+// connsForLocalIP returns a copy of every connection opened by an internal
+// host
+func (p *Pair[IP]) connsForLocalIP(ip IP) []ConnInfo[IP] {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	var res []ConnInfo[IP]
+	for _, conn := range p.out {
+		if conn.LocalSrcIP == ip {
+			res = append(res, conn.info())
+		}
+	}
+	return res
+}
+
+// deleteForLocalIP removes every connection opened by an internal host,
+// returning how many there were
+func (p *Pair[IP]) deleteForLocalIP(ip IP) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var toRemove []*Conn[IP]
+	for _, conn := range p.out {
+		if conn.LocalSrcIP == ip {
+			toRemove = append(toRemove, conn)
+		}
+	}
+	for _, conn := range toRemove {
+		p.deleteLocked(conn)
+	}
+	return len(toRemove)
+}
+
+// expireOlderThan removes the connections last seen before cutoff, counting
+// them as expired at now
+func (p *Pair[IP]) expireOlderThan(cutoff, now int64) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var toRemove []*Conn[IP]
+	for _, conn := range p.out {
+		if conn.LastSeen < cutoff {
+			toRemove = append(toRemove, conn)
+		}
+	}
+	for _, conn := range toRemove {
+		p.reaps.Expired.add(now - conn.LastSeen)
+		p.deleteLocked(conn)
+	}
+	return len(toRemove)
+}
+
+// outsideForSource returns the outside address and port of a masqueraded
+// connection opened from the given internal source, whatever its destination
+func (p *Pair[IP]) outsideForSource(key InternalKey[IP]) (IP, uint16, bool) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	for k, conn := range p.out {
+		if k.Namespace == key.Namespace && k.SrcIP == key.SrcIP && k.SrcPort == key.SrcPort && !conn.PreserveSource {
+			return conn.OutsideSrcIP, conn.OutsideSrcPort, true
+		}
+	}
+	var zero IP
+	return zero, 0, false
+}
+
+// lookupByPort returns a copy of the first connection using the given
+// outside port
+func (p *Pair[IP]) lookupByPort(port uint16) (ConnInfo[IP], bool) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if conns := p.byPort[port]; len(conns) > 0 {
+		return conns[0].info(), true
+	}
+	return ConnInfo[IP]{}, false
+}
+
+// repoint sends the connection of key to a new outside destination,
+// moving its in map entry. It fails if there is no such connection or
+// another one already receives replies from the new destination.
+func (p *Pair[IP]) repoint(key InternalKey[IP], dstIP IP, dstPort uint16) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	conn := p.out[key]
+	if conn == nil {
+		return false
+	}
+	inKey := ExternalKey[IP]{
+		SrcIP:   dstIP,
+		DstIP:   conn.OutsideSrcIP,
+		SrcPort: dstPort,
+		DstPort: conn.OutsideSrcPort,
+	}
+	if existing := p.in[inKey]; existing != nil && existing != conn {
+		return false
+	}
+
+	delete(p.in, conn.externalKey())
+	p.forgetCachedLocked(conn)
+	conn.OutsideDstIP = dstIP
+	conn.OutsideDstPort = dstPort
+	conn.RewriteDestination = dstIP != conn.LocalDstIp || dstPort != conn.LocalDstPort
+	p.in[inKey] = conn
+	p.forgetCachedLocked(conn)
+	return true
+}
+
+// portFree reports whether port is neither used by a connection with the
+// outside address ip nor taken from the pool
+func (p *Pair[IP]) portFree(ip IP, port uint16) bool {
+	if p.ports == nil {
+		return false
+	}
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	for _, conn := range p.byPort[port] {
+		if conn.OutsideSrcIP == ip {
+			return false
+		}
+	}
+	return !p.ports.inUse(port)
+}
+
+// lookupReplyFrom returns the connection on the outside address and port
+// key is addressed to whose remote host, on the same port as the source of
+// key, is in network
+func (p *Pair[IP]) lookupReplyFrom(key ExternalKey[IP], network *net.IPNet) *Conn[IP] {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	for _, conn := range p.byPort[key.DstPort] {
+		if conn.OutsideSrcIP == key.DstIP && conn.OutsideDstPort == key.SrcPort &&
+			network.Contains(net.IP(ipBytes(&conn.OutsideDstIP))) {
+			return conn
 		}
+	}
+	return nil
+}
 
-		externalKey := ExternalKey[IP]{
-			SrcIP:   conn.OutsideDstIP,
-			DstIP:   conn.OutsideSrcIP,
-			SrcPort: conn.OutsideDstPort,
-			DstPort: conn.OutsideSrcPort,
+// acceptedOutsideIP returns the outside address of a connection key would
+// match but for its destination address, preferring preferred when several
+// connections do
+func (p *Pair[IP]) acceptedOutsideIP(key ExternalKey[IP], preferred IP) (IP, bool) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	var found IP
+	ok := false
+	for _, conn := range p.byPort[key.DstPort] {
+		if conn.OutsideDstIP != key.SrcIP || conn.OutsideDstPort != key.SrcPort {
+			continue
+		}
+		if conn.OutsideSrcIP == preferred {
+			return preferred, true
+		}
+		if !ok {
+			found, ok = conn.OutsideSrcIP, true
 		}
+	}
+	return found, ok
+}
 
-		delete(p.out, internalKey)
-		delete(p.in, externalKey)
+// drainPort marks every connection using an outside port as draining,
+// returning how many there were
+func (p *Pair[IP]) drainPort(port uint16, deadline int64) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	conns := p.byPort[port]
+	for _, conn := range conns {
+		conn.Draining = true
+		conn.drainDeadline = deadline
 	}
+	return len(conns)
 }
 
 // checkDropRule checks if a packet should be dropped based on drop rules
@@ -134,31 +798,184 @@ func (p *Pair[IP]) checkDropRule(dstPort uint16) bool {
 	p.mutex.RLock()
 	defer p.mutex.RUnlock()
 
-	for _, rule := range p.dropRules {
-		if rule.DstPort == dstPort {
-			return true
-		}
+	hits, ok := p.dropIndex[dstPort]
+	if ok {
+		countHit(hits)
+		p.ruleDrops.Add(1)
 	}
-	return false
+	return ok
 }
 
 // checkRedirectRule checks if a packet should be redirected
-// Returns newDstIP, newDstPort, shouldRedirect
-func (p *Pair[IP]) checkRedirectRule(dstIP IP, dstPort uint16) (IP, uint16, bool) {
+// Returns the matching rule and whether there was one
+func (p *Pair[IP]) checkRedirectRule(dstIP IP, dstPort uint16) (RedirectRule[IP], bool) {
 	p.mutex.RLock()
 	defer p.mutex.RUnlock()
 
-	for _, rule := range p.redirectRules {
-		if rule.DstPort == dstPort && rule.DstIP == dstIP {
-			return rule.NewDstIP, rule.NewDstPort, true
+	i, ok := p.redirectIndex[redirectMatch[IP]{dstIP, dstPort}]
+	if !ok {
+		return RedirectRule[IP]{}, false
+	}
+	rule := p.redirectRules[i]
+	countHit(rule.hits)
+	return rule, true
+}
+
+// redirectMatch is the destination a redirect rule matches
+type redirectMatch[IP comparable] struct {
+	ip   IP
+	port uint16
+}
+
+// addDropRuleLocked adds a drop rule to p. Only the first rule for a port
+// is indexed, the one matching packets as it is listed first. The caller
+// must hold the write lock.
+func (p *Pair[IP]) addDropRuleLocked(rule DropRule) {
+	p.dropRules = append(p.dropRules, rule)
+	if _, ok := p.dropIndex[rule.DstPort]; !ok {
+		if p.dropIndex == nil {
+			p.dropIndex = make(map[uint16]*atomic.Uint64)
+		}
+		p.dropIndex[rule.DstPort] = rule.hits
+	}
+}
+
+// addRedirectRuleLocked is addDropRuleLocked for redirect rules
+func (p *Pair[IP]) addRedirectRuleLocked(rule RedirectRule[IP]) {
+	p.redirectRules = append(p.redirectRules, rule)
+	match := redirectMatch[IP]{rule.DstIP, rule.DstPort}
+	if _, ok := p.redirectIndex[match]; !ok {
+		if p.redirectIndex == nil {
+			p.redirectIndex = make(map[redirectMatch[IP]]int)
+		}
+		p.redirectIndex[match] = len(p.redirectRules) - 1
+	}
+}
+
+// internalPort returns the internal port the external port is forwarded to
+func (fwd *PortRangeForward[IP]) internalPort(port uint16) uint16 {
+	if fwd.InternalPort == 0 {
+		return port
+	}
+	return fwd.InternalPort + (port - fwd.ExtStart)
+}
+
+// checkPortForward returns the port range forward covering an external port
+func (p *Pair[IP]) checkPortForward(port uint16) (PortRangeForward[IP], bool) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	for _, fwd := range p.forwards {
+		if port >= fwd.ExtStart && port <= fwd.ExtEnd {
+			countHit(fwd.hits)
+			return fwd, true
 		}
 	}
-	return dstIP, dstPort, false
+	return PortRangeForward[IP]{}, false
+}
+
+// countHit counts a match of a rule
+func countHit(hits *atomic.Uint64) {
+	if hits != nil {
+		hits.Add(1)
+	}
+}
+
+// rules returns the rules of the pair for ListRules
+func (p *Pair[IP]) rules(protocol uint8) []RuleInfo[IP] {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	var res []RuleInfo[IP]
+	for _, rule := range p.dropRules {
+		res = append(res, RuleInfo[IP]{Protocol: protocol, Kind: RuleDrop, Drop: rule, Hits: rule.hits.Load()})
+	}
+	for _, rule := range p.redirectRules {
+		res = append(res, RuleInfo[IP]{Protocol: protocol, Kind: RuleRedirect, Redirect: rule, Hits: rule.hits.Load()})
+	}
+	for _, fwd := range p.forwards {
+		res = append(res, RuleInfo[IP]{Protocol: protocol, Kind: RuleForward, Forward: fwd, Hits: fwd.hits.Load()})
+	}
+	return res
+}
+
+// markForSweep safely flags a connection for removal at the next maintenance
+func (p *Pair[IP]) markForSweep(conn *Conn[IP]) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	conn.PendingSweep = true
+}
+
+// updateLastOutbound safely records outbound activity on a connection, a
+// packet of size bytes sent with the DSCP class dscp
+func (p *Pair[IP]) updateLastOutbound(conn *Conn[IP], now int64, dscp uint8, size int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	conn.LastSeen = now
+	conn.LastOutbound = now
+	conn.PacketsOut++
+	conn.BytesOut += uint64(size)
+	if conn.LastInbound != 0 {
+		conn.Assured = true
+	}
+	conn.DSCP = dscp
 }
 
-// updateLastSeen safely updates the LastSeen field of a connection
-func (p *Pair[IP]) updateLastSeen(conn *Conn[IP], now int64) {
+// updateLastInbound safely records inbound activity on a connection, a
+// packet of size bytes
+func (p *Pair[IP]) updateLastInbound(conn *Conn[IP], now int64, size int) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 	conn.LastSeen = now
+	conn.LastInbound = now
+	conn.PacketsIn++
+	conn.BytesIn += uint64(size)
+	if conn.LastOutbound != 0 {
+		conn.Assured = true
+	}
+}
+
+// info returns a copy of the connection's state
+func (c *Conn[IP]) info() ConnInfo[IP] {
+	return ConnInfo[IP]{
+		Protocol:           c.Protocol,
+		Namespace:          c.Namespace,
+		CreatedAt:          c.CreatedAt,
+		LastSeen:           c.LastSeen,
+		LastOutbound:       c.LastOutbound,
+		LastInbound:        c.LastInbound,
+		DSCP:               c.DSCP,
+		PacketsOut:         c.PacketsOut,
+		PacketsIn:          c.PacketsIn,
+		BytesOut:           c.BytesOut,
+		BytesIn:            c.BytesIn,
+		LocalSrcIP:         c.LocalSrcIP,
+		LocalSrcPort:       c.LocalSrcPort,
+		LocalDstIP:         c.LocalDstIp,
+		LocalDstPort:       c.LocalDstPort,
+		OutsideSrcIP:       c.OutsideSrcIP,
+		OutsideSrcPort:     c.OutsideSrcPort,
+		OutsideDstIP:       c.OutsideDstIP,
+		OutsideDstPort:     c.OutsideDstPort,
+		RewriteDestination: c.RewriteDestination,
+		PreserveSource:     c.PreserveSource,
+		PendingSweep:       c.PendingSweep,
+		Draining:           c.Draining,
+		InboundInitiated:   c.InboundInitiated,
+		Assured:            c.Assured,
+		State:              c.State,
+		Payload:            string(c.Payload),
+	}
+}
+
+// snapshot returns a copy of every connection currently in the pair
+func (p *Pair[IP]) snapshot() []ConnInfo[IP] {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	res := make([]ConnInfo[IP], 0, len(p.out))
+	for _, conn := range p.out {
+		res = append(res, conn.info())
+	}
+	return res
 }
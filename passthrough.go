@@ -0,0 +1,117 @@
+package swnat
+
+// UnknownProtocolPolicy selects what the table does with packets of
+// protocols it has no handler for
+type UnknownProtocolPolicy int
+
+const (
+	// UnknownProtocolDrop drops them
+	UnknownProtocolDrop UnknownProtocolPolicy = iota
+
+	// UnknownProtocolPassthroughSNAT only rewrites their source address on
+	// the way out and destination address on the way back, leaving the
+	// payload alone, so protocols such as VRRP, OSPF or GRE can cross the
+	// NAT. Flows are tracked in Table.Other by internal host, remote host
+	// and protocol: like ESP, a remote host can only be reached with a
+	// given protocol by one internal host at a time. Protocols checksumming
+	// a pseudo-header with the addresses are left with a wrong checksum.
+	UnknownProtocolPassthroughSNAT
+)
+
+// Connections of Table.Other have no ports. The protocol takes the place of
+// the remote port in their keys, so flows of different protocols between
+// the same hosts are told apart.
+
+// trackingPair is pair, also returning Table.Other for protocols without a
+// handler when they are passed through
+func (t *Table[IP]) trackingPair(protocol uint8) *Pair[IP] {
+	if p := t.pair(protocol); p != nil {
+		return p
+	}
+	if t.UnknownProtocolPolicy == UnknownProtocolPassthroughSNAT {
+		return &t.Other
+	}
+	return nil
+}
+
+func (t *Table[IP]) handleOutboundOther(packet []byte, ipHeader *IPv4Header, namespace uintptr, now int64, res *OutboundResult[IP]) error {
+	if t.UnknownProtocolPolicy != UnknownProtocolPassthroughSNAT {
+		return ErrDropPacket
+	}
+
+	internalKey := InternalKey[IP]{
+		SrcIP:     any(ipHeader.SourceIP).(IP),
+		DstIP:     any(ipHeader.DestinationIP).(IP),
+		DstPort:   uint16(ipHeader.Protocol),
+		Namespace: namespace,
+	}
+
+	conn := t.Other.lookupOutbound(internalKey)
+	created := conn == nil
+	if conn == nil {
+		outsideIP := t.pickExternalIP(ipHeader.Protocol)
+		peerKey := ExternalKey[IP]{SrcIP: internalKey.DstIP, DstIP: outsideIP, SrcPort: internalKey.DstPort}
+		if t.Other.lookupInbound(peerKey) != nil {
+			// another internal host already talks to this peer
+			return ErrDropPacket
+		}
+		conn = t.newConn(&t.Other, Conn[IP]{
+			LastSeen:       now,
+			CreatedAt:      now,
+			LastOutbound:   now,
+			PacketsOut:     1,
+			BytesOut:       uint64(len(packet)),
+			DSCP:           ipHeader.DSCP(),
+			Protocol:       ipHeader.Protocol,
+			Namespace:      namespace,
+			LocalSrcIP:     internalKey.SrcIP,
+			LocalDstIp:     internalKey.DstIP,
+			LocalDstPort:   internalKey.DstPort,
+			OutsideSrcIP:   outsideIP,
+			OutsideDstIP:   internalKey.DstIP,
+			OutsideDstPort: internalKey.DstPort,
+		})
+		if err := t.admitConn(&t.Other, conn); err != nil {
+			return err
+		}
+		if err := t.addConn(&t.Other, conn); err != nil {
+			return err
+		}
+	} else {
+		t.Other.updateLastOutbound(conn, now, ipHeader.DSCP(), len(packet))
+	}
+
+	ipHeader.SourceIP = any(conn.OutsideSrcIP).(IPv4)
+	ipHeader.Marshal(packet)
+
+	res.set(conn, created)
+	return nil
+}
+
+func (t *Table[IP]) handleInboundOther(packet []byte, ipHeader *IPv4Header, now int64) (uintptr, error) {
+	if t.UnknownProtocolPolicy != UnknownProtocolPassthroughSNAT {
+		return 0, ErrDropPacket
+	}
+
+	externalKey := ExternalKey[IP]{
+		SrcIP:   any(ipHeader.SourceIP).(IP),
+		DstIP:   any(ipHeader.DestinationIP).(IP),
+		SrcPort: uint16(ipHeader.Protocol),
+	}
+	externalKey.DstIP = t.inboundDst(&t.Other, externalKey)
+
+	conn, err := t.lookupInbound(&t.Other, externalKey)
+	if err != nil {
+		return 0, err
+	}
+	if conn == nil {
+		return 0, ErrDropPacket
+	}
+
+	t.Other.updateLastInbound(conn, now, len(packet))
+
+	ipHeader.DestinationIP = any(conn.LocalSrcIP).(IPv4)
+	ipHeader.Marshal(packet)
+
+	return conn.Namespace, nil
+}
@@ -0,0 +1,210 @@
+package swnat
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// ipPool spreads new TCP, UDP and DCCP flows over several external
+// addresses, each with ports of its own, see Table.SetExternalIPPool. The
+// table's external IP keeps allocating from the port pools of the pairs, so
+// port forwards and drained ports still apply to it. The pool is the
+// PortAllocator of the connections it allocates for.
+type ipPool[IP comparable] struct {
+	t     *Table[IP]
+	mutex sync.RWMutex
+	ips   []IP
+	next  atomic.Uint32
+
+	// ports of the addresses other than the external IP, kept after their
+	// address leaves the pool so connections still using them can release
+	// their port
+	ports map[ipProtocol[IP]]*portPool
+}
+
+// ipProtocol identifies the ports of a protocol on one address of the pool
+type ipProtocol[IP comparable] struct {
+	ip       IP
+	protocol uint8
+}
+
+// poolProtocols are the protocols whose flows are spread over the pool
+var poolProtocols = [...]uint8{ProtocolTCP, ProtocolUDP, ProtocolDCCP}
+
+// SetExternalIPPool spreads new TCP, UDP and DCCP connections over ips,
+// each address having the whole port range to itself, for gateways running
+// out of ports on a single address. Addresses are picked in turn, skipping
+// those whose ports are exhausted. Inbound packets to any of them are
+// accepted as addressed to the NAT. ICMP and other protocols keep using the
+// external IP. Calling it with no address goes back to the external IP
+// alone; connections keep their address until they are removed. It has no
+// effect while PortAllocator is set.
+func (t *Table[IP]) SetExternalIPPool(ips []IP) {
+	a := &t.extPool
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.t = t
+	a.ips = nil
+	for _, ip := range ips {
+		a.addLocked(ip)
+	}
+}
+
+// AddExternalIP adds ip to the external IP pool, see SetExternalIPPool. The
+// first address added joins the external IP in the pool.
+func (t *Table[IP]) AddExternalIP(ip IP) {
+	a := &t.extPool
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.t = t
+	if len(a.ips) == 0 && ip != t.externalIP {
+		a.addLocked(t.externalIP)
+	}
+	a.addLocked(ip)
+}
+
+// ExternalIPPool returns the addresses of the external IP pool, nil when
+// none is set
+func (t *Table[IP]) ExternalIPPool() []IP {
+	a := &t.extPool
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return slices.Clone(a.ips)
+}
+
+// addLocked adds ip to the pool, creating its port pools
+func (a *ipPool[IP]) addLocked(ip IP) {
+	if slices.Contains(a.ips, ip) {
+		return
+	}
+	a.ips = append(a.ips, ip)
+	if ip == a.t.externalIP {
+		return
+	}
+	if a.ports == nil {
+		a.ports = make(map[ipProtocol[IP]]*portPool)
+	}
+	for _, protocol := range poolProtocols {
+		key := ipProtocol[IP]{ip, protocol}
+		if a.ports[key] != nil {
+			continue
+		}
+		ports := newPortPool(uint16(a.t.nextPort), uint16(a.t.maxPort))
+		ports.clock = func() int64 { return a.t.Now() }
+		ports.holdUntil = a.t.portHoldUntil
+		a.ports[key] = ports
+	}
+}
+
+// portsLocked returns the ports of protocol on ip, or nil if ip never was
+// in the pool
+func (a *ipPool[IP]) portsLocked(protocol uint8, ip IP) *portPool {
+	if ports := a.ports[ipProtocol[IP]{ip, protocol}]; ports != nil {
+		return ports
+	}
+	if p := a.t.pair(protocol); p != nil && ip == a.t.externalIP {
+		return p.ports
+	}
+	return nil
+}
+
+// enabled reports whether the pool has addresses to allocate from
+func (a *ipPool[IP]) enabled() bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return len(a.ips) > 0
+}
+
+// contains reports whether ip is an address of the pool
+func (a *ipPool[IP]) contains(ip IP) bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return slices.Contains(a.ips, ip)
+}
+
+// Allocate picks the next address of the pool with a free port for
+// protocol, returning ErrPortExhausted when every address is exhausted
+func (a *ipPool[IP]) Allocate(namespace uintptr, protocol uint8, internal IP, internalPort uint16) (IP, uint16, error) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	start := a.next.Add(1) - 1
+	for i := range a.ips {
+		ip := a.ips[(start+uint32(i))%uint32(len(a.ips))]
+		if ports := a.portsLocked(protocol, ip); ports != nil {
+			if port, ok := ports.allocate(); ok {
+				return ip, port, nil
+			}
+		}
+	}
+	var zero IP
+	return zero, 0, ErrPortExhausted
+}
+
+// Release returns a port handed out by Allocate
+func (a *ipPool[IP]) Release(namespace uintptr, protocol uint8, externalIP IP, externalPort uint16) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	if ports := a.portsLocked(protocol, externalIP); ports != nil {
+		ports.release(externalPort)
+	}
+}
+
+// inUse reports whether port of ip, an address of the pool other than the
+// external IP, is allocated, and whether ip has ports of its own
+func (a *ipPool[IP]) inUse(protocol uint8, ip IP, port uint16) (used, ok bool) {
+	a.mutex.RLock()
+	ports := a.ports[ipProtocol[IP]{ip, protocol}]
+	a.mutex.RUnlock()
+	if ports == nil {
+		return false, false
+	}
+	return ports.inUse(port), true
+}
+
+// available returns the number of ports of pair p that can still be
+// allocated on the addresses of the pool other than the external IP
+func (a *ipPool[IP]) available(p *Pair[IP]) int {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	n := 0
+	for _, protocol := range poolProtocols {
+		if len(a.ips) == 0 || a.t.pair(protocol) != p {
+			continue
+		}
+		for _, ip := range a.ips {
+			if ports := a.ports[ipProtocol[IP]{ip, protocol}]; ports != nil {
+				n += ports.available()
+			}
+		}
+	}
+	return n
+}
+
+// allocated returns the number of ports allocated on the addresses that
+// have ports of their own
+func (a *ipPool[IP]) allocated() int {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	n := 0
+	for _, ports := range a.ports {
+		n += ports.allocated()
+	}
+	return n
+}
+
+// portAllocator returns where the outside ports of new TCP, UDP and DCCP
+// connections come from: PortAllocator, else the external IP pool when
+// set, else nil for the port pools of the pairs
+func (t *Table[IP]) portAllocator() PortAllocator[IP] {
+	if t.PortAllocator != nil {
+		return t.PortAllocator
+	}
+	if t.extPool.enabled() {
+		return &t.extPool
+	}
+	return nil
+}
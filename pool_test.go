@@ -0,0 +1,107 @@
+package swnat
+
+import (
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestIPv4TableExternalIPPool(t *testing.T) {
+	nat, err := NewIPv4WithConfig(Config{ExternalIP: net.ParseIP("1.2.3.4"), PortRangeStart: 50000, PortRangeEnd: 50003})
+	if err != nil {
+		t.Fatalf("NewIPv4WithConfig failed: %v", err)
+	}
+	table := nat.(*Table[IPv4])
+	pool := []IPv4{{1, 2, 3, 5}, {1, 2, 3, 6}}
+	table.SetExternalIPPool(pool)
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+	used := make(map[IPv4]int)
+	tuples := make(map[[2]any]bool)
+	for i := 0; i < 8; i++ {
+		packet := CreateIPv4UDPPacket(client, server, uint16(5000+i), 53, nil)
+		if err := table.HandleOutboundPacket(packet, 1); err != nil {
+			t.Fatalf("Flow %d: HandleOutboundPacket failed: %v", i, err)
+		}
+		header, _ := ParseIPv4Header(packet)
+		udp, _ := ParseUDPHeader(packet, 20)
+		tuple := [2]any{header.SourceIP, udp.SourcePort}
+		if tuples[tuple] {
+			t.Errorf("Flow %d: %v:%d allocated twice", i, header.SourceIP, udp.SourcePort)
+		}
+		tuples[tuple] = true
+		used[header.SourceIP]++
+
+		// the reply finds its way back through the pool address
+		reply := CreateIPv4UDPPacket(server, header.SourceIP, 53, udp.SourcePort, nil)
+		if _, err := table.HandleInboundPacket(reply); err != nil {
+			t.Errorf("Flow %d: reply to %v:%d failed: %v", i, header.SourceIP, udp.SourcePort, err)
+		}
+	}
+	if len(used) != 2 || used[pool[0]] != 4 || used[pool[1]] != 4 {
+		t.Errorf("Expected flows spread evenly over the pool, got %v", used)
+	}
+
+	// Every address is exhausted
+	if err := table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, 6000, 53, nil), 1); err != ErrPortExhausted {
+		t.Errorf("Expected ErrPortExhausted with the pool exhausted, got %v", err)
+	}
+	// while TCP has its own ports
+	if err := table.HandleOutboundPacket(CreateIPv4TCPPacket(client, server, 40000, 80, TCPFlagSYN), 1); err != nil {
+		t.Errorf("TCP flow failed: %v", err)
+	}
+	if stats := table.Stats(); stats.PortsAllocated != 9 {
+		t.Errorf("Expected 9 ports allocated, got %d", stats.PortsAllocated)
+	}
+	if table.IsExternalPortFree(ProtocolUDP, pool[0], 50000) || !table.IsExternalPortFree(ProtocolUDP, IPv4{1, 2, 3, 4}, 50000) {
+		t.Error("IsExternalPortFree doesn't reflect the pool ports")
+	}
+
+	table.RunMaintenance(table.Now() + table.TCPTimeout + 1)
+	if stats := table.Stats(); stats.PortsAllocated != 0 {
+		t.Errorf("Expected the ports released after expiry, %d still allocated", stats.PortsAllocated)
+	}
+	if err := table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, 6000, 53, nil), 1); err != nil {
+		t.Errorf("Expected released ports to be reused, got %v", err)
+	}
+
+	// Clearing the pool goes back to the external IP
+	table.SetExternalIPPool(nil)
+	packet := CreateIPv4UDPPacket(client, server, 6001, 53, nil)
+	if err := table.HandleOutboundPacket(packet, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	if header, _ := ParseIPv4Header(packet); header.SourceIP != (IPv4{1, 2, 3, 4}) {
+		t.Errorf("Expected the external IP without a pool, got %v", header.SourceIP)
+	}
+}
+
+func TestIPv4TableAddExternalIP(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	table.AddPortForward(ProtocolUDP, 49152, IPv4{192, 168, 1, 50}, 53, 1)
+	table.AddExternalIP(IPv4{1, 2, 3, 5})
+	table.AddExternalIP(IPv4{1, 2, 3, 5})
+
+	want := []IPv4{{1, 2, 3, 4}, {1, 2, 3, 5}}
+	if got := table.ExternalIPPool(); !slices.Equal(got, want) {
+		t.Fatalf("Expected pool %v, got %v", want, got)
+	}
+
+	seen := make(map[IPv4]bool)
+	for i := 0; i < 4; i++ {
+		packet := CreateIPv4UDPPacket(IPv4{192, 168, 1, 100}, IPv4{8, 8, 8, 8}, uint16(5000+i), 53, nil)
+		if err := table.HandleOutboundPacket(packet, 1); err != nil {
+			t.Fatalf("HandleOutboundPacket failed: %v", err)
+		}
+		header, _ := ParseIPv4Header(packet)
+		udp, _ := ParseUDPHeader(packet, 20)
+		if header.SourceIP == want[0] && udp.SourcePort == 49152 {
+			t.Error("Forwarded port of the external IP allocated to an outbound flow")
+		}
+		seen[header.SourceIP] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("Expected both addresses used, got %v", seen)
+	}
+}
@@ -0,0 +1,309 @@
+package swnat
+
+import (
+	"math/bits"
+	"sync"
+	"unsafe"
+)
+
+// PortAllocator hands out the external addresses and ports of new TCP, UDP
+// and DCCP flows in place of the table's own pools, so several NAT instances
+// can share a port space through a central authority, see
+// Table.PortAllocator. ICMP identifiers are still allocated locally.
+type PortAllocator[IP comparable] interface {
+	// Allocate returns the external address and port for a new flow from
+	// internal:internalPort. An error refuses the flow and is returned by
+	// the outbound handler.
+	Allocate(namespace uintptr, protocol uint8, internal IP, internalPort uint16) (externalIP IP, externalPort uint16, err error)
+
+	// Release returns a port handed out by Allocate once its connection is
+	// removed. It is called with table locks held and must not call back
+	// into the table.
+	Release(namespace uintptr, protocol uint8, externalIP IP, externalPort uint16)
+}
+
+// portPool allocates 16-bit identifiers (ports or ICMP IDs) from an inclusive
+// range. Identifiers are handed out in order until the range has been walked
+// once, after which released identifiers are reused from a free-list.
+type portPool struct {
+	mutex sync.Mutex
+	min   uint16
+	max   uint16
+	next  uint32       // next never-allocated identifier, > max once exhausted
+	free  []uint16     // released identifiers
+	used  [1024]uint64 // bitmap of identifiers currently allocated
+
+	reserved [1024]uint64 // bitmap of identifiers never handed out
+	skip     int          // reserved or taken identifiers not yet walked past by next
+
+	// holdUntil, when set, returns until when a released identifier is
+	// withheld from reuse, or 0 to free it right away. clock returns the
+	// time it is compared to. Held identifiers stay marked used.
+	holdUntil func() int64
+	clock     func() int64
+	held      []heldPort   // in release order, freed in that order
+	holding   [1024]uint64 // bitmap of held identifiers
+}
+
+// heldPort is a released identifier waiting out the reuse delay
+type heldPort struct {
+	port     uint16
+	released int64
+	until    int64
+}
+
+func newPortPool(min, max uint16) *portPool {
+	return &portPool{min: min, max: max, next: uint32(min)}
+}
+
+func (p *portPool) isUsed(port uint16) bool {
+	return p.used[port>>6]&(1<<(port&63)) != 0
+}
+
+func (p *portPool) isReserved(port uint16) bool {
+	return p.reserved[port>>6]&(1<<(port&63)) != 0
+}
+
+func (p *portPool) isHeld(port uint16) bool {
+	return p.holding[port>>6]&(1<<(port&63)) != 0
+}
+
+func (p *portPool) setUsed(port uint16, used bool) {
+	if used {
+		p.used[port>>6] |= 1 << (port & 63)
+	} else {
+		p.used[port>>6] &^= 1 << (port & 63)
+	}
+}
+
+// allocate returns a free identifier, or false if the pool is exhausted
+func (p *portPool) allocate() (uint16, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.expireHeldLocked()
+
+	for p.next <= uint32(p.max) {
+		port := uint16(p.next)
+		p.next++
+		if p.isReserved(port) || p.isUsed(port) {
+			// reserved or taken before the walk reached it
+			p.skip--
+			continue
+		}
+		p.setUsed(port, true)
+		return port, true
+	}
+
+	if len(p.free) == 0 {
+		return 0, false
+	}
+	port := p.free[len(p.free)-1]
+	p.free = p.free[:len(p.free)-1]
+	p.setUsed(port, true)
+	return port, true
+}
+
+// release returns an identifier to the pool. Releasing an identifier that
+// isn't allocated is a no-op.
+func (p *portPool) release(port uint16) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if port < p.min || port > p.max || !p.isUsed(port) || p.isReserved(port) {
+		return
+	}
+	if p.isHeld(port) {
+		return
+	}
+	if p.holdUntil != nil {
+		if until := p.holdUntil(); until > 0 {
+			p.holding[port>>6] |= 1 << (port & 63)
+			p.held = append(p.held, heldPort{port, p.clock(), until})
+			return
+		}
+	}
+	p.freeLocked(port)
+}
+
+// expireHeldLocked frees the held identifiers whose delay has passed. The
+// caller must hold the mutex.
+func (p *portPool) expireHeldLocked() {
+	if len(p.held) == 0 {
+		return
+	}
+	now := p.clock()
+	for len(p.held) > 0 && p.held[0].until <= now {
+		port := p.held[0].port
+		p.held = p.held[1:]
+		p.holding[port>>6] &^= 1 << (port & 63)
+		if !p.isReserved(port) {
+			p.freeLocked(port)
+		}
+	}
+}
+
+// freeLocked makes an allocated identifier available again. The caller
+// must hold the mutex.
+func (p *portPool) freeLocked(port uint16) {
+	p.setUsed(port, false)
+	if uint32(port) >= p.next {
+		// taken ahead of the walk, which will now hand it out
+		p.skip--
+		return
+	}
+	p.free = append(p.free, port)
+}
+
+// take allocates a specific identifier, returning false if it isn't free
+func (p *portPool) take(port uint16) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.expireHeldLocked()
+
+	if port < p.min || port > p.max || p.isUsed(port) || p.isReserved(port) {
+		return false
+	}
+	p.setUsed(port, true)
+	if uint32(port) >= p.next {
+		p.skip++
+	} else {
+		p.removeFree(port)
+	}
+	return true
+}
+
+// heldSince returns when a held identifier was released, and false if it
+// isn't held
+func (p *portPool) heldSince(port uint16) (int64, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.expireHeldLocked()
+
+	if !p.isHeld(port) {
+		return 0, false
+	}
+	for _, h := range p.held {
+		if h.port == port {
+			return h.released, true
+		}
+	}
+	return 0, false
+}
+
+// unhold ends the reuse delay of a held identifier, which stays allocated
+func (p *portPool) unhold(port uint16) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.isHeld(port) {
+		return
+	}
+	p.holding[port>>6] &^= 1 << (port & 63)
+	for i, h := range p.held {
+		if h.port == port {
+			p.held = append(p.held[:i], p.held[i+1:]...)
+			return
+		}
+	}
+}
+
+// removeFree drops an identifier from the free-list
+func (p *portPool) removeFree(port uint16) {
+	for i, f := range p.free {
+		if f == port {
+			p.free = append(p.free[:i], p.free[i+1:]...)
+			return
+		}
+	}
+}
+
+// reserve permanently removes an identifier from the pool, so it is never
+// allocated. Reserving an identifier currently in use only prevents it from
+// being handed out again once released.
+func (p *portPool) reserve(port uint16) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if port < p.min || port > p.max || p.isReserved(port) {
+		return
+	}
+	p.reserved[port>>6] |= 1 << (port & 63)
+	if uint32(port) >= p.next {
+		if !p.isUsed(port) {
+			p.skip++
+		}
+		return
+	}
+	if !p.isUsed(port) {
+		p.removeFree(port)
+	}
+	p.setUsed(port, true)
+}
+
+// shareable reports whether port is allocated and may be shared by another
+// connection once the pool is exhausted, not being reserved or held
+func (p *portPool) shareable(port uint16) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.expireHeldLocked()
+	return p.isUsed(port) && !p.isReserved(port) && !p.isHeld(port)
+}
+
+// contains reports whether port belongs to the range of the pool
+func (p *portPool) contains(port uint16) bool {
+	return port >= p.min && port <= p.max
+}
+
+// inUse reports whether port is currently allocated, held or reserved
+func (p *portPool) inUse(port uint16) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.expireHeldLocked()
+	return p.isUsed(port) || p.isReserved(port)
+}
+
+// marked reports whether port is marked allocated, held or reserved. Unlike
+// inUse, it leaves held identifiers whose delay ran out to the next call
+// freeing them, so it doesn't change the pool.
+func (p *portPool) marked(port uint16) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.isUsed(port) || p.isReserved(port)
+}
+
+// allocated returns the number of identifiers currently allocated, held ones
+// included
+func (p *portPool) allocated() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.expireHeldLocked()
+
+	n := 0
+	for i, used := range p.used {
+		n += bits.OnesCount64(used &^ p.reserved[i])
+	}
+	return n
+}
+
+// available returns the number of identifiers that can still be allocated
+func (p *portPool) available() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.expireHeldLocked()
+
+	n := len(p.free)
+	if p.next <= uint32(p.max) {
+		n += int(uint32(p.max)-p.next+1) - p.skip
+	}
+	return n
+}
+
+// memory returns an approximate number of bytes used by the pool: its
+// bitmaps and its free and held lists
+func (p *portPool) memory() int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return int64(unsafe.Sizeof(*p)) +
+		int64(cap(p.free))*int64(unsafe.Sizeof(uint16(0))) +
+		int64(cap(p.held))*int64(unsafe.Sizeof(heldPort{}))
+}
@@ -0,0 +1,349 @@
+package swnat
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestPortPool(t *testing.T) {
+	pool := newPortPool(0, 65535)
+
+	seen := make(map[uint16]bool)
+	for i := 0; i < 65536; i++ {
+		port, ok := pool.allocate()
+		if !ok {
+			t.Fatalf("Pool exhausted after %d allocations", i)
+		}
+		if seen[port] {
+			t.Fatalf("Identifier %d allocated twice", port)
+		}
+		seen[port] = true
+	}
+
+	if _, ok := pool.allocate(); ok {
+		t.Error("Allocation succeeded on an exhausted pool")
+	}
+
+	pool.release(12345)
+	pool.release(12345) // double release must not duplicate it
+	if port, ok := pool.allocate(); !ok || port != 12345 {
+		t.Errorf("Expected released identifier 12345, got %d (ok=%v)", port, ok)
+	}
+	if _, ok := pool.allocate(); ok {
+		t.Error("Double release made an identifier available twice")
+	}
+}
+
+func TestPortPoolReserve(t *testing.T) {
+	pool := newPortPool(100, 109)
+
+	first, _ := pool.allocate()
+	pool.reserve(first) // in use, must stay out once released
+	pool.reserve(105)   // not yet walked
+	pool.reserve(200)   // out of range, ignored
+	if n := pool.available(); n != 8 {
+		t.Errorf("Expected 8 available identifiers, got %d", n)
+	}
+
+	pool.release(first)
+	for {
+		port, ok := pool.allocate()
+		if !ok {
+			break
+		}
+		if port == first || port == 105 {
+			t.Errorf("Reserved identifier %d was allocated", port)
+		}
+	}
+	if n := pool.available(); n != 0 {
+		t.Errorf("Expected exhausted pool, %d still available", n)
+	}
+}
+
+func TestPortPoolTake(t *testing.T) {
+	pool := newPortPool(100, 109)
+
+	first, _ := pool.allocate()
+	if pool.take(first) {
+		t.Error("Took an identifier already allocated")
+	}
+	if !pool.take(107) || pool.take(107) {
+		t.Error("Expected 107 to be taken exactly once")
+	}
+	if pool.take(99) {
+		t.Error("Took an identifier out of range")
+	}
+
+	// Released ahead of the walk, then taken again
+	pool.take(108)
+	pool.release(108)
+	pool.take(108)
+
+	seen := map[uint16]bool{first: true, 107: true, 108: true}
+	for {
+		port, ok := pool.allocate()
+		if !ok {
+			break
+		}
+		if seen[port] {
+			t.Fatalf("Identifier %d allocated twice", port)
+		}
+		seen[port] = true
+	}
+	if len(seen) != 10 {
+		t.Errorf("Expected all 10 identifiers handed out, got %d", len(seen))
+	}
+
+	pool.release(107)
+	if !pool.take(107) {
+		t.Error("Couldn't take a released identifier")
+	}
+	if _, ok := pool.allocate(); ok {
+		t.Error("Taken identifier still on the free-list")
+	}
+}
+
+func TestPortPoolHold(t *testing.T) {
+	now := int64(1000)
+	pool := newPortPool(100, 102)
+	pool.clock = func() int64 { return now }
+	pool.holdUntil = func() int64 { return now + 30 }
+
+	for i := 0; i < 3; i++ {
+		pool.allocate()
+	}
+	pool.release(101)
+	pool.release(101) // double release must not hold it twice
+	if _, ok := pool.allocate(); ok {
+		t.Error("Held identifier allocated before its delay")
+	}
+	if !pool.inUse(101) || pool.available() != 0 {
+		t.Error("Held identifier reported free")
+	}
+	if pool.take(101) {
+		t.Error("Held identifier taken before its delay")
+	}
+
+	now += 30
+	if n := pool.available(); n != 1 {
+		t.Errorf("Expected 1 available identifier after the delay, got %d", n)
+	}
+	if port, ok := pool.allocate(); !ok || port != 101 {
+		t.Errorf("Expected identifier 101 after the delay, got %d (ok=%v)", port, ok)
+	}
+	if _, ok := pool.allocate(); ok {
+		t.Error("Identifier held twice became available twice")
+	}
+}
+
+func TestIPv4TableSharedPorts(t *testing.T) {
+	nat, err := NewIPv4WithConfig(Config{ExternalIP: net.ParseIP("1.2.3.4"), PortRangeStart: 50000, PortRangeEnd: 50001})
+	if err != nil {
+		t.Fatalf("NewIPv4WithConfig failed: %v", err)
+	}
+	table := nat.(*Table[IPv4])
+	client := IPv4{192, 168, 1, 100}
+	serverA := IPv4{8, 8, 8, 8}
+	serverB := IPv4{9, 9, 9, 9}
+
+	outbound := func(srcPort uint16, server IPv4) (uint16, error) {
+		packet := CreateIPv4UDPPacket(client, server, srcPort, 53, nil)
+		if err := table.HandleOutboundPacket(packet, 1); err != nil {
+			return 0, err
+		}
+		udp, _ := ParseUDPHeader(packet, 20)
+		return udp.SourcePort, nil
+	}
+
+	// Both ports of the pool map serverA
+	for i := uint16(0); i < 2; i++ {
+		if _, err := outbound(5000+i, serverA); err != nil {
+			t.Fatalf("HandleOutboundPacket failed: %v", err)
+		}
+	}
+	if _, err := outbound(5002, serverA); err != ErrPortExhausted {
+		t.Errorf("Expected ErrPortExhausted with every port mapping serverA, got %v", err)
+	}
+
+	// serverB can still be reached through a shared port
+	shared, err := outbound(5003, serverB)
+	if err != nil {
+		t.Fatalf("Expected a shared port for serverB, got %v", err)
+	}
+	for _, tc := range []struct {
+		server  IPv4
+		srcPort uint16
+	}{{serverA, 5000 + shared - 50000}, {serverB, 5003}} {
+		reply := CreateIPv4UDPPacket(tc.server, IPv4{1, 2, 3, 4}, 53, shared, nil)
+		if _, err := table.HandleInboundPacket(reply); err != nil {
+			t.Fatalf("Reply from %v failed: %v", tc.server, err)
+		}
+		if udp, _ := ParseUDPHeader(reply, 20); udp.DestinationPort != tc.srcPort {
+			t.Errorf("Reply from %v delivered to port %d, want %d", tc.server, udp.DestinationPort, tc.srcPort)
+		}
+	}
+
+	// Removing one of the connections sharing the port keeps it allocated
+	table.UDP.removeConnection(table.UDP.lookupOutbound(InternalKey[IPv4]{SrcIP: client, DstIP: serverB, SrcPort: 5003, DstPort: 53, Namespace: 1}))
+	if err := table.HealthCheck(); err != nil {
+		t.Errorf("HealthCheck failed: %v", err)
+	}
+	if _, err := outbound(5004, serverA); err != ErrPortExhausted {
+		t.Errorf("Expected the port still mapping serverA to stay allocated, got %v", err)
+	}
+}
+
+func TestIPv4TableSharedPortsPerInternalIP(t *testing.T) {
+	nat, err := NewIPv4WithConfig(Config{ExternalIP: net.ParseIP("1.2.3.4"), PortRangeStart: 50000, PortRangeEnd: 50001})
+	if err != nil {
+		t.Fatalf("NewIPv4WithConfig failed: %v", err)
+	}
+	table := nat.(*Table[IPv4])
+	table.MaxPortsPerInternalIP = 3
+	client := IPv4{192, 168, 1, 100}
+
+	// Four servers over the two ports of the pool, shared ports counting
+	// once towards the cap
+	for i := 0; i < 4; i++ {
+		packet := CreateIPv4UDPPacket(client, IPv4{8, 8, 8, byte(i)}, 5000, 53, nil)
+		if err := table.HandleOutboundPacket(packet, 1); err != nil {
+			t.Fatalf("Flow %d refused: %v", i, err)
+		}
+	}
+	if n := table.UDP.sourcePorts(client); n != 2 {
+		t.Errorf("Expected 2 ports held by the client, got %d", n)
+	}
+
+	// A port counts until its last connection is gone, the sharing ones
+	// going first
+	for i, want := range []int{2, 2, 1, 0} {
+		server := IPv4{8, 8, 8, byte(3 - i)}
+		table.UDP.removeConnection(table.UDP.lookupOutbound(InternalKey[IPv4]{SrcIP: client, DstIP: server, SrcPort: 5000, DstPort: 53, Namespace: 1}))
+		if n := table.UDP.sourcePorts(client); n != want {
+			t.Errorf("Expected %d ports after removing the flow to %v, got %d", want, server, n)
+		}
+	}
+}
+
+func TestIPv4TableSharedPortsParallel(t *testing.T) {
+	for round := 0; round < 100; round++ {
+		nat, err := NewIPv4WithConfig(Config{ExternalIP: net.ParseIP("1.2.3.4"), PortRangeStart: 50000, PortRangeEnd: 50001})
+		if err != nil {
+			t.Fatalf("NewIPv4WithConfig failed: %v", err)
+		}
+		table := nat.(*Table[IPv4])
+		clientA := IPv4{192, 168, 1, 100}
+		clientB := IPv4{192, 168, 1, 101}
+		serverA := IPv4{8, 8, 8, 8}
+		serverB := IPv4{9, 9, 9, 9}
+
+		// Both ports of the pool map serverA, serverB gets shared ones
+		for i := uint16(0); i < 2; i++ {
+			if err := table.HandleOutboundPacket(CreateIPv4UDPPacket(clientA, serverA, 5000+i, 53, nil), 1); err != nil {
+				t.Fatalf("HandleOutboundPacket failed: %v", err)
+			}
+		}
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		ports := make(map[uint16]int)
+		start := make(chan struct{})
+		for i := uint16(0); i < 32; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				packet := CreateIPv4UDPPacket(clientB, serverB, 6000+i, 53, nil)
+				<-start
+				err := table.HandleOutboundPacket(packet, 1)
+				if err != nil {
+					if err != ErrPortExhausted {
+						t.Errorf("Expected ErrPortExhausted, got %v", err)
+					}
+					return
+				}
+				udp, _ := ParseUDPHeader(packet, 20)
+				mu.Lock()
+				ports[udp.SourcePort]++
+				mu.Unlock()
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		// Each port maps serverB at most once
+		if len(ports) != 2 {
+			t.Fatalf("Expected both ports shared with serverB, got %v", ports)
+		}
+		for port, n := range ports {
+			if n != 1 {
+				t.Fatalf("Port %d given to %d connections to the same endpoint", port, n)
+			}
+		}
+
+		// Removing the serverB connections leaves the serverA mappings whole
+		table.DeleteForInternalIP(clientB)
+		if err := table.HealthCheck(); err != nil {
+			t.Fatalf("HealthCheck failed: %v", err)
+		}
+		for port := uint16(50000); port <= 50001; port++ {
+			if _, err := table.HandleInboundPacket(CreateIPv4UDPPacket(serverA, IPv4{1, 2, 3, 4}, 53, port, nil)); err != nil {
+				t.Fatalf("Reply from serverA to port %d failed: %v", port, err)
+			}
+		}
+	}
+}
+
+func TestIPv4TableSharedPortCollision(t *testing.T) {
+	nat, err := NewIPv4WithConfig(Config{ExternalIP: net.ParseIP("1.2.3.4"), PortRangeStart: 50000, PortRangeEnd: 50001})
+	if err != nil {
+		t.Fatalf("NewIPv4WithConfig failed: %v", err)
+	}
+	table := nat.(*Table[IPv4])
+	external := IPv4{1, 2, 3, 4}
+	clientB := IPv4{192, 168, 1, 101}
+	serverA := IPv4{8, 8, 8, 8}
+	serverB := IPv4{9, 9, 9, 9}
+	for i := uint16(0); i < 2; i++ {
+		if err := table.HandleOutboundPacket(CreateIPv4UDPPacket(IPv4{192, 168, 1, 100}, serverA, 5000+i, 53, nil), 1); err != nil {
+			t.Fatalf("HandleOutboundPacket failed: %v", err)
+		}
+	}
+
+	// Two flows to serverB both see a shared port free of serverB, as when
+	// their packets are handled concurrently, before either is added
+	port, err := table.allocatePort(&table.UDP, external, serverB, 53)
+	if err != nil {
+		t.Fatalf("allocatePort failed: %v", err)
+	}
+	conns := make([]*Conn[IPv4], 2)
+	for i := range conns {
+		conns[i] = &Conn[IPv4]{
+			LastSeen: table.Now(), CreatedAt: table.Now(), Protocol: ProtocolUDP, Namespace: 1,
+			LocalSrcIP: clientB, LocalSrcPort: 6000 + uint16(i), LocalDstIp: serverB, LocalDstPort: 53,
+			OutsideSrcIP: external, OutsideSrcPort: port, OutsideDstIP: serverB, OutsideDstPort: 53,
+		}
+	}
+	if err := table.addConn(&table.UDP, conns[0]); err != nil {
+		t.Fatalf("addConn failed: %v", err)
+	}
+	if err := table.addConn(&table.UDP, conns[1]); err != ErrPortExhausted {
+		t.Fatalf("Expected ErrPortExhausted for the second flow, got %v", err)
+	}
+
+	reply := CreateIPv4UDPPacket(serverB, external, 53, port, nil)
+	if _, err := table.HandleInboundPacket(reply); err != nil {
+		t.Fatalf("Reply from serverB failed: %v", err)
+	}
+	if udp, _ := ParseUDPHeader(reply, 20); udp.DestinationPort != 6000 {
+		t.Errorf("Reply from serverB delivered to port %d, want 6000", udp.DestinationPort)
+	}
+
+	table.DeleteForInternalIP(clientB)
+	if err := table.HealthCheck(); err != nil {
+		t.Errorf("HealthCheck failed: %v", err)
+	}
+	if _, err := table.HandleInboundPacket(CreateIPv4UDPPacket(serverA, external, 53, port, nil)); err != nil {
+		t.Errorf("Reply from serverA failed: %v", err)
+	}
+}
@@ -0,0 +1,270 @@
+package swnat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// maxOwnedAddresses caps how many addresses of an owned prefix are used for
+// allocation
+const maxOwnedAddresses = 1 << 16
+
+// ownedPrefix is a contiguous range of external addresses owned by the NAT
+type ownedPrefix[IP comparable] struct {
+	network *net.IPNet
+	base    IP
+	size    uint32 // number of addresses used for allocation
+	next    atomic.Uint32
+}
+
+// SetOwnedExternalPrefix declares that the NAT owns every address of prefix,
+// e.g. a /29 on a multi-homed edge. Inbound packets to any of them are
+// accepted as addressed to the NAT, and new outbound connections spread
+// over them in turn. The external IP set with SetExternalIP remains owned.
+func (t *Table[IP]) SetOwnedExternalPrefix(prefix net.IPNet) error {
+	network, err := familyPrefix[IP](prefix)
+	if err != nil {
+		return err
+	}
+	ones, bits := network.Mask.Size()
+
+	var base IP
+	copy(ipBytes(&base), network.IP)
+
+	size := uint32(maxOwnedAddresses)
+	if bits-ones < 16 {
+		size = 1 << (bits - ones)
+	}
+	t.owned.Store(&ownedPrefix[IP]{network: network, base: base, size: size})
+	return nil
+}
+
+// familyPrefix returns prefix masked and in the address family of IP, so its
+// Contains accepts raw IP bytes
+func familyPrefix[IP comparable](prefix net.IPNet) (*net.IPNet, error) {
+	var zero IP
+	raw := ipBytes(&zero)
+
+	ip := prefix.IP.To16()
+	ones, bits := prefix.Mask.Size()
+	if len(raw) == 4 {
+		ip = prefix.IP.To4()
+		if bits == 128 {
+			ones -= 96
+			bits = 32
+		}
+	}
+	if ip == nil || bits != len(raw)*8 || ones < 0 {
+		return nil, fmt.Errorf("prefix %s doesn't match the table address family", prefix.String())
+	}
+	return &net.IPNet{IP: ip.Mask(net.CIDRMask(ones, bits)), Mask: net.CIDRMask(ones, bits)}, nil
+}
+
+// RegisterInternalPrefix declares prefix as an internal network, whose
+// hosts' packets Handle treats as outbound. It can be called several times
+// to register more prefixes.
+func (t *Table[IP]) RegisterInternalPrefix(prefix net.IPNet) error {
+	network, err := familyPrefix[IP](prefix)
+	if err != nil {
+		return err
+	}
+
+	t.internalMutex.Lock()
+	defer t.internalMutex.Unlock()
+	t.internalPrefixes = append(t.internalPrefixes, network)
+	return nil
+}
+
+// isInternal reports whether ip belongs to a registered internal prefix
+func (t *Table[IP]) isInternal(ip IP) bool {
+	t.internalMutex.RLock()
+	defer t.internalMutex.RUnlock()
+
+	raw := net.IP(ipBytes(&ip))
+	for _, network := range t.internalPrefixes {
+		if network.Contains(raw) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowReplyFromCIDR lets TCP and UDP mappings on an external port accept
+// replies from any address of prefix, e.g. a load-balanced server farm
+// answering from several addresses. A reply whose source doesn't match a
+// mapping exactly is delivered to the mapping on the port whose remote host
+// is in prefix, with the same remote port. Replies keep their actual source.
+func (t *Table[IP]) AllowReplyFromCIDR(externalPort uint16, prefix net.IPNet) error {
+	network, err := familyPrefix[IP](prefix)
+	if err != nil {
+		return err
+	}
+
+	t.replyMutex.Lock()
+	defer t.replyMutex.Unlock()
+	if t.replyFrom == nil {
+		t.replyFrom = make(map[uint16][]*net.IPNet)
+	}
+	t.replyFrom[externalPort] = append(t.replyFrom[externalPort], network)
+	return nil
+}
+
+// lookupReplyFrom returns the connection of p a reply that missed the exact
+// lookup belongs to, per AllowReplyFromCIDR, or nil
+func (t *Table[IP]) lookupReplyFrom(p *Pair[IP], key ExternalKey[IP]) *Conn[IP] {
+	t.replyMutex.RLock()
+	networks := t.replyFrom[key.DstPort]
+	t.replyMutex.RUnlock()
+	if len(networks) == 0 {
+		return nil
+	}
+
+	src := net.IP(ipBytes(&key.SrcIP))
+	for _, network := range networks {
+		if network.Contains(src) {
+			if conn := p.lookupReplyFrom(key, network); conn != nil {
+				return conn
+			}
+		}
+	}
+	return nil
+}
+
+// Handle translates a packet whose direction isn't known to the caller. It
+// is outbound when its source belongs to a prefix registered with
+// RegisterInternalPrefix, and inbound when its destination is one of the
+// NAT's external addresses. Packets matching both, such as hairpinned ones,
+// or neither get ErrUnknownDirection. The namespace is used for outbound
+// packets; the one returned is that of the packet's connection.
+func (t *Table[IP]) Handle(packet []byte, namespace uintptr) (uintptr, error) {
+	src, dst, err := t.packetAddresses(packet)
+	if err != nil {
+		return 0, err
+	}
+
+	outbound := t.isInternal(src)
+	inbound := t.ownsIP(dst)
+	switch {
+	case outbound && !inbound:
+		return namespace, t.HandleOutboundPacket(packet, namespace)
+	case inbound && !outbound:
+		return t.HandleInboundPacket(packet)
+	}
+	return 0, ErrUnknownDirection
+}
+
+// SetInboundAcceptIPs sets extra addresses inbound replies may arrive to in
+// asymmetric deployments, e.g. anycast addresses in front of the NAT. Replies
+// to them are matched as if sent to the outside address their connection
+// masquerades behind, be it the external IP, an owned prefix address or a
+// protocol address, which stays the source of outbound packets. Calling it
+// with no address clears the set.
+func (t *Table[IP]) SetInboundAcceptIPs(ips ...IP) {
+	accept := make(map[IP]bool, len(ips))
+	for _, ip := range ips {
+		accept[ip] = true
+	}
+
+	t.acceptMutex.Lock()
+	defer t.acceptMutex.Unlock()
+	t.inboundAccept = accept
+}
+
+// isInboundAccept reports whether ip is in the inbound accept set
+func (t *Table[IP]) isInboundAccept(ip IP) bool {
+	t.acceptMutex.RLock()
+	defer t.acceptMutex.RUnlock()
+	return t.inboundAccept[ip]
+}
+
+// inboundDst returns the outside address under which the connection of p
+// key is addressed to is tracked. A reply to an inbound accept IP belongs to
+// the connection with its ports and remote host, whichever external, owned
+// prefix or protocol address it was masqueraded behind.
+func (t *Table[IP]) inboundDst(p *Pair[IP], key ExternalKey[IP]) IP {
+	if key.DstIP == t.externalIP || !t.isInboundAccept(key.DstIP) {
+		return key.DstIP
+	}
+	if p != nil {
+		if ip, ok := p.acceptedOutsideIP(key, t.externalIP); ok {
+			return ip
+		}
+	}
+	return t.externalIP
+}
+
+// SetProtocolExternalIP sets the external address new connections of
+// protocol masquerade behind, instead of the table's external IP or owned
+// prefix. Replies to it are accepted like replies to the external IP. The
+// zero address clears it.
+func (t *Table[IP]) SetProtocolExternalIP(protocol uint8, ip IP) error {
+	if t.pair(protocol) == nil {
+		return fmt.Errorf("unsupported protocol %d", protocol)
+	}
+
+	t.protoMutex.Lock()
+	defer t.protoMutex.Unlock()
+	var zero IP
+	if ip == zero {
+		delete(t.protoIPs, protocol)
+		return nil
+	}
+	if t.protoIPs == nil {
+		t.protoIPs = make(map[uint8]IP)
+	}
+	t.protoIPs[protocol] = ip
+	return nil
+}
+
+// protocolExternalIP returns the external address set for protocol by
+// SetProtocolExternalIP, if any
+func (t *Table[IP]) protocolExternalIP(protocol uint8) (IP, bool) {
+	t.protoMutex.RLock()
+	defer t.protoMutex.RUnlock()
+	ip, ok := t.protoIPs[protocol]
+	return ip, ok
+}
+
+// isProtocolIP reports whether ip was set for any protocol by
+// SetProtocolExternalIP
+func (t *Table[IP]) isProtocolIP(ip IP) bool {
+	t.protoMutex.RLock()
+	defer t.protoMutex.RUnlock()
+	for _, pip := range t.protoIPs {
+		if pip == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// ownsIP reports whether ip is one of the NAT's external addresses
+func (t *Table[IP]) ownsIP(ip IP) bool {
+	if ip == t.externalIP || t.isInboundAccept(ip) || t.isProtocolIP(ip) || t.extPool.contains(ip) {
+		return true
+	}
+	owned := t.owned.Load()
+	return owned != nil && owned.network.Contains(net.IP(ipBytes(&ip)))
+}
+
+// pickExternalIP returns the external address for a new outbound
+// connection of protocol: the one set by SetProtocolExternalIP, or else
+// the external IP, rotating over the owned prefix when one is set
+func (t *Table[IP]) pickExternalIP(protocol uint8) IP {
+	if ip, ok := t.protocolExternalIP(protocol); ok {
+		return ip
+	}
+	owned := t.owned.Load()
+	if owned == nil {
+		return t.externalIP
+	}
+	offset := (owned.next.Add(1) - 1) % owned.size
+
+	ip := owned.base
+	raw := ipBytes(&ip)
+	tail := raw[len(raw)-4:]
+	binary.BigEndian.PutUint32(tail, binary.BigEndian.Uint32(tail)+offset)
+	return ip
+}
@@ -0,0 +1,119 @@
+package swnat
+
+// QUIC connection IDs are at most 20 bytes long (RFC 9000 section 17.2)
+const maxQUICConnIDLen = 20
+
+// quicDestConnID returns the destination connection ID of a QUIC packet. Long
+// header packets carry the ID length, short header packets don't, in which
+// case idLen is used. It returns nil if payload doesn't look like QUIC.
+func quicDestConnID(payload []byte, idLen int) []byte {
+	if len(payload) < 1 || payload[0]&0x40 == 0 {
+		// fixed bit unset, not QUIC v1
+		return nil
+	}
+	if payload[0]&0x80 != 0 {
+		// long header: flags, 4 bytes version, DCID length, DCID
+		if len(payload) < 6 {
+			return nil
+		}
+		idLen = int(payload[5])
+		if idLen > maxQUICConnIDLen || len(payload) < 6+idLen {
+			return nil
+		}
+		return payload[6 : 6+idLen]
+	}
+	// short header: flags then DCID
+	if idLen == 0 || len(payload) < 1+idLen {
+		return nil
+	}
+	return payload[1 : 1+idLen]
+}
+
+// findQUICLocked returns the connection known for the destination connection
+// ID of payload. The caller must hold the lock.
+func (p *Pair[IP]) findQUICLocked(payload []byte) *Conn[IP] {
+	if payload[0]&0x80 != 0 {
+		if id := quicDestConnID(payload, 0); id != nil {
+			return p.quic[string(id)]
+		}
+		return nil
+	}
+	// short header, try every ID length seen so far
+	for idLen := 1; idLen <= maxQUICConnIDLen; idLen++ {
+		if !p.quicIDLens[idLen] {
+			continue
+		}
+		if id := quicDestConnID(payload, idLen); id != nil {
+			if conn := p.quic[string(id)]; conn != nil {
+				return conn
+			}
+		}
+	}
+	return nil
+}
+
+// learnQUIC records the destination connection ID of an outbound long header
+// QUIC packet so the client can later migrate to another source address.
+func (p *Pair[IP]) learnQUIC(conn *Conn[IP], payload []byte) {
+	if len(payload) == 0 || payload[0]&0x80 == 0 {
+		return
+	}
+	id := quicDestConnID(payload, 0)
+	if len(id) == 0 {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if conn.quicConnID == string(id) {
+		return
+	}
+	if p.quic == nil {
+		p.quic = make(map[string]*Conn[IP])
+	}
+	p.forgetQUICLocked(conn)
+	conn.quicConnID = string(id)
+	p.quic[conn.quicConnID] = conn
+	p.quicIDLens[len(id)] = true
+}
+
+// forgetQUICLocked drops the connection ID recorded for conn. The caller must
+// hold the write lock.
+func (p *Pair[IP]) forgetQUICLocked(conn *Conn[IP]) {
+	if conn.quicConnID == "" {
+		return
+	}
+	if p.quic[conn.quicConnID] == conn {
+		delete(p.quic, conn.quicConnID)
+	}
+	conn.quicConnID = ""
+}
+
+// migrateQUIC looks for a connection to the same destination and namespace
+// already using the QUIC connection ID of payload, and moves it to the
+// internal tuple of key, keeping its external mapping. It returns the
+// migrated connection, or nil if there is none.
+func (p *Pair[IP]) migrateQUIC(key InternalKey[IP], payload []byte) *Conn[IP] {
+	if len(payload) == 0 {
+		return nil
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	conn := p.findQUICLocked(payload)
+	if conn == nil || conn.Namespace != key.Namespace || conn.LocalDstIp != key.DstIP || conn.LocalDstPort != key.DstPort {
+		return nil
+	}
+
+	delete(p.out, conn.internalKey())
+	p.forgetCachedLocked(conn)
+	p.countSourceLocked(conn, -1)
+	conn.LocalSrcIP = key.SrcIP
+	conn.LocalSrcPort = key.SrcPort
+	p.out[key] = conn
+	p.forgetCachedLocked(conn)
+	p.countSourceLocked(conn, 1)
+	return conn
+}
@@ -0,0 +1,79 @@
+package swnat
+
+import (
+	"net"
+	"testing"
+)
+
+func TestQUICDestConnID(t *testing.T) {
+	id := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	long := append([]byte{0xc0, 0, 0, 0, 1, byte(len(id))}, id...)
+	short := append([]byte{0x40}, id...)
+
+	if got := quicDestConnID(long, 0); string(got) != string(id) {
+		t.Errorf("Long header DCID %x, want %x", got, id)
+	}
+	if got := quicDestConnID(short, len(id)); string(got) != string(id) {
+		t.Errorf("Short header DCID %x, want %x", got, id)
+	}
+	if got := quicDestConnID(short, 0); got != nil {
+		t.Errorf("Short header without known length returned %x", got)
+	}
+	if got := quicDestConnID([]byte{0x00, 1, 2}, 2); got != nil {
+		t.Errorf("Non-QUIC payload returned %x", got)
+	}
+	if got := quicDestConnID(long[:10], 0); got != nil {
+		t.Errorf("Truncated long header returned %x", got)
+	}
+}
+
+func TestQUICMigrationKeepsMapping(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	table.EnableQUICALG = true
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+	dcid := []byte{0xde, 0xad, 0xbe, 0xef, 0xca, 0xfe, 0xba, 0xbe}
+
+	// Handshake packet, long header carrying the server-chosen DCID
+	initial := CreateIPv4UDPPacket(client, server, 5000, 443, append([]byte{0xe0, 0, 0, 0, 1, byte(len(dcid))}, dcid...))
+	if err := table.HandleOutboundPacket(initial, 1); err != nil {
+		t.Fatalf("Handshake packet failed: %v", err)
+	}
+	udp, _ := ParseUDPHeader(initial, 20)
+	externalPort := udp.SourcePort
+
+	// The client moves to a new source port and sends a short header packet
+	migrated := CreateIPv4UDPPacket(client, server, 6000, 443, append([]byte{0x40}, dcid...))
+	if err := table.HandleOutboundPacket(migrated, 1); err != nil {
+		t.Fatalf("Migrated packet failed: %v", err)
+	}
+	udp, _ = ParseUDPHeader(migrated, 20)
+	if udp.SourcePort != externalPort {
+		t.Errorf("Migration changed the external port from %d to %d", externalPort, udp.SourcePort)
+	}
+	if n := table.UDP.len(); n != 1 {
+		t.Errorf("Expected a single mapping after migration, got %d", n)
+	}
+
+	// Replies now reach the new source port
+	reply := CreateIPv4UDPPacket(server, table.externalIP, 443, externalPort, append([]byte{0x40}, 1, 2, 3))
+	if _, err := table.HandleInboundPacket(reply); err != nil {
+		t.Fatalf("Reply failed: %v", err)
+	}
+	udp, _ = ParseUDPHeader(reply, 20)
+	if udp.DestinationPort != 6000 {
+		t.Errorf("Reply delivered to port %d, want 6000", udp.DestinationPort)
+	}
+
+	// Without the ALG a port change is a new flow
+	table.EnableQUICALG = false
+	other := CreateIPv4UDPPacket(client, server, 7000, 443, append([]byte{0x40}, dcid...))
+	if err := table.HandleOutboundPacket(other, 1); err != nil {
+		t.Fatalf("Packet without ALG failed: %v", err)
+	}
+	udp, _ = ParseUDPHeader(other, 20)
+	if udp.SourcePort == externalPort {
+		t.Error("Mapping was reused with the ALG disabled")
+	}
+}
@@ -0,0 +1,272 @@
+package swnat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// seqAdjust records where an ALG last resized the payload in one direction
+// of a TCP connection, so that retransmissions of earlier segments keep the
+// offset that was in effect for them
+type seqAdjust struct {
+	active bool
+	pos    uint32 // sequence number of the last resized segment
+	before int32  // offset for segments up to pos
+}
+
+// seqAfter reports whether a comes after b in sequence space
+func seqAfter(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// seqOffset returns the offset to add to the sequence number of a segment
+// going the way adj tracks
+func (adj *seqAdjust) seqOffset(seq uint32, delta int32) int32 {
+	if !adj.active || seqAfter(seq, adj.pos) {
+		return delta
+	}
+	return adj.before
+}
+
+// ackOffset returns the offset to remove from an acknowledgment of segments
+// going the way adj tracks
+func (adj *seqAdjust) ackOffset(ack uint32, delta int32) int32 {
+	if !adj.active || seqAfter(ack-uint32(delta), adj.pos) {
+		return delta
+	}
+	return adj.before
+}
+
+// fixSequence applies the ALG offsets of conn to a TCP header
+func (p *Pair[IP]) fixSequence(conn *Conn[IP], h *TCPHeader, outbound bool) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	if !conn.seqAdj.active && !conn.ackAdj.active {
+		return
+	}
+	if outbound {
+		h.Sequence += uint32(conn.seqAdj.seqOffset(h.Sequence, conn.SeqDelta))
+		if h.Flags&TCPFlagACK != 0 {
+			h.Acknowledgment -= uint32(conn.ackAdj.ackOffset(h.Acknowledgment, conn.AckDelta))
+		}
+	} else {
+		h.Sequence += uint32(conn.ackAdj.seqOffset(h.Sequence, conn.AckDelta))
+		if h.Flags&TCPFlagACK != 0 {
+			h.Acknowledgment -= uint32(conn.seqAdj.ackOffset(h.Acknowledgment, conn.SeqDelta))
+		}
+	}
+}
+
+// adjustUrgent moves the urgent pointer of a segment whose payload an ALG
+// resized by delta bytes, to payloadLen. The pointer is only moved when it
+// marks the end of the original payload or beyond, so the edit lies before
+// the urgent data; otherwise where the edit happened is unknown and it is
+// left as is. It reports whether the pointer changed.
+func adjustUrgent(h *TCPHeader, payloadLen int, delta int32) bool {
+	if h.Flags&TCPFlagURG == 0 || delta == 0 {
+		return false
+	}
+	urgent := int(h.Urgent) + int(delta)
+	if int(h.Urgent) < payloadLen-int(delta) || urgent < 0 || urgent > 0xffff {
+		return false
+	}
+	h.Urgent = uint16(urgent)
+	return true
+}
+
+// AdjustTCPSequence records that an ALG changed the payload length of a TCP
+// packet by delta bytes. The packet is given untranslated, as it is passed
+// to HandleOutboundPacket (with its namespace) or HandleInboundPacket. The
+// edited segment keeps its sequence number, later segments in the same
+// direction are shifted by delta and acknowledgments coming back are shifted
+// the other way, for the life of the connection. Recording the same segment
+// twice, such as for a retransmission, has no effect.
+//
+// The packet is expected to carry the edited payload. When it has URG set and
+// its urgent pointer marks the end of the original payload or beyond, the
+// pointer is moved by delta to keep pointing at the same byte. A pointer
+// inside the payload is left unmodified, as the edit may lie on either side
+// of it. Later segments need no change, their pointer being relative to
+// their own sequence number.
+func (t *Table[IP]) AdjustTCPSequence(packet []byte, outbound bool, namespace uintptr, delta int32) error {
+	if err := t.checkFamily(packet); err != nil {
+		return err
+	}
+
+	// the TCP segment, and how to recompute its checksum
+	var src, dst IP
+	var tcpData []byte
+	var setChecksum func()
+	if isIPv6Packet(packet) {
+		ipHeader, err := ParseIPv6Header(packet)
+		if err != nil {
+			return fmt.Errorf("failed to parse IP header: %w", err)
+		}
+		if ipHeader.Protocol != ProtocolTCP {
+			return errors.New("not a TCP packet")
+		}
+		if tcpData, err = ipHeader.upperLayer(packet); err != nil {
+			return err
+		}
+		src, dst = any(ipHeader.SourceIP).(IP), any(ipHeader.DestinationIP).(IP)
+		setChecksum = func() { t.setChecksum6(ipHeader, ProtocolTCP, tcpData, 16) }
+	} else {
+		ipHeader, err := ParseIPv4Header(packet)
+		if err != nil {
+			return fmt.Errorf("failed to parse IP header: %w", err)
+		}
+		if ipHeader.Protocol != ProtocolTCP {
+			return errors.New("not a TCP packet")
+		}
+		tcpData = packet[int(ipHeader.IHL)*4 : ipHeader.TotalLength]
+		src, dst = any(ipHeader.SourceIP).(IP), any(ipHeader.DestinationIP).(IP)
+		setChecksum = func() {
+			binary.BigEndian.PutUint16(tcpData[16:18], 0)
+			if !t.SkipChecksums {
+				checksum := calculateTCPChecksum(ipHeader.SourceIP, ipHeader.DestinationIP, tcpData)
+				binary.BigEndian.PutUint16(tcpData[16:18], checksum)
+			}
+		}
+	}
+	tcpHeader, err := ParseTCPHeader(tcpData, 0)
+	if err != nil {
+		return fmt.Errorf("failed to parse TCP header: %w", err)
+	}
+
+	var conn *Conn[IP]
+	if outbound {
+		conn = t.TCP.lookupOutbound(InternalKey[IP]{
+			SrcIP:     src,
+			DstIP:     dst,
+			SrcPort:   tcpHeader.SourcePort,
+			DstPort:   tcpHeader.DestinationPort,
+			Namespace: namespace,
+		})
+	} else {
+		conn = t.TCP.lookupInbound(ExternalKey[IP]{
+			SrcIP:   src,
+			DstIP:   dst,
+			SrcPort: tcpHeader.SourcePort,
+			DstPort: tcpHeader.DestinationPort,
+		})
+	}
+	if conn == nil {
+		return errors.New("no connection matches the packet")
+	}
+
+	tcpHeaderLen := int(tcpHeader.DataOffset) * 4
+	payloadLen := len(tcpData) - tcpHeaderLen
+	if tcpHeaderLen >= 20 && payloadLen >= 0 && adjustUrgent(tcpHeader, payloadLen, delta) {
+		binary.BigEndian.PutUint16(tcpData[18:20], tcpHeader.Urgent)
+		setChecksum()
+	}
+
+	t.TCP.mutex.Lock()
+	defer t.TCP.mutex.Unlock()
+
+	adj, total := &conn.seqAdj, &conn.SeqDelta
+	if !outbound {
+		adj, total = &conn.ackAdj, &conn.AckDelta
+	}
+	if adj.active && !seqAfter(tcpHeader.Sequence, adj.pos) {
+		return nil
+	}
+	adj.active = true
+	adj.pos = tcpHeader.Sequence
+	adj.before = *total
+	*total += delta
+	return nil
+}
+
+// ResizePayload replaces the TCP or UDP payload of packet, translated or
+// not, with payload, for ALGs changing its length. The IPv4 total length or
+// IPv6 payload length, the UDP length and the checksums are updated, the TCP
+// and UDP ones unless SkipChecksums is set. Like append, it returns the
+// resized packet, in the array of packet if it has the capacity, to be used
+// in place of packet. Bytes past the IP packet length, such as link layer
+// padding, are dropped. For TCP, the change must also be recorded with
+// AdjustTCPSequence.
+func (t *Table[IP]) ResizePayload(packet, payload []byte) ([]byte, error) {
+	// where the layer 4 header starts and the IP packet ends
+	var ipHeaderLen, end int
+	var protocol uint8
+	var ipv4 *IPv4Header
+	var ipv6 *IPv6Header
+	if isIPv6Packet(packet) {
+		ipHeader, err := ParseIPv6Header(packet)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse IP header: %w", err)
+		}
+		ipv6, ipHeaderLen, end, protocol = ipHeader, ipHeader.HeaderLen, 40+int(ipHeader.PayloadLength), ipHeader.Protocol
+	} else {
+		ipHeader, err := ParseIPv4Header(packet)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse IP header: %w", err)
+		}
+		ipv4, ipHeaderLen, end, protocol = ipHeader, int(ipHeader.IHL)*4, int(ipHeader.TotalLength), ipHeader.Protocol
+	}
+
+	var l4HeaderLen int
+	switch protocol {
+	case ProtocolTCP:
+		tcpHeader, err := ParseTCPHeader(packet, ipHeaderLen)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse TCP header: %w", err)
+		}
+		l4HeaderLen = int(tcpHeader.DataOffset) * 4
+	case ProtocolUDP:
+		if _, err := ParseUDPHeader(packet, ipHeaderLen); err != nil {
+			return nil, fmt.Errorf("failed to parse UDP header: %w", err)
+		}
+		l4HeaderLen = 8
+	default:
+		return nil, errors.New("not a TCP or UDP packet")
+	}
+
+	start := ipHeaderLen + l4HeaderLen
+	if start > end {
+		return nil, fmt.Errorf("invalid IP packet length %d", end)
+	}
+	// the IPv4 total length covers the header, the IPv6 payload length not
+	length := start + len(payload)
+	if ipv6 != nil {
+		length -= 40
+	}
+	if length > 0xffff {
+		return nil, errors.New("resized packet too large")
+	}
+	packet = append(packet[:start], payload...)
+
+	l4 := packet[ipHeaderLen:]
+	if protocol == ProtocolUDP {
+		binary.BigEndian.PutUint16(l4[4:6], uint16(len(l4)))
+	}
+	if ipv6 != nil {
+		ipv6.PayloadLength = uint16(length)
+		ipv6.Marshal(packet)
+		if protocol == ProtocolTCP {
+			t.setChecksum6(ipv6, protocol, l4, 16)
+		} else {
+			t.setChecksum6(ipv6, protocol, l4, 6)
+		}
+		return packet, nil
+	}
+
+	ipv4.TotalLength = uint16(length)
+	ipv4.Marshal(packet)
+	switch protocol {
+	case ProtocolTCP:
+		binary.BigEndian.PutUint16(l4[16:18], 0)
+		if !t.SkipChecksums {
+			binary.BigEndian.PutUint16(l4[16:18], calculateTCPChecksum(ipv4.SourceIP, ipv4.DestinationIP, l4))
+		}
+	case ProtocolUDP:
+		binary.BigEndian.PutUint16(l4[6:8], 0)
+		if !t.SkipChecksums {
+			binary.BigEndian.PutUint16(l4[6:8], calculateUDPChecksum(ipv4.SourceIP, ipv4.DestinationIP, l4))
+		}
+	}
+	return packet, nil
+}
@@ -0,0 +1,341 @@
+package swnat
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// tcpSegment builds a TCP packet with the given sequence and ack numbers
+func tcpSegment(src, dst IPv4, srcPort, dstPort uint16, flags uint8, seq, ack uint32) []byte {
+	packet := CreateIPv4TCPPacket(src, dst, srcPort, dstPort, flags)
+	tcp, _ := ParseTCPHeader(packet, 20)
+	tcp.Sequence = seq
+	tcp.Acknowledgment = ack
+	tcp.Marshal(packet, 20)
+	return packet
+}
+
+func TestAdjustTCPSequence(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	outbound := func(flags uint8, seq, ack uint32) *TCPHeader {
+		t.Helper()
+		packet := tcpSegment(client, server, 40000, 21, flags, seq, ack)
+		if err := table.HandleOutboundPacket(packet, 1); err != nil {
+			t.Fatalf("HandleOutboundPacket failed: %v", err)
+		}
+		if !VerifyTCPChecksum(packet) {
+			t.Error("Invalid TCP checksum on outbound packet")
+		}
+		tcp, _ := ParseTCPHeader(packet, 20)
+		return tcp
+	}
+
+	syn := outbound(TCPFlagSYN, 1000, 0)
+	external := syn.SourcePort
+	inbound := func(flags uint8, seq, ack uint32) *TCPHeader {
+		t.Helper()
+		packet := tcpSegment(server, table.externalIP, 21, external, flags, seq, ack)
+		if _, err := table.HandleInboundPacket(packet); err != nil {
+			t.Fatalf("HandleInboundPacket failed: %v", err)
+		}
+		tcp, _ := ParseTCPHeader(packet, 20)
+		return tcp
+	}
+
+	// An ALG grows the 10 bytes segment at 1001 by 5 bytes
+	edited := tcpSegment(client, server, 40000, 21, TCPFlagACK, 1001, 5001)
+	if err := table.AdjustTCPSequence(edited, true, 1, 5); err != nil {
+		t.Fatalf("AdjustTCPSequence failed: %v", err)
+	}
+	if tcp := outbound(TCPFlagACK, 1001, 5001); tcp.Sequence != 1001 {
+		t.Errorf("Edited segment should keep its sequence, got %d", tcp.Sequence)
+	}
+	if tcp := outbound(TCPFlagACK, 1011, 5001); tcp.Sequence != 1016 {
+		t.Errorf("Expected following segment at 1016, got %d", tcp.Sequence)
+	}
+	// Recording the retransmitted segment again changes nothing
+	table.AdjustTCPSequence(edited, true, 1, 5)
+	if tcp := outbound(TCPFlagACK, 1001, 5001); tcp.Sequence != 1001 {
+		t.Errorf("Retransmission should keep its sequence, got %d", tcp.Sequence)
+	}
+
+	// The server acknowledges 15 bytes, the client only sent 10
+	if tcp := inbound(TCPFlagACK, 5001, 1016); tcp.Acknowledgment != 1011 {
+		t.Errorf("Expected ack 1011, got %d", tcp.Acknowledgment)
+	}
+
+	// An ALG shrinks the 20 bytes server segment at 5001 by 3 bytes
+	reply := tcpSegment(server, table.externalIP, 21, external, TCPFlagACK, 5001, 1016)
+	if err := table.AdjustTCPSequence(reply, false, 0, -3); err != nil {
+		t.Fatalf("AdjustTCPSequence failed: %v", err)
+	}
+	if tcp := inbound(TCPFlagACK, 5021, 1026); tcp.Sequence != 5018 || tcp.Acknowledgment != 1021 {
+		t.Errorf("Expected seq 5018 ack 1021, got seq %d ack %d", tcp.Sequence, tcp.Acknowledgment)
+	}
+	if tcp := outbound(TCPFlagACK, 1021, 5018); tcp.Sequence != 1026 || tcp.Acknowledgment != 5021 {
+		t.Errorf("Expected seq 1026 ack 5021, got seq %d ack %d", tcp.Sequence, tcp.Acknowledgment)
+	}
+
+	unknown := tcpSegment(client, server, 40001, 21, TCPFlagACK, 1, 1)
+	if err := table.AdjustTCPSequence(unknown, true, 1, 5); err == nil {
+		t.Error("Expected an error for a packet without connection")
+	}
+}
+
+func TestAdjustTCPSequenceIPv6(t *testing.T) {
+	table := NewIPv6(net.ParseIP("2001:db8::1")).(*Table[IPv6])
+	client, _ := ParseIPv6("fd00::100")
+	server, _ := ParseIPv6("2001:db8:21::21")
+
+	segment := func(flags uint8, seq, ack uint32) []byte {
+		packet := CreateIPv6TCPPacket(client, server, 40000, 21, flags)
+		tcp, _ := ParseTCPHeader(packet, 40)
+		tcp.Sequence = seq
+		tcp.Acknowledgment = ack
+		tcp.Marshal(packet, 40)
+		return packet
+	}
+	outbound := func(flags uint8, seq, ack uint32) *TCPHeader {
+		t.Helper()
+		packet := segment(flags, seq, ack)
+		if err := table.HandleOutboundPacket(packet, 1); err != nil {
+			t.Fatalf("HandleOutboundPacket failed: %v", err)
+		}
+		if !VerifyIPv6Checksum(packet) {
+			t.Error("Invalid TCP checksum on outbound packet")
+		}
+		tcp, _ := ParseTCPHeader(packet, 40)
+		return tcp
+	}
+
+	outbound(TCPFlagSYN, 1000, 0)
+	if err := table.AdjustTCPSequence(segment(TCPFlagACK, 1001, 5001), true, 1, 5); err != nil {
+		t.Fatalf("AdjustTCPSequence failed: %v", err)
+	}
+	if tcp := outbound(TCPFlagACK, 1011, 5001); tcp.Sequence != 1016 {
+		t.Errorf("Expected following segment at 1016, got %d", tcp.Sequence)
+	}
+
+	ipv4 := tcpSegment(IPv4{192, 168, 1, 100}, IPv4{8, 8, 8, 8}, 40000, 21, TCPFlagACK, 1, 1)
+	if err := table.AdjustTCPSequence(ipv4, true, 1, 5); !errors.Is(err, ErrWrongAddressFamily) {
+		t.Errorf("Expected ErrWrongAddressFamily, got %v", err)
+	}
+}
+
+func TestResizePayloadIPv6(t *testing.T) {
+	table := NewIPv6(net.ParseIP("2001:db8::1")).(*Table[IPv6])
+	client, _ := ParseIPv6("fd00::100")
+	server, _ := ParseIPv6("2001:db8:21::21")
+
+	check := func(packet []byte, l4HeaderLen int, payload string) {
+		t.Helper()
+		ip, err := ParseIPv6Header(packet)
+		if err != nil {
+			t.Fatalf("ParseIPv6Header failed: %v", err)
+		}
+		if int(ip.PayloadLength) != len(packet)-40 {
+			t.Errorf("PayloadLength %d, packet length %d", ip.PayloadLength, len(packet))
+		}
+		if ip.Protocol == ProtocolUDP {
+			udp, _ := ParseUDPHeader(packet, 40)
+			if int(udp.Length) != len(packet)-40 {
+				t.Errorf("UDP length %d, want %d", udp.Length, len(packet)-40)
+			}
+		}
+		if !VerifyIPv6Checksum(packet) {
+			t.Error("Invalid checksum")
+		}
+		if got := string(packet[40+l4HeaderLen:]); got != payload {
+			t.Errorf("Expected payload %q, got %q", payload, got)
+		}
+	}
+
+	const grown = "INVITE [fd00::100]"
+	packet, err := table.ResizePayload(CreateIPv6UDPPacket(client, server, 5000, 5060, []byte("INVITE fd00::1")), []byte(grown))
+	if err != nil {
+		t.Fatalf("ResizePayload failed: %v", err)
+	}
+	check(packet, 8, grown)
+	if err := table.HandleOutboundPacket(packet, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	check(packet, 8, grown)
+
+	outbound := CreateIPv6TCPPacket(client, server, 40000, 21, TCPFlagSYN)
+	if err := table.HandleOutboundPacket(outbound, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	seg, err := table.ResizePayload(CreateIPv6TCPPacket(client, server, 40000, 21, TCPFlagACK), []byte("EPRT |2|fd00::100|5282|"))
+	if err != nil {
+		t.Fatalf("ResizePayload failed: %v", err)
+	}
+	check(seg, 20, "EPRT |2|fd00::100|5282|")
+	if err := table.HandleOutboundPacket(seg, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	check(seg, 20, "EPRT |2|fd00::100|5282|")
+}
+
+// urgentSegment builds a TCP packet with URG set, the given urgent pointer
+// and payload
+func urgentSegment(src, dst IPv4, srcPort, dstPort uint16, seq uint32, urgent uint16, payload []byte) []byte {
+	packet := append(CreateIPv4TCPPacket(src, dst, srcPort, dstPort, TCPFlagACK|TCPFlagURG), payload...)
+	ip, _ := ParseIPv4Header(packet[:40])
+	ip.TotalLength = uint16(len(packet))
+	ip.Marshal(packet)
+	tcp, _ := ParseTCPHeader(packet, 20)
+	tcp.Sequence = seq
+	tcp.Urgent = urgent
+	tcp.Checksum = 0
+	tcp.Marshal(packet, 20)
+	tcp.Checksum = calculateTCPChecksum(src, dst, packet[20:])
+	tcp.Marshal(packet, 20)
+	return packet
+}
+
+func TestTCPUrgentPointer(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	translate := func(packet []byte) *TCPHeader {
+		t.Helper()
+		if err := table.HandleOutboundPacket(packet, 1); err != nil {
+			t.Fatalf("HandleOutboundPacket failed: %v", err)
+		}
+		if !VerifyTCPChecksum(packet) {
+			t.Error("Invalid TCP checksum")
+		}
+		tcp, _ := ParseTCPHeader(packet, 20)
+		return tcp
+	}
+	translate(tcpSegment(client, server, 40000, 23, TCPFlagSYN, 1000, 0))
+
+	// Plain translation leaves the pointer alone
+	if tcp := translate(urgentSegment(client, server, 40000, 23, 1001, 4, []byte("abcdefgh"))); tcp.Urgent != 4 || tcp.Flags&TCPFlagURG == 0 {
+		t.Errorf("Expected URG with pointer 4, got flags %#x pointer %d", tcp.Flags, tcp.Urgent)
+	}
+
+	// An ALG grows a segment whose urgent data ends the payload by 5 bytes,
+	// the pointer follows the last byte
+	edited := urgentSegment(client, server, 40000, 23, 1009, 10, []byte("0123456789+++++"))
+	if err := table.AdjustTCPSequence(edited, true, 1, 5); err != nil {
+		t.Fatalf("AdjustTCPSequence failed: %v", err)
+	}
+	if !VerifyTCPChecksum(edited) {
+		t.Error("Invalid TCP checksum after moving the urgent pointer")
+	}
+	if tcp := translate(edited); tcp.Urgent != 15 || tcp.Sequence != 1009 {
+		t.Errorf("Expected pointer 15 at 1009, got %d at %d", tcp.Urgent, tcp.Sequence)
+	}
+
+	// A pointer inside the edited payload can't be placed, it is left as is
+	edited = urgentSegment(client, server, 40000, 23, 1019, 3, []byte("0123456789+++++"))
+	table.AdjustTCPSequence(edited, true, 1, 5)
+	if tcp := translate(edited); tcp.Urgent != 3 || tcp.Sequence != 1024 {
+		t.Errorf("Expected pointer 3 at 1024, got %d at %d", tcp.Urgent, tcp.Sequence)
+	}
+
+	// Segments after the edit keep their relative pointer
+	if tcp := translate(urgentSegment(client, server, 40000, 23, 1029, 2, []byte("abcd"))); tcp.Urgent != 2 || tcp.Sequence != 1039 {
+		t.Errorf("Expected pointer 2 at 1039, got %d at %d", tcp.Urgent, tcp.Sequence)
+	}
+}
+
+func TestResizePayload(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	check := func(packet []byte, payload string) {
+		t.Helper()
+		ip, err := ParseIPv4Header(packet)
+		if err != nil {
+			t.Fatalf("ParseIPv4Header failed: %v", err)
+		}
+		if int(ip.TotalLength) != len(packet) {
+			t.Errorf("TotalLength %d, packet length %d", ip.TotalLength, len(packet))
+		}
+		if !VerifyIPv4Checksum(packet) {
+			t.Error("Invalid IP checksum")
+		}
+		var got string
+		switch ip.Protocol {
+		case ProtocolUDP:
+			udp, _ := ParseUDPHeader(packet, 20)
+			if int(udp.Length) != len(packet)-20 {
+				t.Errorf("UDP length %d, want %d", udp.Length, len(packet)-20)
+			}
+			if !VerifyUDPChecksum(packet) {
+				t.Error("Invalid UDP checksum")
+			}
+			got = string(packet[28:])
+		case ProtocolTCP:
+			if !VerifyTCPChecksum(packet) {
+				t.Error("Invalid TCP checksum")
+			}
+			got = string(packet[40:])
+		}
+		if got != payload {
+			t.Errorf("Expected payload %q, got %q", payload, got)
+		}
+	}
+
+	// An ALG grows a UDP payload by 6 bytes before translation
+	const grown = "INVITE 192.168.100.10"
+	packet := CreateIPv4UDPPacket(client, server, 5000, 5060, []byte("INVITE 10.0.0.1"))
+	packet, err := table.ResizePayload(packet, []byte(grown))
+	if err != nil {
+		t.Fatalf("ResizePayload failed: %v", err)
+	}
+	if len(packet) != 28+21 {
+		t.Fatalf("Expected a %d bytes packet, got %d", 28+21, len(packet))
+	}
+	check(packet, grown)
+	if err := table.HandleOutboundPacket(packet, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	check(packet, grown)
+
+	// and after translation, in place when the buffer has room
+	packet = make([]byte, 0, 1500)
+	packet = append(packet, CreateIPv4UDPPacket(client, server, 5001, 5060, []byte("abcdef"))...)
+	if err := table.HandleOutboundPacket(packet, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	resized, err := table.ResizePayload(packet, []byte("abcdefghijkl"))
+	if err != nil {
+		t.Fatalf("ResizePayload failed: %v", err)
+	}
+	if len(resized) != len(packet)+6 || &resized[0] != &packet[0] {
+		t.Errorf("Expected the packet grown by 6 bytes in place, got %d bytes", len(resized))
+	}
+	check(resized, "abcdefghijkl")
+
+	// a TCP segment grown along with its sequence offset
+	seg := tcpSegment(client, server, 40000, 21, TCPFlagSYN, 1000, 0)
+	if err := table.HandleOutboundPacket(seg, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	seg, err = table.ResizePayload(tcpSegment(client, server, 40000, 21, TCPFlagACK, 1001, 1), []byte("PORT 1,2"))
+	if err != nil {
+		t.Fatalf("ResizePayload failed: %v", err)
+	}
+	check(seg, "PORT 1,2")
+	if err := table.AdjustTCPSequence(seg, true, 1, 8); err != nil {
+		t.Fatalf("AdjustTCPSequence failed: %v", err)
+	}
+	if err := table.HandleOutboundPacket(seg, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	check(seg, "PORT 1,2")
+
+	if _, err := table.ResizePayload(CreateIPv4ICMPPacket(client, server, 8, 0, 1, 1), nil); err == nil {
+		t.Error("Expected an error for an ICMP packet")
+	}
+}
@@ -0,0 +1,295 @@
+package swnat
+
+import (
+	"slices"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Stats is a snapshot of the activity of a table
+type Stats struct {
+	// Connections currently tracked, in total and by protocol
+	Connections int
+	TCP         int
+	UDP         int
+	ICMP        int
+	DCCP        int
+	ESP         int
+	Other       int
+
+	// Namespaces holds the number of connections of each namespace having
+	// any, e.g. to enforce billing limits
+	Namespaces map[uintptr]int
+
+	// PortsAllocated counts the outside ports and ICMP identifiers in use,
+	// including those withheld from reuse after their release
+	PortsAllocated int
+
+	// Packets translated in either direction since the table was created,
+	// and packets dropped by drop rules or for matching no connection. The
+	// latter only counts inbound TCP, UDP and DCCP packets, like
+	// NoMatchPortStats.
+	PacketsTranslated uint64
+	RuleDrops         uint64
+	NoMatchDrops      uint64
+
+	// Connection setups timed with MeasureSetupLatency, with their average
+	// and longest duration in nanoseconds
+	Setups        uint64
+	AvgSetupNanos int64
+	MaxSetupNanos int64
+}
+
+// Stats returns a snapshot of the activity of the table. Connections are
+// counted under the read lock of each protocol in turn, so the counts of
+// different protocols may be taken at slightly different times.
+func (t *Table[IP]) Stats() Stats {
+	s := Stats{
+		Namespaces:        make(map[uintptr]int),
+		PacketsTranslated: t.translated.Load(),
+		NoMatchDrops:      t.noMatchDrops.Load(),
+		Setups:            t.setups.count.Load(),
+		MaxSetupNanos:     t.setups.max.Load(),
+	}
+	if s.Setups > 0 {
+		s.AvgSetupNanos = t.setups.total.Load() / int64(s.Setups)
+	}
+
+	counts := []*int{&s.TCP, &s.UDP, &s.ICMP, &s.DCCP, &s.ESP, &s.Other}
+	for i, p := range t.pairs() {
+		p.mutex.RLock()
+		*counts[i] = len(p.out)
+		for key := range p.out {
+			s.Namespaces[key.Namespace]++
+		}
+		p.mutex.RUnlock()
+
+		s.Connections += *counts[i]
+		s.RuleDrops += p.ruleDrops.Load()
+		if p.ports != nil {
+			s.PortsAllocated += p.ports.allocated()
+		}
+	}
+	s.PortsAllocated += t.extPool.allocated()
+	return s
+}
+
+// setupCounters accumulate the durations of connection setups
+type setupCounters struct {
+	count atomic.Uint64
+	total atomic.Int64
+	max   atomic.Int64
+}
+
+func (c *setupCounters) add(nanos int64) {
+	c.count.Add(1)
+	c.total.Add(nanos)
+	for {
+		longest := c.max.Load()
+		if nanos <= longest || c.max.CompareAndSwap(longest, nanos) {
+			return
+		}
+	}
+}
+
+// MemoryEstimate returns an approximate number of bytes used by the
+// connection maps, indexes and rules of the table.
+//
+// Each connection is counted as its Conn structure, its captured payload
+// and one entry in each of the in and out maps and in the outside port
+// index. The per source port, half-open and per destination counters, the
+// QUIC connection IDs, the rules, forwards and their indexes, the port
+// pools of the pairs and of the external IP pool and the flow cache slots are
+// counted as well. Map entries are counted twice their raw size to account
+// for free slots and bookkeeping, which is roughly what Go maps use after
+// successive growths. The real footprint depends on the runtime and on the
+// table's history, so this should only be used for sizing.
+func (t *Table[IP]) MemoryEstimate() int64 {
+	const ptrSize = int64(unsafe.Sizeof(uintptr(0)))
+	const intSize = int64(unsafe.Sizeof(0))
+
+	var conn Conn[IP]
+	var inKey ExternalKey[IP]
+	var outKey InternalKey[IP]
+	var redirect RedirectRule[IP]
+	var drop DropRule
+	var forward PortRangeForward[IP]
+	var ip IP
+	var srcPort sourcePort[IP]
+	var dest destination[IP]
+	var match redirectMatch[IP]
+	var slice []*Conn[IP]
+	var quicID string
+
+	// mapBytes returns the estimated size of a map of n entries of entry
+	// bytes each
+	mapBytes := func(n int, entry int64) int64 {
+		return 2 * int64(n) * entry
+	}
+
+	perConn := int64(unsafe.Sizeof(conn)) +
+		mapBytes(1, int64(unsafe.Sizeof(inKey))+ptrSize) +
+		mapBytes(1, int64(unsafe.Sizeof(outKey))+ptrSize) +
+		ptrSize // its byPort slice element
+
+	var total int64
+	for _, p := range t.pairs() {
+		p.mutex.RLock()
+		total += int64(len(p.out)) * perConn
+		for _, c := range p.out {
+			total += int64(cap(c.Payload))
+		}
+		total += mapBytes(len(p.byPort), 2+int64(unsafe.Sizeof(slice)))
+		total += mapBytes(len(p.srcPorts), int64(unsafe.Sizeof(ip))+intSize)
+		total += mapBytes(len(p.srcPortRefs), int64(unsafe.Sizeof(srcPort))+intSize)
+		total += mapBytes(len(p.halfOpen), ptrSize+intSize)
+		total += mapBytes(len(p.toDest), int64(unsafe.Sizeof(dest))+intSize)
+		for id := range p.quic {
+			total += mapBytes(1, int64(unsafe.Sizeof(quicID))+ptrSize) + int64(len(id))
+		}
+
+		total += int64(cap(p.redirectRules)) * int64(unsafe.Sizeof(redirect))
+		total += int64(cap(p.dropRules)) * int64(unsafe.Sizeof(drop))
+		total += int64(cap(p.forwards)) * int64(unsafe.Sizeof(forward))
+		total += mapBytes(len(p.dropIndex), 2+ptrSize) + int64(len(p.dropIndex))*8
+		total += mapBytes(len(p.redirectIndex), int64(unsafe.Sizeof(match))+intSize)
+		ports := p.ports
+		p.mutex.RUnlock()
+
+		if ports != nil {
+			total += ports.memory()
+		}
+		if cache := p.cache.Load(); cache != nil {
+			total += int64(cap(cache.out)+cap(cache.in)) * ptrSize
+		}
+	}
+
+	a := &t.extPool
+	a.mutex.RLock()
+	for _, ports := range a.ports {
+		total += mapBytes(1, int64(unsafe.Sizeof(ipProtocol[IP]{}))+ptrSize) + ports.memory()
+	}
+	a.mutex.RUnlock()
+	return total
+}
+
+// reapBuckets are the upper bounds, in seconds, of IdleHistogram buckets
+var reapBuckets = [...]int64{1, 10, 60, 300, 3600, 86400}
+
+// IdleHistogram counts connections by how long they had been idle. Buckets
+// hold idle times below 1s, 10s, 1m, 5m, 1h and 24h, the last bucket
+// holding everything longer.
+type IdleHistogram [len(reapBuckets) + 1]uint64
+
+func (h *IdleHistogram) add(idle int64) {
+	for i, bound := range reapBuckets {
+		if idle < bound {
+			h[i]++
+			return
+		}
+	}
+	h[len(reapBuckets)]++
+}
+
+// total returns the number of connections in all buckets
+func (h *IdleHistogram) total() uint64 {
+	var n uint64
+	for _, v := range h {
+		n += v
+	}
+	return n
+}
+
+// ProtocolReapStats describes the connections of one protocol removed by
+// maintenance, split by reason.
+type ProtocolReapStats struct {
+	Swept   IdleHistogram // closed connections (TCP FIN/RST, DCCP Close/Reset)
+	Expired IdleHistogram // connections that reached their idle timeout
+}
+
+// ReapStats holds, per protocol, how long connections had been idle when
+// maintenance removed them. It helps tuning timeouts.
+type ReapStats struct {
+	TCP  ProtocolReapStats
+	UDP  ProtocolReapStats
+	ICMP ProtocolReapStats
+	DCCP ProtocolReapStats
+	ESP  ProtocolReapStats
+
+	// Other covers protocols passed through by UnknownProtocolPassthroughSNAT
+	Other ProtocolReapStats
+}
+
+// ReapStats returns the idle time histograms of connections removed by
+// maintenance since the table was created.
+func (t *Table[IP]) ReapStats() ReapStats {
+	read := func(p *Pair[IP]) ProtocolReapStats {
+		p.mutex.RLock()
+		defer p.mutex.RUnlock()
+		return p.reaps
+	}
+	return ReapStats{
+		TCP:  read(&t.TCP),
+		UDP:  read(&t.UDP),
+		ICMP: read(&t.ICMP),
+		DCCP: read(&t.DCCP),
+		ESP:  read(&t.ESP),
+
+		Other: read(&t.Other),
+	}
+}
+
+// ConnectionAgeStats returns the age in seconds of the oldest and newest
+// connections across all protocols, and the median age, computed from their
+// creation time. All three are zero when the table is empty. It copies the
+// creation time of every connection, so it is meant for occasional capacity
+// planning rather than frequent polling.
+func (t *Table[IP]) ConnectionAgeStats() (oldest, newest, median int64) {
+	var created []int64
+	for _, p := range t.pairs() {
+		p.mutex.RLock()
+		for _, conn := range p.out {
+			created = append(created, conn.CreatedAt)
+		}
+		p.mutex.RUnlock()
+	}
+	if len(created) == 0 {
+		return 0, 0, 0
+	}
+
+	slices.Sort(created)
+	now := t.Now()
+	return now - created[0], now - created[len(created)-1], now - created[len(created)/2]
+}
+
+// countNoMatch counts an inbound packet to port dropped for matching no
+// connection, by port up to NoMatchPortLimit
+func (t *Table[IP]) countNoMatch(port uint16) {
+	t.noMatchDrops.Add(1)
+	if t.NoMatchPortLimit <= 0 {
+		return
+	}
+	t.noMatchMutex.Lock()
+	defer t.noMatchMutex.Unlock()
+	if _, ok := t.noMatch[port]; !ok && len(t.noMatch) >= t.NoMatchPortLimit {
+		return
+	}
+	if t.noMatch == nil {
+		t.noMatch = make(map[uint16]uint64)
+	}
+	t.noMatch[port]++
+}
+
+// NoMatchPortStats returns, by external destination port, the number of
+// inbound TCP, UDP and DCCP packets dropped for matching no connection,
+// e.g. to spot port scans. Only the first NoMatchPortLimit ports probed
+// are tracked.
+func (t *Table[IP]) NoMatchPortStats() map[uint16]uint64 {
+	t.noMatchMutex.Lock()
+	defer t.noMatchMutex.Unlock()
+	res := make(map[uint16]uint64, len(t.noMatch))
+	for port, n := range t.noMatch {
+		res[port] = n
+	}
+	return res
+}
@@ -0,0 +1,221 @@
+package swnat
+
+import (
+	"net"
+	"runtime"
+	"testing"
+)
+
+func TestMemoryEstimate(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+
+	addConns := func(from, to int) {
+		for i := from; i < to; i++ {
+			table.UDP.addConnection(&Conn[IPv4]{
+				Protocol:       ProtocolUDP,
+				Namespace:      1,
+				LocalSrcIP:     IPv4{10, byte(i >> 16), byte(i >> 8), byte(i)},
+				LocalSrcPort:   5000,
+				LocalDstIp:     IPv4{8, 8, 8, 8},
+				LocalDstPort:   53,
+				OutsideSrcIP:   table.externalIP,
+				OutsideSrcPort: uint16(i),
+				OutsideDstIP:   IPv4{8, 8, 8, 8},
+				OutsideDstPort: 53,
+			}, evictPolicy{})
+		}
+	}
+
+	prev := table.MemoryEstimate()
+	for _, n := range []int{10, 100, 1000} {
+		addConns(table.UDP.len(), n)
+		est := table.MemoryEstimate()
+		if est <= prev {
+			t.Errorf("Estimate did not grow with %d connections: %d <= %d", n, est, prev)
+		}
+		prev = est
+	}
+
+	// Compare against the heap growth of a fresh table
+	table = NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	addConns(0, 20000)
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+
+	actual := int64(after.HeapAlloc) - int64(before.HeapAlloc)
+	est := table.MemoryEstimate()
+	if est < actual/3 || est > actual*3 {
+		t.Errorf("Estimate %d too far from measured heap growth %d", est, actual)
+	}
+	t.Logf("estimate=%d measured=%d", est, actual)
+}
+
+func TestMemoryEstimateCoverage(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	// grew runs change and reports whether the estimate grew
+	grew := func(what string, change func()) {
+		t.Helper()
+		before := table.MemoryEstimate()
+		change()
+		if after := table.MemoryEstimate(); after <= before {
+			t.Errorf("Estimate did not grow with %s: %d <= %d", what, after, before)
+		}
+	}
+
+	grew("a connection", func() {
+		table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, 5000, 53, nil), 1)
+	})
+	table.CapturePayloadBytes = 1024
+	grew("a captured payload", func() {
+		table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, 5001, 53, make([]byte, 1000)), 1)
+	})
+	grew("a port forward", func() {
+		table.AddPortForward(ProtocolTCP, 8080, IPv4{192, 168, 1, 10}, 80, 1)
+	})
+	grew("an external IP pool", func() {
+		table.SetExternalIPPool([]IPv4{{1, 2, 3, 4}, {1, 2, 3, 5}})
+	})
+
+	// Ports held after their connections are reaped are counted with the pool
+	table.PortReuseDelay = 60
+	held := table.UDP.ports.memory()
+	table.RunMaintenance(table.Now() + table.UDPTimeout + 1)
+	if got := table.UDP.ports.memory(); got <= held {
+		t.Errorf("Pool estimate did not grow with held ports: %d <= %d", got, held)
+	}
+}
+
+func TestReapStats(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	now := int64(10000)
+	table.Now = func() int64 { return now }
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{1, 1, 1, 1}
+
+	// A TCP flow closed by FIN and a UDP flow left to time out
+	syn := CreateIPv4TCPPacket(client, server, 45000, 80, TCPFlagSYN)
+	fin := CreateIPv4TCPPacket(client, server, 45000, 80, TCPFlagFIN|TCPFlagACK)
+	udp := CreateIPv4UDPPacket(client, server, 5000, 53, nil)
+	for _, packet := range [][]byte{syn, fin, udp} {
+		if err := table.HandleOutboundPacket(packet, 1); err != nil {
+			t.Fatalf("HandleOutboundPacket failed: %v", err)
+		}
+	}
+
+	// FIN-closed flow swept right away
+	table.RunMaintenance(now + 5)
+	stats := table.ReapStats()
+	if stats.TCP.Swept[1] != 1 {
+		t.Errorf("TCP swept histogram %v, want one connection in the <10s bucket", stats.TCP.Swept)
+	}
+	if stats.UDP.Expired != (IdleHistogram{}) {
+		t.Errorf("UDP flow reaped too early: %v", stats.UDP.Expired)
+	}
+
+	// UDP flow idle for 200s is past its 180s timeout
+	table.RunMaintenance(now + 200)
+	stats = table.ReapStats()
+	if stats.UDP.Expired[3] != 1 {
+		t.Errorf("UDP expired histogram %v, want one connection in the <5m bucket", stats.UDP.Expired)
+	}
+	if stats.UDP.Swept != (IdleHistogram{}) || stats.TCP.Expired != (IdleHistogram{}) {
+		t.Errorf("Connections counted under the wrong reason: %+v", stats)
+	}
+}
+
+func TestConnectionAgeStats(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	now := int64(10000)
+	table.Now = func() int64 { return now }
+
+	if oldest, newest, median := table.ConnectionAgeStats(); oldest != 0 || newest != 0 || median != 0 {
+		t.Errorf("Expected zeros for an empty table, got %d/%d/%d", oldest, newest, median)
+	}
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{1, 1, 1, 1}
+
+	// Flows opened 100, 90, ... 0 seconds before the check, alternating
+	// UDP and ICMP
+	for i := 0; i <= 10; i++ {
+		packet := CreateIPv4UDPPacket(client, server, uint16(5000+i), 53, nil)
+		if i%2 == 1 {
+			packet = CreateIPv4ICMPPacket(client, server, ICMPTypeEchoRequest, 0, uint16(i), 1)
+		}
+		if err := table.HandleOutboundPacket(packet, 1); err != nil {
+			t.Fatalf("HandleOutboundPacket failed: %v", err)
+		}
+		if i < 10 {
+			now += 10
+		}
+	}
+
+	oldest, newest, median := table.ConnectionAgeStats()
+	if oldest != 100 {
+		t.Errorf("Expected oldest age 100, got %d", oldest)
+	}
+	if newest != 0 {
+		t.Errorf("Expected newest age 0, got %d", newest)
+	}
+	if median < 40 || median > 60 {
+		t.Errorf("Expected median age around 50, got %d", median)
+	}
+}
+
+func TestIPv4TableStats(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+	table.AddDropRule(ProtocolUDP, 25)
+
+	packets := []struct {
+		packet    []byte
+		namespace uintptr
+	}{
+		{CreateIPv4UDPPacket(client, server, 5000, 53, nil), 1},
+		{CreateIPv4UDPPacket(client, server, 5001, 53, nil), 1},
+		{CreateIPv4TCPPacket(client, server, 40000, 80, TCPFlagSYN), 2},
+		{CreateIPv4ICMPPacket(client, server, ICMPTypeEchoRequest, 0, 1234, 1), 2},
+		{CreateIPv4ICMPPacket(client, server, ICMPTypeEchoRequest, 0, 1234, 2), 2},
+	}
+	for _, p := range packets {
+		if err := table.HandleOutboundPacket(p.packet, p.namespace); err != nil {
+			t.Fatalf("HandleOutboundPacket failed: %v", err)
+		}
+	}
+	if _, err := table.HandleInboundPacket(CreateIPv4UDPPacket(server, IPv4{1, 2, 3, 4}, 53, 49152, nil)); err != nil {
+		t.Fatalf("HandleInboundPacket failed: %v", err)
+	}
+
+	// dropped by a rule, then for matching no connection
+	table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, 5002, 25, nil), 1)
+	table.HandleInboundPacket(CreateIPv4UDPPacket(server, IPv4{1, 2, 3, 4}, 53, 60000, nil))
+	table.HandleInboundPacket(CreateIPv4TCPPacket(server, IPv4{1, 2, 3, 4}, 80, 60000, TCPFlagACK))
+
+	stats := table.Stats()
+	if stats.Connections != 4 || stats.TCP != 1 || stats.UDP != 2 || stats.ICMP != 1 || stats.DCCP+stats.ESP+stats.Other != 0 {
+		t.Errorf("Unexpected connection counts %+v", stats)
+	}
+	if len(stats.Namespaces) != 2 || stats.Namespaces[1] != 2 || stats.Namespaces[2] != 2 {
+		t.Errorf("Expected 2 connections in each namespace, got %v", stats.Namespaces)
+	}
+	if stats.PortsAllocated != 4 {
+		t.Errorf("Expected 4 ports allocated, got %d", stats.PortsAllocated)
+	}
+	if stats.PacketsTranslated != 6 || stats.RuleDrops != 1 || stats.NoMatchDrops != 2 {
+		t.Errorf("Expected 6 packets translated, 1 rule drop and 2 unmatched, got %d, %d and %d",
+			stats.PacketsTranslated, stats.RuleDrops, stats.NoMatchDrops)
+	}
+
+	table.RunMaintenance(table.Now() + table.TCPTimeout + 1)
+	if stats := table.Stats(); stats.Connections != 0 || len(stats.Namespaces) != 0 || stats.PortsAllocated != 0 {
+		t.Errorf("Expected an empty table after expiry, got %+v", stats)
+	}
+}
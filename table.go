@@ -1,18 +1,63 @@
 package swnat
 
 import (
-	"crypto/rand"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// Reasons passed to Table.OnEvict
+const (
+	EvictReasonNamespaceLimit = "namespace-limit" // MaxConnPerNamespace reached
+	EvictReasonGlobalLimit    = "global-limit"    // MaxTotalConn reached
+)
+
+// GlobalEvictionPolicy selects the namespace a connection is evicted from
+// when MaxTotalConn is reached
+type GlobalEvictionPolicy int
+
+const (
+	// EvictRequester evicts from the namespace opening the new
+	// connection, or from any namespace if it has none
+	EvictRequester GlobalEvictionPolicy = iota
+
+	// EvictLargestNamespace evicts from the namespace with the most
+	// connections, so a well-behaved namespace isn't penalized for an
+	// abusive one
+	EvictLargestNamespace
+)
+
+// SweepBehavior selects what happens to packets of connections marked for
+// removal at the next maintenance, by a TCP FIN or RST or a DCCP Close or
+// Reset
+type SweepBehavior int
+
+const (
+	// SweepLingerUntilMaintenance keeps translating them, so late segments
+	// such as the last ACK get through
+	SweepLingerUntilMaintenance SweepBehavior = iota
+
+	// SweepImmediateDrop removes the connection on its next packet, which
+	// is then handled as matching no connection
+	SweepImmediateDrop
+)
+
 type Table[IP comparable] struct {
 	TCP  Pair[IP]
 	UDP  Pair[IP]
 	ICMP Pair[IP]
+	DCCP Pair[IP]
+	ESP  Pair[IP] // see handleOutboundESP
+
+	// Other tracks protocols without a handler under
+	// UnknownProtocolPassthroughSNAT
+	Other Pair[IP]
 
 	externalIP  IP
 	portCounter uint32
@@ -21,41 +66,301 @@ type Table[IP comparable] struct {
 
 	// Now is a function that returns the current time in Unix seconds.
 	// Defaults to time.Now().Unix() but can be overridden for performance.
-	Now func() int64
+	// SetClock replaces it along with the nanosecond time source.
+	Now   func() int64
+	clock Clock
 
 	// MaxConnPerNamespace is the maximum number of connections allowed per namespace.
 	// When this limit is reached, oldest connections will be removed.
 	// Defaults to 200.
 	MaxConnPerNamespace int
 
+	// MaxTotalConn, when positive, caps the connections of each protocol
+	// across all namespaces. Once reached, a connection is evicted from the
+	// namespace selected by GlobalEvictionPolicy to make room for a new one.
+	MaxTotalConn         int
+	GlobalEvictionPolicy GlobalEvictionPolicy
+
+	// SweepBehavior selects whether connections closed by a FIN or RST
+	// still translate packets until the next maintenance, which they do by
+	// default
+	SweepBehavior SweepBehavior
+
+	// UnknownProtocolPolicy selects what happens to packets of protocols
+	// without a handler, dropped by default
+	UnknownProtocolPolicy UnknownProtocolPolicy
+
+	// MaxHalfOpenPerNamespace, when positive, caps the outbound TCP
+	// connections of a namespace still waiting for the remote host to
+	// answer their SYN. Further SYNs get ErrSynFlood until one of them is
+	// answered, closed or times out. This keeps a SYN flood from an internal
+	// host from exhausting ports.
+	MaxHalfOpenPerNamespace int
+
+	// MaxICMPToDestination, when positive, caps the concurrent ICMP echo
+	// flows, one per identifier, a namespace may have to a single
+	// destination. Further echo requests with new identifiers get
+	// ErrICMPFlood until some of them expire.
+	MaxICMPToDestination int
+
+	// MaxPortsPerInternalIP, when positive, caps the outside ports of each
+	// protocol a single internal host may hold, whatever its namespace. New
+	// flows from a host at the limit get ErrTooManyPorts.
+	MaxPortsPerInternalIP int
+
 	// Protocol-specific timeouts in seconds
 	TCPTimeout  int64
 	UDPTimeout  int64
 	ICMPTimeout int64
+	DCCPTimeout int64
+	ESPTimeout  int64
+
+	// UnknownProtocolTimeout applies to the connections of Other
+	UnknownProtocolTimeout int64
+
+	// TCP timeouts by connection state, in seconds. TCPSynTimeout applies
+	// to connections whose opening SYN wasn't answered yet, so unanswered
+	// SYNs don't hold entries for long; it defaults to TCPEstablishedTimeout
+	// when 0. TCPEstablishedTimeout defaults to TCPTimeout. TCPClosingTimeout
+	// applies once one side sent a FIN, TCPTimeWaitTimeout once both did;
+	// left at 0 a FIN has the connection swept at the next maintenance, like
+	// a RST always does.
+	TCPSynTimeout         int64
+	TCPEstablishedTimeout int64
+	TCPClosingTimeout     int64
+	TCPTimeWaitTimeout    int64
+
+	// MaxConnAge, when positive, is the longest a connection may live in
+	// seconds: maintenance removes older connections even if they are
+	// still active, forcing them to be established again.
+	MaxConnAge int64
+
+	// AdaptiveTimeouts has maintenance shorten idle timeouts as the table
+	// fills up, to shed load before it is full. From AdaptiveLowWatermark
+	// to AdaptiveHighWatermark connections, across protocols, timeouts
+	// shrink linearly from their configured value down to
+	// AdaptiveMinTimeout seconds, and grow back as the table empties.
+	// Timeouts already shorter than AdaptiveMinTimeout are left alone.
+	AdaptiveTimeouts      bool
+	AdaptiveLowWatermark  int
+	AdaptiveHighWatermark int
+	AdaptiveMinTimeout    int64
+
+	// DropMartians drops inbound packets whose source address can't
+	// legitimately appear on the outside: loopback, "this network",
+	// link-local, or one of our own external addresses.
+	DropMartians bool
+
+	// AdoptExistingFlows lets an outbound TCP packet without SYN create a
+	// mapping when no connection matches, treating the flow as already
+	// established. This allows flows that started before the NAT (restart,
+	// state reload) to survive. When false such packets are dropped.
+	AdoptExistingFlows bool
+
+	// EnableQUICALG tracks QUIC connection IDs of UDP flows to QUICPort, so
+	// a client migrating to another source IP or port keeps its external
+	// mapping.
+	EnableQUICALG bool
+	QUICPort      uint16
+
+	// PortReuseDelay, when positive, is how long in seconds a released
+	// external port (or ICMP identifier) is kept out of the pool before
+	// being allocated again, so late packets of the old flow can't reach a
+	// new one. Ports are returned in the order they were released.
+	PortReuseDelay int64
+
+	// PreserveICMPID keeps the identifier of outbound ICMP echo requests as
+	// their external identifier when no other flow uses it, for monitoring
+	// that expects it to pass through unchanged. Colliding identifiers are
+	// still reassigned.
+	PreserveICMPID bool
+
+	// ZeroIDForDF clears the IP Identification of outbound atomic datagrams
+	// (Don't Fragment set, not a fragment), which RFC 6864 lets receivers
+	// ignore, so it doesn't leak the host's counter. Packets that may be
+	// fragmented keep theirs.
+	ZeroIDForDF bool
+
+	// StrictInternalSource drops outbound packets of a namespace with
+	// prefixes registered by RegisterNamespacePrefix whose source is outside
+	// all of them, as spoofed, with ErrSpoofedSource. Namespaces without
+	// prefixes aren't checked.
+	StrictInternalSource bool
+
+	// PortLowWatermark reserves headroom in the TCP and UDP port pools: once
+	// only this many ports are free, only namespaces with a positive
+	// priority (see SetNamespacePriority) may open new connections, others
+	// get ErrPortsLow. Zero disables the watermark.
+	PortLowWatermark int
+
+	// PriorityEviction makes namespace limit evictions pick connections
+	// with the lowest DSCP class first (e.g. best effort before EF voice
+	// traffic), falling back to the least recently used.
+	PriorityEviction bool
+
+	// ReuseConns recycles connection objects through a pool to reduce GC
+	// pressure under heavy flow churn. A connection is recycled as soon as
+	// it leaves the table, so a packet handled concurrently with the
+	// removal of its connection (by RunMaintenance or an eviction from
+	// another goroutine) could see the state of a newer flow. Only enable
+	// it when packet handling and removals are serialized.
+	ReuseConns bool
+
+	// DrainGracePeriod is how long, in seconds, connections on a port passed
+	// to DrainExternalPort may live before being torn down. Zero lets them
+	// run until their normal expiry.
+	DrainGracePeriod int64
+
+	// CoupledPorts gives a new TCP flow the external port of an existing
+	// UDP mapping from the same internal source and vice versa, when that
+	// port is free, which helps services such as DNS or QUIC with a TCP
+	// fallback. Finding the other mapping walks the connections of the
+	// other protocol, so it is costly on large tables.
+	CoupledPorts bool
+
+	// SkipChecksums leaves the TCP, UDP and DCCP checksums of translated
+	// packets zeroed instead of computing them, for NICs that fill them on
+	// transmit. IP header and ICMP checksums are still computed.
+	SkipChecksums bool
+
+	// NamespaceResolver derives the namespace of an outbound packet from
+	// the buffer it was received in, for HandleOutboundPacketAuto. It
+	// returns false when the packet doesn't belong to any namespace.
+	NamespaceResolver func(packet []byte) (uintptr, bool)
+
+	// OnNewConn, when set, is called with every connection added to the
+	// table, after it was added and without holding table locks.
+	// Connections opened by remote clients, e.g. through port forwards,
+	// have InboundInitiated set: their remote endpoint is OutsideDstIP for
+	// forwards and LocalSrcIP for DNAT rules.
+	OnNewConn func(c ConnInfo[IP])
+
+	// OnEvict, when set, is called with every connection evicted to make
+	// room for a new one, the reason (an EvictReason constant) and the
+	// number of connections the namespace had for the protocol, or the
+	// whole table for EvictReasonGlobalLimit. Like OnNewConn it is called
+	// without holding table locks.
+	OnEvict func(c ConnInfo[IP], reason string, count int)
+
+	// CapturePayloadBytes, when positive, keeps the first bytes of payload
+	// the internal host sends on each TCP, UDP or DCCP connection, up to
+	// that many, in Conn.Payload, for classifiers to label the flow from
+	// ConnInfo.
+	CapturePayloadBytes int
+
+	// TraceWriter, when set, receives a record of every packet passed to
+	// HandleOutboundPacket and HandleInboundPacket, which ReplayTrace can
+	// feed to another table to reproduce its state.
+	TraceWriter io.Writer
+	tracer      traceState
+
+	// RecordModifications, when set, has every translated packet compared
+	// with its original so LastModification can tell which fields changed,
+	// for verifying that nothing else did. It costs a copy of each packet.
+	RecordModifications bool
+	lastMod             atomic.Pointer[ModRecord]
+
+	// PortAllocator, when set, allocates the external address and port of
+	// new TCP, UDP and DCCP flows instead of the table, and gets them back
+	// when their connection is removed.
+	PortAllocator PortAllocator[IP]
+
+	extPool ipPool[IP] // see SetExternalIPPool
+
+	// AllowConn, when set, is consulted before any new connection is added
+	// to the table. Returning false refuses it: outbound packets get
+	// ErrConnRefused and inbound ones are dropped. It is called without
+	// holding table locks and must be safe for concurrent use.
+	AllowConn func(c ConnInfo[IP]) bool
+
+	// SelfHeal has every inbound lookup check that the connection found
+	// is still the one its internal key maps to, which costs one more map
+	// lookup. A stale entry left by an inconsistency between the maps is
+	// removed and its packet dropped, see SelfHealRepairs.
+	SelfHeal bool
+	repairs  atomic.Uint64
+
+	// NoMatchPortLimit, when positive, has inbound packets matching no
+	// connection counted by destination port for NoMatchPortStats, for up
+	// to that many ports so random-port scans can't grow it unbounded.
+	NoMatchPortLimit int
+	noMatchMutex     sync.Mutex
+	noMatch          map[uint16]uint64
+	noMatchDrops     atomic.Uint64
+
+	// MeasureSetupLatency has the time taken to add new connections to
+	// their pair, eviction scans included, reported by Stats
+	MeasureSetupLatency bool
+	setups              setupCounters
+
+	nsMutex    sync.RWMutex
+	namespaces map[uintptr]*namespaceConfig
+	nsStats    sync.Map // namespace to *nsCounters, see nsCounters
+	drops      dropCounters
+	translated atomic.Uint64
+
+	owned atomic.Pointer[ownedPrefix[IP]]
+
+	acceptMutex   sync.RWMutex
+	inboundAccept map[IP]bool
+
+	protoMutex sync.RWMutex
+	protoIPs   map[uint8]IP // see SetProtocolExternalIP
+
+	internalMutex    sync.RWMutex
+	internalPrefixes []*net.IPNet
+
+	replyMutex sync.RWMutex
+	replyFrom  map[uint16][]*net.IPNet // see AllowReplyFromCIDR
+
+	mcastMutex  sync.RWMutex
+	mcastGroups map[IP][]uintptr // see JoinMulticast
 }
 
 func NewIPv4(externalIP net.IP) NAT {
-	t := &Table[IPv4]{
-		nextPort:            49152,
-		maxPort:             65535,
-		Now:                 func() int64 { return time.Now().Unix() },
-		MaxConnPerNamespace: 200,
-		TCPTimeout:          86400, // 24 hours
-		UDPTimeout:          180,   // 3 minutes
-		ICMPTimeout:         30,    // 30 seconds
-	}
-
-	// Convert net.IP to IPv4
-	if ip4 := externalIP.To4(); ip4 != nil {
-		copy(t.externalIP[:], ip4)
-	} else {
+	t, err := NewIPv4WithConfig(Config{ExternalIP: externalIP})
+	if err != nil {
 		panic("NewIPv4: provided IP is not a valid IPv4 address")
 	}
+	return t
+}
+
+// init creates the connection pairs and port pools of a new table
+func (t *Table[IP]) init() {
+	t.Now = func() int64 { return time.Now().Unix() }
 
 	t.TCP.init()
 	t.UDP.init()
 	t.ICMP.init()
-	return t
+	t.DCCP.init()
+	t.ESP.init()
+	t.Other.init()
+
+	t.TCP.ports = newPortPool(uint16(t.nextPort), uint16(t.maxPort))
+	t.UDP.ports = newPortPool(uint16(t.nextPort), uint16(t.maxPort))
+	t.DCCP.ports = newPortPool(uint16(t.nextPort), uint16(t.maxPort))
+
+	// ICMP identifiers are their own 16-bit space, independent from the
+	// TCP/UDP port range
+	t.ICMP.ports = newPortPool(0, 65535)
+
+	for _, p := range t.pairs() {
+		if p.ports == nil {
+			// ESP and unknown protocols have no ports
+			continue
+		}
+		p.ports.clock = func() int64 { return t.Now() }
+		p.ports.holdUntil = t.portHoldUntil
+	}
+}
+
+// portHoldUntil returns until when a released port is withheld from reuse,
+// 0 without PortReuseDelay
+func (t *Table[IP]) portHoldUntil() int64 {
+	if t.PortReuseDelay <= 0 {
+		return 0
+	}
+	return t.Now() + t.PortReuseDelay
 }
 
 // SetExternalIP sets the external IP address that will be used for outbound NAT translations
@@ -68,44 +373,498 @@ func (t *Table[IP]) GetExternalIP() IP {
 	return t.externalIP
 }
 
-func (t *Table[IP]) allocatePort() uint16 {
-	for attempts := 0; attempts < 1000; attempts++ {
-		port := atomic.AddUint32(&t.portCounter, 1)
-		port = (port % (t.maxPort - t.nextPort)) + t.nextPort
-		if port <= t.maxPort {
-			return uint16(port)
+// pair returns the connection pair tracking the given protocol, or nil if the
+// protocol isn't tracked
+func (t *Table[IP]) pair(protocol uint8) *Pair[IP] {
+	switch protocol {
+	case ProtocolTCP:
+		return &t.TCP
+	case ProtocolUDP:
+		return &t.UDP
+	case ProtocolICMP:
+		return &t.ICMP
+	case ProtocolDCCP:
+		return &t.DCCP
+	case ProtocolESP:
+		return &t.ESP
+	}
+	return nil
+}
+
+// pairs returns all connection pairs of the table
+func (t *Table[IP]) pairs() []*Pair[IP] {
+	return []*Pair[IP]{&t.TCP, &t.UDP, &t.ICMP, &t.DCCP, &t.ESP, &t.Other}
+}
+
+// checkFamily returns ErrWrongAddressFamily for an IPv4 packet handed to an
+// IPv6 table or the reverse. Other versions are left to the header parser.
+func (t *Table[IP]) checkFamily(packet []byte) error {
+	if len(packet) == 0 {
+		return nil
+	}
+	_, v6 := any(t.externalIP).(IPv6)
+	switch packet[0] >> 4 {
+	case 4:
+		if v6 {
+			return ErrWrongAddressFamily
+		}
+	case 6:
+		if !v6 {
+			return ErrWrongAddressFamily
 		}
 	}
-	// Fallback to random port
-	var b [2]byte
-	rand.Read(b[:])
-	return uint16(binary.BigEndian.Uint16(b[:])%(uint16(t.maxPort-t.nextPort))) + uint16(t.nextPort)
+	return nil
 }
 
-func (t *Table[IP]) HandleOutboundPacket(packet []byte, namespace uintptr) error {
-	// For now, assume IPv4
+// packetAddresses returns the source and destination addresses of an IPv4
+// or IPv6 packet, ErrWrongAddressFamily if it doesn't match the table
+func (t *Table[IP]) packetAddresses(packet []byte) (src, dst IP, err error) {
+	if err := t.checkFamily(packet); err != nil {
+		return src, dst, err
+	}
+	if isIPv6Packet(packet) {
+		ipHeader, err := ParseIPv6Header(packet)
+		if err != nil {
+			return src, dst, fmt.Errorf("failed to parse IP header: %w", err)
+		}
+		return any(ipHeader.SourceIP).(IP), any(ipHeader.DestinationIP).(IP), nil
+	}
 	ipHeader, err := ParseIPv4Header(packet)
 	if err != nil {
-		return fmt.Errorf("failed to parse IP header: %w", err)
+		return src, dst, fmt.Errorf("failed to parse IP header: %w", err)
 	}
+	return any(ipHeader.SourceIP).(IP), any(ipHeader.DestinationIP).(IP), nil
+}
 
-	headerLen := int(ipHeader.IHL) * 4
+// isLoop reports whether a packet's destination, after any redirection, is
+// the very endpoint that sent it. Such a packet would hairpin back to its
+// sender through the NAT forever.
+func isLoop[IP comparable](srcIP IP, srcPort uint16, dstIP IP, dstPort uint16) bool {
+	return srcIP == dstIP && srcPort == dstPort
+}
+
+// translatedHairpin reports whether an outbound packet from srcIP to dstIP
+// in namespace was already translated once on a hairpin: its source is one
+// of the NAT's addresses and its destination, as the first translation
+// rewrote it, an internal host of the same namespace. Translating it again
+// would send it around forever. Packets from an owned address to outside
+// hosts are translated as usual.
+func (t *Table[IP]) translatedHairpin(namespace uintptr, srcIP, dstIP IP) bool {
+	return t.ownsIP(srcIP) && t.internalTo(namespace, dstIP)
+}
+
+// isMartian reports whether ip can't be the source of a packet received from
+// the outside
+func (t *Table[IP]) isMartian(ip IP) bool {
+	if t.ownsIP(ip) {
+		return true
+	}
+	switch v := any(ip).(type) {
+	case IPv4:
+		return v[0] == 127 || v[0] == 0 || (v[0] == 169 && v[1] == 254)
+	case IPv6:
+		// loopback, unspecified, and fe80::/10 link-local
+		return v == IPv6{15: 1} || v.IsZero() || (v[0] == 0xfe && v[1]&0xc0 == 0x80)
+	}
+	return false
+}
+
+// newConn returns a connection initialized to init, recycled from the pool
+// of p when ReuseConns is set
+func (t *Table[IP]) newConn(p *Pair[IP], init Conn[IP]) *Conn[IP] {
+	if !t.ReuseConns {
+		conn := init
+		return &conn
+	}
+	conn, _ := p.connPool.Get().(*Conn[IP])
+	if conn == nil {
+		conn = new(Conn[IP])
+	}
+	*conn = init
+	conn.pooled = true
+	return conn
+}
+
+// admitConn asks AllowConn whether a new connection may be added, undoing
+// its port allocation when refused
+func (t *Table[IP]) admitConn(p *Pair[IP], conn *Conn[IP]) error {
+	if t.AllowConn == nil || t.AllowConn(conn.info()) {
+		return nil
+	}
+	p.mutex.RLock()
+	p.recycle(conn)
+	p.mutex.RUnlock()
+	return ErrConnRefused
+}
+
+// addConn adds a new connection to p, accounting for any connection evicted
+// to make room for it, and reports them to OnEvict and OnNewConn. The port
+// allocation of a connection that can't be added is undone.
+func (t *Table[IP]) addConn(p *Pair[IP], conn *Conn[IP]) error {
+	var start int64
+	if t.MeasureSetupLatency {
+		start = t.nowNano()
+	}
+	ev, evicted, err := p.addConnection(conn, t.evictionPolicy())
+	if err != nil {
+		p.mutex.RLock()
+		p.recycle(conn)
+		p.mutex.RUnlock()
+		return err
+	}
+	if t.MeasureSetupLatency {
+		t.setups.add(t.nowNano() - start)
+	}
+	if evicted {
+		t.activeNSCounters(ev.victim.Namespace).evictions.Add(1)
+		if t.OnEvict != nil {
+			t.OnEvict(ev.victim, ev.reason, ev.count)
+		}
+	}
+	if t.OnNewConn != nil {
+		p.mutex.RLock()
+		info := conn.info()
+		p.mutex.RUnlock()
+		t.OnNewConn(info)
+	}
+	return nil
+}
+
+// evictionPolicy returns the eviction settings currently configured
+func (t *Table[IP]) evictionPolicy() evictPolicy {
+	return evictPolicy{
+		maxPerNamespace: t.MaxConnPerNamespace,
+		maxTotal:        t.MaxTotalConn,
+		byPriority:      t.PriorityEviction,
+		global:          t.GlobalEvictionPolicy,
+	}
+}
+
+// checkPortWatermark refuses new connections from low priority namespaces
+// once the free ports of p dropped to PortLowWatermark
+func (t *Table[IP]) checkPortWatermark(p *Pair[IP], namespace uintptr) error {
+	if t.PortLowWatermark <= 0 || p.ports.available()+t.extPool.available(p) > t.PortLowWatermark {
+		return nil
+	}
+	if t.namespacePriority(namespace) > 0 {
+		return nil
+	}
+	return ErrPortsLow
+}
+
+// checkSourcePorts refuses new connections from an internal host already
+// holding MaxPortsPerInternalIP outside ports of p
+func (t *Table[IP]) checkSourcePorts(p *Pair[IP], ip IP) error {
+	if t.MaxPortsPerInternalIP > 0 && p.sourcePorts(ip) >= t.MaxPortsPerInternalIP {
+		return ErrTooManyPorts
+	}
+	return nil
+}
+
+// lookupInbound returns the connection of p matching key. With SelfHeal, a
+// stale match is removed and the packet dropped with ErrDropPacket. A match
+// marked for removal may be ignored, see SweepBehavior.
+func (t *Table[IP]) lookupInbound(p *Pair[IP], key ExternalKey[IP]) (*Conn[IP], error) {
+	if !t.SelfHeal {
+		return t.unlessSwept(p, p.lookupInbound(key)), nil
+	}
+	conn, repaired := p.lookupInboundHealing(key)
+	if repaired {
+		t.repairs.Add(1)
+		return nil, ErrDropPacket
+	}
+	return t.unlessSwept(p, conn), nil
+}
+
+// unlessSwept returns conn, or nil after removing it from p if it is marked
+// for removal and SweepBehavior is SweepImmediateDrop
+func (t *Table[IP]) unlessSwept(p *Pair[IP], conn *Conn[IP]) *Conn[IP] {
+	if conn == nil || !conn.PendingSweep || t.SweepBehavior != SweepImmediateDrop {
+		return conn
+	}
+	p.removeConnection(conn)
+	return nil
+}
+
+// SelfHealRepairs returns the number of stale entries removed by SelfHeal
+func (t *Table[IP]) SelfHealRepairs() uint64 {
+	return t.repairs.Load()
+}
+
+// allocateOutside picks the outside address and port of a new connection of
+// p. With CoupledPorts, a TCP or UDP flow reuses the external port of the
+// other protocol's mapping for the same internal source when it is free,
+// unless the protocols masquerade behind different addresses or ports come
+// from a PortAllocator.
+func (t *Table[IP]) allocateOutside(p *Pair[IP], protocol uint8, key InternalKey[IP], dstIP IP, dstPort uint16) (IP, uint16, error) {
+	if t.CoupledPorts && t.portAllocator() == nil {
+		other := &t.UDP
+		if p == &t.UDP {
+			other = &t.TCP
+		}
+		pip, override := t.protocolExternalIP(protocol)
+		if ip, port, ok := other.outsideForSource(key); ok && (!override || ip == pip) && p.ports.take(port) {
+			return ip, port, nil
+		}
+	}
+	return t.allocateExternal(p, protocol, key, dstIP, dstPort)
+}
+
+// allocateExternal returns the outside address and port of a new connection
+// of p, from PortAllocator when set
+func (t *Table[IP]) allocateExternal(p *Pair[IP], protocol uint8, key InternalKey[IP], dstIP IP, dstPort uint16) (IP, uint16, error) {
+	if a := t.portAllocator(); a != nil {
+		return a.Allocate(key.Namespace, protocol, key.SrcIP, key.SrcPort)
+	}
+	ip := t.pickExternalIP(protocol)
+	port, err := t.allocatePort(p, ip, dstIP, dstPort)
+	return ip, port, err
+}
+
+// allocatePort returns an outside port of ip for a new connection of p to
+// dstIP:dstPort, from the pool of p while it has free ports. Once the pool
+// is exhausted, a port already in use is shared with the new connection if
+// it doesn't already map the same remote endpoint, so replies are still
+// told apart by their source. Reserved ports and ports held after release
+// are not shared. ErrPortExhausted is returned when every port maps the
+// endpoint.
+func (t *Table[IP]) allocatePort(p *Pair[IP], ip, dstIP IP, dstPort uint16) (uint16, error) {
+	for {
+		port, ok := p.ports.allocate()
+		if !ok {
+			break
+		}
+		// a port the pool considered free while a connection uses it
+		// stays allocated to that connection
+		if !p.mapsEndpoint(ip, port, dstIP, dstPort) {
+			return port, nil
+		}
+	}
+
+	span := t.maxPort - t.nextPort + 1
+	start := atomic.AddUint32(&t.portCounter, 1)
+	for i := uint32(0); i < span; i++ {
+		port := uint16(t.nextPort + (start+i)%span)
+		if p.ports.shareable(port) && !p.mapsEndpoint(ip, port, dstIP, dstPort) {
+			return port, nil
+		}
+	}
+	return 0, ErrPortExhausted
+}
+
+// OutboundResult describes what ProcessOutbound did with a packet
+type OutboundResult[IP comparable] struct {
+	Namespace    uintptr
+	ExternalIP   IP     // outside source address of the connection
+	ExternalPort uint16 // outside source port, or ICMP identifier
+	NewConn      bool   // the packet opened a new connection
+	Redirected   bool   // the connection was created by a redirect or DNAT rule
+	Modified     bool   // the packet was translated, false when passed through as is
+}
+
+// set fills the result for a packet translated on conn, if r is not nil
+func (r *OutboundResult[IP]) set(conn *Conn[IP], created bool) {
+	if r == nil {
+		return
+	}
+	r.ExternalIP = conn.OutsideSrcIP
+	r.ExternalPort = conn.OutsideSrcPort
+	r.NewConn = created
+	r.Redirected = conn.RewriteDestination
+	r.Modified = true
+}
+
+// ProcessOutbound is HandleOutboundPacket reporting the outcome, so callers
+// don't need to parse the translated packet to learn it
+func (t *Table[IP]) ProcessOutbound(packet []byte, namespace uintptr) (OutboundResult[IP], error) {
+	res := OutboundResult[IP]{Namespace: namespace}
+	err := t.handleOutboundPacket(packet, nil, namespace, &res)
+	return res, err
+}
+
+func (t *Table[IP]) HandleOutboundPacket(packet []byte, namespace uintptr) error {
+	return t.handleOutboundPacket(packet, nil, namespace, nil)
+}
+
+// ChecksumOffsets locates the checksums of a translated packet, for handing
+// their computation to hardware along with SkipChecksums. Offsets are from
+// the start of the packet.
+type ChecksumOffsets struct {
+	IPChecksum int // IPv4 header checksum, -1 for IPv6 which has none
+	L4Start    int // start of the transport header, where its checksum coverage begins
+	L4Checksum int // TCP, UDP, DCCP, ICMP or ICMPv6 checksum, -1 if the protocol has none
+}
+
+// checksumOffsets returns the checksum offsets of a translated IPv4 or IPv6
+// packet
+func checksumOffsets(packet []byte) ChecksumOffsets {
+	offsets := ChecksumOffsets{IPChecksum: 10, L4Start: int(packet[0]&0x0f) * 4, L4Checksum: -1}
+	protocol := packet[9]
+	if isIPv6Packet(packet) {
+		// translation succeeded, so the header parses
+		ipHeader, _ := ParseIPv6Header(packet)
+		offsets.IPChecksum, offsets.L4Start, protocol = -1, ipHeader.HeaderLen, ipHeader.Protocol
+	}
+	switch protocol {
+	case ProtocolTCP:
+		offsets.L4Checksum = offsets.L4Start + 16
+	case ProtocolUDP, ProtocolDCCP:
+		offsets.L4Checksum = offsets.L4Start + 6
+	case ProtocolICMP, ProtocolICMPv6:
+		offsets.L4Checksum = offsets.L4Start + 2
+	}
+	return offsets
+}
+
+// TranslateOutboundInto is HandleOutboundPacket writing the translated
+// packet into dst and leaving src untouched, for packets in read-only
+// buffers. It returns the length of the translated packet, or an error if
+// dst is too small to hold it. The whole packet is copied for now, even
+// though translation only changes its headers.
+func (t *Table[IP]) TranslateOutboundInto(dst, src []byte, namespace uintptr) (int, error) {
+	if len(dst) < len(src) {
+		return 0, io.ErrShortBuffer
+	}
+	n := copy(dst, src)
+	if err := t.HandleOutboundPacket(dst[:n], namespace); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// HandleOutboundPacketOffsets is HandleOutboundPacket also returning where
+// the checksums of the translated packet are
+func (t *Table[IP]) HandleOutboundPacketOffsets(packet []byte, namespace uintptr) (ChecksumOffsets, error) {
+	if err := t.HandleOutboundPacket(packet, namespace); err != nil {
+		return ChecksumOffsets{}, err
+	}
+	return checksumOffsets(packet), nil
+}
+
+// HandleInboundPacketOffsets is HandleInboundPacket also returning where the
+// checksums of the translated packet are
+func (t *Table[IP]) HandleInboundPacketOffsets(packet []byte) (uintptr, ChecksumOffsets, error) {
+	namespace, err := t.HandleInboundPacket(packet)
+	if err != nil {
+		return namespace, ChecksumOffsets{}, err
+	}
+	return namespace, checksumOffsets(packet), nil
+}
+
+// HandleOutboundPacketParsed translates an outbound packet whose IP header
+// the caller already parsed with ParseIPv4Header, saving a second parse. The
+// header must describe packet as it is; only its lengths are checked. It is
+// updated along with the packet.
+func (t *Table[IP]) HandleOutboundPacketParsed(packet []byte, ipHeader *IPv4Header, namespace uintptr) error {
+	if ipHeader == nil || ipHeader.Version != 4 || ipHeader.IHL < 5 || int(ipHeader.IHL)*4 > len(packet) ||
+		int(ipHeader.TotalLength) < int(ipHeader.IHL)*4 || int(ipHeader.TotalLength) > len(packet) {
+		err := errors.New("invalid parsed IPv4 header")
+		if counters := t.nsCounters(namespace); counters != nil {
+			counters.drops.Add(1)
+		}
+		t.drops.add(true, err)
+		return err
+	}
+	return t.handleOutboundPacket(packet, ipHeader, namespace, nil)
+}
+
+// handleOutboundPacket translates an outbound packet and updates the
+// counters. ipHeader is parsed from packet when nil.
+func (t *Table[IP]) handleOutboundPacket(packet []byte, ipHeader *IPv4Header, namespace uintptr, res *OutboundResult[IP]) error {
 	now := t.Now()
+	if t.TraceWriter != nil {
+		t.trace(traceOutbound, packet, namespace, now)
+	}
+
+	var before []byte
+	if t.RecordModifications {
+		before = append(before, packet...)
+	}
+
+	err := t.handleOutbound(packet, ipHeader, namespace, now, res)
+	if before != nil && err == nil {
+		t.recordModification(before, packet, true, namespace)
+	}
+	if err != nil {
+		if counters := t.nsCounters(namespace); counters != nil {
+			counters.drops.Add(1)
+		}
+		t.drops.add(true, err)
+	} else {
+		t.translated.Add(1)
+		counters := t.activeNSCounters(namespace)
+		counters.packetsOut.Add(1)
+		counters.bytesOut.Add(uint64(len(packet)))
+	}
+	return err
+}
+
+func (t *Table[IP]) handleOutbound(packet []byte, ipHeader *IPv4Header, namespace uintptr, now int64, res *OutboundResult[IP]) error {
+	if err := t.checkFamily(packet); err != nil {
+		return err
+	}
+	if ipHeader == nil && isIPv6Packet(packet) {
+		return t.handleOutbound6(packet, namespace, now, res)
+	}
+	if ipHeader == nil {
+		var err error
+		ipHeader, err = ParseIPv4Header(packet)
+		if err != nil {
+			return fmt.Errorf("failed to parse IP header: %w", err)
+		}
+	}
+
+	if t.translatedHairpin(namespace, any(ipHeader.SourceIP).(IP), any(ipHeader.DestinationIP).(IP)) {
+		return ErrLoopDetected
+	}
+
+	if t.StrictInternalSource && !t.sourceAllowed(namespace, any(ipHeader.SourceIP).(IP)) {
+		return ErrSpoofedSource
+	}
+
+	if t.ZeroIDForDF && ipHeader.IsAtomic() {
+		// written along with the translated addresses
+		ipHeader.Identification = 0
+	}
+
+	headerLen := int(ipHeader.IHL) * 4
 
 	switch ipHeader.Protocol {
 	case ProtocolTCP:
-		return t.handleOutboundTCP(packet, ipHeader, headerLen, namespace, now)
+		return t.handleOutboundTCP(packet, ipHeader, headerLen, namespace, now, res)
 	case ProtocolUDP:
-		return t.handleOutboundUDP(packet, ipHeader, headerLen, namespace, now)
+		return t.handleOutboundUDP(packet, ipHeader, headerLen, namespace, now, res)
 	case ProtocolICMP:
-		return t.handleOutboundICMP(packet, ipHeader, headerLen, namespace, now)
+		return t.handleOutboundICMP(packet, ipHeader, headerLen, namespace, now, res)
+	case ProtocolDCCP:
+		return t.handleOutboundDCCP(packet, ipHeader, headerLen, namespace, now, res)
+	case ProtocolESP:
+		return t.handleOutboundESP(packet, ipHeader, headerLen, namespace, now, res)
 	default:
-		// Unsupported protocol, drop the packet
+		// Unsupported protocol, dropped unless passed through
+		return t.handleOutboundOther(packet, ipHeader, namespace, now, res)
+	}
+}
+
+// HandleOutboundPacketAuto translates the IP packet starting at offset in
+// buf, with the namespace returned by NamespaceResolver for the whole buffer,
+// so encapsulation headers in front of the packet (a VLAN tag, a tunnel
+// header) can select it. Packets the resolver rejects are dropped.
+func (t *Table[IP]) HandleOutboundPacketAuto(buf []byte, offset int) error {
+	if t.NamespaceResolver == nil {
+		return errors.New("no namespace resolver set")
+	}
+	if offset < 0 || offset > len(buf) {
+		return fmt.Errorf("invalid packet offset %d", offset)
+	}
+	namespace, ok := t.NamespaceResolver(buf)
+	if !ok {
 		return ErrDropPacket
 	}
+	return t.HandleOutboundPacket(buf[offset:], namespace)
 }
 
-func (t *Table[IP]) handleOutboundTCP(packet []byte, ipHeader *IPv4Header, ipHeaderLen int, namespace uintptr, now int64) error {
+func (t *Table[IP]) handleOutboundTCP(packet []byte, ipHeader *IPv4Header, ipHeaderLen int, namespace uintptr, now int64, res *OutboundResult[IP]) error {
 	tcpHeader, err := ParseTCPHeader(packet, ipHeaderLen)
 	if err != nil {
 		return fmt.Errorf("failed to parse TCP header: %w", err)
@@ -126,38 +885,85 @@ func (t *Table[IP]) handleOutboundTCP(packet []byte, ipHeader *IPv4Header, ipHea
 	}
 
 	// Check if connection already exists
-	conn := t.TCP.lookupOutbound(internalKey)
+	conn := t.unlessSwept(&t.TCP, t.TCP.lookupOutbound(internalKey))
+	if conn != nil && (conn.PendingSweep || conn.State == TCPStateTimeWait) && tcpHeader.Flags&(TCPFlagSYN|TCPFlagACK) == TCPFlagSYN {
+		// A new SYN on a closed connection reopens the flow, don't keep
+		// using a mapping that is about to be swept
+		t.TCP.removeConnection(conn)
+		conn = nil
+	}
+	created := conn == nil
 	if conn == nil {
+		// Only a SYN opens a new flow, unless mid-stream flows are adopted
+		if tcpHeader.Flags&TCPFlagSYN == 0 && !t.AdoptExistingFlows {
+			return ErrDropPacket
+		}
+
 		// Check redirect rules
 		targetDstIP := any(ipHeader.DestinationIP).(IP)
 		targetDstPort := tcpHeader.DestinationPort
-		redirectDstIP, redirectDstPort, shouldRedirect := t.TCP.checkRedirectRule(targetDstIP, targetDstPort)
+		rule, shouldRedirect := t.TCP.checkRedirectRule(targetDstIP, targetDstPort)
 
 		if shouldRedirect {
-			targetDstIP = redirectDstIP
-			targetDstPort = redirectDstPort
+			targetDstIP = rule.NewDstIP
+			targetDstPort = rule.NewDstPort
+		}
+
+		if isLoop(internalKey.SrcIP, internalKey.SrcPort, targetDstIP, targetDstPort) {
+			return ErrLoopDetected
+		}
+
+		if t.MaxHalfOpenPerNamespace > 0 && tcpHeader.Flags&(TCPFlagSYN|TCPFlagACK) == TCPFlagSYN &&
+			t.TCP.countHalfOpen(namespace) >= t.MaxHalfOpenPerNamespace {
+			return ErrSynFlood
 		}
 
-		// Create new connection
-		outsidePort := t.allocatePort()
-		conn = &Conn[IP]{
+		// Create new connection, keeping the original source for pure DNAT
+		outsideIP, outsidePort := internalKey.SrcIP, internalKey.SrcPort
+		if !rule.PreserveSource {
+			if err := t.checkPortWatermark(&t.TCP, namespace); err != nil {
+				return err
+			}
+			if err := t.checkSourcePorts(&t.TCP, internalKey.SrcIP); err != nil {
+				return err
+			}
+			outsideIP, outsidePort, err = t.allocateOutside(&t.TCP, ProtocolTCP, internalKey, targetDstIP, targetDstPort)
+			if err != nil {
+				return err
+			}
+		}
+		conn = t.newConn(&t.TCP, Conn[IP]{
 			LastSeen:           now,
+			CreatedAt:          now,
+			LastOutbound:       now,
+			PacketsOut:         1,
+			BytesOut:           uint64(len(packet)),
+			DSCP:               ipHeader.DSCP(),
 			Protocol:           ProtocolTCP,
 			Namespace:          namespace,
 			LocalSrcIP:         any(ipHeader.SourceIP).(IP),
 			LocalSrcPort:       tcpHeader.SourcePort,
 			LocalDstIp:         any(ipHeader.DestinationIP).(IP),
 			LocalDstPort:       tcpHeader.DestinationPort,
-			OutsideSrcIP:       t.externalIP,
+			OutsideSrcIP:       outsideIP,
 			OutsideSrcPort:     outsidePort,
 			OutsideDstIP:       targetDstIP,
 			OutsideDstPort:     targetDstPort,
 			RewriteDestination: shouldRedirect,
+			PreserveSource:     rule.PreserveSource,
+			InboundInitiated:   rule.PreserveSource,
+			allocator:          t.portAllocator(),
+		})
+		if err := t.admitConn(&t.TCP, conn); err != nil {
+			return err
+		}
+		if err := t.addConn(&t.TCP, conn); err != nil {
+			return err
 		}
-		t.TCP.addConnection(conn, t.MaxConnPerNamespace)
 	} else {
-		conn.LastSeen = now
+		t.TCP.updateLastOutbound(conn, now, ipHeader.DSCP(), len(packet))
 	}
+	t.capturePayload(&t.TCP, conn, packet, ipHeaderLen+int(tcpHeader.DataOffset)*4, int(ipHeader.TotalLength))
 
 	// Rewrite packet
 	ipHeader.SourceIP = any(conn.OutsideSrcIP).(IPv4)
@@ -169,6 +975,8 @@ func (t *Table[IP]) handleOutboundTCP(packet []byte, ipHeader *IPv4Header, ipHea
 		tcpHeader.DestinationPort = conn.OutsideDstPort
 	}
 
+	t.TCP.fixSequence(conn, tcpHeader, true)
+
 	// Update headers in packet
 	ipHeader.Marshal(packet)
 	tcpHeader.Marshal(packet, ipHeaderLen)
@@ -176,23 +984,94 @@ func (t *Table[IP]) handleOutboundTCP(packet []byte, ipHeader *IPv4Header, ipHea
 	// Recalculate TCP checksum
 	tcpData := packet[ipHeaderLen:]
 	binary.BigEndian.PutUint16(tcpData[16:18], 0) // Clear checksum
-	checksum := calculateTCPChecksum(ipHeader.SourceIP, ipHeader.DestinationIP, tcpData)
-	binary.BigEndian.PutUint16(tcpData[16:18], checksum)
+	if !t.SkipChecksums {
+		checksum := calculateTCPChecksum(ipHeader.SourceIP, ipHeader.DestinationIP, tcpData)
+		binary.BigEndian.PutUint16(tcpData[16:18], checksum)
+	}
 
 	// Check if this is a connection termination (FIN or RST)
-	if tcpHeader.Flags&(TCPFlagFIN|TCPFlagRST) != 0 {
-		// Mark connection for immediate removal on next cleanup
-		conn.PendingSweep = true
-	}
+	t.trackTCPState(conn, tcpHeader.Flags, finOutbound, created)
 
+	res.set(conn, created)
 	return nil
 }
 
-func (t *Table[IP]) handleOutboundUDP(packet []byte, ipHeader *IPv4Header, ipHeaderLen int, namespace uintptr, now int64) error {
+// capturePayload appends packet[start:end], the payload of an outbound
+// packet of conn, to its captured bytes until CapturePayloadBytes are held.
+// The buffer is filled under the lock of p, the pair of conn, as ConnInfo
+// copies it from other goroutines.
+func (t *Table[IP]) capturePayload(p *Pair[IP], conn *Conn[IP], packet []byte, start, end int) {
+	if t.CapturePayloadBytes <= 0 || start >= end {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	room := t.CapturePayloadBytes - len(conn.Payload)
+	end = min(end, len(packet), start+room)
+	if room <= 0 || start >= end {
+		return
+	}
+	if conn.Payload == nil {
+		conn.Payload = make([]byte, 0, t.CapturePayloadBytes)
+	}
+	conn.Payload = append(conn.Payload, packet[start:end]...)
+}
+
+// trackTCPState updates the state of conn for a segment with flags sent in
+// direction dir (finOutbound or finInbound), created tells whether the
+// segment opened the connection. A connection opened by a SYN is SYN_SENT
+// until a segment comes back. A RST, or a FIN with no timeout configured
+// for the state it leads to, marks the connection for removal at the next
+// maintenance.
+func (t *Table[IP]) trackTCPState(conn *Conn[IP], flags uint8, dir uint8, created bool) {
+	if flags&TCPFlagRST != 0 {
+		t.TCP.setTCPState(conn, TCPStateClosed, conn.synDir)
+		t.TCP.markForSweep(conn)
+		return
+	}
+	state, synDir := conn.State, conn.synDir
+	switch {
+	case created && flags&(TCPFlagSYN|TCPFlagACK) == TCPFlagSYN:
+		state, synDir = TCPStateSynSent, dir
+	case state == TCPStateSynSent && dir != synDir:
+		state = TCPStateEstablished
+	}
+	if flags&TCPFlagFIN != 0 {
+		conn.finSeen |= dir
+		state = TCPStateClosing
+		if conn.finSeen == finOutbound|finInbound {
+			state = TCPStateTimeWait
+		}
+	}
+	t.TCP.setTCPState(conn, state, synDir)
+	if flags&TCPFlagFIN != 0 && t.tcpTimeouts().forState(state, 0) <= 0 {
+		t.TCP.markForSweep(conn)
+	}
+}
+
+// tcpTimeouts returns the TCP timeouts by state currently configured
+func (t *Table[IP]) tcpTimeouts() *stateTimeouts {
+	established := t.TCPEstablishedTimeout
+	if established <= 0 {
+		established = t.TCPTimeout
+	}
+	synSent := t.TCPSynTimeout
+	if synSent <= 0 {
+		synSent = established
+	}
+	return &stateTimeouts{synSent, established, t.TCPClosingTimeout, t.TCPTimeWaitTimeout}
+}
+
+func (t *Table[IP]) handleOutboundUDP(packet []byte, ipHeader *IPv4Header, ipHeaderLen int, namespace uintptr, now int64, res *OutboundResult[IP]) error {
 	udpHeader, err := ParseUDPHeader(packet, ipHeaderLen)
 	if err != nil {
 		return fmt.Errorf("failed to parse UDP header: %w", err)
 	}
+	udpData, err := udpHeader.datagram(packet, ipHeaderLen)
+	if err != nil {
+		return err
+	}
 
 	// Check drop rules
 	if t.UDP.checkDropRule(udpHeader.DestinationPort) {
@@ -208,40 +1087,82 @@ func (t *Table[IP]) handleOutboundUDP(packet []byte, ipHeader *IPv4Header, ipHea
 		Namespace: namespace,
 	}
 
+	quic := t.EnableQUICALG && udpHeader.DestinationPort == t.QUICPort
+	payload := udpData[8:]
+
 	// Check if connection already exists
 	conn := t.UDP.lookupOutbound(internalKey)
+	if conn == nil && quic {
+		// The client may have moved to a new address, keep its mapping
+		conn = t.UDP.migrateQUIC(internalKey, payload)
+	}
+	created := conn == nil
 	if conn == nil {
 		// Check redirect rules
 		targetDstIP := any(ipHeader.DestinationIP).(IP)
 		targetDstPort := udpHeader.DestinationPort
-		redirectDstIP, redirectDstPort, shouldRedirect := t.UDP.checkRedirectRule(targetDstIP, targetDstPort)
+		rule, shouldRedirect := t.UDP.checkRedirectRule(targetDstIP, targetDstPort)
 
 		if shouldRedirect {
-			targetDstIP = redirectDstIP
-			targetDstPort = redirectDstPort
+			targetDstIP = rule.NewDstIP
+			targetDstPort = rule.NewDstPort
+		}
+
+		if isLoop(internalKey.SrcIP, internalKey.SrcPort, targetDstIP, targetDstPort) {
+			return ErrLoopDetected
 		}
 
-		// Create new connection
-		outsidePort := t.allocatePort()
-		conn = &Conn[IP]{
+		// Create new connection, keeping the original source for pure DNAT
+		outsideIP, outsidePort := internalKey.SrcIP, internalKey.SrcPort
+		if !rule.PreserveSource {
+			if err := t.checkPortWatermark(&t.UDP, namespace); err != nil {
+				return err
+			}
+			if err := t.checkSourcePorts(&t.UDP, internalKey.SrcIP); err != nil {
+				return err
+			}
+			outsideIP, outsidePort, err = t.allocateOutside(&t.UDP, ProtocolUDP, internalKey, targetDstIP, targetDstPort)
+			if err != nil {
+				return err
+			}
+		}
+		conn = t.newConn(&t.UDP, Conn[IP]{
 			LastSeen:           now,
+			CreatedAt:          now,
+			LastOutbound:       now,
+			PacketsOut:         1,
+			BytesOut:           uint64(len(packet)),
+			DSCP:               ipHeader.DSCP(),
 			Protocol:           ProtocolUDP,
 			Namespace:          namespace,
 			LocalSrcIP:         any(ipHeader.SourceIP).(IP),
 			LocalSrcPort:       udpHeader.SourcePort,
 			LocalDstIp:         any(ipHeader.DestinationIP).(IP),
 			LocalDstPort:       udpHeader.DestinationPort,
-			OutsideSrcIP:       t.externalIP,
+			OutsideSrcIP:       outsideIP,
 			OutsideSrcPort:     outsidePort,
 			OutsideDstIP:       targetDstIP,
 			OutsideDstPort:     targetDstPort,
 			RewriteDestination: shouldRedirect,
+			PreserveSource:     rule.PreserveSource,
+			InboundInitiated:   rule.PreserveSource,
+			allocator:          t.portAllocator(),
+		})
+		if err := t.admitConn(&t.UDP, conn); err != nil {
+			return err
+		}
+		if err := t.addConn(&t.UDP, conn); err != nil {
+			return err
 		}
-		t.UDP.addConnection(conn, t.MaxConnPerNamespace)
 	} else {
-		conn.LastSeen = now
+		t.UDP.updateLastOutbound(conn, now, ipHeader.DSCP(), len(packet))
 	}
 
+	if quic {
+		t.UDP.learnQUIC(conn, payload)
+	}
+	t.capturePayload(&t.UDP, conn, payload, 0, len(payload))
+
 	// Rewrite packet
 	ipHeader.SourceIP = any(conn.OutsideSrcIP).(IPv4)
 	udpHeader.SourcePort = conn.OutsideSrcPort
@@ -257,24 +1178,29 @@ func (t *Table[IP]) handleOutboundUDP(packet []byte, ipHeader *IPv4Header, ipHea
 	udpHeader.Marshal(packet, ipHeaderLen)
 
 	// Recalculate UDP checksum
-	udpData := packet[ipHeaderLen:]
 	binary.BigEndian.PutUint16(udpData[6:8], 0) // Clear checksum
-	checksum := calculateUDPChecksum(ipHeader.SourceIP, ipHeader.DestinationIP, udpData)
-	binary.BigEndian.PutUint16(udpData[6:8], checksum)
+	if !t.SkipChecksums {
+		checksum := calculateUDPChecksum(ipHeader.SourceIP, ipHeader.DestinationIP, udpData)
+		binary.BigEndian.PutUint16(udpData[6:8], checksum)
+	}
 
+	res.set(conn, created)
 	return nil
 }
 
-func (t *Table[IP]) handleOutboundICMP(packet []byte, ipHeader *IPv4Header, ipHeaderLen int, namespace uintptr, now int64) error {
-	if len(packet) < ipHeaderLen+8 {
+func (t *Table[IP]) handleOutboundICMP(packet []byte, ipHeader *IPv4Header, ipHeaderLen int, namespace uintptr, now int64, res *OutboundResult[IP]) error {
+	if int(ipHeader.TotalLength) < ipHeaderLen+8 {
 		return fmt.Errorf("ICMP packet too small")
 	}
 
 	icmpType := packet[ipHeaderLen]
 
-	// We only handle echo request/reply for now
+	if isICMPError(icmpType) {
+		return t.handleOutboundICMPError(packet, ipHeader, ipHeaderLen, namespace, res)
+	}
+
+	// Other ICMP types than echo request/reply pass through without NAT
 	if icmpType != ICMPTypeEchoRequest && icmpType != ICMPTypeEchoReply {
-		// For other ICMP types, pass through without NAT
 		return nil
 	}
 
@@ -294,34 +1220,60 @@ func (t *Table[IP]) handleOutboundICMP(packet []byte, ipHeader *IPv4Header, ipHe
 
 	// Check if connection already exists
 	conn := t.ICMP.lookupOutbound(internalKey)
+	created := conn == nil
 	if conn == nil {
 		// Check redirect rules for ICMP (using port 0)
 		targetDstIP := any(ipHeader.DestinationIP).(IP)
-		redirectDstIP, _, shouldRedirect := t.ICMP.checkRedirectRule(targetDstIP, 0)
+		rule, shouldRedirect := t.ICMP.checkRedirectRule(targetDstIP, 0)
 
 		if shouldRedirect {
-			targetDstIP = redirectDstIP
+			targetDstIP = rule.NewDstIP
+		}
+
+		if isLoop(internalKey.SrcIP, 0, targetDstIP, 0) {
+			return ErrLoopDetected
+		}
+
+		if limit := t.MaxICMPToDestination; limit > 0 && t.ICMP.countToDestination(namespace, internalKey.DstIP) >= limit {
+			return ErrICMPFlood
 		}
 
-		// Create new connection with new ID
-		outsideID := t.allocatePort()
-		conn = &Conn[IP]{
+		// Create new connection with new ID, or the original one when it
+		// is to be preserved and still free
+		outsideID, ok := icmpHeader.ID, t.PreserveICMPID && t.ICMP.ports.take(icmpHeader.ID)
+		if !ok {
+			outsideID, ok = t.ICMP.ports.allocate()
+		}
+		if !ok {
+			return ErrPortExhausted
+		}
+		conn = t.newConn(&t.ICMP, Conn[IP]{
 			LastSeen:           now,
+			CreatedAt:          now,
+			LastOutbound:       now,
+			PacketsOut:         1,
+			BytesOut:           uint64(len(packet)),
+			DSCP:               ipHeader.DSCP(),
 			Protocol:           ProtocolICMP,
 			Namespace:          namespace,
 			LocalSrcIP:         any(ipHeader.SourceIP).(IP),
 			LocalSrcPort:       icmpHeader.ID,
 			LocalDstIp:         any(ipHeader.DestinationIP).(IP),
 			LocalDstPort:       0,
-			OutsideSrcIP:       t.externalIP,
+			OutsideSrcIP:       t.pickExternalIP(ProtocolICMP),
 			OutsideSrcPort:     outsideID,
 			OutsideDstIP:       targetDstIP,
 			OutsideDstPort:     0,
 			RewriteDestination: shouldRedirect,
+		})
+		if err := t.admitConn(&t.ICMP, conn); err != nil {
+			return err
+		}
+		if err := t.addConn(&t.ICMP, conn); err != nil {
+			return err
 		}
-		t.ICMP.addConnection(conn, t.MaxConnPerNamespace)
 	} else {
-		conn.LastSeen = now
+		t.ICMP.updateLastOutbound(conn, now, ipHeader.DSCP(), len(packet))
 	}
 
 	// Rewrite packet
@@ -337,24 +1289,61 @@ func (t *Table[IP]) handleOutboundICMP(packet []byte, ipHeader *IPv4Header, ipHe
 	ipHeader.Marshal(packet)
 	icmpHeader.Marshal(packet, ipHeaderLen)
 
-	// Recalculate ICMP checksum
-	icmpData := packet[ipHeaderLen:]
+	// Recalculate ICMP checksum over the datagram, not what may follow it
+	// in the buffer
+	icmpData := packet[ipHeaderLen:ipHeader.TotalLength]
 	binary.BigEndian.PutUint16(icmpData[2:4], 0) // Clear checksum
 	checksum := calculateICMPChecksum(icmpData)
 	binary.BigEndian.PutUint16(icmpData[2:4], checksum)
 
+	res.set(conn, created)
 	return nil
 }
 
 func (t *Table[IP]) HandleInboundPacket(packet []byte) (uintptr, error) {
-	// For now, assume IPv4
+	now := t.Now()
+	if t.TraceWriter != nil {
+		t.trace(traceInbound, packet, 0, now)
+	}
+
+	var before []byte
+	if t.RecordModifications {
+		before = append(before, packet...)
+	}
+
+	namespace, err := t.handleInbound(packet, now)
+	if before != nil && err == nil {
+		t.recordModification(before, packet, false, namespace)
+	}
+	if err != nil {
+		t.drops.add(false, err)
+	} else {
+		t.translated.Add(1)
+		counters := t.activeNSCounters(namespace)
+		counters.packetsIn.Add(1)
+		counters.bytesIn.Add(uint64(len(packet)))
+	}
+	return namespace, err
+}
+
+func (t *Table[IP]) handleInbound(packet []byte, now int64) (uintptr, error) {
+	if err := t.checkFamily(packet); err != nil {
+		return 0, err
+	}
+	if isIPv6Packet(packet) {
+		return t.handleInbound6(packet, now)
+	}
+
 	ipHeader, err := ParseIPv4Header(packet)
 	if err != nil {
 		return 0, fmt.Errorf("failed to parse IP header: %w", err)
 	}
 
+	if t.DropMartians && t.isMartian(any(ipHeader.SourceIP).(IP)) {
+		return 0, ErrDropPacket
+	}
+
 	headerLen := int(ipHeader.IHL) * 4
-	now := t.Now()
 
 	switch ipHeader.Protocol {
 	case ProtocolTCP:
@@ -363,9 +1352,13 @@ func (t *Table[IP]) HandleInboundPacket(packet []byte) (uintptr, error) {
 		return t.handleInboundUDP(packet, ipHeader, headerLen, now)
 	case ProtocolICMP:
 		return t.handleInboundICMP(packet, ipHeader, headerLen, now)
+	case ProtocolDCCP:
+		return t.handleInboundDCCP(packet, ipHeader, headerLen, now)
+	case ProtocolESP:
+		return t.handleInboundESP(packet, ipHeader, headerLen, now)
 	default:
-		// Unsupported protocol, drop the packet
-		return 0, ErrDropPacket
+		// Unsupported protocol, dropped unless passed through
+		return t.handleInboundOther(packet, ipHeader, now)
 	}
 }
 
@@ -382,16 +1375,29 @@ func (t *Table[IP]) handleInboundTCP(packet []byte, ipHeader *IPv4Header, ipHead
 		SrcPort: tcpHeader.SourcePort,
 		DstPort: tcpHeader.DestinationPort,
 	}
+	externalKey.DstIP = t.inboundDst(&t.TCP, externalKey)
 
-	// Look up connection
-	conn := t.TCP.lookupInbound(externalKey)
+	// Look up connection, then port forwards for new flows
+	conn, err := t.lookupInbound(&t.TCP, externalKey)
+	if err != nil {
+		return 0, err
+	}
+	if conn == nil {
+		conn = t.lookupReplyFrom(&t.TCP, externalKey)
+	}
+	created := false
+	if conn == nil && (tcpHeader.Flags&TCPFlagSYN != 0 || t.AdoptExistingFlows) {
+		conn = t.forwardInbound(&t.TCP, ProtocolTCP, externalKey, ipHeader.DSCP(), now)
+		created = conn != nil
+	}
 	if conn == nil {
 		// No matching connection, drop packet
+		t.countNoMatch(tcpHeader.DestinationPort)
 		return 0, ErrDropPacket
 	}
 
 	// Update last seen
-	t.TCP.updateLastSeen(conn, now)
+	t.TCP.updateLastInbound(conn, now, len(packet))
 
 	// Rewrite packet to restore original addresses
 	ipHeader.DestinationIP = any(conn.LocalSrcIP).(IPv4)
@@ -403,6 +1409,8 @@ func (t *Table[IP]) handleInboundTCP(packet []byte, ipHeader *IPv4Header, ipHead
 		tcpHeader.SourcePort = conn.LocalDstPort
 	}
 
+	t.TCP.fixSequence(conn, tcpHeader, false)
+
 	// Update headers in packet
 	ipHeader.Marshal(packet)
 	tcpHeader.Marshal(packet, ipHeaderLen)
@@ -410,14 +1418,13 @@ func (t *Table[IP]) handleInboundTCP(packet []byte, ipHeader *IPv4Header, ipHead
 	// Recalculate TCP checksum
 	tcpData := packet[ipHeaderLen:]
 	binary.BigEndian.PutUint16(tcpData[16:18], 0) // Clear checksum
-	checksum := calculateTCPChecksum(ipHeader.SourceIP, ipHeader.DestinationIP, tcpData)
-	binary.BigEndian.PutUint16(tcpData[16:18], checksum)
+	if !t.SkipChecksums {
+		checksum := calculateTCPChecksum(ipHeader.SourceIP, ipHeader.DestinationIP, tcpData)
+		binary.BigEndian.PutUint16(tcpData[16:18], checksum)
+	}
 
 	// Check if this is a connection termination (FIN or RST)
-	if tcpHeader.Flags&(TCPFlagFIN|TCPFlagRST) != 0 {
-		// Mark connection for immediate removal on next cleanup
-		conn.PendingSweep = true
-	}
+	t.trackTCPState(conn, tcpHeader.Flags, finInbound, created)
 
 	return conn.Namespace, nil
 }
@@ -427,6 +1434,10 @@ func (t *Table[IP]) handleInboundUDP(packet []byte, ipHeader *IPv4Header, ipHead
 	if err != nil {
 		return 0, fmt.Errorf("failed to parse UDP header: %w", err)
 	}
+	udpData, err := udpHeader.datagram(packet, ipHeaderLen)
+	if err != nil {
+		return 0, err
+	}
 
 	// Create external key for lookup
 	externalKey := ExternalKey[IP]{
@@ -435,23 +1446,44 @@ func (t *Table[IP]) handleInboundUDP(packet []byte, ipHeader *IPv4Header, ipHead
 		SrcPort: udpHeader.SourcePort,
 		DstPort: udpHeader.DestinationPort,
 	}
+	externalKey.DstIP = t.inboundDst(&t.UDP, externalKey)
 
-	// Look up connection
-	conn := t.UDP.lookupInbound(externalKey)
+	// Look up connection, then port forwards for new flows
+	conn, err := t.lookupInbound(&t.UDP, externalKey)
+	if err != nil {
+		return 0, err
+	}
+	if conn == nil {
+		conn = t.lookupReplyFrom(&t.UDP, externalKey)
+	}
+	if conn == nil {
+		conn = t.forwardInbound(&t.UDP, ProtocolUDP, externalKey, ipHeader.DSCP(), now)
+	}
 	if conn == nil {
 		// No matching connection, drop packet
+		t.countNoMatch(udpHeader.DestinationPort)
 		return 0, ErrDropPacket
 	}
 
 	// Update last seen
-	t.UDP.updateLastSeen(conn, now)
+	t.UDP.updateLastInbound(conn, now, len(packet))
 
 	// Rewrite packet to restore original addresses
 	ipHeader.DestinationIP = any(conn.LocalSrcIP).(IPv4)
 	udpHeader.DestinationPort = conn.LocalSrcPort
 
-	// If this was a redirected connection, restore source to what client expects
-	if conn.RewriteDestination {
+	// A relayed DHCP client without an address yet can only be reached by
+	// broadcast
+	relayed := conn.RewriteDestination && (isMulticast(conn.LocalDstIp) || isBroadcast(conn.LocalDstIp))
+	var zero IP
+	if relayed && conn.LocalSrcIP == zero && conn.LocalSrcPort == dhcpClientPort {
+		ipHeader.DestinationIP = ipv4Broadcast
+	}
+
+	// If this was a redirected connection, restore source to what client
+	// expects. Relayed multicast and broadcast keep the unicast source, as
+	// neither address can be one.
+	if conn.RewriteDestination && !relayed {
 		ipHeader.SourceIP = any(conn.LocalDstIp).(IPv4)
 		udpHeader.SourcePort = conn.LocalDstPort
 	}
@@ -461,16 +1493,17 @@ func (t *Table[IP]) handleInboundUDP(packet []byte, ipHeader *IPv4Header, ipHead
 	udpHeader.Marshal(packet, ipHeaderLen)
 
 	// Recalculate UDP checksum
-	udpData := packet[ipHeaderLen:]
 	binary.BigEndian.PutUint16(udpData[6:8], 0) // Clear checksum
-	checksum := calculateUDPChecksum(ipHeader.SourceIP, ipHeader.DestinationIP, udpData)
-	binary.BigEndian.PutUint16(udpData[6:8], checksum)
+	if !t.SkipChecksums {
+		checksum := calculateUDPChecksum(ipHeader.SourceIP, ipHeader.DestinationIP, udpData)
+		binary.BigEndian.PutUint16(udpData[6:8], checksum)
+	}
 
 	return conn.Namespace, nil
 }
 
 func (t *Table[IP]) handleInboundICMP(packet []byte, ipHeader *IPv4Header, ipHeaderLen int, now int64) (uintptr, error) {
-	if len(packet) < ipHeaderLen+8 {
+	if int(ipHeader.TotalLength) < ipHeaderLen+8 {
 		return 0, fmt.Errorf("ICMP packet too small")
 	}
 
@@ -491,16 +1524,26 @@ func (t *Table[IP]) handleInboundICMP(packet []byte, ipHeader *IPv4Header, ipHea
 			SrcPort: 0,
 			DstPort: icmpHeader.ID,
 		}
+		externalKey.DstIP = t.inboundDst(&t.ICMP, externalKey)
 
 		// Look up connection
-		conn := t.ICMP.lookupInbound(externalKey)
+		conn, err := t.lookupInbound(&t.ICMP, externalKey)
+		if err != nil {
+			return 0, err
+		}
 		if conn == nil {
 			// No matching connection, drop packet
 			return 0, ErrDropPacket
 		}
 
+		// Only the host the request was sent to may answer it, so a reply
+		// from another server to a colliding ID is never misrouted
+		if externalKey.SrcIP != conn.OutsideDstIP {
+			return 0, ErrDropPacket
+		}
+
 		// Update last seen
-		t.ICMP.updateLastSeen(conn, now)
+		t.ICMP.updateLastInbound(conn, now, len(packet))
 
 		// Rewrite packet to restore original addresses and ID
 		ipHeader.DestinationIP = any(conn.LocalSrcIP).(IPv4)
@@ -515,19 +1558,18 @@ func (t *Table[IP]) handleInboundICMP(packet []byte, ipHeader *IPv4Header, ipHea
 		ipHeader.Marshal(packet)
 		icmpHeader.Marshal(packet, ipHeaderLen)
 
-		// Recalculate ICMP checksum
-		icmpData := packet[ipHeaderLen:]
+		// Recalculate ICMP checksum over the datagram only
+		icmpData := packet[ipHeaderLen:ipHeader.TotalLength]
 		binary.BigEndian.PutUint16(icmpData[2:4], 0) // Clear checksum
 		checksum := calculateICMPChecksum(icmpData)
 		binary.BigEndian.PutUint16(icmpData[2:4], checksum)
 
 		return conn.Namespace, nil
 
-	case ICMPTypeDestinationUnreachable:
-		// ICMP error contains embedded packet that triggered the error
-		// We need to look at the embedded packet to find the original connection
-		// TODO: Implement ICMP error handling
-		return 0, ErrDropPacket
+	case ICMPTypeDestinationUnreachable, ICMPTypeTimeExceeded:
+		// ICMP errors quote the packet that triggered them, which leads
+		// to the original connection
+		return t.handleInboundICMPError(packet, ipHeader, ipHeaderLen)
 
 	default:
 		// Unsupported ICMP type
@@ -537,52 +1579,487 @@ func (t *Table[IP]) handleInboundICMP(packet []byte, ipHeader *IPv4Header, ipHea
 
 // RunMaintenance removes expired connections from the NAT table.
 // This should be called periodically to clean up stale connections.
-// Connections are considered expired based on configurable protocol-specific timeouts.
+// Connections are considered expired based on configurable protocol-specific timeouts,
+// shortened under pressure with AdaptiveTimeouts.
 func (t *Table[IP]) RunMaintenance(now int64) {
-	t.TCP.cleanupExpired(now, t.TCPTimeout)
-	t.UDP.cleanupExpired(now, t.UDPTimeout)
-	t.ICMP.cleanupExpired(now, t.ICMPTimeout)
+	pressure := t.timeoutPressure()
+	for _, m := range t.sweepTargets() {
+		m.p.cleanupExpired(now, t.adaptTimeout(m.timeout, pressure), t.MaxConnAge, t.adaptStates(m.states, pressure))
+	}
+}
+
+// RunMaintenanceCtx is RunMaintenance stopping early, with the error of ctx,
+// once ctx is done, so a shutdown isn't held up by the sweep of a huge
+// table. Connections found expired before that are still removed. It
+// returns the number of connections removed.
+func (t *Table[IP]) RunMaintenanceCtx(ctx context.Context, now int64) (reaped int, err error) {
+	pressure := t.timeoutPressure()
+	for _, m := range t.sweepTargets() {
+		if err := ctx.Err(); err != nil {
+			return reaped, err
+		}
+		n, err := m.p.cleanupExpiredCtx(ctx, now, t.adaptTimeout(m.timeout, pressure), t.MaxConnAge, t.adaptStates(m.states, pressure), nil)
+		reaped += n
+		if err != nil {
+			return reaped, err
+		}
+	}
+	return reaped, nil
+}
+
+// RunMaintenanceCollect is RunMaintenance returning snapshots of the
+// connections it removed, for controllers reacting to expirations, such as
+// billing systems
+func (t *Table[IP]) RunMaintenanceCollect(now int64) []ConnInfo[IP] {
+	var reaped []ConnInfo[IP]
+	pressure := t.timeoutPressure()
+	for _, m := range t.sweepTargets() {
+		m.p.cleanupExpiredCtx(context.Background(), now, t.adaptTimeout(m.timeout, pressure), t.MaxConnAge, t.adaptStates(m.states, pressure), &reaped)
+	}
+	return reaped
+}
+
+// sweepTarget is a pair with the timeouts maintenance applies to it
+type sweepTarget[IP comparable] struct {
+	p       *Pair[IP]
+	timeout int64
+	states  *stateTimeouts
+}
+
+// sweepTargets returns the pairs of the table with their timeouts
+func (t *Table[IP]) sweepTargets() []sweepTarget[IP] {
+	return []sweepTarget[IP]{
+		{&t.TCP, t.TCPTimeout, t.tcpTimeouts()},
+		{&t.UDP, t.UDPTimeout, nil},
+		{&t.ICMP, t.ICMPTimeout, nil},
+		{&t.DCCP, t.DCCPTimeout, nil},
+		{&t.ESP, t.ESPTimeout, nil},
+		{&t.Other, t.UnknownProtocolTimeout, nil},
+	}
+}
+
+// Compact rebuilds the connection maps to release the memory Go maps keep
+// after shrinking, e.g. once a traffic spike has been drained. It is O(n) in
+// the number of connections and locks each protocol while it runs, so it is
+// best called during low traffic.
+func (t *Table[IP]) Compact() {
+	for _, p := range t.pairs() {
+		p.compact()
+	}
+}
+
+// Reserve installs the mapping of a TCP, UDP or DCCP flow before its first
+// packet, for a control plane that negotiates flows in advance, and returns
+// its external port. The first packet of the flow then uses it as if it had
+// created it, and replies are accepted right away. Reserving a flow that
+// already has a mapping returns its port. Like for a new flow, redirect
+// rules apply and errors such as ErrPortsLow or ErrConnRefused are returned.
+func (t *Table[IP]) Reserve(protocol uint8, internalIP IP, internalPort uint16, remoteIP IP, remotePort uint16, namespace uintptr) (uint16, error) {
+	if protocol != ProtocolTCP && protocol != ProtocolUDP && protocol != ProtocolDCCP {
+		return 0, fmt.Errorf("unsupported protocol %d", protocol)
+	}
+	p := t.pair(protocol)
+
+	key := InternalKey[IP]{
+		SrcIP:     internalIP,
+		DstIP:     remoteIP,
+		SrcPort:   internalPort,
+		DstPort:   remotePort,
+		Namespace: namespace,
+	}
+	if conn := p.lookupOutbound(key); conn != nil {
+		return conn.OutsideSrcPort, nil
+	}
+
+	targetDstIP, targetDstPort := remoteIP, remotePort
+	rule, shouldRedirect := p.checkRedirectRule(targetDstIP, targetDstPort)
+	if shouldRedirect {
+		targetDstIP = rule.NewDstIP
+		targetDstPort = rule.NewDstPort
+	}
+	if isLoop(internalIP, internalPort, targetDstIP, targetDstPort) {
+		return 0, ErrLoopDetected
+	}
+
+	outsideIP, outsidePort := internalIP, internalPort
+	if !rule.PreserveSource {
+		if err := t.checkPortWatermark(p, namespace); err != nil {
+			return 0, err
+		}
+		if err := t.checkSourcePorts(p, internalIP); err != nil {
+			return 0, err
+		}
+		var err error
+		if protocol == ProtocolDCCP {
+			outsideIP, outsidePort, err = t.allocateExternal(p, protocol, key, targetDstIP, targetDstPort)
+		} else {
+			outsideIP, outsidePort, err = t.allocateOutside(p, protocol, key, targetDstIP, targetDstPort)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	now := t.Now()
+	conn := t.newConn(p, Conn[IP]{
+		LastSeen:           now,
+		CreatedAt:          now,
+		Protocol:           protocol,
+		Namespace:          namespace,
+		LocalSrcIP:         internalIP,
+		LocalSrcPort:       internalPort,
+		LocalDstIp:         remoteIP,
+		LocalDstPort:       remotePort,
+		OutsideSrcIP:       outsideIP,
+		OutsideSrcPort:     outsidePort,
+		OutsideDstIP:       targetDstIP,
+		OutsideDstPort:     targetDstPort,
+		RewriteDestination: shouldRedirect,
+		PreserveSource:     rule.PreserveSource,
+		InboundInitiated:   rule.PreserveSource,
+		allocator:          t.portAllocator(),
+	})
+	if err := t.admitConn(p, conn); err != nil {
+		return 0, err
+	}
+	if err := t.addConn(p, conn); err != nil {
+		return 0, err
+	}
+	return outsidePort, nil
+}
+
+// Repoint moves the live connection of protocol with the given internal key
+// to a new outside destination, e.g. to fail a redirected flow over to a
+// healthy backend without tearing it down. Outbound packets are then sent
+// to newDstIP:newDstPort and its replies are translated back as coming from
+// the destination the internal host uses. It returns false if there is no
+// such connection or another connection already receives replies from the
+// new destination on the same external port.
+func (t *Table[IP]) Repoint(protocol uint8, internalKey InternalKey[IP], newDstIP IP, newDstPort uint16) bool {
+	p := t.pair(protocol)
+	if p == nil {
+		return false
+	}
+	return p.repoint(internalKey, newDstIP, newDstPort)
+}
+
+// IsExternalPortFree reports whether port of externalIP, one of the NAT's
+// external addresses, is free for a new flow of protocol, e.g. before
+// calling Reserve. Ports held after release by PortReuseDelay or reserved
+// are not free. It allocates nothing, so the port may be taken by the time
+// it is used.
+func (t *Table[IP]) IsExternalPortFree(protocol uint8, externalIP IP, port uint16) bool {
+	p := t.pair(protocol)
+	if p == nil || !t.ownsIP(externalIP) {
+		return false
+	}
+	if used, ok := t.extPool.inUse(protocol, externalIP, port); ok {
+		return !used
+	}
+	return p.portFree(externalIP, port)
+}
+
+// LookupByExternalPort returns the connection using the given external port
+// for a protocol (the ICMP identifier for ICMP). If several connections to
+// different remote hosts share the port, any one of them is returned.
+func (t *Table[IP]) LookupByExternalPort(protocol uint8, port uint16) (ConnInfo[IP], bool) {
+	p := t.pair(protocol)
+	if p == nil {
+		return ConnInfo[IP]{}, false
+	}
+	return p.lookupByPort(port)
+}
+
+// Connections returns a copy of every connection of the table, across
+// protocols and namespaces
+func (t *Table[IP]) Connections() []ConnInfo[IP] {
+	var res []ConnInfo[IP]
+	for _, p := range t.pairs() {
+		res = append(res, p.snapshot()...)
+	}
+	return res
+}
+
+// ForEachConn calls fn with a copy of every connection of the table until
+// it returns false. Each protocol is copied under its read lock before fn
+// sees any of its connections, so fn may call back into the table.
+func (t *Table[IP]) ForEachConn(fn func(ConnInfo[IP]) bool) {
+	for _, p := range t.pairs() {
+		for _, c := range p.snapshot() {
+			if !fn(c) {
+				return
+			}
+		}
+	}
+}
+
+// ConnectionsForInternalIP returns every connection opened by the given
+// internal host, across protocols and namespaces
+func (t *Table[IP]) ConnectionsForInternalIP(ip IP) []ConnInfo[IP] {
+	var res []ConnInfo[IP]
+	for _, p := range t.pairs() {
+		res = append(res, p.connsForLocalIP(ip)...)
+	}
+	return res
+}
+
+// DeleteForInternalIP removes every connection opened by the given internal
+// host, e.g. to kick a device off the network, and returns how many were
+// removed
+func (t *Table[IP]) DeleteForInternalIP(ip IP) int {
+	n := 0
+	for _, p := range t.pairs() {
+		n += p.deleteForLocalIP(ip)
+	}
+	return n
+}
+
+// ExpireOlderThan removes the connections of protocol, or of every protocol
+// for ProtocolAny, last seen before cutoff whatever their timeout, for an
+// external controller aging out flows on its own schedule. It returns the
+// number of connections removed, which ReapStats counts as expired.
+func (t *Table[IP]) ExpireOlderThan(protocol uint8, cutoff int64) int {
+	now := t.Now()
+	n := 0
+	for _, p := range t.rulePairs(protocol) {
+		n += p.expireOlderThan(cutoff, now)
+	}
+	return n
+}
+
+// DrainExternalPort prepares the removal of an external port, e.g. to
+// migrate a service off it: the port is never assigned to a new connection
+// again, while the connections using it keep working until they expire or
+// DrainGracePeriod elapses. It returns the number of connections drained.
+func (t *Table[IP]) DrainExternalPort(protocol uint8, port uint16) int {
+	p := t.pair(protocol)
+	if p == nil {
+		return 0
+	}
+	if p.ports != nil {
+		p.ports.reserve(port)
+	}
+	var deadline int64
+	if t.DrainGracePeriod > 0 {
+		deadline = t.Now() + t.DrainGracePeriod
+	}
+	return p.drainPort(port, deadline)
 }
 
 // AddRedirectRule adds a rule to redirect traffic from one destination to another
+// With ProtocolAny the rule applies to every protocol
 // This method is specific to IPv4 tables
 func (t *Table[IPv4]) AddRedirectRule(protocol uint8, dstIP IPv4, dstPort uint16, newDstIP IPv4, newDstPort uint16) {
-	rule := RedirectRule[IPv4]{
+	t.addRedirectRule(protocol, RedirectRule[IPv4]{
 		DstIP:      dstIP,
 		DstPort:    dstPort,
 		NewDstIP:   newDstIP,
 		NewDstPort: newDstPort,
+	})
+}
+
+// AddDNATRule adds a pure destination NAT rule for TCP, UDP or DCCP (all of
+// them with ProtocolAny): traffic to dstIP:dstPort is sent to
+// newDstIP:newDstPort, but unlike AddRedirectRule the source isn't
+// masqueraded so the backend sees the real client address. The backend must
+// route its replies back through the NAT.
+func (t *Table[IP]) AddDNATRule(protocol uint8, dstIP IP, dstPort uint16, newDstIP IP, newDstPort uint16) {
+	if protocol == ProtocolICMP {
+		return
+	}
+	rule := RedirectRule[IP]{
+		DstIP:          dstIP,
+		DstPort:        dstPort,
+		NewDstIP:       newDstIP,
+		NewDstPort:     newDstPort,
+		PreserveSource: true,
+	}
+	for _, p := range t.rulePairs(protocol) {
+		if p != &t.ICMP {
+			rule.hits = new(atomic.Uint64)
+			p.mutex.Lock()
+			p.addRedirectRuleLocked(rule)
+			p.mutex.Unlock()
+		}
 	}
+}
 
-	switch protocol {
-	case ProtocolTCP:
-		t.TCP.mutex.Lock()
-		t.TCP.redirectRules = append(t.TCP.redirectRules, rule)
-		t.TCP.mutex.Unlock()
-	case ProtocolUDP:
-		t.UDP.mutex.Lock()
-		t.UDP.redirectRules = append(t.UDP.redirectRules, rule)
-		t.UDP.mutex.Unlock()
-	case ProtocolICMP:
-		t.ICMP.mutex.Lock()
-		t.ICMP.redirectRules = append(t.ICMP.redirectRules, rule)
-		t.ICMP.mutex.Unlock()
+// AddMulticastRelay relays outbound UDP multicast sent to group on port, e.g.
+// mDNS to 224.0.0.251:5353, to the unicast host unicastDst on the same port.
+// Replies are routed back to the sender like any other UDP flow, with the
+// unicast host as their source.
+// This method is specific to IPv4 tables
+func (t *Table[IPv4]) AddMulticastRelay(group IPv4, port uint16, unicastDst IPv4) error {
+	if !isMulticast(group) {
+		return fmt.Errorf("%v is not a multicast group", group)
+	}
+	if isMulticast(unicastDst) {
+		return fmt.Errorf("relay destination %v is a multicast address", unicastDst)
+	}
+	t.addRedirectRule(ProtocolUDP, RedirectRule[IPv4]{
+		DstIP:      group,
+		DstPort:    port,
+		NewDstIP:   unicastDst,
+		NewDstPort: port,
+	})
+	return nil
+}
+
+// DHCP ports, see AddDHCPRelay
+const (
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+)
+
+// AddDHCPRelay relays DHCP requests broadcast by internal clients to
+// 255.255.255.255:67 to the unicast DHCP server, NATed like any other UDP
+// flow. Replies from the server are broadcast back to port 68 in the
+// namespace of the client when it has no address yet, and sent from the
+// server itself.
+// This method is specific to IPv4 tables
+func (t *Table[IPv4]) AddDHCPRelay(server IPv4) error {
+	var zero IPv4
+	if server == zero || isBroadcast(server) || isMulticast(server) {
+		return fmt.Errorf("DHCP server %v isn't a unicast address", server)
+	}
+	t.addRedirectRule(ProtocolUDP, RedirectRule[IPv4]{
+		DstIP:      any(ipv4Broadcast).(IPv4),
+		DstPort:    dhcpServerPort,
+		NewDstIP:   server,
+		NewDstPort: dhcpServerPort,
+	})
+	return nil
+}
+
+func (t *Table[IP]) addRedirectRule(protocol uint8, rule RedirectRule[IP]) {
+	for _, p := range t.rulePairs(protocol) {
+		rule.hits = new(atomic.Uint64)
+		p.mutex.Lock()
+		p.addRedirectRuleLocked(rule)
+		p.mutex.Unlock()
+	}
+}
+
+// rulePairs returns the pairs a rule for protocol applies to, all of them
+// for ProtocolAny
+func (t *Table[IP]) rulePairs(protocol uint8) []*Pair[IP] {
+	if protocol == ProtocolAny {
+		return t.pairs()
+	}
+	if p := t.pair(protocol); p != nil {
+		return []*Pair[IP]{p}
+	}
+	return nil
+}
+
+// AddPortRangeForward forwards inbound TCP or UDP traffic to any external
+// port in [extStart, extEnd] to internalIP on the same port, in the given
+// namespace. A connection is created for each remote endpoint on first
+// contact, and replies from the internal host go out from the forwarded
+// port. The range is withdrawn from the ports allocated to outbound flows.
+func (t *Table[IP]) AddPortRangeForward(protocol uint8, extStart, extEnd uint16, internalIP IP, namespace uintptr) {
+	if extStart > extEnd {
+		return
+	}
+	t.addPortForward(protocol, PortRangeForward[IP]{
+		ExtStart:   extStart,
+		ExtEnd:     extEnd,
+		InternalIP: internalIP,
+		Namespace:  namespace,
+	})
+}
+
+// AddPortForward forwards inbound TCP or UDP traffic to externalPort to
+// internalIP on internalPort, in the given namespace, to host a service
+// behind the NAT. It works like a single-port AddPortRangeForward: replies
+// from the internal host go out from externalPort.
+func (t *Table[IP]) AddPortForward(protocol uint8, externalPort uint16, internalIP IP, internalPort uint16, namespace uintptr) {
+	t.addPortForward(protocol, PortRangeForward[IP]{
+		ExtStart:     externalPort,
+		ExtEnd:       externalPort,
+		InternalIP:   internalIP,
+		Namespace:    namespace,
+		InternalPort: internalPort,
+	})
+}
+
+func (t *Table[IP]) addPortForward(protocol uint8, fwd PortRangeForward[IP]) {
+	if protocol != ProtocolTCP && protocol != ProtocolUDP {
+		return
+	}
+	fwd.hits = new(atomic.Uint64)
+	p := t.pair(protocol)
+	p.mutex.Lock()
+	p.forwards = append(p.forwards, fwd)
+	p.mutex.Unlock()
+
+	if p.ports != nil {
+		for port := uint32(fwd.ExtStart); port <= uint32(fwd.ExtEnd); port++ {
+			p.ports.reserve(uint16(port))
+		}
+	}
+}
+
+// forwardInbound creates the connection for an inbound packet matching a
+// port range forward, or returns nil if none matches
+func (t *Table[IP]) forwardInbound(p *Pair[IP], protocol uint8, key ExternalKey[IP], dscp uint8, now int64) *Conn[IP] {
+	if !t.ownsIP(key.DstIP) {
+		return nil
+	}
+	fwd, ok := p.checkPortForward(key.DstPort)
+	if !ok {
+		return nil
 	}
+	conn := t.newConn(p, Conn[IP]{
+		LastSeen:         now,
+		CreatedAt:        now,
+		LastInbound:      now,
+		DSCP:             dscp,
+		Protocol:         protocol,
+		Namespace:        fwd.Namespace,
+		LocalSrcIP:       fwd.InternalIP,
+		LocalSrcPort:     fwd.internalPort(key.DstPort),
+		LocalDstIp:       key.SrcIP,
+		LocalDstPort:     key.SrcPort,
+		OutsideSrcIP:     key.DstIP,
+		OutsideSrcPort:   key.DstPort,
+		OutsideDstIP:     key.SrcIP,
+		OutsideDstPort:   key.SrcPort,
+		InboundInitiated: true,
+	})
+	if t.admitConn(p, conn) != nil || t.addConn(p, conn) != nil {
+		return nil
+	}
+	return conn
 }
 
 // AddDropRule adds a rule to drop traffic to a specific port
+// With ProtocolAny the rule applies to every protocol with ports
 // This method is specific to IPv4 tables
 func (t *Table[IPv4]) AddDropRule(protocol uint8, dstPort uint16) {
 	rule := DropRule{DstPort: dstPort}
 
-	switch protocol {
-	case ProtocolTCP:
-		t.TCP.mutex.Lock()
-		t.TCP.dropRules = append(t.TCP.dropRules, rule)
-		t.TCP.mutex.Unlock()
-	case ProtocolUDP:
-		t.UDP.mutex.Lock()
-		t.UDP.dropRules = append(t.UDP.dropRules, rule)
-		t.UDP.mutex.Unlock()
+	for _, p := range t.rulePairs(protocol) {
+		if p == &t.ICMP || p == &t.ESP || p == &t.Other {
+			// ICMP, ESP and unknown protocols have no ports to match
+			continue
+		}
+		rule.hits = new(atomic.Uint64)
+		p.mutex.Lock()
+		p.addDropRuleLocked(rule)
+		p.mutex.Unlock()
+	}
+}
+
+// ListRules returns the drop, redirect and forward rules of every protocol
+// with their hit counts, e.g. to find rules that never match. A rule added
+// with ProtocolAny is listed, and counted, once per pair, the rules of the
+// pair of otherwise untracked protocols being listed as ProtocolAny.
+func (t *Table[IP]) ListRules() []RuleInfo[IP] {
+	protocols := []uint8{ProtocolTCP, ProtocolUDP, ProtocolICMP, ProtocolDCCP, ProtocolESP, ProtocolAny}
+	var res []RuleInfo[IP]
+	for i, p := range t.pairs() {
+		res = append(res, p.rules(protocols[i])...)
 	}
+	return res
 }
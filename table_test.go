@@ -1,7 +1,16 @@
 package swnat
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"reflect"
+	"runtime"
+	"slices"
 	"sync"
 	"testing"
 	"time"
@@ -378,4 +387,3853 @@ func TestChecksumValidation(t *testing.T) {
 	if !VerifyUDPChecksum(packet) {
 		t.Error("Invalid UDP checksum after NAT")
 	}
-}
\ No newline at end of file
+}
+func TestIPv4TableLoopDetection(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	if err := table.RegisterNamespacePrefix(1, *lan); err != nil {
+		t.Fatalf("RegisterNamespacePrefix failed: %v", err)
+	}
+
+	client := IPv4{192, 168, 1, 100}
+	service := IPv4{10, 0, 0, 243}
+
+	// Misconfigured redirect pointing back at the client itself
+	table.AddRedirectRule(ProtocolUDP, service, 53, client, 5000)
+
+	packet := CreateIPv4UDPPacket(client, service, 5000, 53, []byte("query"))
+	if err := table.HandleOutboundPacket(packet, 1); err != ErrLoopDetected {
+		t.Errorf("Self-addressed hairpin: expected ErrLoopDetected, got %v", err)
+	}
+
+	// A different source port isn't looping
+	packet = CreateIPv4UDPPacket(client, service, 5001, 53, []byte("query"))
+	if err := table.HandleOutboundPacket(packet, 1); err != nil {
+		t.Errorf("Redirect to a different endpoint failed: %v", err)
+	}
+
+	// The hairpinned packet, now from the external address to an internal
+	// host of the same namespace, must not be translated a second time
+	if err := table.HandleOutboundPacket(packet, 1); err != ErrLoopDetected {
+		t.Errorf("Already translated packet: expected ErrLoopDetected, got %v", err)
+	}
+
+	// The same packet in a namespace the host doesn't belong to isn't a loop
+	_, other, _ := net.ParseCIDR("172.16.0.0/16")
+	table.RegisterNamespacePrefix(2, *other)
+	if err := table.HandleOutboundPacket(packet, 2); err == ErrLoopDetected {
+		t.Error("Packet to another namespace's host refused as a loop")
+	}
+
+	// nor is a packet from the external address to an outside host
+	packet = CreateIPv4UDPPacket(table.externalIP, IPv4{8, 8, 8, 8}, 5000, 53, []byte("query"))
+	if err := table.HandleOutboundPacket(packet, 1); err == ErrLoopDetected {
+		t.Error("Packet from the external address to an outside host refused as a loop")
+	}
+}
+
+func TestIPv4TableLastDirection(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	now := int64(1000)
+	table.Now = func() int64 { return now }
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	out := CreateIPv4UDPPacket(client, server, 5000, 53, []byte("query"))
+	if err := table.HandleOutboundPacket(out, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	header, _ := ParseIPv4Header(out)
+	udp, _ := ParseUDPHeader(out, 20)
+
+	info := func() ConnInfo[IPv4] {
+		conns := table.UDP.snapshot()
+		if len(conns) != 1 {
+			t.Fatalf("Expected 1 connection, got %d", len(conns))
+		}
+		return conns[0]
+	}
+
+	if c := info(); c.LastOutbound != 1000 || c.LastInbound != 0 {
+		t.Errorf("After outbound: LastOutbound=%d LastInbound=%d, want 1000/0", c.LastOutbound, c.LastInbound)
+	}
+
+	now = 1050
+	in := CreateIPv4UDPPacket(server, header.SourceIP, 53, udp.SourcePort, []byte("reply"))
+	if _, err := table.HandleInboundPacket(in); err != nil {
+		t.Fatalf("HandleInboundPacket failed: %v", err)
+	}
+	if c := info(); c.LastOutbound != 1000 || c.LastInbound != 1050 || c.LastSeen != 1050 {
+		t.Errorf("After inbound: LastOutbound=%d LastInbound=%d LastSeen=%d, want 1000/1050/1050", c.LastOutbound, c.LastInbound, c.LastSeen)
+	}
+
+	now = 1100
+	out = CreateIPv4UDPPacket(client, server, 5000, 53, []byte("query"))
+	if err := table.HandleOutboundPacket(out, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	if c := info(); c.LastOutbound != 1100 || c.LastInbound != 1050 || c.LastSeen != 1100 {
+		t.Errorf("After second outbound: LastOutbound=%d LastInbound=%d LastSeen=%d, want 1100/1050/1100", c.LastOutbound, c.LastInbound, c.LastSeen)
+	}
+}
+
+func TestIPv4TableICMPIdentifierPool(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	table.MaxConnPerNamespace = 0
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	belowPortRange := false
+	for i := 0; i < 100; i++ {
+		ping := CreateIPv4ICMPPacket(client, server, ICMPTypeEchoRequest, 0, uint16(i), 1)
+		if err := table.HandleOutboundPacket(ping, 1); err != nil {
+			t.Fatalf("ICMP outbound %d failed: %v", i, err)
+		}
+		icmp, _ := ParseICMPHeader(ping, 20)
+		if uint32(icmp.ID) < table.nextPort {
+			belowPortRange = true
+		}
+
+		udp := CreateIPv4UDPPacket(client, server, uint16(5000+i), 53, nil)
+		if err := table.HandleOutboundPacket(udp, 1); err != nil {
+			t.Fatalf("UDP outbound %d failed: %v", i, err)
+		}
+		udpHeader, _ := ParseUDPHeader(udp, 20)
+		if uint32(udpHeader.SourcePort) < table.nextPort || uint32(udpHeader.SourcePort) > table.maxPort {
+			t.Errorf("UDP port %d outside of configured range", udpHeader.SourcePort)
+		}
+	}
+	if !belowPortRange {
+		t.Error("ICMP identifiers never left the TCP/UDP port range")
+	}
+
+	// Expired identifiers go back to the pool
+	table.RunMaintenance(table.Now() + table.ICMPTimeout + 1)
+	if len(table.ICMP.ports.free) != 100 {
+		t.Errorf("Expected 100 identifiers on the free-list, got %d", len(table.ICMP.ports.free))
+	}
+}
+
+func TestIPv4TableDropMartians(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	external := table.GetExternalIP()
+
+	tests := []struct {
+		name    string
+		src     IPv4
+		martian bool
+	}{
+		{"loopback", IPv4{127, 0, 0, 1}, true},
+		{"this network", IPv4{0, 1, 2, 3}, true},
+		{"link-local", IPv4{169, 254, 1, 1}, true},
+		{"external IP", external, true},
+		{"regular host", IPv4{8, 8, 8, 8}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := IPv4{192, 168, 1, 100}
+			out := CreateIPv4UDPPacket(client, tt.src, 5000, 53, nil)
+			if err := table.HandleOutboundPacket(out, 1); err != nil {
+				t.Fatalf("HandleOutboundPacket failed: %v", err)
+			}
+			udp, _ := ParseUDPHeader(out, 20)
+
+			reply := func() error {
+				in := CreateIPv4UDPPacket(tt.src, external, 53, udp.SourcePort, nil)
+				_, err := table.HandleInboundPacket(in)
+				return err
+			}
+
+			table.DropMartians = false
+			if err := reply(); err != nil {
+				t.Errorf("Reply dropped without DropMartians: %v", err)
+			}
+
+			table.DropMartians = true
+			err := reply()
+			if tt.martian && err != ErrDropPacket {
+				t.Errorf("Expected martian reply to be dropped, got %v", err)
+			}
+			if !tt.martian && err != nil {
+				t.Errorf("Legitimate reply dropped: %v", err)
+			}
+		})
+	}
+}
+
+func TestIPv4TableSYNReopensSweptConnection(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{1, 1, 1, 1}
+
+	syn := CreateIPv4TCPPacket(client, server, 45000, 80, TCPFlagSYN)
+	if err := table.HandleOutboundPacket(syn, 1); err != nil {
+		t.Fatalf("SYN failed: %v", err)
+	}
+	rst := CreateIPv4TCPPacket(client, server, 45000, 80, TCPFlagRST)
+	if err := table.HandleOutboundPacket(rst, 1); err != nil {
+		t.Fatalf("RST failed: %v", err)
+	}
+
+	// The client retries on the same tuple before maintenance ran
+	syn = CreateIPv4TCPPacket(client, server, 45000, 80, TCPFlagSYN)
+	if err := table.HandleOutboundPacket(syn, 1); err != nil {
+		t.Fatalf("Second SYN failed: %v", err)
+	}
+	header, _ := ParseIPv4Header(syn)
+	tcp, _ := ParseTCPHeader(syn, 20)
+
+	conns := table.TCP.snapshot()
+	if len(conns) != 1 {
+		t.Fatalf("Expected 1 connection, got %d", len(conns))
+	}
+	if conns[0].PendingSweep {
+		t.Error("Reopened connection is still pending sweep")
+	}
+
+	// The fresh mapping must survive maintenance and carry replies
+	table.RunMaintenance(table.Now())
+	synAck := CreateIPv4TCPPacket(server, header.SourceIP, 80, tcp.SourcePort, TCPFlagSYN|TCPFlagACK)
+	namespace, err := table.HandleInboundPacket(synAck)
+	if err != nil {
+		t.Fatalf("SYN-ACK on reopened connection failed: %v", err)
+	}
+	if namespace != 1 {
+		t.Errorf("Expected namespace 1, got %d", namespace)
+	}
+}
+
+func TestIPv4TableLookupByExternalPort(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{1, 1, 1, 1}
+
+	syn := CreateIPv4TCPPacket(client, server, 45000, 443, TCPFlagSYN)
+	if err := table.HandleOutboundPacket(syn, 7); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	tcp, _ := ParseTCPHeader(syn, 20)
+
+	info, ok := table.LookupByExternalPort(ProtocolTCP, tcp.SourcePort)
+	if !ok {
+		t.Fatalf("No connection found on external port %d", tcp.SourcePort)
+	}
+	if info.LocalSrcIP != client || info.LocalSrcPort != 45000 || info.Namespace != 7 {
+		t.Errorf("Wrong connection returned: %+v", info)
+	}
+
+	if _, ok := table.LookupByExternalPort(ProtocolUDP, tcp.SourcePort); ok {
+		t.Error("TCP port found in the UDP table")
+	}
+
+	// The index follows connection removal
+	table.RunMaintenance(table.Now() + table.TCPTimeout + 1)
+	if _, ok := table.LookupByExternalPort(ProtocolTCP, tcp.SourcePort); ok {
+		t.Error("Expired connection still found by external port")
+	}
+}
+
+func TestIPv4TableAdoptExistingFlows(t *testing.T) {
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{1, 1, 1, 1}
+
+	for _, adopt := range []bool{false, true} {
+		table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+		table.AdoptExistingFlows = adopt
+
+		ack := CreateIPv4TCPPacket(client, server, 45000, 443, TCPFlagACK|TCPFlagPSH)
+		err := table.HandleOutboundPacket(ack, 1)
+		if !adopt {
+			if err != ErrDropPacket {
+				t.Errorf("Mid-stream ACK without adoption: expected ErrDropPacket, got %v", err)
+			}
+			if n := table.TCP.len(); n != 0 {
+				t.Errorf("Mid-stream ACK without adoption created %d connections", n)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("Mid-stream ACK with adoption failed: %v", err)
+		}
+		header, _ := ParseIPv4Header(ack)
+		tcp, _ := ParseTCPHeader(ack, 20)
+
+		reply := CreateIPv4TCPPacket(server, header.SourceIP, 443, tcp.SourcePort, TCPFlagACK)
+		namespace, err := table.HandleInboundPacket(reply)
+		if err != nil {
+			t.Fatalf("Reply to adopted flow failed: %v", err)
+		}
+		if namespace != 1 {
+			t.Errorf("Expected namespace 1, got %d", namespace)
+		}
+	}
+}
+
+func TestIPv4TablePureDNAT(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+
+	client := IPv4{203, 0, 113, 5}
+	vip := IPv4{10, 0, 0, 1}
+	backend := IPv4{192, 168, 1, 10}
+	table.AddDNATRule(ProtocolTCP, vip, 80, backend, 8080)
+
+	syn := CreateIPv4TCPPacket(client, vip, 40000, 80, TCPFlagSYN)
+	if err := table.HandleOutboundPacket(syn, 3); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	header, _ := ParseIPv4Header(syn)
+	tcp, _ := ParseTCPHeader(syn, 20)
+	if header.SourceIP != client || tcp.SourcePort != 40000 {
+		t.Errorf("Backend sees %v:%d, want the real client %v:40000", header.SourceIP, tcp.SourcePort, client)
+	}
+	if header.DestinationIP != backend || tcp.DestinationPort != 8080 {
+		t.Errorf("Packet sent to %v:%d, want %v:8080", header.DestinationIP, tcp.DestinationPort, backend)
+	}
+	if !VerifyIPv4Checksum(syn) || !VerifyTCPChecksum(syn) {
+		t.Error("Invalid checksums after DNAT")
+	}
+
+	// The backend replies straight to the client address
+	synAck := CreateIPv4TCPPacket(backend, client, 8080, 40000, TCPFlagSYN|TCPFlagACK)
+	namespace, err := table.HandleInboundPacket(synAck)
+	if err != nil {
+		t.Fatalf("HandleInboundPacket failed: %v", err)
+	}
+	if namespace != 3 {
+		t.Errorf("Expected namespace 3, got %d", namespace)
+	}
+	header, _ = ParseIPv4Header(synAck)
+	tcp, _ = ParseTCPHeader(synAck, 20)
+	if header.SourceIP != vip || tcp.SourcePort != 80 {
+		t.Errorf("Reply comes from %v:%d, want %v:80", header.SourceIP, tcp.SourcePort, vip)
+	}
+	if header.DestinationIP != client || tcp.DestinationPort != 40000 {
+		t.Errorf("Reply sent to %v:%d, want %v:40000", header.DestinationIP, tcp.DestinationPort, client)
+	}
+}
+
+func TestIPv4TablePortLowWatermark(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	table.UDP.ports = newPortPool(65526, 65535) // 10 ports
+	table.PortLowWatermark = 3
+	table.SetNamespacePriority(2, 10)
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+	open := func(namespace uintptr, srcPort uint16) error {
+		packet := CreateIPv4UDPPacket(client, server, srcPort, 53, nil)
+		return table.HandleOutboundPacket(packet, namespace)
+	}
+
+	// The low priority namespace can use ports down to the watermark
+	for i := 0; i < 7; i++ {
+		if err := open(1, uint16(5000+i)); err != nil {
+			t.Fatalf("Low priority flow %d failed: %v", i, err)
+		}
+	}
+	if err := open(1, 5007); err != ErrPortsLow {
+		t.Errorf("Low priority flow below watermark: expected ErrPortsLow, got %v", err)
+	}
+
+	// The high priority namespace gets the reserved headroom
+	for i := 0; i < 3; i++ {
+		if err := open(2, uint16(6000+i)); err != nil {
+			t.Errorf("High priority flow %d failed: %v", i, err)
+		}
+	}
+
+	// Existing low priority flows keep working
+	if err := open(1, 5000); err != nil {
+		t.Errorf("Existing low priority flow failed: %v", err)
+	}
+}
+
+func TestIPv4TablePriorityEviction(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	now := int64(1000)
+	table.Now = func() int64 { return now }
+	table.MaxConnPerNamespace = 2
+	table.PriorityEviction = true
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+	open := func(srcPort uint16, dscp uint8) {
+		packet := CreateIPv4UDPPacket(client, server, srcPort, 5060, nil)
+		packet[1] = dscp << 2
+		if err := table.HandleOutboundPacket(packet, 1); err != nil {
+			t.Fatalf("HandleOutboundPacket failed: %v", err)
+		}
+		now++
+	}
+
+	open(5000, 46) // EF voice flow, oldest
+	open(5001, 0)  // best effort
+	open(5002, 0)  // pushes the namespace over its limit
+
+	ports := make(map[uint16]bool)
+	for _, c := range table.UDP.snapshot() {
+		ports[c.LocalSrcPort] = true
+	}
+	if !ports[5000] {
+		t.Error("EF flow was evicted")
+	}
+	if ports[5001] {
+		t.Error("Best effort flow survived instead of the EF one")
+	}
+}
+
+func TestIPv4TableReuseConns(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	table.MaxConnPerNamespace = 1
+	table.ReuseConns = true
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	var ports []uint16
+	for i := 0; i < 50; i++ {
+		packet := CreateIPv4UDPPacket(client, server, uint16(5000+i), 53, nil)
+		if err := table.HandleOutboundPacket(packet, 1); err != nil {
+			t.Fatalf("HandleOutboundPacket %d failed: %v", i, err)
+		}
+		udp, _ := ParseUDPHeader(packet, 20)
+		ports = append(ports, udp.SourcePort)
+	}
+
+	// Only the last flow remains, with its own tuple
+	conns := table.UDP.snapshot()
+	if len(conns) != 1 {
+		t.Fatalf("Expected 1 connection, got %d", len(conns))
+	}
+	if conns[0].LocalSrcPort != 5049 || conns[0].OutsideSrcPort != ports[49] {
+		t.Errorf("Recycled connection carries a stale tuple: %+v", conns[0])
+	}
+	if len(table.UDP.in) != 1 || len(table.UDP.byPort) != 1 {
+		t.Errorf("Maps out of sync: %d in, %d indexed ports", len(table.UDP.in), len(table.UDP.byPort))
+	}
+
+	// Replies to evicted flows must not reach the recycled connection
+	for i, port := range ports {
+		reply := CreateIPv4UDPPacket(server, table.externalIP, 53, port, nil)
+		_, err := table.HandleInboundPacket(reply)
+		if i == len(ports)-1 {
+			if err != nil {
+				t.Errorf("Reply to the live flow failed: %v", err)
+			}
+		} else if err == nil {
+			t.Errorf("Reply to evicted flow %d was accepted", i)
+		}
+	}
+}
+
+func TestIPv4TablePortRangeForward(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+
+	internal := IPv4{192, 168, 1, 50}
+	remote := IPv4{8, 8, 8, 8}
+	table.AddPortRangeForward(ProtocolUDP, 10000, 10010, internal, 7)
+
+	packet := CreateIPv4UDPPacket(remote, table.externalIP, 4000, 10005, []byte("rtp"))
+	namespace, err := table.HandleInboundPacket(packet)
+	if err != nil {
+		t.Fatalf("HandleInboundPacket failed: %v", err)
+	}
+	if namespace != 7 {
+		t.Errorf("Expected namespace 7, got %d", namespace)
+	}
+	header, _ := ParseIPv4Header(packet)
+	udp, _ := ParseUDPHeader(packet, 20)
+	if header.DestinationIP != internal || udp.DestinationPort != 10005 {
+		t.Errorf("Expected %s:10005, got %s:%d", internal, header.DestinationIP, udp.DestinationPort)
+	}
+
+	// The internal host answers from the forwarded port
+	reply := CreateIPv4UDPPacket(internal, remote, 10005, 4000, []byte("rtp"))
+	if err := table.HandleOutboundPacket(reply, 7); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	header, _ = ParseIPv4Header(reply)
+	udp, _ = ParseUDPHeader(reply, 20)
+	if header.SourceIP != table.externalIP || udp.SourcePort != 10005 {
+		t.Errorf("Expected reply from %s:10005, got %s:%d", table.externalIP, header.SourceIP, udp.SourcePort)
+	}
+
+	// Ports outside the range and other protocols aren't forwarded
+	outside := CreateIPv4UDPPacket(remote, table.externalIP, 4000, 10011, nil)
+	if _, err := table.HandleInboundPacket(outside); err != ErrDropPacket {
+		t.Errorf("Expected ErrDropPacket outside the range, got %v", err)
+	}
+	tcp := CreateIPv4TCPPacket(remote, table.externalIP, 4000, 10005, TCPFlagSYN)
+	if _, err := table.HandleInboundPacket(tcp); err != ErrDropPacket {
+		t.Errorf("Expected ErrDropPacket for TCP, got %v", err)
+	}
+}
+
+func TestIPv4TableOwnedExternalPrefix(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	_, prefix, _ := net.ParseCIDR("5.6.7.8/29")
+	if err := table.SetOwnedExternalPrefix(*prefix); err != nil {
+		t.Fatalf("SetOwnedExternalPrefix failed: %v", err)
+	}
+	_, v6, _ := net.ParseCIDR("2001:db8::/64")
+	if err := table.SetOwnedExternalPrefix(*v6); err == nil {
+		t.Error("Expected an IPv6 prefix to be refused by an IPv4 table")
+	}
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	used := make(map[IPv4]int)
+	for i := 0; i < 16; i++ {
+		packet := CreateIPv4UDPPacket(client, server, uint16(5000+i), 53, nil)
+		if err := table.HandleOutboundPacket(packet, 1); err != nil {
+			t.Fatalf("HandleOutboundPacket failed: %v", err)
+		}
+		header, _ := ParseIPv4Header(packet)
+		udp, _ := ParseUDPHeader(packet, 20)
+		if header.SourceIP[0] != 5 || header.SourceIP[1] != 6 || header.SourceIP[2] != 7 || header.SourceIP[3]&^7 != 8 {
+			t.Fatalf("Allocated %s outside the owned prefix", header.SourceIP)
+		}
+		used[header.SourceIP]++
+
+		// Replies to whichever address was picked are accepted
+		reply := CreateIPv4UDPPacket(server, header.SourceIP, 53, udp.SourcePort, nil)
+		if _, err := table.HandleInboundPacket(reply); err != nil {
+			t.Errorf("Reply to %s failed: %v", header.SourceIP, err)
+		}
+	}
+	if len(used) != 8 {
+		t.Errorf("Expected allocations over the 8 addresses of the /29, got %v", used)
+	}
+
+	// Any owned address is ours for martian and loop checks
+	table.DropMartians = true
+	spoofed := CreateIPv4UDPPacket(IPv4{5, 6, 7, 13}, IPv4{5, 6, 7, 9}, 53, 5000, nil)
+	if _, err := table.HandleInboundPacket(spoofed); err != ErrDropPacket {
+		t.Errorf("Expected ErrDropPacket from an owned source, got %v", err)
+	}
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	table.RegisterInternalPrefix(*lan)
+	looped := CreateIPv4UDPPacket(IPv4{5, 6, 7, 12}, client, 5000, 53, nil)
+	if err := table.HandleOutboundPacket(looped, 1); err != ErrLoopDetected {
+		t.Errorf("Expected ErrLoopDetected, got %v", err)
+	}
+}
+
+func TestIPv4TableAllowConn(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+
+	blocked := IPv4{6, 6, 6, 6}
+	var calls int
+	table.AllowConn = func(c ConnInfo[IPv4]) bool {
+		calls++
+		return c.OutsideDstIP != blocked
+	}
+
+	client := IPv4{192, 168, 1, 100}
+	free := table.UDP.ports.available()
+
+	packet := CreateIPv4UDPPacket(client, blocked, 5000, 53, nil)
+	if err := table.HandleOutboundPacket(packet, 1); err != ErrConnRefused {
+		t.Errorf("Expected ErrConnRefused, got %v", err)
+	}
+	icmp := CreateIPv4ICMPPacket(client, blocked, ICMPTypeEchoRequest, 0, 1234, 1)
+	if err := table.HandleOutboundPacket(icmp, 1); err != ErrConnRefused {
+		t.Errorf("Expected ErrConnRefused for ICMP, got %v", err)
+	}
+	if table.UDP.len() != 0 || table.ICMP.len() != 0 {
+		t.Error("Refused flows left a mapping behind")
+	}
+	if n := table.UDP.ports.available(); n != free {
+		t.Errorf("Refused flow leaked its port: %d available, want %d", n, free)
+	}
+
+	packet = CreateIPv4UDPPacket(client, IPv4{8, 8, 8, 8}, 5000, 53, nil)
+	if err := table.HandleOutboundPacket(packet, 1); err != nil {
+		t.Errorf("Allowed flow failed: %v", err)
+	}
+	// Existing flows aren't asked again
+	packet = CreateIPv4UDPPacket(client, IPv4{8, 8, 8, 8}, 5000, 53, nil)
+	table.HandleOutboundPacket(packet, 1)
+	if calls != 3 {
+		t.Errorf("Expected AllowConn to be called 3 times, got %d", calls)
+	}
+}
+
+func TestIPv4TableConfig(t *testing.T) {
+	nat, err := NewIPv4WithConfig(Config{
+		ExternalIP:     net.ParseIP("1.2.3.4"),
+		PortRangeStart: 20000,
+		PortRangeEnd:   30000,
+		UDPTimeout:     60,
+	})
+	if err != nil {
+		t.Fatalf("NewIPv4WithConfig failed: %v", err)
+	}
+	table := nat.(*Table[IPv4])
+
+	cfg := table.Config()
+	if !cfg.ExternalIP.Equal(net.ParseIP("1.2.3.4")) || cfg.PortRangeStart != 20000 || cfg.PortRangeEnd != 30000 {
+		t.Errorf("Unexpected address or port range in %+v", cfg)
+	}
+	if cfg.UDPTimeout != 60 || cfg.TCPTimeout != 86400 || cfg.MaxConnPerNamespace != 200 || cfg.QUICPort != 443 {
+		t.Errorf("Unexpected defaults in %+v", cfg)
+	}
+
+	table.SetExternalIP(IPv4{5, 6, 7, 8})
+	table.TCPTimeout = 3600
+	table.MaxConnPerNamespace = 0
+	table.DropMartians = true
+	table.PriorityEviction = true
+	table.DrainGracePeriod = 30
+	table.MaxHalfOpenPerNamespace = 16
+	table.MaxTotalConn = 1000
+	table.GlobalEvictionPolicy = EvictLargestNamespace
+	table.PreserveICMPID = true
+	table.PortReuseDelay = 60
+	table.MaxPortsPerInternalIP = 64
+	table.ZeroIDForDF = true
+	table.RecordModifications = true
+	table.StrictInternalSource = true
+	table.MaxICMPToDestination = 8
+	table.SelfHeal = true
+	table.CapturePayloadBytes = 32
+	table.AdaptiveTimeouts = true
+	table.AdaptiveLowWatermark = 100
+	table.AdaptiveHighWatermark = 200
+	table.AdaptiveMinTimeout = 10
+	table.NoMatchPortLimit = 128
+	table.MeasureSetupLatency = true
+	table.SweepBehavior = SweepImmediateDrop
+
+	cfg = table.Config()
+	if !cfg.ExternalIP.Equal(net.ParseIP("5.6.7.8")) {
+		t.Errorf("Expected external IP 5.6.7.8, got %s", cfg.ExternalIP)
+	}
+	if cfg.TCPTimeout != 3600 || cfg.MaxConnPerNamespace != -1 || !cfg.DropMartians || !cfg.PriorityEviction {
+		t.Errorf("Field changes not reflected in %+v", cfg)
+	}
+	if cfg.DrainGracePeriod != 30 ||
+		cfg.MaxHalfOpenPerNamespace != 16 ||
+		cfg.MaxTotalConn != 1000 || cfg.GlobalEvictionPolicy != EvictLargestNamespace ||
+		!cfg.PreserveICMPID ||
+		cfg.PortReuseDelay != 60 ||
+		cfg.MaxPortsPerInternalIP != 64 ||
+		!cfg.ZeroIDForDF ||
+		!cfg.RecordModifications ||
+		!cfg.StrictInternalSource ||
+		cfg.MaxICMPToDestination != 8 ||
+		!cfg.SelfHeal ||
+		cfg.CapturePayloadBytes != 32 ||
+		!cfg.AdaptiveTimeouts || cfg.AdaptiveLowWatermark != 100 || cfg.AdaptiveHighWatermark != 200 || cfg.AdaptiveMinTimeout != 10 ||
+		cfg.NoMatchPortLimit != 128 ||
+		!cfg.MeasureSetupLatency ||
+		cfg.SweepBehavior != SweepImmediateDrop {
+		t.Errorf("Settings not reflected in %+v", cfg)
+	}
+
+	// The configuration clones the table
+	clone, err := NewIPv4WithConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewIPv4WithConfig from Config() failed: %v", err)
+	}
+	if got := clone.(*Table[IPv4]).Config(); !reflect.DeepEqual(got, cfg) {
+		t.Errorf("Clone configuration differs:\n got %+v\nwant %+v", got, cfg)
+	}
+
+	if _, err := NewIPv4WithConfig(Config{ExternalIP: net.ParseIP("::1")}); err == nil {
+		t.Error("Expected an IPv6 external IP to be refused")
+	}
+
+	// The protocols follow the address family
+	if want := []uint8{ProtocolICMP, ProtocolTCP, ProtocolUDP, ProtocolDCCP, ProtocolESP}; !reflect.DeepEqual(cfg.Protocols, want) {
+		t.Errorf("Expected IPv4 protocols %v, got %v", want, cfg.Protocols)
+	}
+	v6 := NewIPv6(net.ParseIP("2001:db8::1")).(*Table[IPv6])
+	if want := []uint8{ProtocolICMPv6, ProtocolTCP, ProtocolUDP}; !reflect.DeepEqual(v6.Config().Protocols, want) {
+		t.Errorf("Expected IPv6 protocols %v, got %v", want, v6.Config().Protocols)
+	}
+}
+
+func TestIPv4TableDrainExternalPort(t *testing.T) {
+	nat, _ := NewIPv4WithConfig(Config{
+		ExternalIP:     net.ParseIP("1.2.3.4"),
+		PortRangeStart: 20000,
+		PortRangeEnd:   20003,
+	})
+	table := nat.(*Table[IPv4])
+	now := int64(1000)
+	table.Now = func() int64 { return now }
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	packet := CreateIPv4UDPPacket(client, server, 5000, 53, nil)
+	table.HandleOutboundPacket(packet, 1)
+	udp, _ := ParseUDPHeader(packet, 20)
+	drained := udp.SourcePort
+
+	if n := table.DrainExternalPort(ProtocolUDP, drained); n != 1 {
+		t.Fatalf("Expected 1 drained connection, got %d", n)
+	}
+	if info, _ := table.LookupByExternalPort(ProtocolUDP, drained); !info.Draining {
+		t.Error("Connection not flagged as draining")
+	}
+
+	// The drained flow keeps working
+	reply := CreateIPv4UDPPacket(server, table.externalIP, 53, drained, nil)
+	if _, err := table.HandleInboundPacket(reply); err != nil {
+		t.Errorf("Reply on drained port failed: %v", err)
+	}
+
+	// Let it expire, then churn through the rest of the range
+	now += table.UDPTimeout + 1
+	table.RunMaintenance(now)
+	for i := 0; i < 10; i++ {
+		packet := CreateIPv4UDPPacket(client, server, uint16(6000+i), 53, nil)
+		table.HandleOutboundPacket(packet, 1)
+		udp, _ := ParseUDPHeader(packet, 20)
+		if udp.SourcePort == drained {
+			t.Fatalf("Drained port %d reassigned to a new flow", drained)
+		}
+		table.RunMaintenance(now + table.UDPTimeout + 1)
+		now += table.UDPTimeout + 1
+	}
+
+	// With a grace period, active connections are torn down once it elapses
+	table.DrainGracePeriod = 30
+	packet = CreateIPv4UDPPacket(client, server, 7000, 53, nil)
+	table.HandleOutboundPacket(packet, 1)
+	udp, _ = ParseUDPHeader(packet, 20)
+	table.DrainExternalPort(ProtocolUDP, udp.SourcePort)
+
+	now += 20
+	table.RunMaintenance(now)
+	if _, ok := table.LookupByExternalPort(ProtocolUDP, udp.SourcePort); !ok {
+		t.Error("Connection removed before the grace period elapsed")
+	}
+	now += 20
+	table.RunMaintenance(now)
+	if _, ok := table.LookupByExternalPort(ProtocolUDP, udp.SourcePort); ok {
+		t.Error("Connection still present after the grace period")
+	}
+}
+
+func TestIPv4TableUDPLengthBounds(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	verify := func(packet []byte) bool {
+		udp, _ := ParseUDPHeader(packet, 20)
+		src := IPv4{packet[12], packet[13], packet[14], packet[15]}
+		dst := IPv4{packet[16], packet[17], packet[18], packet[19]}
+		return calculateUDPChecksum(src, dst, packet[20:20+int(udp.Length)]) == 0
+	}
+
+	// Trailing garbage after the declared datagram, e.g. Ethernet padding
+	packet := append(CreateIPv4UDPPacket(client, server, 5000, 53, []byte("hello")), 0xde, 0xad, 0xbe, 0xef)
+	if err := table.HandleOutboundPacket(packet, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	if !verify(packet) {
+		t.Error("Outbound checksum doesn't verify over the declared length")
+	}
+	if !bytes.Equal(packet[len(packet)-4:], []byte{0xde, 0xad, 0xbe, 0xef}) {
+		t.Error("Trailing bytes were modified")
+	}
+
+	udp, _ := ParseUDPHeader(packet, 20)
+	reply := append(CreateIPv4UDPPacket(server, table.externalIP, 53, udp.SourcePort, []byte("world")), 1, 2, 3)
+	if _, err := table.HandleInboundPacket(reply); err != nil {
+		t.Fatalf("HandleInboundPacket failed: %v", err)
+	}
+	if !verify(reply) {
+		t.Error("Inbound checksum doesn't verify over the declared length")
+	}
+
+	// A length past the end of the buffer is refused
+	bad := CreateIPv4UDPPacket(client, server, 5001, 53, []byte("hello"))
+	binary.BigEndian.PutUint16(bad[24:26], 100)
+	if err := table.HandleOutboundPacket(bad, 1); err == nil {
+		t.Error("Expected an error for a UDP length past the buffer")
+	}
+}
+
+func TestIPv4TableNamespaceResolver(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+
+	// 4 bytes VLAN-like tag in front of the packet: TPID then VLAN ID
+	table.NamespaceResolver = func(buf []byte) (uintptr, bool) {
+		if len(buf) < 4 || binary.BigEndian.Uint16(buf[0:2]) != 0x8100 {
+			return 0, false
+		}
+		return uintptr(binary.BigEndian.Uint16(buf[2:4]) & 0x0fff), true
+	}
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	tagged := func(vlan uint16, packet []byte) []byte {
+		buf := binary.BigEndian.AppendUint16(nil, 0x8100)
+		buf = binary.BigEndian.AppendUint16(buf, vlan)
+		return append(buf, packet...)
+	}
+
+	buf := tagged(42, CreateIPv4UDPPacket(client, server, 5000, 53, nil))
+	if err := table.HandleOutboundPacketAuto(buf, 4); err != nil {
+		t.Fatalf("HandleOutboundPacketAuto failed: %v", err)
+	}
+	if !bytes.Equal(buf[:4], []byte{0x81, 0x00, 0, 42}) {
+		t.Error("Tag was modified")
+	}
+	if !VerifyUDPChecksum(buf[4:]) {
+		t.Error("Invalid UDP checksum after translation")
+	}
+
+	udp, _ := ParseUDPHeader(buf, 24)
+	reply := CreateIPv4UDPPacket(server, table.externalIP, 53, udp.SourcePort, nil)
+	if namespace, err := table.HandleInboundPacket(reply); err != nil || namespace != 42 {
+		t.Errorf("Expected namespace 42, got %d (%v)", namespace, err)
+	}
+
+	untagged := CreateIPv4UDPPacket(client, server, 5001, 53, nil)
+	if err := table.HandleOutboundPacketAuto(untagged, 0); err != ErrDropPacket {
+		t.Errorf("Expected ErrDropPacket for an unresolved packet, got %v", err)
+	}
+}
+
+func TestIPv4TableInboundAcceptIPs(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	anycast := IPv4{9, 9, 9, 9}
+	table.SetInboundAcceptIPs(anycast)
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	packet := CreateIPv4TCPPacket(client, server, 45000, 80, TCPFlagSYN)
+	if err := table.HandleOutboundPacket(packet, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	header, _ := ParseIPv4Header(packet)
+	tcp, _ := ParseTCPHeader(packet, 20)
+	if header.SourceIP != table.externalIP {
+		t.Errorf("Expected masquerading as %s, got %s", table.externalIP, header.SourceIP)
+	}
+	if info, _ := table.LookupByExternalPort(ProtocolTCP, tcp.SourcePort); info.OutsideSrcIP != table.externalIP {
+		t.Errorf("Connection records outside source %s", info.OutsideSrcIP)
+	}
+
+	// The reply arrives on the anycast address
+	reply := CreateIPv4TCPPacket(server, anycast, 80, tcp.SourcePort, TCPFlagSYN|TCPFlagACK)
+	if _, err := table.HandleInboundPacket(reply); err != nil {
+		t.Fatalf("Reply to accepted address failed: %v", err)
+	}
+	header, _ = ParseIPv4Header(reply)
+	if header.DestinationIP != client || !VerifyTCPChecksum(reply) {
+		t.Errorf("Reply not translated back to %s", client)
+	}
+
+	// Other addresses still don't match
+	stray := CreateIPv4TCPPacket(server, IPv4{9, 9, 9, 10}, 80, tcp.SourcePort, TCPFlagACK)
+	if _, err := table.HandleInboundPacket(stray); err != ErrDropPacket {
+		t.Errorf("Expected ErrDropPacket, got %v", err)
+	}
+
+	table.SetInboundAcceptIPs()
+	reply = CreateIPv4TCPPacket(server, anycast, 80, tcp.SourcePort, TCPFlagACK)
+	if _, err := table.HandleInboundPacket(reply); err != ErrDropPacket {
+		t.Errorf("Expected ErrDropPacket once the set is cleared, got %v", err)
+	}
+}
+
+func TestIPv4TableInboundAcceptIPsOwnedPrefix(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	_, prefix, _ := net.ParseCIDR("5.5.5.0/30")
+	if err := table.SetOwnedExternalPrefix(*prefix); err != nil {
+		t.Fatalf("SetOwnedExternalPrefix failed: %v", err)
+	}
+	udpIP := IPv4{6, 6, 6, 6}
+	if err := table.SetProtocolExternalIP(ProtocolUDP, udpIP); err != nil {
+		t.Fatalf("SetProtocolExternalIP failed: %v", err)
+	}
+	anycast := IPv4{9, 9, 9, 9}
+	table.SetInboundAcceptIPs(anycast)
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	// A TCP flow masqueraded behind the owned prefix
+	packet := CreateIPv4TCPPacket(client, server, 45000, 80, TCPFlagSYN)
+	if err := table.HandleOutboundPacket(packet, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	header, _ := ParseIPv4Header(packet)
+	tcp, _ := ParseTCPHeader(packet, 20)
+	if !prefix.Contains(net.IP(header.SourceIP[:])) {
+		t.Fatalf("Expected masquerading in %s, got %s", prefix, header.SourceIP)
+	}
+
+	reply := CreateIPv4TCPPacket(server, anycast, 80, tcp.SourcePort, TCPFlagSYN|TCPFlagACK)
+	if _, err := table.HandleInboundPacket(reply); err != nil {
+		t.Fatalf("Reply to accepted address failed: %v", err)
+	}
+	header, _ = ParseIPv4Header(reply)
+	if header.DestinationIP != client || !VerifyTCPChecksum(reply) {
+		t.Errorf("Reply not translated back to %s", client)
+	}
+
+	// A UDP flow masqueraded behind its protocol address
+	packet = CreateIPv4UDPPacket(client, server, 5000, 53, []byte("q"))
+	if err := table.HandleOutboundPacket(packet, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	header, _ = ParseIPv4Header(packet)
+	udp, _ := ParseUDPHeader(packet, 20)
+	if header.SourceIP != udpIP {
+		t.Fatalf("Expected masquerading as %s, got %s", udpIP, header.SourceIP)
+	}
+
+	reply = CreateIPv4UDPPacket(server, anycast, 53, udp.SourcePort, []byte("a"))
+	if _, err := table.HandleInboundPacket(reply); err != nil {
+		t.Fatalf("Reply to accepted address failed: %v", err)
+	}
+	header, _ = ParseIPv4Header(reply)
+	if header.DestinationIP != client {
+		t.Errorf("Reply not translated back to %s", client)
+	}
+
+	// A reply from another host still doesn't match
+	stray := CreateIPv4TCPPacket(IPv4{8, 8, 4, 4}, anycast, 80, tcp.SourcePort, TCPFlagACK)
+	if _, err := table.HandleInboundPacket(stray); err != ErrDropPacket {
+		t.Errorf("Expected ErrDropPacket, got %v", err)
+	}
+}
+
+func TestIPv4TableConnections(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+	table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, 5000, 53, []byte("q")), 1)
+	table.HandleOutboundPacket(CreateIPv4TCPPacket(client, server, 40000, 80, TCPFlagSYN), 2)
+	table.HandleOutboundPacket(CreateIPv4ICMPPacket(client, server, ICMPTypeEchoRequest, 0, 1234, 1), 3)
+
+	conns := table.Connections()
+	if len(conns) != 3 {
+		t.Fatalf("Expected 3 connections, got %d", len(conns))
+	}
+	seen := make(map[uint8]uintptr)
+	for _, c := range conns {
+		if c.LocalSrcIP != client || c.OutsideSrcIP != (IPv4{1, 2, 3, 4}) || c.LastSeen == 0 {
+			t.Errorf("Unexpected connection %+v", c)
+		}
+		seen[c.Protocol] = c.Namespace
+	}
+	if seen[ProtocolUDP] != 1 || seen[ProtocolTCP] != 2 || seen[ProtocolICMP] != 3 {
+		t.Errorf("Unexpected protocols and namespaces %v", seen)
+	}
+
+	// The copies are detached from the live connections
+	conns[0].LocalSrcPort = 1
+	for _, c := range table.Connections() {
+		if c.LocalSrcPort == 1 {
+			t.Error("Modifying a returned connection changed the table")
+		}
+	}
+
+	n := 0
+	table.ForEachConn(func(c ConnInfo[IPv4]) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Errorf("Expected ForEachConn to stop after 1 connection, got %d", n)
+	}
+
+	// The callback may modify the table
+	table.ForEachConn(func(c ConnInfo[IPv4]) bool {
+		table.DeleteForInternalIP(c.LocalSrcIP)
+		return true
+	})
+	if n := len(table.Connections()); n != 0 {
+		t.Errorf("Expected no connection left, got %d", n)
+	}
+}
+
+func TestIPv4TableConnectionsDuringTraffic(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	// Packets update the connections while they are listed, which the race
+	// detector checks
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		table.HandleOutboundPacket(CreateIPv4TCPPacket(client, server, 40000, 80, TCPFlagSYN), 1)
+		table.HandleInboundPacket(CreateIPv4TCPPacket(server, IPv4{1, 2, 3, 4}, 80, 49153, TCPFlagSYN|TCPFlagACK))
+		for i := 0; i < 1000; i++ {
+			table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, 5000, 53, nil), 1)
+			table.HandleInboundPacket(CreateIPv4UDPPacket(server, IPv4{1, 2, 3, 4}, 53, 49152, nil))
+			table.HandleOutboundPacket(CreateIPv4TCPPacket(client, server, 40000, 80, TCPFlagACK), 1)
+		}
+		table.HandleOutboundPacket(CreateIPv4TCPPacket(client, server, 40000, 80, TCPFlagRST), 1)
+	}()
+	for polling := true; polling; {
+		select {
+		case <-done:
+			polling = false
+		default:
+		}
+		table.Connections()
+		table.ForEachConn(func(c ConnInfo[IPv4]) bool { return true })
+	}
+
+	for _, c := range table.Connections() {
+		if c.Protocol == ProtocolTCP && (!c.PendingSweep || c.State != TCPStateClosed) {
+			t.Errorf("Expected the TCP connection closed by the RST, got %+v", c)
+		}
+		if c.Protocol == ProtocolUDP && !c.Assured {
+			t.Errorf("Expected the UDP connection assured, got %+v", c)
+		}
+	}
+}
+
+func TestIPv4TableConnectionsForInternalIP(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+
+	target := IPv4{192, 168, 1, 100}
+	other := IPv4{192, 168, 1, 101}
+	server := IPv4{8, 8, 8, 8}
+
+	for _, host := range []IPv4{target, other} {
+		table.HandleOutboundPacket(CreateIPv4TCPPacket(host, server, 45000, 80, TCPFlagSYN), 1)
+		table.HandleOutboundPacket(CreateIPv4UDPPacket(host, server, 5000, 53, nil), 2)
+		table.HandleOutboundPacket(CreateIPv4ICMPPacket(host, server, ICMPTypeEchoRequest, 0, 1234, 1), 3)
+	}
+
+	conns := table.ConnectionsForInternalIP(target)
+	if len(conns) != 3 {
+		t.Fatalf("Expected 3 connections for %s, got %d", target, len(conns))
+	}
+	for _, c := range conns {
+		if c.LocalSrcIP != target {
+			t.Errorf("Unexpected connection from %s", c.LocalSrcIP)
+		}
+	}
+
+	if n := table.DeleteForInternalIP(target); n != 3 {
+		t.Errorf("Expected 3 deleted connections, got %d", n)
+	}
+	if n := len(table.ConnectionsForInternalIP(target)); n != 0 {
+		t.Errorf("%d connections left for %s", n, target)
+	}
+	if n := len(table.ConnectionsForInternalIP(other)); n != 3 {
+		t.Errorf("Expected the 3 connections of %s to remain, got %d", other, n)
+	}
+}
+
+func TestIPv4TableMaxConnAge(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	now := int64(1000)
+	table.Now = func() int64 { return now }
+	table.MaxConnAge = 300
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	var port uint16
+	for ; now <= 1300; now += 60 {
+		packet := CreateIPv4UDPPacket(client, server, 5000, 53, nil)
+		if err := table.HandleOutboundPacket(packet, 1); err != nil {
+			t.Fatalf("HandleOutboundPacket failed: %v", err)
+		}
+		udp, _ := ParseUDPHeader(packet, 20)
+		port = udp.SourcePort
+		table.RunMaintenance(now)
+		if table.UDP.len() != 1 {
+			t.Fatalf("Active flow removed at age %d", now-1000)
+		}
+	}
+	if info, _ := table.LookupByExternalPort(ProtocolUDP, port); info.CreatedAt != 1000 {
+		t.Errorf("Expected CreatedAt 1000, got %d", info.CreatedAt)
+	}
+
+	// Still refreshed, but past the cap
+	table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, 5000, 53, nil), 1)
+	table.RunMaintenance(now)
+	if table.UDP.len() != 0 {
+		t.Error("Flow older than MaxConnAge wasn't removed")
+	}
+}
+
+func TestIPv4TableSkipChecksums(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	table.SkipChecksums = true
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	tcp := CreateIPv4TCPPacket(client, server, 45000, 80, TCPFlagSYN)
+	udp := CreateIPv4UDPPacket(client, server, 5000, 53, []byte("query"))
+	icmp := CreateIPv4ICMPPacket(client, server, ICMPTypeEchoRequest, 0, 1234, 1)
+	for _, packet := range [][]byte{tcp, udp, icmp} {
+		if err := table.HandleOutboundPacket(packet, 1); err != nil {
+			t.Fatalf("HandleOutboundPacket failed: %v", err)
+		}
+		header, _ := ParseIPv4Header(packet)
+		if header.SourceIP != table.externalIP {
+			t.Errorf("Packet not translated, source %s", header.SourceIP)
+		}
+		if !VerifyIPv4Checksum(packet) {
+			t.Error("IP header checksum must still be computed")
+		}
+	}
+
+	if sum := binary.BigEndian.Uint16(tcp[36:38]); sum != 0 {
+		t.Errorf("Expected zero TCP checksum, got %#04x", sum)
+	}
+	if sum := binary.BigEndian.Uint16(udp[26:28]); sum != 0 {
+		t.Errorf("Expected zero UDP checksum, got %#04x", sum)
+	}
+	if calculateICMPChecksum(icmp[20:]) != 0 {
+		t.Error("ICMP checksum must still be computed")
+	}
+
+	udpHeader, _ := ParseUDPHeader(udp, 20)
+	reply := CreateIPv4UDPPacket(server, table.externalIP, 53, udpHeader.SourcePort, []byte("answer"))
+	if _, err := table.HandleInboundPacket(reply); err != nil {
+		t.Fatalf("HandleInboundPacket failed: %v", err)
+	}
+	if sum := binary.BigEndian.Uint16(reply[26:28]); sum != 0 {
+		t.Errorf("Expected zero UDP checksum on inbound, got %#04x", sum)
+	}
+}
+
+func TestIPv4TableProtocolAnyRules(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+
+	client := IPv4{192, 168, 1, 100}
+	service := IPv4{10, 0, 0, 243}
+	backend := IPv4{10, 7, 0, 1}
+	table.AddRedirectRule(ProtocolAny, service, 53, backend, 5353)
+	table.AddDropRule(ProtocolAny, 25)
+
+	tcp := CreateIPv4TCPPacket(client, service, 45000, 53, TCPFlagSYN)
+	udp := CreateIPv4UDPPacket(client, service, 5000, 53, nil)
+	for _, packet := range [][]byte{tcp, udp} {
+		if err := table.HandleOutboundPacket(packet, 1); err != nil {
+			t.Fatalf("HandleOutboundPacket failed: %v", err)
+		}
+		header, _ := ParseIPv4Header(packet)
+		dstPort := binary.BigEndian.Uint16(packet[22:24])
+		if header.DestinationIP != backend || dstPort != 5353 {
+			t.Errorf("Protocol %d not redirected: %s:%d", header.Protocol, header.DestinationIP, dstPort)
+		}
+	}
+
+	for _, packet := range [][]byte{
+		CreateIPv4TCPPacket(client, IPv4{8, 8, 8, 8}, 45001, 25, TCPFlagSYN),
+		CreateIPv4UDPPacket(client, IPv4{8, 8, 8, 8}, 5001, 25, nil),
+	} {
+		if err := table.HandleOutboundPacket(packet, 1); err != ErrDropPacket {
+			t.Errorf("Expected ErrDropPacket on port 25, got %v", err)
+		}
+	}
+}
+
+func TestIPv4TableNamespaceStats(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	table.MaxConnPerNamespace = 2
+	table.AddDropRule(ProtocolUDP, 25)
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	// Namespace 1: three flows, one evicted, and a reply
+	var bytesOut uint64
+	var port uint16
+	for i := 0; i < 3; i++ {
+		packet := CreateIPv4UDPPacket(client, server, uint16(5000+i), 53, []byte("query"))
+		bytesOut += uint64(len(packet))
+		table.HandleOutboundPacket(packet, 1)
+		udp, _ := ParseUDPHeader(packet, 20)
+		port = udp.SourcePort
+	}
+	reply := CreateIPv4UDPPacket(server, table.externalIP, 53, port, []byte("a longer answer"))
+	table.HandleInboundPacket(reply)
+
+	// Namespace 2: one flow and a dropped packet
+	table.HandleOutboundPacket(CreateIPv4TCPPacket(client, server, 45000, 80, TCPFlagSYN), 2)
+	table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, 6000, 25, nil), 2)
+
+	got := table.NamespaceStats(1)
+	want := NamespaceStats{
+		Connections: 2,
+		PacketsOut:  3,
+		PacketsIn:   1,
+		BytesOut:    bytesOut,
+		BytesIn:     uint64(len(reply)),
+		Evictions:   1,
+	}
+	if got != want {
+		t.Errorf("Namespace 1 stats:\n got %+v\nwant %+v", got, want)
+	}
+
+	got = table.NamespaceStats(2)
+	want = NamespaceStats{Connections: 1, PacketsOut: 1, BytesOut: 40, Drops: 1}
+	if got != want {
+		t.Errorf("Namespace 2 stats:\n got %+v\nwant %+v", got, want)
+	}
+
+	if got := table.NamespaceStats(3); got != (NamespaceStats{}) {
+		t.Errorf("Expected empty stats for an unused namespace, got %+v", got)
+	}
+
+	// Refused packets of namespaces without connections create no entry
+	for ns := uintptr(100); ns < 1100; ns++ {
+		table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, 6000, 25, nil), ns)
+	}
+	entries := 0
+	table.nsStats.Range(func(_, _ any) bool {
+		entries++
+		return true
+	})
+	if entries != 2 {
+		t.Errorf("Expected counters for 2 namespaces, got %d", entries)
+	}
+}
+
+func TestIPv4TableCoupledPorts(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	table.CoupledPorts = true
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	// Shift the pools apart so sharing can't happen by chance
+	table.HandleOutboundPacket(CreateIPv4UDPPacket(IPv4{192, 168, 1, 7}, server, 9999, 53, nil), 1)
+
+	udp := CreateIPv4UDPPacket(client, server, 5353, 53, nil)
+	table.HandleOutboundPacket(udp, 1)
+	udpHeader, _ := ParseUDPHeader(udp, 20)
+
+	tcp := CreateIPv4TCPPacket(client, server, 5353, 53, TCPFlagSYN)
+	table.HandleOutboundPacket(tcp, 1)
+	tcpHeader, _ := ParseTCPHeader(tcp, 20)
+
+	if tcpHeader.SourcePort != udpHeader.SourcePort {
+		t.Errorf("Expected TCP to share external port %d, got %d", udpHeader.SourcePort, tcpHeader.SourcePort)
+	}
+
+	// Another source gets its own port, and without the mode nothing is shared
+	other := CreateIPv4TCPPacket(IPv4{192, 168, 1, 101}, server, 5353, 53, TCPFlagSYN)
+	table.HandleOutboundPacket(other, 1)
+	if h, _ := ParseTCPHeader(other, 20); h.SourcePort == udpHeader.SourcePort {
+		t.Error("Unrelated source got the coupled port")
+	}
+
+	table.CoupledPorts = false
+	table.HandleOutboundPacket(CreateIPv4UDPPacket(IPv4{192, 168, 1, 7}, server, 9998, 53, nil), 1)
+	udp = CreateIPv4UDPPacket(client, server, 6000, 53, nil)
+	table.HandleOutboundPacket(udp, 1)
+	udpHeader, _ = ParseUDPHeader(udp, 20)
+	tcp = CreateIPv4TCPPacket(client, server, 6000, 53, TCPFlagSYN)
+	table.HandleOutboundPacket(tcp, 1)
+	if h, _ := ParseTCPHeader(tcp, 20); h.SourcePort == udpHeader.SourcePort {
+		t.Error("Ports coupled with the mode off")
+	}
+}
+
+func TestIPv4TableInboundInitiated(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+
+	var created []ConnInfo[IPv4]
+	table.OnNewConn = func(c ConnInfo[IPv4]) {
+		created = append(created, c)
+	}
+
+	internal := IPv4{192, 168, 1, 50}
+	remote := IPv4{203, 0, 113, 9}
+	table.AddPortRangeForward(ProtocolTCP, 8000, 8010, internal, 1)
+
+	// Outbound-created connection
+	table.HandleOutboundPacket(CreateIPv4TCPPacket(internal, IPv4{8, 8, 8, 8}, 45000, 443, TCPFlagSYN), 1)
+	// Port-forward-created connection
+	if _, err := table.HandleInboundPacket(CreateIPv4TCPPacket(remote, table.externalIP, 51000, 8008, TCPFlagSYN)); err != nil {
+		t.Fatalf("HandleInboundPacket failed: %v", err)
+	}
+
+	if len(created) != 2 {
+		t.Fatalf("Expected 2 OnNewConn calls, got %d", len(created))
+	}
+	if created[0].InboundInitiated {
+		t.Error("Outbound connection flagged as inbound initiated")
+	}
+	fwd := created[1]
+	if !fwd.InboundInitiated {
+		t.Error("Forwarded connection not flagged as inbound initiated")
+	}
+	if fwd.OutsideDstIP != remote || fwd.OutsideSrcPort != 8008 || fwd.LocalSrcIP != internal || fwd.CreatedAt == 0 {
+		t.Errorf("Unexpected forwarded connection record %+v", fwd)
+	}
+}
+
+func TestIPv4TableICMPReplySource(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+
+	client := IPv4{192, 168, 1, 100}
+	serverA := IPv4{8, 8, 8, 8}
+	serverB := IPv4{9, 9, 9, 9}
+
+	pingA := CreateIPv4ICMPPacket(client, serverA, ICMPTypeEchoRequest, 0, 100, 1)
+	if err := table.HandleOutboundPacket(pingA, 1); err != nil {
+		t.Fatalf("ICMP outbound to A failed: %v", err)
+	}
+	pingB := CreateIPv4ICMPPacket(client, serverB, ICMPTypeEchoRequest, 0, 200, 1)
+	if err := table.HandleOutboundPacket(pingB, 1); err != nil {
+		t.Fatalf("ICMP outbound to B failed: %v", err)
+	}
+	ipA, _ := ParseIPv4Header(pingA)
+	icmpA, _ := ParseICMPHeader(pingA, 20)
+
+	// Alias flow A's identifier under server B, as a colliding entry would
+	table.ICMP.mutex.Lock()
+	conn := table.ICMP.in[ExternalKey[IPv4]{SrcIP: serverA, DstIP: ipA.SourceIP, DstPort: icmpA.ID}]
+	table.ICMP.in[ExternalKey[IPv4]{SrcIP: serverB, DstIP: ipA.SourceIP, DstPort: icmpA.ID}] = conn
+	table.ICMP.mutex.Unlock()
+	if conn == nil {
+		t.Fatal("Flow to server A not found")
+	}
+
+	// A reply from the wrong server is dropped rather than misrouted
+	wrong := CreateIPv4ICMPPacket(serverB, ipA.SourceIP, ICMPTypeEchoReply, 0, icmpA.ID, 1)
+	if _, err := table.HandleInboundPacket(wrong); err != ErrDropPacket {
+		t.Errorf("Expected ErrDropPacket for reply from wrong server, got %v", err)
+	}
+
+	// The real server still gets through
+	reply := CreateIPv4ICMPPacket(serverA, ipA.SourceIP, ICMPTypeEchoReply, 0, icmpA.ID, 1)
+	if _, err := table.HandleInboundPacket(reply); err != nil {
+		t.Fatalf("Reply from server A failed: %v", err)
+	}
+	icmp, _ := ParseICMPHeader(reply, 20)
+	if icmp.ID != 100 {
+		t.Errorf("Expected ID restored to 100, got %d", icmp.ID)
+	}
+}
+
+func TestIPv4TableCompact(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	table.MaxConnPerNamespace = 0
+	now := int64(1000)
+	table.Now = func() int64 { return now }
+
+	server := IPv4{8, 8, 8, 8}
+	for i := 0; i < 10000; i++ {
+		client := IPv4{10, 0, byte(i >> 8), byte(i)}
+		if err := table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, 5000, 53, nil), 1); err != nil {
+			t.Fatalf("HandleOutboundPacket %d failed: %v", i, err)
+		}
+	}
+
+	// Drain all but one flow
+	now += table.UDPTimeout
+	survivor := IPv4{10, 0, 0, 1}
+	table.HandleOutboundPacket(CreateIPv4UDPPacket(survivor, server, 5000, 53, nil), 1)
+	table.RunMaintenance(now + 1)
+	if table.UDP.len() != 1 {
+		t.Fatalf("Expected 1 connection after draining, got %d", table.UDP.len())
+	}
+
+	heap := func() uint64 {
+		var m runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&m)
+		return m.HeapAlloc
+	}
+	oldOut := reflect.ValueOf(table.UDP.out).Pointer()
+	before := heap()
+	table.Compact()
+	after := heap()
+
+	if reflect.ValueOf(table.UDP.out).Pointer() == oldOut {
+		t.Error("Compact didn't reallocate the maps")
+	}
+	if after >= before {
+		t.Errorf("Expected the heap to shrink, went from %d to %d bytes", before, after)
+	}
+
+	// The remaining flow still works both ways
+	packet := CreateIPv4UDPPacket(survivor, server, 5000, 53, nil)
+	if err := table.HandleOutboundPacket(packet, 1); err != nil {
+		t.Fatalf("Outbound after Compact failed: %v", err)
+	}
+	ip, _ := ParseIPv4Header(packet)
+	udp, _ := ParseUDPHeader(packet, 20)
+	reply := CreateIPv4UDPPacket(server, ip.SourceIP, 53, udp.SourcePort, nil)
+	if _, err := table.HandleInboundPacket(reply); err != nil {
+		t.Fatalf("Inbound after Compact failed: %v", err)
+	}
+	if info, ok := table.LookupByExternalPort(ProtocolUDP, udp.SourcePort); !ok || info.LocalSrcIP != survivor {
+		t.Error("Port index lost by Compact")
+	}
+}
+
+func TestIPv4TableMulticastRelay(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+
+	client := IPv4{192, 168, 1, 50}
+	group := IPv4{224, 0, 0, 251}
+	resolver := IPv4{10, 9, 9, 9}
+
+	if err := table.AddMulticastRelay(IPv4{10, 0, 0, 1}, 5353, resolver); err == nil {
+		t.Error("Expected an error for a unicast group")
+	}
+	if err := table.AddMulticastRelay(group, 5353, resolver); err != nil {
+		t.Fatalf("AddMulticastRelay failed: %v", err)
+	}
+
+	query := CreateIPv4UDPPacket(client, group, 5353, 5353, []byte("query"))
+	if err := table.HandleOutboundPacket(query, 7); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	ip, _ := ParseIPv4Header(query)
+	udp, _ := ParseUDPHeader(query, 20)
+	if ip.DestinationIP != resolver || udp.DestinationPort != 5353 {
+		t.Fatalf("Expected query relayed to %v:5353, got %v:%d", resolver, ip.DestinationIP, udp.DestinationPort)
+	}
+	if !VerifyUDPChecksum(query) {
+		t.Error("Invalid UDP checksum on relayed query")
+	}
+
+	reply := CreateIPv4UDPPacket(resolver, ip.SourceIP, 5353, udp.SourcePort, []byte("answer"))
+	ns, err := table.HandleInboundPacket(reply)
+	if err != nil {
+		t.Fatalf("HandleInboundPacket failed: %v", err)
+	}
+	if ns != 7 {
+		t.Errorf("Expected namespace 7, got %d", ns)
+	}
+	ip, _ = ParseIPv4Header(reply)
+	udp, _ = ParseUDPHeader(reply, 20)
+	if ip.DestinationIP != client || udp.DestinationPort != 5353 {
+		t.Errorf("Expected reply to %v:5353, got %v:%d", client, ip.DestinationIP, udp.DestinationPort)
+	}
+	if ip.SourceIP != resolver {
+		t.Errorf("Expected reply from the unicast resolver, got %v", ip.SourceIP)
+	}
+}
+
+func TestIPv4TableHandleDirection(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	_, internal, _ := net.ParseCIDR("192.168.0.0/16")
+	if err := table.RegisterInternalPrefix(*internal); err != nil {
+		t.Fatalf("RegisterInternalPrefix failed: %v", err)
+	}
+	_, v6, _ := net.ParseCIDR("2001:db8::/64")
+	if err := table.RegisterInternalPrefix(*v6); err == nil {
+		t.Error("Expected an IPv6 prefix to be refused by an IPv4 table")
+	}
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	// Internal source, handled as outbound
+	packet := CreateIPv4UDPPacket(client, server, 5000, 53, nil)
+	ns, err := table.Handle(packet, 3)
+	if err != nil {
+		t.Fatalf("Handle (outbound) failed: %v", err)
+	}
+	if ns != 3 {
+		t.Errorf("Expected namespace 3 for outbound, got %d", ns)
+	}
+	ip, _ := ParseIPv4Header(packet)
+	udp, _ := ParseUDPHeader(packet, 20)
+	if ip.SourceIP != (IPv4{1, 2, 3, 4}) {
+		t.Errorf("Outbound packet not translated, source %v", ip.SourceIP)
+	}
+
+	// Destined to the external IP, handled as inbound
+	reply := CreateIPv4UDPPacket(server, ip.SourceIP, 53, udp.SourcePort, nil)
+	ns, err = table.Handle(reply, 0)
+	if err != nil {
+		t.Fatalf("Handle (inbound) failed: %v", err)
+	}
+	if ns != 3 {
+		t.Errorf("Expected namespace 3 for inbound, got %d", ns)
+	}
+	if ip, _ := ParseIPv4Header(reply); ip.DestinationIP != client {
+		t.Errorf("Inbound packet not translated, destination %v", ip.DestinationIP)
+	}
+
+	// Internal host to the external IP matches both, others match neither
+	hairpin := CreateIPv4UDPPacket(client, IPv4{1, 2, 3, 4}, 5000, 53, nil)
+	if _, err := table.Handle(hairpin, 3); err != ErrUnknownDirection {
+		t.Errorf("Expected ErrUnknownDirection for hairpin, got %v", err)
+	}
+	stray := CreateIPv4UDPPacket(IPv4{10, 0, 0, 1}, server, 5000, 53, nil)
+	if _, err := table.Handle(stray, 3); err != ErrUnknownDirection {
+		t.Errorf("Expected ErrUnknownDirection for unknown source, got %v", err)
+	}
+}
+
+func TestIPv4TableMaxHalfOpen(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	table.MaxHalfOpenPerNamespace = 3
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	var first []byte
+	for i := 0; i < 3; i++ {
+		syn := CreateIPv4TCPPacket(client, server, uint16(40000+i), 80, TCPFlagSYN)
+		if err := table.HandleOutboundPacket(syn, 1); err != nil {
+			t.Fatalf("SYN %d failed: %v", i, err)
+		}
+		if first == nil {
+			first = syn
+		}
+	}
+
+	// Unanswered SYNs fill the cap
+	flood := CreateIPv4TCPPacket(client, server, 40010, 80, TCPFlagSYN)
+	if err := table.HandleOutboundPacket(flood, 1); err != ErrSynFlood {
+		t.Fatalf("Expected ErrSynFlood, got %v", err)
+	}
+	if err := table.HandleOutboundPacket(CreateIPv4TCPPacket(client, server, 40010, 80, TCPFlagSYN), 2); err != nil {
+		t.Errorf("Other namespace affected by the cap: %v", err)
+	}
+
+	// Answering one frees a slot
+	ip, _ := ParseIPv4Header(first)
+	tcp, _ := ParseTCPHeader(first, 20)
+	synAck := CreateIPv4TCPPacket(server, ip.SourceIP, 80, tcp.SourcePort, TCPFlagSYN|TCPFlagACK)
+	if _, err := table.HandleInboundPacket(synAck); err != nil {
+		t.Fatalf("SYN-ACK failed: %v", err)
+	}
+	if err := table.HandleOutboundPacket(CreateIPv4TCPPacket(client, server, 40010, 80, TCPFlagSYN), 1); err != nil {
+		t.Errorf("SYN after a slot was freed failed: %v", err)
+	}
+	if err := table.HandleOutboundPacket(CreateIPv4TCPPacket(client, server, 40011, 80, TCPFlagSYN), 1); err != ErrSynFlood {
+		t.Errorf("Expected ErrSynFlood once full again, got %v", err)
+	}
+
+	// Half-open connections timing out free their slots too
+	table.RunMaintenance(table.Now() + table.TCPTimeout + 1)
+	if err := table.HandleOutboundPacket(CreateIPv4TCPPacket(client, server, 40011, 80, TCPFlagSYN), 1); err != nil {
+		t.Errorf("SYN after timeouts failed: %v", err)
+	}
+
+	// Flows adopted mid-stream never were in SYN_SENT and don't count
+	table.AdoptExistingFlows = true
+	for i := 0; i < 3; i++ {
+		if err := table.HandleOutboundPacket(CreateIPv4TCPPacket(client, server, uint16(41000+i), 80, TCPFlagACK), 3); err != nil {
+			t.Fatalf("Adopted flow %d failed: %v", i, err)
+		}
+	}
+	if err := table.HandleOutboundPacket(CreateIPv4TCPPacket(client, server, 41010, 80, TCPFlagSYN), 3); err != nil {
+		t.Errorf("SYN next to adopted flows failed: %v", err)
+	}
+}
+
+func TestIPv4TableHalfOpenCount(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	var syns [][]byte
+	for i := 0; i < 3; i++ {
+		syn := CreateIPv4TCPPacket(client, server, uint16(40000+i), 80, TCPFlagSYN)
+		if err := table.HandleOutboundPacket(syn, 1); err != nil {
+			t.Fatalf("SYN %d failed: %v", i, err)
+		}
+		syns = append(syns, syn)
+	}
+	if n := table.TCP.countHalfOpen(1); n != 3 {
+		t.Fatalf("Expected 3 half-open connections, got %d", n)
+	}
+
+	// The count follows the connections into an imported table
+	var buf bytes.Buffer
+	if err := table.ExportBinary(&buf); err != nil {
+		t.Fatalf("ExportBinary failed: %v", err)
+	}
+	imported := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	if err := imported.ImportBinary(&buf); err != nil {
+		t.Fatalf("ImportBinary failed: %v", err)
+	}
+	if n := imported.TCP.countHalfOpen(1); n != 3 {
+		t.Errorf("Expected 3 imported half-open connections, got %d", n)
+	}
+
+	// A RST leaves SYN_SENT, its removal doesn't count it twice
+	ip, _ := ParseIPv4Header(syns[0])
+	tcp, _ := ParseTCPHeader(syns[0], 20)
+	rst := CreateIPv4TCPPacket(server, ip.SourceIP, 80, tcp.SourcePort, TCPFlagRST|TCPFlagACK)
+	if _, err := table.HandleInboundPacket(rst); err != nil {
+		t.Fatalf("RST failed: %v", err)
+	}
+	if n := table.TCP.countHalfOpen(1); n != 2 {
+		t.Errorf("Expected 2 half-open connections after a RST, got %d", n)
+	}
+	table.RunMaintenance(table.Now())
+	if n := table.TCP.countHalfOpen(1); n != 2 {
+		t.Errorf("Expected 2 half-open connections after removal, got %d", n)
+	}
+
+	// Timed out connections leave the count
+	table.RunMaintenance(table.Now() + table.TCPSynTimeout + 1)
+	if n := table.TCP.countHalfOpen(1); n != 0 {
+		t.Errorf("Expected no half-open connection after timeouts, got %d", n)
+	}
+}
+
+func TestIPv4TableAllowReplyFromCIDR(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+
+	client := IPv4{192, 168, 1, 100}
+	farm := IPv4{10, 20, 0, 10}
+
+	packet := CreateIPv4UDPPacket(client, farm, 5000, 53, nil)
+	if err := table.HandleOutboundPacket(packet, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	ip, _ := ParseIPv4Header(packet)
+	udp, _ := ParseUDPHeader(packet, 20)
+
+	other := CreateIPv4UDPPacket(IPv4{10, 20, 0, 11}, ip.SourceIP, 53, udp.SourcePort, nil)
+	if _, err := table.HandleInboundPacket(other); err != ErrDropPacket {
+		t.Fatalf("Expected reply from another farm host dropped before AllowReplyFromCIDR, got %v", err)
+	}
+
+	_, prefix, _ := net.ParseCIDR("10.20.0.0/24")
+	if err := table.AllowReplyFromCIDR(udp.SourcePort, *prefix); err != nil {
+		t.Fatalf("AllowReplyFromCIDR failed: %v", err)
+	}
+
+	for _, src := range []IPv4{{10, 20, 0, 11}, {10, 20, 0, 12}} {
+		reply := CreateIPv4UDPPacket(src, ip.SourceIP, 53, udp.SourcePort, nil)
+		ns, err := table.HandleInboundPacket(reply)
+		if err != nil {
+			t.Fatalf("Reply from %v failed: %v", src, err)
+		}
+		if ns != 1 {
+			t.Errorf("Expected namespace 1, got %d", ns)
+		}
+		rip, _ := ParseIPv4Header(reply)
+		rudp, _ := ParseUDPHeader(reply, 20)
+		if rip.DestinationIP != client || rudp.DestinationPort != 5000 {
+			t.Errorf("Reply from %v not routed to the client: %v:%d", src, rip.DestinationIP, rudp.DestinationPort)
+		}
+	}
+
+	// Outside the prefix, or from another remote port
+	outside := CreateIPv4UDPPacket(IPv4{10, 21, 0, 1}, ip.SourceIP, 53, udp.SourcePort, nil)
+	if _, err := table.HandleInboundPacket(outside); err != ErrDropPacket {
+		t.Errorf("Expected reply from outside the prefix dropped, got %v", err)
+	}
+	wrongPort := CreateIPv4UDPPacket(IPv4{10, 20, 0, 11}, ip.SourceIP, 54, udp.SourcePort, nil)
+	if _, err := table.HandleInboundPacket(wrongPort); err != ErrDropPacket {
+		t.Errorf("Expected reply from another port dropped, got %v", err)
+	}
+}
+
+func TestIPv4TableHandleOutboundPacketParsed(t *testing.T) {
+	parsed := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	plain := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	for _, packet := range [][]byte{
+		CreateIPv4UDPPacket(client, server, 5000, 53, []byte("query")),
+		CreateIPv4TCPPacket(client, server, 40000, 80, TCPFlagSYN),
+		CreateIPv4ICMPPacket(client, server, ICMPTypeEchoRequest, 0, 77, 1),
+	} {
+		want := append([]byte(nil), packet...)
+		if err := plain.HandleOutboundPacket(want, 1); err != nil {
+			t.Fatalf("HandleOutboundPacket failed: %v", err)
+		}
+
+		ipHeader, err := ParseIPv4Header(packet)
+		if err != nil {
+			t.Fatalf("ParseIPv4Header failed: %v", err)
+		}
+		if err := parsed.HandleOutboundPacketParsed(packet, ipHeader, 1); err != nil {
+			t.Fatalf("HandleOutboundPacketParsed failed: %v", err)
+		}
+		if !bytes.Equal(packet, want) {
+			t.Errorf("Protocol %d: parsed path produced %x, want %x", ipHeader.Protocol, packet, want)
+		}
+		if ipHeader.SourceIP != (IPv4{1, 2, 3, 4}) {
+			t.Errorf("Header not updated, source %v", ipHeader.SourceIP)
+		}
+	}
+	if got := parsed.NamespaceStats(1).PacketsOut; got != 3 {
+		t.Errorf("Expected 3 outbound packets counted, got %d", got)
+	}
+
+	// A header that doesn't fit the packet is refused
+	packet := CreateIPv4UDPPacket(client, server, 5001, 53, nil)
+	ipHeader, _ := ParseIPv4Header(packet)
+	ipHeader.IHL = 15
+	if err := parsed.HandleOutboundPacketParsed(packet, ipHeader, 1); err == nil {
+		t.Error("Expected an error for a header longer than the packet")
+	}
+	if err := parsed.HandleOutboundPacketParsed(packet, nil, 1); err == nil {
+		t.Error("Expected an error for a nil header")
+	}
+}
+
+func TestIPv4TableOnEvict(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	now := int64(1000)
+	table.Now = func() int64 { return now }
+	table.MaxConnPerNamespace = 3
+
+	type eviction struct {
+		conn   ConnInfo[IPv4]
+		reason string
+		count  int
+	}
+	var evictions []eviction
+	table.OnEvict = func(c ConnInfo[IPv4], reason string, count int) {
+		evictions = append(evictions, eviction{c, reason, count})
+	}
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	var firstPort uint16
+	for i := 0; i < 4; i++ {
+		packet := CreateIPv4UDPPacket(client, server, uint16(5000+i), 53, nil)
+		if err := table.HandleOutboundPacket(packet, 1); err != nil {
+			t.Fatalf("HandleOutboundPacket %d failed: %v", i, err)
+		}
+		if i == 0 {
+			udp, _ := ParseUDPHeader(packet, 20)
+			firstPort = udp.SourcePort
+		}
+		now++
+	}
+
+	if len(evictions) != 1 {
+		t.Fatalf("Expected 1 eviction, got %d", len(evictions))
+	}
+	e := evictions[0]
+	if e.reason != EvictReasonNamespaceLimit {
+		t.Errorf("Expected reason %q, got %q", EvictReasonNamespaceLimit, e.reason)
+	}
+	if e.count != 3 {
+		t.Errorf("Expected namespace count 3, got %d", e.count)
+	}
+	c := e.conn
+	if c.Protocol != ProtocolUDP || c.Namespace != 1 ||
+		c.LocalSrcIP != client || c.LocalSrcPort != 5000 || c.LocalDstIP != server || c.LocalDstPort != 53 ||
+		c.OutsideSrcIP != (IPv4{1, 2, 3, 4}) || c.OutsideSrcPort != firstPort || c.OutsideDstIP != server || c.OutsideDstPort != 53 {
+		t.Errorf("Unexpected victim %+v", c)
+	}
+}
+
+func TestIPv4TableGlobalEvictionPolicy(t *testing.T) {
+	server := IPv4{8, 8, 8, 8}
+	small := IPv4{192, 168, 1, 10}
+	large := IPv4{192, 168, 1, 20}
+
+	fill := func(policy GlobalEvictionPolicy) (*Table[IPv4], []string) {
+		table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+		now := int64(1000)
+		table.Now = func() int64 { return now }
+		table.MaxConnPerNamespace = 0
+		table.MaxTotalConn = 6
+		table.GlobalEvictionPolicy = policy
+
+		var reasons []string
+		table.OnEvict = func(c ConnInfo[IPv4], reason string, count int) {
+			reasons = append(reasons, reason)
+			if count != 6 {
+				t.Errorf("Expected a table count of 6, got %d", count)
+			}
+		}
+
+		// The small namespace opens the oldest flow, the large one fills
+		// the rest of the table
+		open := func(client IPv4, port uint16, ns uintptr) {
+			if err := table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, port, 53, nil), ns); err != nil {
+				t.Fatalf("HandleOutboundPacket failed: %v", err)
+			}
+			now++
+		}
+		open(small, 5000, 1)
+		for i := 0; i < 5; i++ {
+			open(large, uint16(6000+i), 2)
+		}
+		open(small, 5001, 1)
+		return table, reasons
+	}
+
+	table, reasons := fill(EvictLargestNamespace)
+	if table.UDP.len() != 6 {
+		t.Errorf("Expected 6 connections under the cap, got %d", table.UDP.len())
+	}
+	if n := table.NamespaceStats(1).Connections; n != 2 {
+		t.Errorf("Expected the small namespace to keep both flows, has %d", n)
+	}
+	if n := table.NamespaceStats(2).Evictions; n != 1 {
+		t.Errorf("Expected 1 eviction from the large namespace, got %d", n)
+	}
+	if len(reasons) != 1 || reasons[0] != EvictReasonGlobalLimit {
+		t.Errorf("Expected one %q eviction, got %v", EvictReasonGlobalLimit, reasons)
+	}
+
+	// By default the requesting namespace pays
+	table, _ = fill(EvictRequester)
+	if n := table.NamespaceStats(1).Connections; n != 1 {
+		t.Errorf("Expected the small namespace to lose its old flow, has %d", n)
+	}
+	if n := table.NamespaceStats(2).Connections; n != 5 {
+		t.Errorf("Expected the large namespace untouched, has %d", n)
+	}
+}
+
+func TestIPv4TablePreserveICMPID(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	table.PreserveICMPID = true
+
+	server := IPv4{8, 8, 8, 8}
+	first := IPv4{192, 168, 1, 100}
+	second := IPv4{192, 168, 1, 101}
+
+	ping := CreateIPv4ICMPPacket(first, server, ICMPTypeEchoRequest, 0, 4242, 1)
+	if err := table.HandleOutboundPacket(ping, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	icmp, _ := ParseICMPHeader(ping, 20)
+	if icmp.ID != 4242 {
+		t.Errorf("Expected ID 4242 preserved, got %d", icmp.ID)
+	}
+
+	// Same ID from another host collides and is reassigned
+	ping = CreateIPv4ICMPPacket(second, server, ICMPTypeEchoRequest, 0, 4242, 1)
+	if err := table.HandleOutboundPacket(ping, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	icmp, _ = ParseICMPHeader(ping, 20)
+	if icmp.ID == 4242 {
+		t.Error("Colliding ID wasn't reassigned")
+	}
+
+	// Both replies are routed to their host
+	for _, tc := range []struct {
+		id   uint16
+		host IPv4
+	}{{4242, first}, {icmp.ID, second}} {
+		reply := CreateIPv4ICMPPacket(server, IPv4{1, 2, 3, 4}, ICMPTypeEchoReply, 0, tc.id, 1)
+		if _, err := table.HandleInboundPacket(reply); err != nil {
+			t.Fatalf("Reply to ID %d failed: %v", tc.id, err)
+		}
+		ip, _ := ParseIPv4Header(reply)
+		rh, _ := ParseICMPHeader(reply, 20)
+		if ip.DestinationIP != tc.host || rh.ID != 4242 {
+			t.Errorf("Reply to ID %d went to %v with ID %d", tc.id, ip.DestinationIP, rh.ID)
+		}
+	}
+}
+
+func TestIPv4TableListRules(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	table.AddDropRule(ProtocolUDP, 137)
+	table.AddDropRule(ProtocolTCP, 23)
+	table.AddRedirectRule(ProtocolTCP, IPv4{8, 8, 8, 8}, 80, IPv4{10, 0, 0, 80}, 8080)
+	table.AddPortRangeForward(ProtocolUDP, 7000, 7010, IPv4{192, 168, 1, 50}, 1)
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+	remote := IPv4{9, 9, 9, 9}
+
+	table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, 5000, 137, nil), 1)
+	table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, 5001, 137, nil), 1)
+	table.HandleOutboundPacket(CreateIPv4TCPPacket(client, server, 40000, 80, TCPFlagSYN), 1)
+	table.HandleOutboundPacket(CreateIPv4TCPPacket(client, server, 40001, 80, TCPFlagSYN), 1)
+	table.HandleInboundPacket(CreateIPv4UDPPacket(remote, IPv4{1, 2, 3, 4}, 1234, 7005, nil))
+
+	want := map[string]uint64{
+		"drop/17":    2,
+		"drop/6":     0,
+		"redirect/6": 2,
+		"forward/17": 1,
+	}
+	rules := table.ListRules()
+	if len(rules) != len(want) {
+		t.Fatalf("Expected %d rules, got %d: %+v", len(want), len(rules), rules)
+	}
+	for _, rule := range rules {
+		key := fmt.Sprintf("%s/%d", rule.Kind, rule.Protocol)
+		if hits, ok := want[key]; !ok || rule.Hits != hits {
+			t.Errorf("Rule %s has %d hits, want %d", key, rule.Hits, hits)
+		}
+	}
+	if rules[0].Kind != RuleDrop || rules[0].Drop.DstPort != 23 {
+		t.Errorf("Expected the TCP drop rule first, got %+v", rules[0])
+	}
+
+	// a rule for every protocol with ports shows in each of their pairs,
+	// and only those
+	table.AddDropRule(ProtocolAny, 9)
+	seen := make(map[uint8]bool)
+	for _, rule := range table.ListRules() {
+		if rule.Kind == RuleDrop && rule.Drop.DstPort == 9 {
+			seen[rule.Protocol] = true
+		}
+	}
+	for _, protocol := range []uint8{ProtocolTCP, ProtocolUDP, ProtocolDCCP} {
+		if !seen[protocol] {
+			t.Errorf("ProtocolAny drop rule not listed for protocol %d", protocol)
+		}
+	}
+	for _, protocol := range []uint8{ProtocolICMP, ProtocolESP, ProtocolAny} {
+		if seen[protocol] {
+			t.Errorf("ProtocolAny drop rule listed for portless protocol %d", protocol)
+		}
+	}
+}
+
+// countdownCtx is a context that reports cancellation once Err has been
+// called a given number of times
+type countdownCtx struct {
+	context.Context
+	calls int
+}
+
+func (c *countdownCtx) Err() error {
+	if c.calls--; c.calls < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestIPv4TableRunMaintenanceCtx(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	table.MaxConnPerNamespace = 0
+
+	server := IPv4{8, 8, 8, 8}
+	const total = 10000
+	for i := 0; i < total; i++ {
+		client := IPv4{10, 0, byte(i >> 8), byte(i)}
+		if err := table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, 5000, 53, nil), 1); err != nil {
+			t.Fatalf("HandleOutboundPacket %d failed: %v", i, err)
+		}
+	}
+	expired := table.Now() + table.UDPTimeout + 1
+
+	// Cancelled partway through the UDP scan
+	ctx := &countdownCtx{Context: context.Background(), calls: 4}
+	reaped, err := table.RunMaintenanceCtx(ctx, expired)
+	if err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if reaped == 0 || reaped >= total {
+		t.Errorf("Expected a partial sweep, reaped %d of %d", reaped, total)
+	}
+	left := table.UDP.len()
+	if left != total-reaped {
+		t.Errorf("Expected %d connections left, got %d", total-reaped, left)
+	}
+	table.UDP.mutex.RLock()
+	if len(table.UDP.in) != left || len(table.UDP.byPort) != left {
+		t.Errorf("Maps out of sync: out %d, in %d, byPort %d", left, len(table.UDP.in), len(table.UDP.byPort))
+	}
+	table.UDP.mutex.RUnlock()
+
+	// An uncancelled run finishes the job
+	reaped, err = table.RunMaintenanceCtx(context.Background(), expired)
+	if err != nil {
+		t.Fatalf("RunMaintenanceCtx failed: %v", err)
+	}
+	if reaped != left || table.UDP.len() != 0 {
+		t.Errorf("Expected the %d remaining connections reaped, reaped %d with %d left", left, reaped, table.UDP.len())
+	}
+	if n := table.UDP.ports.available(); n != 16384 {
+		t.Errorf("Expected all ports back in the pool, %d available", n)
+	}
+}
+
+func TestIPv4TablePortReuseDelay(t *testing.T) {
+	nat, err := NewIPv4WithConfig(Config{ExternalIP: net.ParseIP("1.2.3.4"), PortRangeStart: 50000, PortRangeEnd: 50001})
+	if err != nil {
+		t.Fatalf("NewIPv4WithConfig failed: %v", err)
+	}
+	table := nat.(*Table[IPv4])
+	now := int64(1000)
+	table.Now = func() int64 { return now }
+	table.PortReuseDelay = 60
+
+	server := IPv4{8, 8, 8, 8}
+	open := func(client IPv4) (uint16, error) {
+		packet := CreateIPv4UDPPacket(client, server, 5000, 53, nil)
+		err := table.HandleOutboundPacket(packet, 1)
+		udp, _ := ParseUDPHeader(packet, 20)
+		return udp.SourcePort, err
+	}
+
+	first, _ := open(IPv4{192, 168, 1, 1})
+	open(IPv4{192, 168, 1, 2})
+	table.DeleteForInternalIP(IPv4{192, 168, 1, 1})
+
+	now += 59
+	if n := table.UDP.ports.available(); n != 0 {
+		t.Errorf("Expected the freed port held, %d available", n)
+	}
+	if _, ok := table.LookupByExternalPort(ProtocolUDP, first); ok {
+		t.Error("Deleted flow still listed")
+	}
+
+	now++
+	port, err := open(IPv4{192, 168, 1, 3})
+	if err != nil {
+		t.Fatalf("HandleOutboundPacket after the delay failed: %v", err)
+	}
+	if port != first {
+		t.Errorf("Expected port %d reused after the delay, got %d", first, port)
+	}
+}
+
+func TestIPv4TableDHCPRelay(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	server := IPv4{10, 0, 0, 53}
+
+	if err := table.AddDHCPRelay(IPv4{255, 255, 255, 255}); err == nil {
+		t.Error("Expected an error for a broadcast server")
+	}
+	if err := table.AddDHCPRelay(server); err != nil {
+		t.Fatalf("AddDHCPRelay failed: %v", err)
+	}
+
+	discover := CreateIPv4UDPPacket(IPv4{}, IPv4{255, 255, 255, 255}, 68, 67, []byte("discover"))
+	if err := table.HandleOutboundPacket(discover, 4); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	ip, _ := ParseIPv4Header(discover)
+	udp, _ := ParseUDPHeader(discover, 20)
+	if ip.DestinationIP != server || udp.DestinationPort != 67 {
+		t.Fatalf("Expected discover relayed to %v:67, got %v:%d", server, ip.DestinationIP, udp.DestinationPort)
+	}
+	if ip.SourceIP != (IPv4{1, 2, 3, 4}) {
+		t.Errorf("Expected discover sent from the external IP, got %v", ip.SourceIP)
+	}
+	if !VerifyUDPChecksum(discover) {
+		t.Error("Invalid UDP checksum on relayed discover")
+	}
+
+	offer := CreateIPv4UDPPacket(server, ip.SourceIP, 67, udp.SourcePort, []byte("offer"))
+	ns, err := table.HandleInboundPacket(offer)
+	if err != nil {
+		t.Fatalf("HandleInboundPacket failed: %v", err)
+	}
+	if ns != 4 {
+		t.Errorf("Expected the offer for namespace 4, got %d", ns)
+	}
+	ip, _ = ParseIPv4Header(offer)
+	udp, _ = ParseUDPHeader(offer, 20)
+	if ip.DestinationIP != (IPv4{255, 255, 255, 255}) || udp.DestinationPort != 68 {
+		t.Errorf("Expected offer broadcast to port 68, got %v:%d", ip.DestinationIP, udp.DestinationPort)
+	}
+	if ip.SourceIP != server || udp.SourcePort != 67 {
+		t.Errorf("Expected offer from %v:67, got %v:%d", server, ip.SourceIP, udp.SourcePort)
+	}
+	if !VerifyUDPChecksum(offer) {
+		t.Error("Invalid UDP checksum on returned offer")
+	}
+}
+
+func TestIPv4TableMaxPortsPerInternalIP(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	table.MaxPortsPerInternalIP = 3
+
+	greedy := IPv4{192, 168, 1, 10}
+	server := IPv4{8, 8, 8, 8}
+	for i := 0; i < 3; i++ {
+		// spread over namespaces, the cap is per host
+		packet := CreateIPv4UDPPacket(greedy, server, uint16(5000+i), 53, nil)
+		if err := table.HandleOutboundPacket(packet, uintptr(i)); err != nil {
+			t.Fatalf("Flow %d refused: %v", i, err)
+		}
+	}
+	packet := CreateIPv4UDPPacket(greedy, server, 5100, 53, nil)
+	if err := table.HandleOutboundPacket(packet, 9); !errors.Is(err, ErrTooManyPorts) {
+		t.Errorf("Expected ErrTooManyPorts for a fourth port, got %v", err)
+	}
+	// an existing flow still goes through
+	packet = CreateIPv4UDPPacket(greedy, server, 5000, 53, nil)
+	if err := table.HandleOutboundPacket(packet, 0); err != nil {
+		t.Errorf("Existing flow refused: %v", err)
+	}
+	// the cap is per protocol
+	packet = CreateIPv4TCPPacket(greedy, server, 5100, 80, TCPFlagSYN)
+	if err := table.HandleOutboundPacket(packet, 0); err != nil {
+		t.Errorf("TCP flow refused: %v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		packet := CreateIPv4UDPPacket(IPv4{192, 168, 1, 20}, server, uint16(5000+i), 53, nil)
+		if err := table.HandleOutboundPacket(packet, 0); i < 3 && err != nil {
+			t.Fatalf("Other host refused: %v", err)
+		} else if i >= 3 && !errors.Is(err, ErrTooManyPorts) {
+			t.Errorf("Expected the other host capped too, got %v", err)
+		}
+	}
+
+	// freeing a port lets the host allocate again
+	table.DeleteForInternalIP(greedy)
+	packet = CreateIPv4UDPPacket(greedy, server, 5100, 53, nil)
+	if err := table.HandleOutboundPacket(packet, 9); err != nil {
+		t.Errorf("Flow refused after the host's ports were freed: %v", err)
+	}
+}
+
+func TestIPv4TableAssuredEviction(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	table.MaxConnPerNamespace = 2
+	now := int64(1000)
+	table.Now = func() int64 { return now }
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	// the oldest flow gets a reply and becomes assured
+	assured := CreateIPv4UDPPacket(client, server, 5000, 53, nil)
+	if err := table.HandleOutboundPacket(assured, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	udp, _ := ParseUDPHeader(assured, 20)
+	reply := CreateIPv4UDPPacket(server, IPv4{1, 2, 3, 4}, 53, udp.SourcePort, nil)
+	if _, err := table.HandleInboundPacket(reply); err != nil {
+		t.Fatalf("HandleInboundPacket failed: %v", err)
+	}
+	info, _ := table.LookupByExternalPort(ProtocolUDP, udp.SourcePort)
+	if !info.Assured {
+		t.Error("Expected the flow assured once answered")
+	}
+
+	now++
+	oneWay := CreateIPv4UDPPacket(client, server, 5001, 53, nil)
+	table.HandleOutboundPacket(oneWay, 1)
+	oneWayUDP, _ := ParseUDPHeader(oneWay, 20)
+	if info, _ := table.LookupByExternalPort(ProtocolUDP, oneWayUDP.SourcePort); info.Assured {
+		t.Error("Expected an unanswered flow not assured")
+	}
+
+	now++
+	table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, 5002, 53, nil), 1)
+
+	if _, ok := table.LookupByExternalPort(ProtocolUDP, udp.SourcePort); !ok {
+		t.Error("Assured flow evicted")
+	}
+	if _, ok := table.LookupByExternalPort(ProtocolUDP, oneWayUDP.SourcePort); ok {
+		t.Error("Expected the newer one-way flow evicted first")
+	}
+}
+
+func TestIPv4TableZeroIDForDF(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	table.ZeroIDForDF = true
+
+	send := func(port uint16, flags uint8) uint16 {
+		t.Helper()
+		packet := CreateIPv4UDPPacket(IPv4{192, 168, 1, 100}, IPv4{8, 8, 8, 8}, port, 53, []byte("query"))
+		ip, _ := ParseIPv4Header(packet)
+		ip.Identification = 0x1234
+		ip.Flags = flags
+		ip.Marshal(packet)
+		if err := table.HandleOutboundPacket(packet, 1); err != nil {
+			t.Fatalf("HandleOutboundPacket failed: %v", err)
+		}
+		if !VerifyIPv4Checksum(packet) {
+			t.Error("Invalid IP checksum")
+		}
+		ip, _ = ParseIPv4Header(packet)
+		return ip.Identification
+	}
+
+	if id := send(5000, IPv4FlagDontFragment); id != 0 {
+		t.Errorf("Expected DF packet ID zeroed, got %#x", id)
+	}
+	if id := send(5000, 0); id != 0x1234 {
+		t.Errorf("Expected fragmentable packet ID kept, got %#x", id)
+	}
+	if id := send(5001, IPv4FlagDontFragment|IPv4FlagMoreFragments); id != 0x1234 {
+		t.Errorf("Expected fragment ID kept, got %#x", id)
+	}
+
+	table.ZeroIDForDF = false
+	if id := send(5000, IPv4FlagDontFragment); id != 0x1234 {
+		t.Errorf("Expected DF packet ID kept with the option off, got %#x", id)
+	}
+}
+
+func TestIPv4TableTCPStateTimeouts(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	table.TCPClosingTimeout = 120
+	table.TCPTimeWaitTimeout = 30
+	now := int64(1000)
+	table.Now = func() int64 { return now }
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+	open := func(port uint16) uint16 {
+		t.Helper()
+		syn := CreateIPv4TCPPacket(client, server, port, 80, TCPFlagSYN)
+		if err := table.HandleOutboundPacket(syn, 1); err != nil {
+			t.Fatalf("SYN failed: %v", err)
+		}
+		tcp, _ := ParseTCPHeader(syn, 20)
+		synAck := CreateIPv4TCPPacket(server, IPv4{1, 2, 3, 4}, 80, tcp.SourcePort, TCPFlagSYN|TCPFlagACK)
+		if _, err := table.HandleInboundPacket(synAck); err != nil {
+			t.Fatalf("SYN-ACK failed: %v", err)
+		}
+		return tcp.SourcePort
+	}
+	established, closing, timeWait := open(40000), open(40001), open(40002)
+
+	table.HandleOutboundPacket(CreateIPv4TCPPacket(client, server, 40001, 80, TCPFlagFIN|TCPFlagACK), 1)
+	table.HandleOutboundPacket(CreateIPv4TCPPacket(client, server, 40002, 80, TCPFlagFIN|TCPFlagACK), 1)
+	if _, err := table.HandleInboundPacket(CreateIPv4TCPPacket(server, IPv4{1, 2, 3, 4}, 80, timeWait, TCPFlagFIN|TCPFlagACK)); err != nil {
+		t.Fatalf("Inbound FIN failed: %v", err)
+	}
+
+	for port, want := range map[uint16]TCPState{established: TCPStateEstablished, closing: TCPStateClosing, timeWait: TCPStateTimeWait} {
+		if info, _ := table.LookupByExternalPort(ProtocolTCP, port); info.State != want || info.PendingSweep {
+			t.Errorf("Port %d: expected %v, got %v (pending sweep %v)", port, want, info.State, info.PendingSweep)
+		}
+	}
+
+	alive := func(port uint16) bool {
+		_, ok := table.LookupByExternalPort(ProtocolTCP, port)
+		return ok
+	}
+	table.RunMaintenance(now + 31)
+	if alive(timeWait) || !alive(closing) || !alive(established) {
+		t.Errorf("After 31s expected only TIME_WAIT reaped: %v %v %v", alive(established), alive(closing), alive(timeWait))
+	}
+	table.RunMaintenance(now + 121)
+	if alive(closing) || !alive(established) {
+		t.Errorf("After 121s expected CLOSING reaped before ESTABLISHED: %v %v", alive(established), alive(closing))
+	}
+	table.RunMaintenance(now + 86401)
+	if alive(established) {
+		t.Error("ESTABLISHED connection outlived TCPTimeout")
+	}
+
+	// Without closing timeouts a FIN still has the connection swept
+	table.TCPClosingTimeout = 0
+	port := open(40003)
+	table.HandleOutboundPacket(CreateIPv4TCPPacket(client, server, 40003, 80, TCPFlagFIN|TCPFlagACK), 1)
+	if info, _ := table.LookupByExternalPort(ProtocolTCP, port); !info.PendingSweep {
+		t.Error("Expected FIN to mark the connection for sweeping")
+	}
+}
+
+func TestIPv4TableTCPSynTimeout(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	now := int64(1000)
+	table.Now = func() int64 { return now }
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+	syn := func(port uint16) uint16 {
+		t.Helper()
+		packet := CreateIPv4TCPPacket(client, server, port, 80, TCPFlagSYN)
+		if err := table.HandleOutboundPacket(packet, 1); err != nil {
+			t.Fatalf("SYN failed: %v", err)
+		}
+		tcp, _ := ParseTCPHeader(packet, 20)
+		return tcp.SourcePort
+	}
+	state := func(port uint16) (TCPState, bool) {
+		info, ok := table.LookupByExternalPort(ProtocolTCP, port)
+		return info.State, ok
+	}
+
+	unanswered, answered, reset := syn(40000), syn(40001), syn(40002)
+	if s, _ := state(unanswered); s != TCPStateSynSent {
+		t.Errorf("Expected SYN_SENT after a SYN, got %v", s)
+	}
+
+	// A retransmitted SYN doesn't complete the handshake, the SYN-ACK does
+	syn(40001)
+	if s, _ := state(answered); s != TCPStateSynSent {
+		t.Errorf("Expected SYN_SENT after a retransmitted SYN, got %v", s)
+	}
+	if _, err := table.HandleInboundPacket(CreateIPv4TCPPacket(server, IPv4{1, 2, 3, 4}, 80, answered, TCPFlagSYN|TCPFlagACK)); err != nil {
+		t.Fatalf("SYN-ACK failed: %v", err)
+	}
+	if s, _ := state(answered); s != TCPStateEstablished {
+		t.Errorf("Expected ESTABLISHED after the SYN-ACK, got %v", s)
+	}
+
+	if _, err := table.HandleInboundPacket(CreateIPv4TCPPacket(server, IPv4{1, 2, 3, 4}, 80, reset, TCPFlagRST|TCPFlagACK)); err != nil {
+		t.Fatalf("RST failed: %v", err)
+	}
+	if info, _ := table.LookupByExternalPort(ProtocolTCP, reset); info.State != TCPStateClosed || !info.PendingSweep {
+		t.Errorf("Expected CLOSED and pending sweep after a RST, got %v (pending sweep %v)", info.State, info.PendingSweep)
+	}
+
+	table.RunMaintenance(now + table.TCPSynTimeout + 1)
+	if _, ok := state(unanswered); ok {
+		t.Error("SYN_SENT connection outlived TCPSynTimeout")
+	}
+	if _, ok := state(reset); ok {
+		t.Error("CLOSED connection survived maintenance")
+	}
+	if _, ok := state(answered); !ok {
+		t.Error("ESTABLISHED connection expired with TCPSynTimeout")
+	}
+}
+
+func TestIPv4TableRecordModifications(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	table.RecordModifications = true
+
+	if rec := table.LastModification(); rec != (ModRecord{}) {
+		t.Errorf("Expected no record before any packet, got %+v", rec)
+	}
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+	packet := CreateIPv4UDPPacket(client, server, 5000, 53, []byte("query"))
+	original := append([]byte(nil), packet...)
+	if err := table.HandleOutboundPacket(packet, 3); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+
+	rec := table.LastModification()
+	want := ModSrcIP | ModSrcPort | ModIPChecksum | ModL4Checksum
+	if rec.Fields != want {
+		t.Errorf("Expected %v changed, got %v", want, rec.Fields)
+	}
+	if !rec.Outbound || rec.Namespace != 3 {
+		t.Errorf("Expected outbound record for namespace 3, got %+v", rec)
+	}
+	if rec.Before != hashPacket(original) || rec.After != hashPacket(packet) {
+		t.Error("Record hashes don't match the packet before and after translation")
+	}
+
+	udp, _ := ParseUDPHeader(packet, 20)
+	reply := CreateIPv4UDPPacket(server, IPv4{1, 2, 3, 4}, 53, udp.SourcePort, []byte("answer"))
+	if _, err := table.HandleInboundPacket(reply); err != nil {
+		t.Fatalf("HandleInboundPacket failed: %v", err)
+	}
+	rec = table.LastModification()
+	if want := ModDstIP | ModDstPort | ModIPChecksum | ModL4Checksum; rec.Fields != want || rec.Outbound {
+		t.Errorf("Expected inbound record with %v, got %+v", want, rec)
+	}
+
+	// A corrupted payload shows up
+	if got := diffPacket(original, append(original[:len(original)-1:len(original)-1], 'X')); got != ModPayload {
+		t.Errorf("Expected a payload change, got %v", got)
+	}
+}
+
+func TestIPv4TableStrictInternalSource(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	table.StrictInternalSource = true
+	_, prefix, _ := net.ParseCIDR("192.168.1.0/24")
+	if err := table.RegisterNamespacePrefix(1, *prefix); err != nil {
+		t.Fatalf("RegisterNamespacePrefix failed: %v", err)
+	}
+	_, v6, _ := net.ParseCIDR("2001:db8::/64")
+	if err := table.RegisterNamespacePrefix(1, *v6); err == nil {
+		t.Error("Expected an IPv6 prefix to be refused by an IPv4 table")
+	}
+
+	server := IPv4{8, 8, 8, 8}
+	if err := table.HandleOutboundPacket(CreateIPv4UDPPacket(IPv4{192, 168, 1, 100}, server, 5000, 53, nil), 1); err != nil {
+		t.Errorf("In-prefix packet refused: %v", err)
+	}
+	spoofed := CreateIPv4UDPPacket(IPv4{192, 168, 2, 100}, server, 5000, 53, nil)
+	if err := table.HandleOutboundPacket(spoofed, 1); !errors.Is(err, ErrSpoofedSource) {
+		t.Errorf("Expected ErrSpoofedSource, got %v", err)
+	}
+	// namespaces without prefixes aren't checked
+	if err := table.HandleOutboundPacket(CreateIPv4UDPPacket(IPv4{192, 168, 2, 100}, server, 5000, 53, nil), 2); err != nil {
+		t.Errorf("Packet of a namespace without prefixes refused: %v", err)
+	}
+	if !table.isInternal(IPv4{192, 168, 1, 7}) {
+		t.Error("Namespace prefix not registered as internal")
+	}
+
+	table.StrictInternalSource = false
+	if err := table.HandleOutboundPacket(spoofed, 1); err != nil {
+		t.Errorf("Packet refused with StrictInternalSource off: %v", err)
+	}
+}
+
+func TestIPv4TableExpireOlderThan(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	now := int64(1000)
+	table.Now = func() int64 { return now }
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+	for i := 0; i < 4; i++ {
+		now = 1000 + int64(i)*100
+		table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, uint16(5000+i), 53, nil), 1)
+	}
+	table.HandleOutboundPacket(CreateIPv4TCPPacket(client, server, 40000, 80, TCPFlagSYN), 1)
+
+	// flows seen at 1000 and 1100 are older than 1150, the timeout is ignored
+	if n := table.ExpireOlderThan(ProtocolUDP, 1150); n != 2 {
+		t.Errorf("Expected 2 connections expired, got %d", n)
+	}
+	var seen []int64
+	for _, c := range table.UDP.snapshot() {
+		seen = append(seen, c.LastSeen)
+	}
+	slices.Sort(seen)
+	if !slices.Equal(seen, []int64{1200, 1300}) {
+		t.Errorf("Expected flows seen at 1200 and 1300 left, got %v", seen)
+	}
+	if table.TCP.len() != 1 {
+		t.Error("Other protocol affected")
+	}
+	if stats := table.ReapStats(); stats.UDP.Expired.total() != 2 {
+		t.Errorf("Expected 2 expirations counted, got %v", stats.UDP.Expired)
+	}
+
+	if n := table.ExpireOlderThan(ProtocolAny, 2000); n != 3 {
+		t.Errorf("Expected the 3 remaining connections expired, got %d", n)
+	}
+}
+
+func TestIPv4TableChecksumOffsets(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	table.SkipChecksums = true
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+	for _, tc := range []struct {
+		name   string
+		packet []byte
+		verify func([]byte) bool
+	}{
+		{"tcp", CreateIPv4TCPPacket(client, server, 40000, 80, TCPFlagSYN), VerifyTCPChecksum},
+		{"udp", CreateIPv4UDPPacket(client, server, 5000, 53, []byte("query")), VerifyUDPChecksum},
+		{"icmp", CreateIPv4ICMPPacket(client, server, ICMPTypeEchoRequest, 0, 77, 1), func(p []byte) bool {
+			return calculateIPv4Checksum(p[20:]) == 0
+		}},
+	} {
+		offsets, err := table.HandleOutboundPacketOffsets(tc.packet, 1)
+		if err != nil {
+			t.Fatalf("%s: HandleOutboundPacketOffsets failed: %v", tc.name, err)
+		}
+		if offsets.IPChecksum != 10 || offsets.L4Start != 20 {
+			t.Errorf("%s: unexpected offsets %+v", tc.name, offsets)
+		}
+
+		// finish the job like hardware would, at the reported offsets
+		ip, _ := ParseIPv4Header(tc.packet)
+		binary.BigEndian.PutUint16(tc.packet[offsets.IPChecksum:], 0)
+		binary.BigEndian.PutUint16(tc.packet[offsets.IPChecksum:], calculateIPv4Checksum(tc.packet[:20]))
+		l4 := tc.packet[offsets.L4Start:]
+		binary.BigEndian.PutUint16(tc.packet[offsets.L4Checksum:], 0)
+		var sum uint16
+		switch tc.name {
+		case "tcp":
+			sum = calculateTCPChecksum(ip.SourceIP, ip.DestinationIP, l4)
+		case "udp":
+			sum = calculateUDPChecksum(ip.SourceIP, ip.DestinationIP, l4)
+		case "icmp":
+			sum = calculateIPv4Checksum(l4)
+		}
+		binary.BigEndian.PutUint16(tc.packet[offsets.L4Checksum:], sum)
+
+		if !VerifyIPv4Checksum(tc.packet) || !tc.verify(tc.packet) {
+			t.Errorf("%s: checksums computed at the reported offsets don't verify", tc.name)
+		}
+	}
+}
+
+func TestIPv4TableMaxICMPToDestination(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	table.MaxICMPToDestination = 3
+
+	client := IPv4{192, 168, 1, 100}
+	target := IPv4{8, 8, 8, 8}
+	ping := func(dst IPv4, id uint16, namespace uintptr) error {
+		return table.HandleOutboundPacket(CreateIPv4ICMPPacket(client, dst, ICMPTypeEchoRequest, 0, id, 1), namespace)
+	}
+
+	for id := uint16(1); id <= 3; id++ {
+		if err := ping(target, id, 1); err != nil {
+			t.Fatalf("Ping %d refused: %v", id, err)
+		}
+	}
+	if err := ping(target, 4, 1); !errors.Is(err, ErrICMPFlood) {
+		t.Errorf("Expected ErrICMPFlood for the fourth flow, got %v", err)
+	}
+	// existing flows keep going
+	if err := ping(target, 2, 1); err != nil {
+		t.Errorf("Existing flow refused: %v", err)
+	}
+	if err := ping(IPv4{1, 1, 1, 1}, 4, 1); err != nil {
+		t.Errorf("Ping to another target refused: %v", err)
+	}
+	if err := ping(target, 4, 2); err != nil {
+		t.Errorf("Ping from another namespace refused: %v", err)
+	}
+
+	// expired flows free their slots
+	table.RunMaintenance(table.Now() + table.ICMPTimeout + 1)
+	if n := table.ICMP.countToDestination(1, target); n != 0 {
+		t.Errorf("Expected no flow left to the target, got %d", n)
+	}
+	if err := ping(target, 4, 1); err != nil {
+		t.Errorf("Ping after the flows expired refused: %v", err)
+	}
+}
+
+func TestIPv4TableICMPJumboEcho(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	// a 2000 bytes echo followed by unrelated bytes left in the buffer
+	echo := func(src, dst IPv4, icmpType uint8, id uint16) ([]byte, int) {
+		packet := CreateIPv4ICMPPacket(src, dst, icmpType, 0, id, 1)
+		for i := 0; i < 2000; i++ {
+			packet = append(packet, byte(i))
+		}
+		declared := len(packet)
+		ip, _ := ParseIPv4Header(packet)
+		ip.TotalLength = uint16(declared)
+		ip.Marshal(packet)
+		binary.BigEndian.PutUint16(packet[22:24], 0)
+		binary.BigEndian.PutUint16(packet[22:24], calculateICMPChecksum(packet[20:]))
+		return append(packet, 0xde, 0xad, 0xbe, 0xef, 0x01), declared
+	}
+	valid := func(packet []byte, declared int) bool {
+		return calculateICMPChecksum(packet[20:declared]) == 0
+	}
+
+	request, declared := echo(client, server, ICMPTypeEchoRequest, 42)
+	if err := table.HandleOutboundPacket(request, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	if !valid(request, declared) {
+		t.Error("Outbound ICMP checksum doesn't cover the declared length")
+	}
+
+	icmp, _ := ParseICMPHeader(request, 20)
+	reply, declared := echo(server, IPv4{1, 2, 3, 4}, ICMPTypeEchoReply, icmp.ID)
+	if _, err := table.HandleInboundPacket(reply); err != nil {
+		t.Fatalf("HandleInboundPacket failed: %v", err)
+	}
+	if !valid(reply, declared) {
+		t.Error("Inbound ICMP checksum doesn't cover the declared length")
+	}
+}
+
+func TestIPv4TableProcessOutbound(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+	proxy := IPv4{10, 0, 0, 1}
+	table.AddRedirectRule(ProtocolTCP, server, 80, proxy, 8080)
+
+	packet := CreateIPv4UDPPacket(client, server, 5000, 53, nil)
+	res, err := table.ProcessOutbound(packet, 4)
+	if err != nil {
+		t.Fatalf("ProcessOutbound failed: %v", err)
+	}
+	udp, _ := ParseUDPHeader(packet, 20)
+	want := OutboundResult[IPv4]{Namespace: 4, ExternalIP: IPv4{1, 2, 3, 4}, ExternalPort: udp.SourcePort, NewConn: true, Modified: true}
+	if res != want {
+		t.Errorf("New flow: expected %+v, got %+v", want, res)
+	}
+
+	res, err = table.ProcessOutbound(CreateIPv4UDPPacket(client, server, 5000, 53, nil), 4)
+	want.NewConn = false
+	if err != nil || res != want {
+		t.Errorf("Existing flow: expected %+v, got %+v (%v)", want, res, err)
+	}
+
+	packet = CreateIPv4TCPPacket(client, server, 40000, 80, TCPFlagSYN)
+	res, err = table.ProcessOutbound(packet, 4)
+	tcp, _ := ParseTCPHeader(packet, 20)
+	want = OutboundResult[IPv4]{Namespace: 4, ExternalIP: IPv4{1, 2, 3, 4}, ExternalPort: tcp.SourcePort, NewConn: true, Redirected: true, Modified: true}
+	if err != nil || res != want {
+		t.Errorf("Redirected flow: expected %+v, got %+v (%v)", want, res, err)
+	}
+
+	// ICMP errors from inside matching no connection are dropped
+	res, err = table.ProcessOutbound(CreateIPv4ICMPPacket(client, server, ICMPTypeDestinationUnreachable, 3, 0, 0), 4)
+	if !errors.Is(err, ErrDropPacket) || res.Modified || res.NewConn {
+		t.Errorf("Unmatched ICMP error: got %+v (%v), expected ErrDropPacket", res, err)
+	}
+}
+
+func TestIPv4TableSelfHeal(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	table.SelfHeal = true
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	if err := table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, 5000, 53, nil), 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	reply := func() error {
+		_, err := table.HandleInboundPacket(CreateIPv4UDPPacket(server, IPv4{1, 2, 3, 4}, 53, 49152, nil))
+		return err
+	}
+	if err := reply(); err != nil {
+		t.Fatalf("Reply to a consistent entry failed: %v", err)
+	}
+	if n := table.SelfHealRepairs(); n != 0 {
+		t.Errorf("Expected no repairs, got %d", n)
+	}
+
+	// Desynchronize the maps: the in entry no longer has a matching out entry
+	table.UDP.mutex.Lock()
+	for key := range table.UDP.out {
+		delete(table.UDP.out, key)
+	}
+	table.UDP.mutex.Unlock()
+
+	if err := reply(); !errors.Is(err, ErrDropPacket) {
+		t.Errorf("Expected ErrDropPacket for a stale entry, got %v", err)
+	}
+	if n := table.SelfHealRepairs(); n != 1 {
+		t.Errorf("Expected 1 repair, got %d", n)
+	}
+	if n := len(table.UDP.in); n != 0 {
+		t.Errorf("Expected the stale in entry to be removed, %d left", n)
+	}
+
+	if err := reply(); !errors.Is(err, ErrDropPacket) {
+		t.Errorf("Expected ErrDropPacket once repaired, got %v", err)
+	}
+	if n := table.SelfHealRepairs(); n != 1 {
+		t.Errorf("Expected the repair to be counted once, got %d", n)
+	}
+}
+
+func TestIPv4TableProtocolExternalIP(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	ipA := IPv4{5, 5, 5, 5}
+	ipB := IPv4{6, 6, 6, 6}
+	if err := table.SetProtocolExternalIP(ProtocolTCP, ipA); err != nil {
+		t.Fatalf("SetProtocolExternalIP failed: %v", err)
+	}
+	if err := table.SetProtocolExternalIP(ProtocolUDP, ipB); err != nil {
+		t.Fatalf("SetProtocolExternalIP failed: %v", err)
+	}
+	if err := table.SetProtocolExternalIP(99, ipB); err == nil {
+		t.Error("Expected an error for an untracked protocol")
+	}
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	tcpPacket := CreateIPv4TCPPacket(client, server, 40000, 443, TCPFlagSYN)
+	if err := table.HandleOutboundPacket(tcpPacket, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket TCP failed: %v", err)
+	}
+	tcpIP, _ := ParseIPv4Header(tcpPacket)
+	if tcpIP.SourceIP != ipA {
+		t.Errorf("Expected TCP behind %v, got %v", ipA, tcpIP.SourceIP)
+	}
+	tcpPort := binary.BigEndian.Uint16(tcpPacket[20:22])
+
+	udpPacket := CreateIPv4UDPPacket(client, server, 5000, 53, nil)
+	if err := table.HandleOutboundPacket(udpPacket, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket UDP failed: %v", err)
+	}
+	udpIP, _ := ParseIPv4Header(udpPacket)
+	if udpIP.SourceIP != ipB {
+		t.Errorf("Expected UDP behind %v, got %v", ipB, udpIP.SourceIP)
+	}
+	udpPort := binary.BigEndian.Uint16(udpPacket[20:22])
+
+	reply := CreateIPv4TCPPacket(server, ipA, 443, tcpPort, TCPFlagSYN|TCPFlagACK)
+	if ns, err := table.HandleInboundPacket(reply); err != nil || ns != 1 {
+		t.Fatalf("TCP reply to %v failed: ns=%d err=%v", ipA, ns, err)
+	}
+	if ip, _ := ParseIPv4Header(reply); ip.DestinationIP != client {
+		t.Errorf("Expected TCP reply to %v, got %v", client, ip.DestinationIP)
+	}
+
+	reply = CreateIPv4UDPPacket(server, ipB, 53, udpPort, nil)
+	if ns, err := table.HandleInboundPacket(reply); err != nil || ns != 1 {
+		t.Fatalf("UDP reply to %v failed: ns=%d err=%v", ipB, ns, err)
+	}
+	if ip, _ := ParseIPv4Header(reply); ip.DestinationIP != client {
+		t.Errorf("Expected UDP reply to %v, got %v", client, ip.DestinationIP)
+	}
+
+	// A reply to the wrong protocol's address matches nothing
+	if _, err := table.HandleInboundPacket(CreateIPv4UDPPacket(server, ipA, 53, udpPort, nil)); err == nil {
+		t.Error("Expected a UDP reply to the TCP address to be dropped")
+	}
+	for _, ip := range []IPv4{ipA, ipB, {1, 2, 3, 4}} {
+		if !table.ownsIP(ip) {
+			t.Errorf("Expected %v to be owned", ip)
+		}
+	}
+}
+
+func TestIPv4TableCapturePayloadBytes(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	table.CapturePayloadBytes = 8
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	send := func(payload string) ConnInfo[IPv4] {
+		t.Helper()
+		if err := table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, 5000, 53, []byte(payload)), 1); err != nil {
+			t.Fatalf("HandleOutboundPacket failed: %v", err)
+		}
+		info, ok := table.LookupByExternalPort(ProtocolUDP, 49152)
+		if !ok {
+			t.Fatal("Connection not found")
+		}
+		return info
+	}
+
+	if info := send("GET"); info.Payload != "GET" {
+		t.Errorf("Expected the first payload captured, got %q", info.Payload)
+	}
+	if info := send(" /index.html"); info.Payload != "GET /ind" {
+		t.Errorf("Expected capture to stop at the limit, got %q", info.Payload)
+	}
+	table.UDP.mutex.RLock()
+	conn := table.UDP.out[InternalKey[IPv4]{SrcIP: client, DstIP: server, SrcPort: 5000, DstPort: 53, Namespace: 1}]
+	table.UDP.mutex.RUnlock()
+	if info := send("more data"); info.Payload != "GET /ind" || cap(conn.Payload) != 8 {
+		t.Errorf("Expected the buffer to stay at 8 bytes, got %q with capacity %d", info.Payload, cap(conn.Payload))
+	}
+
+	// TCP captures the payload after the header and options
+	packet := CreateIPv4TCPPacket(client, server, 40000, 80, TCPFlagSYN)
+	if err := table.HandleOutboundPacket(packet, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	if info, _ := table.LookupByExternalPort(ProtocolTCP, 49152); info.Payload != "" {
+		t.Errorf("Expected nothing captured from a bare SYN, got %q", info.Payload)
+	}
+}
+
+func TestIPv4TableCapturePayloadConcurrent(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	table.CapturePayloadBytes = 64
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	// The buffer fills while the connections are listed, which the race
+	// detector checks
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, uint16(5000+i), 53, []byte("0123456789")), 1)
+			for j := 0; j < 7; j++ {
+				table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, uint16(5000+i), 53, []byte("abcdefghij")), 1)
+			}
+		}
+	}()
+	for polling := true; polling; {
+		select {
+		case <-done:
+			polling = false
+		default:
+		}
+		for _, c := range table.Connections() {
+			if len(c.Payload) > 64 {
+				t.Fatalf("Captured %d bytes, more than the limit", len(c.Payload))
+			}
+		}
+	}
+
+	for _, c := range table.Connections() {
+		if len(c.Payload) != 64 || c.Payload[:10] != "0123456789" {
+			t.Errorf("Expected 64 bytes captured, got %q", c.Payload)
+		}
+	}
+}
+
+// espPacket builds an IPv4 ESP packet with the given SPI and sequence number
+func espPacket(src, dst IPv4, spi, seq uint32) []byte {
+	packet := make([]byte, 20+8+16)
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	packet[8] = 64
+	packet[9] = ProtocolESP
+	copy(packet[12:16], src[:])
+	copy(packet[16:20], dst[:])
+	binary.BigEndian.PutUint16(packet[10:12], calculateIPv4Checksum(packet[:20]))
+	binary.BigEndian.PutUint32(packet[20:24], spi)
+	binary.BigEndian.PutUint32(packet[24:28], seq)
+	return packet
+}
+
+func TestIPv4TableESP(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	client := IPv4{192, 168, 1, 100}
+	peer := IPv4{203, 0, 113, 9}
+	external := IPv4{1, 2, 3, 4}
+
+	packet := espPacket(client, peer, 0x1000, 1)
+	if err := table.HandleOutboundPacket(packet, 7); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	ipHeader, _ := ParseIPv4Header(packet)
+	if ipHeader.SourceIP != external || ipHeader.DestinationIP != peer {
+		t.Errorf("Expected %v -> %v, got %v -> %v", external, peer, ipHeader.SourceIP, ipHeader.DestinationIP)
+	}
+	if !VerifyIPv4Checksum(packet) {
+		t.Error("Invalid IP checksum")
+	}
+	if binary.BigEndian.Uint32(packet[20:24]) != 0x1000 {
+		t.Error("The SPI must not be changed")
+	}
+
+	// The peer answers with its own SPI, which is learned
+	reply := espPacket(peer, external, 0x2000, 1)
+	ns, err := table.HandleInboundPacket(reply)
+	if err != nil || ns != 7 {
+		t.Fatalf("Inbound ESP failed: ns=%d err=%v", ns, err)
+	}
+	if ipHeader, _ := ParseIPv4Header(reply); ipHeader.DestinationIP != client {
+		t.Errorf("Expected reply to %v, got %v", client, ipHeader.DestinationIP)
+	}
+	if !VerifyIPv4Checksum(reply) {
+		t.Error("Invalid IP checksum on reply")
+	}
+	if _, err := table.HandleInboundPacket(espPacket(peer, external, 0x3000, 2)); !errors.Is(err, ErrDropPacket) {
+		t.Errorf("Expected a foreign SPI to be dropped, got %v", err)
+	}
+	if _, err := table.HandleInboundPacket(espPacket(peer, external, 0x2000, 2)); err != nil {
+		t.Errorf("Expected the learned SPI to pass, got %v", err)
+	}
+
+	// A rekey from the inside lets the next inbound SPI be learned
+	if err := table.HandleOutboundPacket(espPacket(client, peer, 0x1001, 1), 7); err != nil {
+		t.Fatalf("HandleOutboundPacket after rekey failed: %v", err)
+	}
+	if _, err := table.HandleInboundPacket(espPacket(peer, external, 0x3000, 1)); err != nil {
+		t.Errorf("Expected the new inbound SPI to be learned, got %v", err)
+	}
+
+	// Only one internal host may talk ESP to a peer
+	if err := table.HandleOutboundPacket(espPacket(IPv4{192, 168, 1, 101}, peer, 0x4000, 1), 7); !errors.Is(err, ErrDropPacket) {
+		t.Errorf("Expected a second client to the same peer to be dropped, got %v", err)
+	}
+
+	table.RunMaintenance(table.Now() + table.ESPTimeout + 1)
+	if n := table.ESP.len(); n != 0 {
+		t.Errorf("Expected the ESP flow to expire, %d left", n)
+	}
+}
+
+// fakePortAllocator hands out consecutive ports from next and records
+// released ones
+type fakePortAllocator struct {
+	ip       IPv4
+	next     uint16
+	released []uint16
+}
+
+func (a *fakePortAllocator) Allocate(namespace uintptr, protocol uint8, internal IPv4, internalPort uint16) (IPv4, uint16, error) {
+	if a.next == 0 {
+		return IPv4{}, 0, ErrPortsLow
+	}
+	port := a.next
+	a.next++
+	return a.ip, port, nil
+}
+
+func (a *fakePortAllocator) Release(namespace uintptr, protocol uint8, externalIP IPv4, externalPort uint16) {
+	a.released = append(a.released, externalPort)
+}
+
+func TestIPv4TablePortAllocator(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	alloc := &fakePortAllocator{ip: IPv4{9, 9, 9, 9}, next: 1000}
+	table.PortAllocator = alloc
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	packet := CreateIPv4TCPPacket(client, server, 40000, 80, TCPFlagSYN)
+	if err := table.HandleOutboundPacket(packet, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	ipHeader, _ := ParseIPv4Header(packet)
+	tcpHeader, _ := ParseTCPHeader(packet, 20)
+	if ipHeader.SourceIP != alloc.ip || tcpHeader.SourcePort != 1000 {
+		t.Errorf("Expected %v:1000 from the allocator, got %v:%d", alloc.ip, ipHeader.SourceIP, tcpHeader.SourcePort)
+	}
+	if n := table.TCP.ports.available(); n != 65535-49152+1 {
+		t.Errorf("Expected the built-in pool untouched, %d ports available", n)
+	}
+
+	reply := CreateIPv4TCPPacket(server, alloc.ip, 80, 1000, TCPFlagSYN|TCPFlagACK)
+	if _, err := table.HandleInboundPacket(reply); err != nil {
+		t.Fatalf("Reply to the allocated port failed: %v", err)
+	}
+	if err := table.HealthCheck(); err != nil {
+		t.Errorf("HealthCheck failed: %v", err)
+	}
+
+	// Teardown releases the port to the allocator
+	if err := table.HandleOutboundPacket(CreateIPv4TCPPacket(client, server, 40000, 80, TCPFlagRST), 1); err != nil {
+		t.Fatalf("HandleOutboundPacket RST failed: %v", err)
+	}
+	table.RunMaintenance(table.Now())
+	if !slices.Equal(alloc.released, []uint16{1000}) {
+		t.Errorf("Expected port 1000 released, got %v", alloc.released)
+	}
+
+	// A refused flow gives its port back right away
+	table.AllowConn = func(c ConnInfo[IPv4]) bool { return false }
+	if err := table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, 5000, 53, nil), 1); !errors.Is(err, ErrConnRefused) {
+		t.Fatalf("Expected ErrConnRefused, got %v", err)
+	}
+	if !slices.Equal(alloc.released, []uint16{1000, 1001}) {
+		t.Errorf("Expected port 1001 released, got %v", alloc.released)
+	}
+	table.AllowConn = nil
+
+	// Allocation errors are returned to the caller
+	alloc.next = 0
+	if err := table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, 5001, 53, nil), 1); !errors.Is(err, ErrPortsLow) {
+		t.Errorf("Expected the allocator's error, got %v", err)
+	}
+}
+
+func TestIPv4TableMulticastFanOut(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	group := IPv4{239, 1, 2, 3}
+	source := IPv4{203, 0, 113, 5}
+
+	if err := table.JoinMulticast(IPv4{10, 0, 0, 1}, 1); err == nil {
+		t.Error("Expected JoinMulticast to refuse a unicast address")
+	}
+	for _, ns := range []uintptr{7, 3, 7} {
+		if err := table.JoinMulticast(group, ns); err != nil {
+			t.Fatalf("JoinMulticast failed: %v", err)
+		}
+	}
+
+	packet := CreateIPv4UDPPacket(source, group, 5000, 5000, []byte("stream"))
+	orig := slices.Clone(packet)
+	namespaces, err := table.HandleInboundPacketMulticast(packet)
+	if err != nil {
+		t.Fatalf("HandleInboundPacketMulticast failed: %v", err)
+	}
+	if !slices.Equal(namespaces, []uintptr{3, 7}) {
+		t.Errorf("Expected namespaces [3 7], got %v", namespaces)
+	}
+	if !bytes.Equal(packet, orig) {
+		t.Error("Multicast packet must not be modified")
+	}
+	if stats := table.NamespaceStats(3); stats.PacketsIn != 1 {
+		t.Errorf("Expected 1 inbound packet for namespace 3, got %d", stats.PacketsIn)
+	}
+
+	table.LeaveMulticast(group, 3)
+	if namespaces, _ := table.HandleInboundPacketMulticast(packet); !slices.Equal(namespaces, []uintptr{7}) {
+		t.Errorf("Expected namespaces [7] after leaving, got %v", namespaces)
+	}
+	table.LeaveMulticast(group, 7)
+	if _, err := table.HandleInboundPacketMulticast(packet); !errors.Is(err, ErrDropPacket) {
+		t.Errorf("Expected ErrDropPacket without members, got %v", err)
+	}
+
+	// Unicast packets are translated as usual
+	if err := table.HandleOutboundPacket(CreateIPv4UDPPacket(IPv4{192, 168, 1, 100}, source, 5000, 53, nil), 5); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	namespaces, err = table.HandleInboundPacketMulticast(CreateIPv4UDPPacket(source, IPv4{1, 2, 3, 4}, 53, 49152, nil))
+	if err != nil || !slices.Equal(namespaces, []uintptr{5}) {
+		t.Errorf("Expected unicast reply for namespace 5, got %v (%v)", namespaces, err)
+	}
+}
+
+func TestIPv4TableFlowCacheInvalidation(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	table.ReuseConns = true
+	table.EnableFlowCache(16)
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+	outKey := InternalKey[IPv4]{SrcIP: client, DstIP: server, SrcPort: 40000, DstPort: 80, Namespace: 1}
+	inKey := ExternalKey[IPv4]{SrcIP: server, DstIP: IPv4{1, 2, 3, 4}, SrcPort: 80, DstPort: 49152}
+
+	for i := 0; i < 3; i++ {
+		if err := table.HandleOutboundPacket(CreateIPv4TCPPacket(client, server, 40000, 80, TCPFlagSYN), 1); err != nil {
+			t.Fatalf("HandleOutboundPacket failed: %v", err)
+		}
+		if _, err := table.HandleInboundPacket(CreateIPv4TCPPacket(server, IPv4{1, 2, 3, 4}, 80, 49152, TCPFlagSYN|TCPFlagACK)); err != nil {
+			t.Fatalf("HandleInboundPacket failed: %v", err)
+		}
+	}
+	c := table.TCP.cache.Load()
+	if e := c.outSlot(outKey).Load(); e == nil || e.key != outKey {
+		t.Fatal("Expected the outbound lookup to be cached")
+	}
+	if e := c.inSlot(inKey).Load(); e == nil || e.key != inKey {
+		t.Fatal("Expected the inbound lookup to be cached")
+	}
+
+	// Tear the flow down, its recycled object then serves another flow
+	if err := table.HandleOutboundPacket(CreateIPv4TCPPacket(client, server, 40000, 80, TCPFlagRST), 1); err != nil {
+		t.Fatalf("HandleOutboundPacket RST failed: %v", err)
+	}
+	table.RunMaintenance(table.Now())
+	if err := table.HandleOutboundPacket(CreateIPv4TCPPacket(client, server, 40001, 80, TCPFlagSYN), 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+
+	if conn := table.TCP.lookupOutbound(outKey); conn != nil {
+		t.Errorf("Stale outbound hit after teardown: %+v", conn.info())
+	}
+	if conn := table.TCP.lookupInbound(inKey); conn != nil {
+		t.Errorf("Stale inbound hit after teardown: %+v", conn.info())
+	}
+	if _, err := table.HandleInboundPacket(CreateIPv4TCPPacket(server, IPv4{1, 2, 3, 4}, 80, 49152, TCPFlagACK)); !errors.Is(err, ErrDropPacket) {
+		t.Errorf("Expected a reply to the torn down flow to be dropped, got %v", err)
+	}
+
+	table.EnableFlowCache(0)
+	if table.TCP.cache.Load() != nil {
+		t.Error("Expected EnableFlowCache(0) to disable the cache")
+	}
+}
+
+func TestIPv4TableReserve(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	// Take the first port so the reservation isn't trivially the next one
+	if err := table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, 6000, 53, nil), 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+
+	port, err := table.Reserve(ProtocolUDP, client, 5060, server, 5060, 1)
+	if err != nil {
+		t.Fatalf("Reserve failed: %v", err)
+	}
+	if port != 49153 {
+		t.Errorf("Expected port 49153, got %d", port)
+	}
+	if again, err := table.Reserve(ProtocolUDP, client, 5060, server, 5060, 1); err != nil || again != port {
+		t.Errorf("Expected reserving again to return %d, got %d (%v)", port, again, err)
+	}
+	if _, err := table.Reserve(ProtocolICMP, client, 1, server, 0, 1); err == nil {
+		t.Error("Expected Reserve to refuse ICMP")
+	}
+
+	packet := CreateIPv4UDPPacket(client, server, 5060, 5060, []byte("INVITE"))
+	res, err := table.ProcessOutbound(packet, 1)
+	if err != nil {
+		t.Fatalf("ProcessOutbound failed: %v", err)
+	}
+	if res.NewConn || res.ExternalPort != port {
+		t.Errorf("Expected the first packet to use the reserved port %d, got %+v", port, res)
+	}
+	if udp, _ := ParseUDPHeader(packet, 20); udp.SourcePort != port {
+		t.Errorf("Expected source port %d, got %d", port, udp.SourcePort)
+	}
+
+	reply := CreateIPv4UDPPacket(server, IPv4{1, 2, 3, 4}, 5060, port, []byte("200 OK"))
+	ns, err := table.HandleInboundPacket(reply)
+	if err != nil || ns != 1 {
+		t.Fatalf("Reply failed: ns=%d err=%v", ns, err)
+	}
+	ipHeader, _ := ParseIPv4Header(reply)
+	udp, _ := ParseUDPHeader(reply, 20)
+	if ipHeader.DestinationIP != client || udp.DestinationPort != 5060 {
+		t.Errorf("Expected reply to %v:5060, got %v:%d", client, ipHeader.DestinationIP, udp.DestinationPort)
+	}
+	if !VerifyUDPChecksum(reply) {
+		t.Error("Invalid UDP checksum on reply")
+	}
+}
+
+func TestIPv4TableWrongAddressFamily(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+
+	// A minimal IPv6 UDP packet
+	packet := make([]byte, 48)
+	packet[0] = 0x60
+	binary.BigEndian.PutUint16(packet[4:6], 8)
+	packet[6] = ProtocolUDP
+	packet[7] = 64
+	copy(packet[8:24], net.ParseIP("fd00::1"))
+	copy(packet[24:40], net.ParseIP("2001:db8::1"))
+
+	if err := table.HandleOutboundPacket(packet, 1); !errors.Is(err, ErrWrongAddressFamily) {
+		t.Errorf("Expected ErrWrongAddressFamily outbound, got %v", err)
+	}
+	if _, err := table.HandleInboundPacket(packet); !errors.Is(err, ErrWrongAddressFamily) {
+		t.Errorf("Expected ErrWrongAddressFamily inbound, got %v", err)
+	}
+
+	// Other versions are still parse errors
+	packet[0] = 0x50
+	if err := table.HandleOutboundPacket(packet, 1); err == nil || errors.Is(err, ErrWrongAddressFamily) {
+		t.Errorf("Expected a parse error for version 5, got %v", err)
+	}
+}
+
+func TestIPv4TableECNFlagsDontSweep(t *testing.T) {
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+	external := IPv4{1, 2, 3, 4}
+
+	for _, flags := range []uint8{TCPFlagECE, TCPFlagCWR, TCPFlagURG, TCPFlagECE | TCPFlagCWR | TCPFlagURG | TCPFlagPSH} {
+		t.Run(fmt.Sprintf("flags-%#x", flags), func(t *testing.T) {
+			table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+			if err := table.HandleOutboundPacket(CreateIPv4TCPPacket(client, server, 40000, 80, TCPFlagSYN|TCPFlagECE|TCPFlagCWR), 1); err != nil {
+				t.Fatalf("HandleOutboundPacket SYN failed: %v", err)
+			}
+
+			// CE-marked segments in both directions carrying the flags
+			out := CreateIPv4TCPPacket(client, server, 40000, 80, TCPFlagACK|flags)
+			out[1] = 0x03
+			binary.BigEndian.PutUint16(out[10:12], 0)
+			binary.BigEndian.PutUint16(out[10:12], calculateIPv4Checksum(out[:20]))
+			if err := table.HandleOutboundPacket(out, 1); err != nil {
+				t.Fatalf("HandleOutboundPacket failed: %v", err)
+			}
+			in := CreateIPv4TCPPacket(server, external, 80, 49152, TCPFlagACK|flags)
+			in[1] = 0x03
+			binary.BigEndian.PutUint16(in[10:12], 0)
+			binary.BigEndian.PutUint16(in[10:12], calculateIPv4Checksum(in[:20]))
+			if _, err := table.HandleInboundPacket(in); err != nil {
+				t.Fatalf("HandleInboundPacket failed: %v", err)
+			}
+
+			for _, packet := range [][]byte{out, in} {
+				if packet[1]&0x03 != 0x03 {
+					t.Errorf("ECN codepoint lost: TOS %#x", packet[1])
+				}
+				if packet[33] != TCPFlagACK|flags {
+					t.Errorf("Expected flags %#x preserved, got %#x", TCPFlagACK|flags, packet[33])
+				}
+			}
+
+			info, ok := table.LookupByExternalPort(ProtocolTCP, 49152)
+			if !ok {
+				t.Fatal("Connection not found")
+			}
+			if info.PendingSweep || info.State != TCPStateEstablished {
+				t.Errorf("Expected the connection to stay established, got PendingSweep=%v State=%v", info.PendingSweep, info.State)
+			}
+			table.RunMaintenance(table.Now())
+			if table.TCP.len() != 1 {
+				t.Error("Expected the connection to survive maintenance")
+			}
+		})
+	}
+}
+
+func TestIPv4TableIsExternalPortFree(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	external := IPv4{1, 2, 3, 4}
+	client := IPv4{192, 168, 1, 100}
+
+	if !table.IsExternalPortFree(ProtocolUDP, external, 49152) {
+		t.Fatal("Expected port 49152 to be free")
+	}
+	if table.IsExternalPortFree(ProtocolUDP, IPv4{5, 6, 7, 8}, 49152) {
+		t.Error("Expected a port of a foreign address not to be free")
+	}
+
+	port, err := table.Reserve(ProtocolUDP, client, 5060, IPv4{8, 8, 8, 8}, 5060, 1)
+	if err != nil || port != 49152 {
+		t.Fatalf("Reserve returned %d, %v", port, err)
+	}
+	if table.IsExternalPortFree(ProtocolUDP, external, 49152) {
+		t.Error("Expected the reserved port not to be free")
+	}
+	if !table.IsExternalPortFree(ProtocolTCP, external, 49152) {
+		t.Error("Expected the port to stay free for TCP")
+	}
+
+	if n := table.DeleteForInternalIP(client); n != 1 {
+		t.Fatalf("Expected 1 connection deleted, got %d", n)
+	}
+	if !table.IsExternalPortFree(ProtocolUDP, external, 49152) {
+		t.Error("Expected the port to be free again")
+	}
+}
+
+func TestIPv4TableRepoint(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	table.EnableFlowCache(16)
+	client := IPv4{192, 168, 1, 100}
+	service := IPv4{10, 0, 0, 100}
+	backendA := IPv4{10, 0, 1, 1}
+	backendB := IPv4{10, 0, 1, 2}
+	external := IPv4{1, 2, 3, 4}
+	table.AddRedirectRule(ProtocolUDP, service, 5000, backendA, 6000)
+
+	send := func() *IPv4Header {
+		t.Helper()
+		packet := CreateIPv4UDPPacket(client, service, 4000, 5000, []byte("ping"))
+		if err := table.HandleOutboundPacket(packet, 1); err != nil {
+			t.Fatalf("HandleOutboundPacket failed: %v", err)
+		}
+		ipHeader, _ := ParseIPv4Header(packet)
+		return ipHeader
+	}
+	reply := func(from IPv4, port uint16) ([]byte, error) {
+		packet := CreateIPv4UDPPacket(from, external, port, 49152, []byte("pong"))
+		_, err := table.HandleInboundPacket(packet)
+		return packet, err
+	}
+
+	if dst := send().DestinationIP; dst != backendA {
+		t.Fatalf("Expected the flow to go to %v, got %v", backendA, dst)
+	}
+	if _, err := reply(backendA, 6000); err != nil {
+		t.Fatalf("Reply from backend A failed: %v", err)
+	}
+
+	key := InternalKey[IPv4]{SrcIP: client, DstIP: service, SrcPort: 4000, DstPort: 5000, Namespace: 1}
+	if !table.Repoint(ProtocolUDP, key, backendB, 7000) {
+		t.Fatal("Repoint failed")
+	}
+	if table.Repoint(ProtocolUDP, InternalKey[IPv4]{SrcIP: client, DstIP: service, SrcPort: 4001, DstPort: 5000, Namespace: 1}, backendB, 7000) {
+		t.Error("Expected Repoint of an unknown flow to fail")
+	}
+
+	packet := CreateIPv4UDPPacket(client, service, 4000, 5000, []byte("ping"))
+	if err := table.HandleOutboundPacket(packet, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	ipHeader, _ := ParseIPv4Header(packet)
+	udp, _ := ParseUDPHeader(packet, 20)
+	if ipHeader.DestinationIP != backendB || udp.DestinationPort != 7000 || udp.SourcePort != 49152 {
+		t.Errorf("Expected %v:7000 from port 49152, got %v:%d from %d", backendB, ipHeader.DestinationIP, udp.DestinationPort, udp.SourcePort)
+	}
+
+	if _, err := reply(backendA, 6000); !errors.Is(err, ErrDropPacket) {
+		t.Errorf("Expected replies from the old backend to be dropped, got %v", err)
+	}
+	back, err := reply(backendB, 7000)
+	if err != nil {
+		t.Fatalf("Reply from backend B failed: %v", err)
+	}
+	ipHeader, _ = ParseIPv4Header(back)
+	udp, _ = ParseUDPHeader(back, 20)
+	if ipHeader.SourceIP != service || udp.SourcePort != 5000 || ipHeader.DestinationIP != client || udp.DestinationPort != 4000 {
+		t.Errorf("Expected reply %v:5000 -> %v:4000, got %v:%d -> %v:%d", service, client, ipHeader.SourceIP, udp.SourcePort, ipHeader.DestinationIP, udp.DestinationPort)
+	}
+	if err := table.HealthCheck(); err != nil {
+		t.Errorf("HealthCheck failed: %v", err)
+	}
+}
+
+func TestIPv4TableAdaptiveTimeouts(t *testing.T) {
+	server := IPv4{8, 8, 8, 8}
+	reaped := func(flows int) int {
+		table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+		table.AdaptiveTimeouts = true
+		table.AdaptiveLowWatermark = 50
+		table.AdaptiveHighWatermark = 100
+		table.AdaptiveMinTimeout = 10
+		now := int64(1000)
+		table.Now = func() int64 { return now }
+		for i := 0; i < flows; i++ {
+			// idle for 104-i%100 seconds at the maintenance, within UDPTimeout
+			now = 1000 + int64(i%100)
+			packet := CreateIPv4UDPPacket(IPv4{192, 168, 1, byte(i)}, server, 5000, 53, nil)
+			if err := table.HandleOutboundPacket(packet, uintptr(i)); err != nil {
+				t.Fatalf("HandleOutboundPacket failed: %v", err)
+			}
+		}
+		n, err := table.RunMaintenanceCtx(context.Background(), 1104)
+		if err != nil {
+			t.Fatalf("RunMaintenanceCtx failed: %v", err)
+		}
+		return n
+	}
+
+	if n := reaped(40); n != 0 {
+		t.Errorf("Expected no connection reaped below the low watermark, got %d", n)
+	}
+	// At 75 connections timeouts are halfway between 180 and 10 seconds
+	if n := reaped(75); n != 9 {
+		t.Errorf("Expected the 9 connections idle for over 95 seconds reaped, got %d", n)
+	}
+	// Past the high watermark timeouts drop to 10 seconds
+	if n := reaped(150); n != 144 {
+		t.Errorf("Expected the 144 connections idle for over 10 seconds reaped, got %d", n)
+	}
+
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	table.AdaptiveMinTimeout = 10
+	if got := table.adaptTimeout(180, 0.5); got != 95 {
+		t.Errorf("Expected 95 seconds at half pressure, got %d", got)
+	}
+	if got := table.adaptTimeout(5, 1); got != 5 {
+		t.Errorf("Expected a timeout below the minimum left alone, got %d", got)
+	}
+}
+
+func TestIPv4TableNoMatchPortStats(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	scanner := IPv4{203, 0, 113, 66}
+	external := IPv4{1, 2, 3, 4}
+
+	// Disabled by default
+	table.HandleInboundPacket(CreateIPv4TCPPacket(scanner, external, 40000, 22, TCPFlagSYN))
+	if stats := table.NoMatchPortStats(); len(stats) != 0 {
+		t.Errorf("Expected no stats when disabled, got %v", stats)
+	}
+
+	table.NoMatchPortLimit = 3
+	for _, port := range []uint16{22, 22, 23, 80, 443, 8080, 22} {
+		if _, err := table.HandleInboundPacket(CreateIPv4TCPPacket(scanner, external, 40000, port, TCPFlagSYN)); !errors.Is(err, ErrDropPacket) {
+			t.Fatalf("Expected probe to port %d dropped, got %v", port, err)
+		}
+	}
+	table.HandleInboundPacket(CreateIPv4UDPPacket(scanner, external, 40000, 23, nil))
+
+	want := map[uint16]uint64{22: 3, 23: 2, 80: 1}
+	if stats := table.NoMatchPortStats(); !reflect.DeepEqual(stats, want) {
+		t.Errorf("Expected %v, got %v", want, stats)
+	}
+
+	// Replies to live connections aren't counted
+	if err := table.HandleOutboundPacket(CreateIPv4UDPPacket(IPv4{192, 168, 1, 100}, scanner, 5000, 53, nil), 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	if _, err := table.HandleInboundPacket(CreateIPv4UDPPacket(scanner, external, 53, 49152, nil)); err != nil {
+		t.Fatalf("Reply failed: %v", err)
+	}
+	if stats := table.NoMatchPortStats(); !reflect.DeepEqual(stats, want) {
+		t.Errorf("Expected %v after a matched reply, got %v", want, stats)
+	}
+}
+
+func TestIPv4TableTranslateOutboundInto(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	src := CreateIPv4UDPPacket(IPv4{192, 168, 1, 100}, IPv4{8, 8, 8, 8}, 5000, 53, []byte("query"))
+	orig := slices.Clone(src)
+
+	if _, err := table.TranslateOutboundInto(make([]byte, len(src)-1), src, 1); !errors.Is(err, io.ErrShortBuffer) {
+		t.Errorf("Expected io.ErrShortBuffer for a small dst, got %v", err)
+	}
+
+	dst := make([]byte, 1500)
+	n, err := table.TranslateOutboundInto(dst, src, 1)
+	if err != nil {
+		t.Fatalf("TranslateOutboundInto failed: %v", err)
+	}
+	if !bytes.Equal(src, orig) {
+		t.Error("src was modified")
+	}
+	if n != len(src) {
+		t.Fatalf("Expected %d bytes written, got %d", len(src), n)
+	}
+
+	want := slices.Clone(orig)
+	other := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	if err := other.HandleOutboundPacket(want, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	if !bytes.Equal(dst[:n], want) {
+		t.Errorf("Expected %x, got %x", want, dst[:n])
+	}
+	if !VerifyIPv4Checksum(dst[:n]) || !VerifyUDPChecksum(dst[:n]) {
+		t.Error("Invalid checksums in dst")
+	}
+}
+
+type fakeClock struct {
+	sec, nano int64
+}
+
+func (c *fakeClock) Now() int64     { return c.sec }
+func (c *fakeClock) NowNano() int64 { return c.nano }
+
+func TestIPv4TableClock(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	clock := &fakeClock{sec: 1000, nano: 1000_123456789}
+	table.SetClock(clock)
+	table.RecordModifications = true
+
+	packet := CreateIPv4UDPPacket(IPv4{192, 168, 1, 100}, IPv4{8, 8, 8, 8}, 12345, 53, []byte("test"))
+	if err := table.HandleOutboundPacket(packet, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	if rec := table.LastModification(); rec.Time != clock.nano {
+		t.Errorf("Expected modification time %d, got %d", clock.nano, rec.Time)
+	}
+	var conn *Conn[IPv4]
+	for _, c := range table.UDP.out {
+		conn = c
+	}
+	if conn == nil || conn.LastSeen != clock.sec {
+		t.Fatalf("Expected a connection last seen at %d, got %+v", clock.sec, conn)
+	}
+
+	// the clock now drives maintenance as well
+	clock.sec += table.UDPTimeout + 1
+	table.RunMaintenance(clock.sec)
+	if n := len(table.UDP.out); n != 0 {
+		t.Errorf("Expected the connection to expire, %d left", n)
+	}
+
+	table.SetClock(nil)
+	if now := table.Now(); now < time.Now().Unix()-1 {
+		t.Errorf("Expected the system time after SetClock(nil), got %d", now)
+	}
+}
+
+func opaquePacket(src, dst IPv4, protocol uint8, payload []byte) []byte {
+	packet := make([]byte, 20+len(payload))
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	packet[8] = 64
+	packet[9] = protocol
+	copy(packet[12:16], src[:])
+	copy(packet[16:20], dst[:])
+	binary.BigEndian.PutUint16(packet[10:12], calculateIPv4Checksum(packet[:20]))
+	copy(packet[20:], payload)
+	return packet
+}
+
+func TestIPv4TableUnknownProtocolPolicy(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	client := IPv4{192, 168, 1, 100}
+	peer := IPv4{203, 0, 113, 9}
+	external := IPv4{1, 2, 3, 4}
+	const protocol = 253 // reserved for experimentation
+	payload := []byte("opaque payload")
+
+	// dropped by default
+	if err := table.HandleOutboundPacket(opaquePacket(client, peer, protocol, payload), 1); err != ErrDropPacket {
+		t.Errorf("Expected ErrDropPacket by default, got %v", err)
+	}
+	if _, err := table.HandleInboundPacket(opaquePacket(peer, external, protocol, payload)); err != ErrDropPacket {
+		t.Errorf("Expected ErrDropPacket inbound by default, got %v", err)
+	}
+
+	table.UnknownProtocolPolicy = UnknownProtocolPassthroughSNAT
+	packet := opaquePacket(client, peer, protocol, payload)
+	if err := table.HandleOutboundPacket(packet, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	header, _ := ParseIPv4Header(packet)
+	if header.SourceIP != external || header.DestinationIP != peer || header.Protocol != protocol {
+		t.Errorf("Expected %v -> %v, got %v -> %v protocol %d", external, peer, header.SourceIP, header.DestinationIP, header.Protocol)
+	}
+	if !VerifyIPv4Checksum(packet) || !bytes.Equal(packet[20:], payload) {
+		t.Error("Bad checksum or modified payload")
+	}
+
+	reply := opaquePacket(peer, external, protocol, payload)
+	namespace, err := table.HandleInboundPacket(reply)
+	if err != nil {
+		t.Fatalf("HandleInboundPacket failed: %v", err)
+	}
+	header, _ = ParseIPv4Header(reply)
+	if namespace != 1 || header.DestinationIP != client || !VerifyIPv4Checksum(reply) {
+		t.Errorf("Expected reply to %v in namespace 1, got %v in %d", client, header.DestinationIP, namespace)
+	}
+
+	// another protocol from the same peer isn't matched
+	if _, err := table.HandleInboundPacket(opaquePacket(peer, external, protocol-1, payload)); err != ErrDropPacket {
+		t.Errorf("Expected ErrDropPacket for another protocol, got %v", err)
+	}
+	// neither is another internal host to the same peer
+	if err := table.HandleOutboundPacket(opaquePacket(IPv4{192, 168, 1, 101}, peer, protocol, payload), 1); err != ErrDropPacket {
+		t.Errorf("Expected ErrDropPacket for a second host, got %v", err)
+	}
+
+	table.RunMaintenance(table.Now() + table.UnknownProtocolTimeout + 1)
+	if n := table.Other.len(); n != 0 {
+		t.Errorf("Expected the flow to expire, %d left", n)
+	}
+}
+
+func TestIPv4TableSetupLatency(t *testing.T) {
+	setup := func(existing int) Stats {
+		table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+		table.MaxConnPerNamespace = 0 // fill without scanning
+		for i := 0; i < existing; i++ {
+			packet := CreateIPv4UDPPacket(IPv4{192, 168, 1, 100}, IPv4{8, 8, byte(i >> 8), byte(i)}, 5000, 53, nil)
+			if err := table.HandleOutboundPacket(packet, 1); err != nil {
+				t.Fatalf("HandleOutboundPacket failed: %v", err)
+			}
+		}
+		if stats := table.Stats(); stats.Setups != 0 {
+			t.Fatalf("Expected no setups measured while disabled, got %d", stats.Setups)
+		}
+
+		// each new connection evicts one, after scanning the namespace
+		table.MaxConnPerNamespace = existing + 1
+		table.MeasureSetupLatency = true
+		for i := 0; i < 50; i++ {
+			packet := CreateIPv4UDPPacket(IPv4{192, 168, 1, 101}, IPv4{8, 8, 8, 8}, uint16(5000+i), 53, nil)
+			if err := table.HandleOutboundPacket(packet, 1); err != nil {
+				t.Fatalf("HandleOutboundPacket failed: %v", err)
+			}
+		}
+		return table.Stats()
+	}
+
+	empty, full := setup(0), setup(20000)
+	if empty.Setups != 50 || full.Setups != 50 {
+		t.Fatalf("Expected 50 setups measured, got %d and %d", empty.Setups, full.Setups)
+	}
+	if full.AvgSetupNanos <= empty.AvgSetupNanos {
+		t.Errorf("Expected slower setups in a near-full namespace, got %dns vs %dns", full.AvgSetupNanos, empty.AvgSetupNanos)
+	}
+	if full.MaxSetupNanos < full.AvgSetupNanos {
+		t.Errorf("Max setup %dns below average %dns", full.MaxSetupNanos, full.AvgSetupNanos)
+	}
+}
+
+func TestIPv4TableSweepBehavior(t *testing.T) {
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+	external := IPv4{1, 2, 3, 4}
+
+	for _, behavior := range []SweepBehavior{SweepLingerUntilMaintenance, SweepImmediateDrop} {
+		table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+		table.SweepBehavior = behavior
+
+		syn := CreateIPv4TCPPacket(client, server, 40000, 80, TCPFlagSYN)
+		if err := table.HandleOutboundPacket(syn, 1); err != nil {
+			t.Fatalf("HandleOutboundPacket failed: %v", err)
+		}
+		tcp, _ := ParseTCPHeader(syn, 20)
+		port := tcp.SourcePort
+
+		// the server closes, marking the connection for removal
+		fin := CreateIPv4TCPPacket(server, external, 80, port, TCPFlagFIN|TCPFlagACK)
+		if _, err := table.HandleInboundPacket(fin); err != nil {
+			t.Fatalf("HandleInboundPacket failed: %v", err)
+		}
+
+		late := CreateIPv4TCPPacket(server, external, 80, port, TCPFlagACK)
+		_, err := table.HandleInboundPacket(late)
+		switch behavior {
+		case SweepLingerUntilMaintenance:
+			if err != nil {
+				t.Errorf("Expected the late packet translated while lingering, got %v", err)
+			}
+			if n := table.TCP.len(); n != 1 {
+				t.Errorf("Expected the connection kept until maintenance, got %d", n)
+			}
+		case SweepImmediateDrop:
+			if err != ErrDropPacket {
+				t.Errorf("Expected ErrDropPacket for the late packet, got %v", err)
+			}
+			if n := table.TCP.len(); n != 0 {
+				t.Errorf("Expected the connection removed, got %d", n)
+			}
+			// and the client's late ACK isn't translated either
+			ack := CreateIPv4TCPPacket(client, server, 40000, 80, TCPFlagACK)
+			if err := table.HandleOutboundPacket(ack, 1); err != ErrDropPacket {
+				t.Errorf("Expected ErrDropPacket for the outbound late packet, got %v", err)
+			}
+		}
+	}
+}
+
+func TestIPv4TableRunMaintenanceCollect(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	now := int64(1000)
+	table.Now = func() int64 { return now }
+
+	client := IPv4{192, 168, 1, 100}
+	for i := 0; i < 3; i++ {
+		packet := CreateIPv4UDPPacket(client, IPv4{8, 8, 8, 8}, uint16(5000+i), 53, []byte("test"))
+		if err := table.HandleOutboundPacket(packet, 1); err != nil {
+			t.Fatalf("HandleOutboundPacket failed: %v", err)
+		}
+	}
+	if err := table.HandleOutboundPacket(CreateIPv4ICMPPacket(client, IPv4{8, 8, 4, 4}, 8, 0, 7, 1), 2); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	// opened when the others expire
+	now += table.UDPTimeout + 1
+	if err := table.HandleOutboundPacket(CreateIPv4TCPPacket(client, IPv4{8, 8, 8, 8}, 6000, 80, TCPFlagSYN), 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+
+	all := func() []ConnInfo[IPv4] {
+		var res []ConnInfo[IPv4]
+		for _, p := range table.pairs() {
+			res = append(res, p.snapshot()...)
+		}
+		return res
+	}
+	before := all()
+	reaped := table.RunMaintenanceCollect(now)
+	left := all()
+	if len(reaped) != 4 || len(left) != 1 || left[0].Protocol != ProtocolTCP {
+		t.Fatalf("Expected 4 connections collected and the TCP one left, got %+v and %+v", reaped, left)
+	}
+
+	removed := make(map[ConnInfo[IPv4]]bool)
+	for _, c := range before {
+		if c != left[0] {
+			removed[c] = true
+		}
+	}
+	for _, c := range reaped {
+		if !removed[c] {
+			t.Errorf("Collected connection %+v wasn't removed", c)
+		}
+		delete(removed, c)
+	}
+	if len(removed) != 0 {
+		t.Errorf("Removed connections not collected: %+v", removed)
+	}
+
+	if reaped := table.RunMaintenanceCollect(now); len(reaped) != 0 {
+		t.Errorf("Expected nothing collected on a second pass, got %d", len(reaped))
+	}
+}
+
+func TestIPv4TableRuleIndex(t *testing.T) {
+	table := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	for i := 0; i < 500; i++ {
+		table.AddDropRule(ProtocolUDP, uint16(1000+i))
+	}
+	table.AddDropRule(ProtocolAny, 1000)
+	table.AddRedirectRule(ProtocolTCP, IPv4{8, 8, 8, 8}, 80, IPv4{10, 0, 0, 1}, 8080)
+	table.AddRedirectRule(ProtocolTCP, IPv4{8, 8, 8, 8}, 80, IPv4{10, 0, 0, 2}, 8080)
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+	for port, dropped := range map[uint16]bool{999: false, 1000: true, 1250: true, 1499: true, 1500: false} {
+		err := table.HandleOutboundPacket(CreateIPv4UDPPacket(client, server, 5000, port, nil), 1)
+		if (err == ErrDropPacket) != dropped {
+			t.Errorf("UDP to port %d: expected dropped %v, got %v", port, dropped, err)
+		}
+	}
+	if err := table.HandleOutboundPacket(CreateIPv4TCPPacket(client, server, 40000, 1000, TCPFlagSYN), 1); err != ErrDropPacket {
+		t.Errorf("Expected TCP to port 1000 dropped, got %v", err)
+	}
+	if err := table.HandleOutboundPacket(CreateIPv4TCPPacket(client, server, 40000, 1001, TCPFlagSYN), 1); err != nil {
+		t.Errorf("Expected TCP to port 1001 translated, got %v", err)
+	}
+
+	// the first of duplicate rules matches, as with a scan
+	packet := CreateIPv4TCPPacket(client, server, 40001, 80, TCPFlagSYN)
+	if err := table.HandleOutboundPacket(packet, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	if header, _ := ParseIPv4Header(packet); header.DestinationIP != (IPv4{10, 0, 0, 1}) {
+		t.Errorf("Expected redirect to the first rule, got %v", header.DestinationIP)
+	}
+	packet = CreateIPv4TCPPacket(client, IPv4{8, 8, 4, 4}, 40002, 80, TCPFlagSYN)
+	if err := table.HandleOutboundPacket(packet, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	if header, _ := ParseIPv4Header(packet); header.DestinationIP != (IPv4{8, 8, 4, 4}) {
+		t.Errorf("Expected no redirect for another address, got %v", header.DestinationIP)
+	}
+
+	var hits []string
+	for _, rule := range table.ListRules() {
+		if (rule.Kind == RuleDrop && rule.Drop.DstPort == 1000) || rule.Kind == RuleRedirect {
+			hits = append(hits, fmt.Sprintf("%s/%d=%d", rule.Kind, rule.Protocol, rule.Hits))
+		}
+	}
+	// TCP rules are listed first, then the UDP rule added before the
+	// ProtocolAny one, then its copies in the other pairs
+	want := []string{"drop/6=1", "redirect/6=1", "redirect/6=0", "drop/17=1", "drop/17=0", "drop/33=0"}
+	if !reflect.DeepEqual(hits, want) {
+		t.Errorf("Expected hits %v, got %v", want, hits)
+	}
+}
+
+func TestIPv6TableICMPv6(t *testing.T) {
+	table := NewIPv6(net.ParseIP("2001:db8::1")).(*Table[IPv6])
+	client, _ := ParseIPv6("fd00::100")
+	server, _ := ParseIPv6("2001:db8:53::53")
+	external, _ := ParseIPv6("2001:db8::1")
+
+	ping := CreateIPv6ICMPPacket(client, server, ICMPv6TypeEchoRequest, 0, 1234, 1)
+	if err := table.HandleOutboundPacket(ping, 1); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	header, _ := ParseIPv6Header(ping)
+	icmp, _ := ParseICMPHeader(ping, 40)
+	if header.SourceIP != external || !VerifyIPv6Checksum(ping) {
+		t.Errorf("Expected a valid echo request from %v, got %v", external, header.SourceIP)
+	}
+
+	reply := CreateIPv6ICMPPacket(server, external, ICMPv6TypeEchoReply, 0, icmp.ID, 1)
+	namespace, err := table.HandleInboundPacket(reply)
+	if err != nil {
+		t.Fatalf("HandleInboundPacket failed: %v", err)
+	}
+	header, _ = ParseIPv6Header(reply)
+	icmp, _ = ParseICMPHeader(reply, 40)
+	if namespace != 1 || header.DestinationIP != client || icmp.ID != 1234 || !VerifyIPv6Checksum(reply) {
+		t.Errorf("Echo reply routed to %v id %d in namespace %d", header.DestinationIP, icmp.ID, namespace)
+	}
+
+	// Neighbor solicitations don't cross the NAT
+	ns := CreateIPv6ICMPPacket(client, server, 135, 0, 0, 0)
+	if err := table.HandleOutboundPacket(ns, 1); err != ErrDropPacket {
+		t.Errorf("Expected neighbor discovery dropped, got %v", err)
+	}
+
+	// and IPv4 packets are refused
+	if err := table.HandleOutboundPacket(CreateIPv4UDPPacket(IPv4{192, 168, 1, 1}, IPv4{8, 8, 8, 8}, 1, 53, nil), 1); !errors.Is(err, ErrWrongAddressFamily) {
+		t.Errorf("Expected ErrWrongAddressFamily, got %v", err)
+	}
+}
+
+func TestIPv6TableHandleDirection(t *testing.T) {
+	table := NewIPv6(net.ParseIP("2001:db8::1")).(*Table[IPv6])
+	_, internal, _ := net.ParseCIDR("fd00::/64")
+	if err := table.RegisterInternalPrefix(*internal); err != nil {
+		t.Fatalf("RegisterInternalPrefix failed: %v", err)
+	}
+	client, _ := ParseIPv6("fd00::100")
+	server, _ := ParseIPv6("2001:db8:53::53")
+	external, _ := ParseIPv6("2001:db8::1")
+
+	packet := CreateIPv6UDPPacket(client, server, 5000, 53, nil)
+	if ns, err := table.Handle(packet, 3); err != nil || ns != 3 {
+		t.Fatalf("Handle (outbound) returned namespace %d, %v", ns, err)
+	}
+	header, _ := ParseIPv6Header(packet)
+	udp, _ := ParseUDPHeader(packet, 40)
+	if header.SourceIP != external {
+		t.Errorf("Outbound packet not translated, source %v", header.SourceIP)
+	}
+
+	reply := CreateIPv6UDPPacket(server, external, 53, udp.SourcePort, nil)
+	if ns, err := table.Handle(reply, 0); err != nil || ns != 3 {
+		t.Fatalf("Handle (inbound) returned namespace %d, %v", ns, err)
+	}
+	if header, _ := ParseIPv6Header(reply); header.DestinationIP != client {
+		t.Errorf("Inbound packet not translated, destination %v", header.DestinationIP)
+	}
+
+	ipv4 := CreateIPv4UDPPacket(IPv4{192, 168, 1, 100}, IPv4{8, 8, 8, 8}, 5000, 53, nil)
+	if _, err := table.Handle(ipv4, 3); !errors.Is(err, ErrWrongAddressFamily) {
+		t.Errorf("Expected ErrWrongAddressFamily, got %v", err)
+	}
+}
+
+func TestIPv6TableRecordModifications(t *testing.T) {
+	table := NewIPv6(net.ParseIP("2001:db8::1")).(*Table[IPv6])
+	table.RecordModifications = true
+	client, _ := ParseIPv6("fd00::100")
+	server, _ := ParseIPv6("2001:db8:53::53")
+	external, _ := ParseIPv6("2001:db8::1")
+
+	packet := CreateIPv6UDPPacket(client, server, 5000, 53, []byte("query"))
+	if err := table.HandleOutboundPacket(packet, 3); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	rec := table.LastModification()
+	if want := ModSrcIP | ModSrcPort | ModL4Checksum; rec.Fields != want || !rec.Outbound {
+		t.Errorf("Expected outbound record with %v, got %+v", want, rec)
+	}
+
+	ping := CreateIPv6ICMPPacket(client, server, ICMPv6TypeEchoRequest, 0, 1234, 1)
+	if err := table.HandleOutboundPacket(ping, 3); err != nil {
+		t.Fatalf("HandleOutboundPacket failed: %v", err)
+	}
+	if want := ModSrcIP | ModICMPID | ModL4Checksum; table.LastModification().Fields&^want != 0 {
+		t.Errorf("Expected at most %v changed, got %v", want, table.LastModification().Fields)
+	}
+
+	udp, _ := ParseUDPHeader(packet, 40)
+	reply := CreateIPv6UDPPacket(server, external, 53, udp.SourcePort, []byte("answer"))
+	if _, err := table.HandleInboundPacket(reply); err != nil {
+		t.Fatalf("HandleInboundPacket failed: %v", err)
+	}
+	if want := ModDstIP | ModDstPort | ModL4Checksum; table.LastModification().Fields != want {
+		t.Errorf("Expected %v changed inbound, got %v", want, table.LastModification().Fields)
+	}
+
+	relabeled := slices.Clone(packet)
+	relabeled[3] ^= 1
+	relabeled[7]--
+	if got := diffPacket(packet, relabeled); got != ModFlowLabel|ModTTL {
+		t.Errorf("Expected flow label and hop limit changes, got %v", got)
+	}
+}
+
+func TestIPv6TableChecksumOffsets(t *testing.T) {
+	table := NewIPv6(net.ParseIP("2001:db8::1")).(*Table[IPv6])
+	table.SkipChecksums = true
+	client, _ := ParseIPv6("fd00::100")
+	server, _ := ParseIPv6("2001:db8:53::53")
+
+	for _, tc := range []struct {
+		name   string
+		packet []byte
+	}{
+		{"tcp", CreateIPv6TCPPacket(client, server, 40000, 80, TCPFlagSYN)},
+		{"udp", CreateIPv6UDPPacket(client, server, 5000, 53, []byte("query"))},
+		{"icmpv6", CreateIPv6ICMPPacket(client, server, ICMPv6TypeEchoRequest, 0, 77, 1)},
+	} {
+		offsets, err := table.HandleOutboundPacketOffsets(tc.packet, 1)
+		if err != nil {
+			t.Fatalf("%s: HandleOutboundPacketOffsets failed: %v", tc.name, err)
+		}
+		if offsets.IPChecksum != -1 || offsets.L4Start != 40 || offsets.L4Checksum < 40 {
+			t.Errorf("%s: unexpected offsets %+v", tc.name, offsets)
+		}
+
+		// finish the job like hardware would, at the reported offsets
+		ip, _ := ParseIPv6Header(tc.packet)
+		binary.BigEndian.PutUint16(tc.packet[offsets.L4Checksum:], 0)
+		sum := calculateIPv6Checksum(ip.SourceIP, ip.DestinationIP, ip.Protocol, tc.packet[offsets.L4Start:])
+		binary.BigEndian.PutUint16(tc.packet[offsets.L4Checksum:], sum)
+		if !VerifyIPv6Checksum(tc.packet) {
+			t.Errorf("%s: checksum computed at the reported offset doesn't verify", tc.name)
+		}
+	}
+}
+
+func TestIPv6TableMulticastFanOut(t *testing.T) {
+	table := NewIPv6(net.ParseIP("2001:db8::1")).(*Table[IPv6])
+	group, _ := ParseIPv6("ff0e::101")
+	source, _ := ParseIPv6("2001:db8:113::5")
+
+	for _, ns := range []uintptr{7, 3} {
+		if err := table.JoinMulticast(group, ns); err != nil {
+			t.Fatalf("JoinMulticast failed: %v", err)
+		}
+	}
+	packet := CreateIPv6UDPPacket(source, group, 5000, 5000, []byte("stream"))
+	orig := slices.Clone(packet)
+	namespaces, err := table.HandleInboundPacketMulticast(packet)
+	if err != nil || !slices.Equal(namespaces, []uintptr{3, 7}) {
+		t.Errorf("Expected namespaces [3 7], got %v (%v)", namespaces, err)
+	}
+	if !bytes.Equal(packet, orig) {
+		t.Error("Multicast packet must not be modified")
+	}
+
+	ipv4 := CreateIPv4UDPPacket(IPv4{203, 0, 113, 5}, IPv4{239, 1, 2, 3}, 5000, 5000, nil)
+	if _, err := table.HandleInboundPacketMulticast(ipv4); !errors.Is(err, ErrWrongAddressFamily) {
+		t.Errorf("Expected ErrWrongAddressFamily, got %v", err)
+	}
+}
@@ -124,4 +124,62 @@ func VerifyUDPChecksum(packet []byte) bool {
 	dstIP := IPv4{packet[16], packet[17], packet[18], packet[19]}
 	udpLen := len(packet) - 20
 	return calculateUDPChecksum(srcIP, dstIP, packet[20:20+udpLen]) == 0
-}
\ No newline at end of file
+}
+// createIPv6Packet creates a test IPv6 packet carrying l4, the transport
+// header and payload, with the checksum at l4[checksumAt] computed
+func createIPv6Packet(srcIP, dstIP IPv6, protocol uint8, l4 []byte, checksumAt int) []byte {
+	packet := make([]byte, 40+len(l4))
+	packet[0] = 0x60 // Version 6
+	binary.BigEndian.PutUint16(packet[4:6], uint16(len(l4)))
+	packet[6] = protocol
+	packet[7] = 64 // Hop limit
+	copy(packet[8:24], srcIP[:])
+	copy(packet[24:40], dstIP[:])
+	copy(packet[40:], l4)
+
+	checksum := calculateIPv6Checksum(srcIP, dstIP, protocol, packet[40:])
+	binary.BigEndian.PutUint16(packet[40+checksumAt:], checksum)
+	return packet
+}
+
+// CreateIPv6TCPPacket creates a test IPv6 packet with TCP header
+func CreateIPv6TCPPacket(srcIP, dstIP IPv6, srcPort, dstPort uint16, flags uint8) []byte {
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp[0:2], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:4], dstPort)
+	tcp[12] = 0x50 // Data offset (5 * 4 = 20 bytes)
+	tcp[13] = flags
+	return createIPv6Packet(srcIP, dstIP, ProtocolTCP, tcp, 16)
+}
+
+// CreateIPv6UDPPacket creates a test IPv6 packet with UDP header
+func CreateIPv6UDPPacket(srcIP, dstIP IPv6, srcPort, dstPort uint16, data []byte) []byte {
+	udp := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint16(udp[0:2], srcPort)
+	binary.BigEndian.PutUint16(udp[2:4], dstPort)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(len(udp)))
+	copy(udp[8:], data)
+	return createIPv6Packet(srcIP, dstIP, ProtocolUDP, udp, 6)
+}
+
+// CreateIPv6ICMPPacket creates a test IPv6 packet with ICMPv6 header
+func CreateIPv6ICMPPacket(srcIP, dstIP IPv6, icmpType, code uint8, id, seq uint16) []byte {
+	icmp := make([]byte, 8)
+	icmp[0] = icmpType
+	icmp[1] = code
+	binary.BigEndian.PutUint16(icmp[4:6], id)
+	binary.BigEndian.PutUint16(icmp[6:8], seq)
+	return createIPv6Packet(srcIP, dstIP, ProtocolICMPv6, icmp, 2)
+}
+
+// VerifyIPv6Checksum verifies the TCP, UDP or ICMPv6 checksum of an IPv6
+// packet without extension headers
+func VerifyIPv6Checksum(packet []byte) bool {
+	if len(packet) < 48 {
+		return false
+	}
+	var srcIP, dstIP IPv6
+	copy(srcIP[:], packet[8:24])
+	copy(dstIP[:], packet[24:40])
+	return calculateIPv6Checksum(srcIP, dstIP, packet[6], packet[40:]) == 0
+}
@@ -0,0 +1,90 @@
+package swnat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Trace format
+//
+// A trace is a sequence of records, each made of its length as a big-endian
+// uint32 followed by: direction (1 byte, 0 outbound, 1 inbound), namespace
+// (8 bytes, 0 for inbound), timestamp as returned by Table.Now (8 bytes),
+// then the packet as it was passed to the table, before translation.
+const (
+	traceOutbound = 0
+	traceInbound  = 1
+
+	traceHeaderLen = 17
+)
+
+// traceState serializes writes to Table.TraceWriter
+type traceState struct {
+	mutex sync.Mutex
+	buf   []byte
+}
+
+// trace appends a packet to TraceWriter. Write errors are ignored, tracing
+// never affects packet handling.
+func (t *Table[IP]) trace(direction byte, packet []byte, namespace uintptr, now int64) {
+	t.tracer.mutex.Lock()
+	defer t.tracer.mutex.Unlock()
+
+	buf := t.tracer.buf[:0]
+	buf = binary.BigEndian.AppendUint32(buf, uint32(traceHeaderLen+len(packet)))
+	buf = append(buf, direction)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(namespace))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(now))
+	buf = append(buf, packet...)
+	t.tracer.buf = buf
+
+	t.TraceWriter.Write(buf)
+}
+
+// ReplayTrace feeds the packets of a trace written through TraceWriter to
+// the table, which should be freshly created with the same settings as the
+// recorded one. Now returns the recorded timestamps during the replay. Errors
+// returned by the packet handlers are part of the replay and ignored.
+func (t *Table[IP]) ReplayTrace(r io.Reader) error {
+	var now int64
+	origNow := t.Now
+	t.Now = func() int64 { return now }
+	defer func() { t.Now = origNow }()
+
+	var lenBuf [4]byte
+	var buf []byte
+	for {
+		if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("failed to read trace record length: %w", noEOF(err))
+		}
+		recLen := int(binary.BigEndian.Uint32(lenBuf[:]))
+		if recLen < traceHeaderLen {
+			return fmt.Errorf("trace record too short (%d bytes)", recLen)
+		}
+		if cap(buf) < recLen {
+			buf = make([]byte, recLen)
+		}
+		buf = buf[:recLen]
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return fmt.Errorf("truncated trace record: %w", noEOF(err))
+		}
+
+		namespace := uintptr(binary.BigEndian.Uint64(buf[1:9]))
+		now = int64(binary.BigEndian.Uint64(buf[9:17]))
+		packet := buf[traceHeaderLen:]
+
+		switch buf[0] {
+		case traceOutbound:
+			t.HandleOutboundPacket(packet, namespace)
+		case traceInbound:
+			t.HandleInboundPacket(packet)
+		default:
+			return fmt.Errorf("invalid trace record direction %d", buf[0])
+		}
+	}
+}
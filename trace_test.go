@@ -0,0 +1,62 @@
+package swnat
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func sortedConns(table *Table[IPv4]) []ConnInfo[IPv4] {
+	var res []ConnInfo[IPv4]
+	for _, p := range table.pairs() {
+		res = append(res, p.snapshot()...)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Protocol != res[j].Protocol {
+			return res[i].Protocol < res[j].Protocol
+		}
+		return res[i].OutsideSrcPort < res[j].OutsideSrcPort
+	})
+	return res
+}
+
+func TestTraceReplay(t *testing.T) {
+	src := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	now := int64(1000)
+	src.Now = func() int64 { now++; return now }
+
+	var trace bytes.Buffer
+	src.TraceWriter = &trace
+
+	client := IPv4{192, 168, 1, 100}
+	server := IPv4{8, 8, 8, 8}
+
+	src.HandleOutboundPacket(CreateIPv4TCPPacket(client, server, 45000, 80, TCPFlagSYN), 1)
+	src.HandleOutboundPacket(CreateIPv4ICMPPacket(client, server, ICMPTypeEchoRequest, 0, 1234, 1), 2)
+	udp := CreateIPv4UDPPacket(client, server, 5000, 53, []byte("query"))
+	src.HandleOutboundPacket(udp, 1)
+	udpHeader, _ := ParseUDPHeader(udp, 20)
+	src.HandleInboundPacket(CreateIPv4UDPPacket(server, src.externalIP, 53, udpHeader.SourcePort, []byte("answer")))
+	// Dropped packets are recorded too
+	src.HandleInboundPacket(CreateIPv4UDPPacket(server, src.externalIP, 53, 1, nil))
+
+	dst := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4])
+	if err := dst.ReplayTrace(bytes.NewReader(trace.Bytes())); err != nil {
+		t.Fatalf("ReplayTrace failed: %v", err)
+	}
+
+	want := sortedConns(src)
+	if len(want) != 3 {
+		t.Fatalf("Expected 3 recorded connections, got %d", len(want))
+	}
+	if got := sortedConns(dst); !reflect.DeepEqual(got, want) {
+		t.Errorf("Replayed state differs:\n got %+v\nwant %+v", got, want)
+	}
+
+	// Truncated traces are reported
+	if err := NewIPv4(net.ParseIP("1.2.3.4")).(*Table[IPv4]).ReplayTrace(bytes.NewReader(trace.Bytes()[:trace.Len()-1])); err == nil {
+		t.Error("Expected an error replaying a truncated trace")
+	}
+}
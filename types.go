@@ -1,6 +1,10 @@
 package swnat
 
-import "sync"
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
 
 type (
 	IPv4 [4]byte
@@ -14,9 +18,20 @@ type NAT interface {
 }
 
 type Conn[IP comparable] struct {
-	LastSeen  int64
-	Protocol  uint8 // ICMP, TCP, UDP
-	Namespace uintptr
+	CreatedAt    int64
+	LastSeen     int64
+	LastOutbound int64 // last packet from the internal host
+	LastInbound  int64 // last packet from the remote host
+	Protocol     uint8 // ICMP, TCP, UDP
+	Namespace    uintptr
+	DSCP         uint8 // last DSCP seen on outbound packets
+
+	// packets and bytes seen from the internal host (out) and the remote
+	// host (in), IP headers included
+	PacketsOut uint64
+	PacketsIn  uint64
+	BytesOut   uint64
+	BytesIn    uint64
 
 	LocalSrcIP   IP
 	LocalSrcPort uint16
@@ -28,9 +43,103 @@ type Conn[IP comparable] struct {
 	OutsideDstIP   IP
 	OutsideDstPort uint16
 
+	// TCP sequence offsets left by ALGs resizing payloads, see
+	// Table.AdjustTCPSequence. SeqDelta shifts the sequence numbers of
+	// outbound segments, AckDelta those of inbound ones.
+	SeqDelta int32
+	AckDelta int32
+	seqAdj   seqAdjust
+	ackAdj   seqAdjust
+
 	// special flags
 	RewriteDestination bool
+	PreserveSource     bool // Pure DNAT, the outside source is the local source
 	PendingSweep       bool // Mark connection for immediate removal (e.g. TCP FIN/RST)
+	Draining           bool // External port is being drained, see Table.DrainExternalPort
+	InboundInitiated   bool // Opened by a remote client, through a port forward or DNAT rule
+	Assured            bool // Both directions carried traffic, evicted after one-way flows
+
+	State   TCPState // TCP only, see Table.TCPClosingTimeout
+	finSeen uint8    // finOutbound and finInbound
+	synDir  uint8    // direction of the SYN of a TCPStateSynSent connection
+
+	Payload []byte // first payload bytes sent, see Table.CapturePayloadBytes
+
+	drainDeadline int64             // when a draining connection is torn down, 0 for normal expiry
+	quicConnID    string            // QUIC destination connection ID, when tracked by the ALG
+	espSPIOut     uint32            // SPI of outbound ESP packets
+	espSPIIn      uint32            // SPI of inbound ESP packets, 0 until learned
+	allocator     PortAllocator[IP] // where the outside port came from, nil for the pair's pool
+	pooled        bool              // returned to the pair's pool on removal
+}
+
+// TCPState is the progress of a TCP connection, derived from the flags seen
+// in both directions. Connections adopted mid-stream start established.
+type TCPState uint8
+
+const (
+	TCPStateEstablished TCPState = iota // both sides exchanged segments, no FIN seen yet
+	TCPStateClosing                     // FIN seen in one direction
+	TCPStateTimeWait                    // FIN seen in both directions
+	TCPStateSynSent                     // opened by a SYN the other side hasn't answered
+	TCPStateClosed                      // reset, removed at the next maintenance
+)
+
+func (s TCPState) String() string {
+	switch s {
+	case TCPStateEstablished:
+		return "ESTABLISHED"
+	case TCPStateClosing:
+		return "CLOSING"
+	case TCPStateTimeWait:
+		return "TIME_WAIT"
+	case TCPStateSynSent:
+		return "SYN_SENT"
+	case TCPStateClosed:
+		return "CLOSED"
+	}
+	return fmt.Sprintf("TCPState(%d)", uint8(s))
+}
+
+// Directions a FIN was seen in, see Conn.finSeen
+const (
+	finOutbound = 1 << iota
+	finInbound
+)
+
+// ConnInfo is a point-in-time copy of a connection's state. Changing it has
+// no effect on the table.
+type ConnInfo[IP comparable] struct {
+	Protocol     uint8
+	Namespace    uintptr
+	CreatedAt    int64
+	LastSeen     int64
+	LastOutbound int64
+	LastInbound  int64
+	DSCP         uint8
+	PacketsOut   uint64
+	PacketsIn    uint64
+	BytesOut     uint64
+	BytesIn      uint64
+
+	LocalSrcIP   IP
+	LocalSrcPort uint16
+	LocalDstIP   IP
+	LocalDstPort uint16
+
+	OutsideSrcIP   IP
+	OutsideSrcPort uint16
+	OutsideDstIP   IP
+	OutsideDstPort uint16
+
+	RewriteDestination bool
+	PreserveSource     bool
+	PendingSweep       bool
+	Draining           bool
+	InboundInitiated   bool
+	Assured            bool
+	State              TCPState
+	Payload            string // Conn.Payload, as a string to keep ConnInfo comparable
 }
 
 type ExternalKey[IP comparable] struct {
@@ -49,17 +158,101 @@ type RedirectRule[IP comparable] struct {
 	DstPort    uint16
 	NewDstIP   IP
 	NewDstPort uint16
+
+	// PreserveSource performs pure destination NAT, leaving the source
+	// address and port untouched
+	PreserveSource bool
+
+	hits *atomic.Uint64
 }
 
 // DropRule defines a rule for dropping traffic to specific ports
 type DropRule struct {
 	DstPort uint16
+
+	hits *atomic.Uint64
+}
+
+// PortRangeForward forwards inbound traffic to an external port range to an
+// internal host, keeping the port offset
+type PortRangeForward[IP comparable] struct {
+	ExtStart   uint16
+	ExtEnd     uint16
+	InternalIP IP
+	Namespace  uintptr
+
+	// InternalPort is the port ExtStart is forwarded to, 0 keeping the
+	// external ports
+	InternalPort uint16
+
+	hits *atomic.Uint64
+}
+
+// Kinds of rules reported by Table.ListRules
+const (
+	RuleDrop     = "drop"
+	RuleRedirect = "redirect" // redirect and DNAT rules
+	RuleForward  = "forward"  // port range forwards
+)
+
+// RuleInfo describes a rule of the table and how often it matched. Only the
+// field matching Kind is set.
+type RuleInfo[IP comparable] struct {
+	Protocol uint8
+	Kind     string
+
+	Drop     DropRule
+	Redirect RedirectRule[IP]
+	Forward  PortRangeForward[IP]
+
+	// Hits is the number of packets a drop rule dropped, or of
+	// connections a redirect rule or forward created
+	Hits uint64
 }
 
 type Pair[IP comparable] struct {
 	mutex         sync.RWMutex
+	connPool      sync.Pool // recycled *Conn[IP], see Table.ReuseConns
 	in            map[ExternalKey[IP]]*Conn[IP]
 	out           map[InternalKey[IP]]*Conn[IP]
+	byPort        map[uint16][]*Conn[IP] // index by outside source port
 	redirectRules []RedirectRule[IP]
 	dropRules     []DropRule
+
+	// the first rule matching each destination, so packets are matched
+	// without scanning the rules, see addDropRuleLocked
+	dropIndex     map[uint16]*atomic.Uint64
+	redirectIndex map[redirectMatch[IP]]int
+	forwards      []PortRangeForward[IP]
+
+	// ruleDrops counts the packets dropped by drop rules, including rules
+	// since removed
+	ruleDrops atomic.Uint64
+
+	// ports, when set, is the pool outside ports (or ICMP identifiers) of
+	// this pair are allocated from, and released to on removal
+	ports *portPool
+
+	// srcPorts counts the distinct outside ports allocated to each internal
+	// source IP, srcPortRefs the connections of the source using each of
+	// them, see Table.MaxPortsPerInternalIP
+	srcPorts    map[IP]int
+	srcPortRefs map[sourcePort[IP]]int
+
+	// halfOpen counts the connections of each namespace in TCPStateSynSent
+	// after an outbound SYN, see Table.MaxHalfOpenPerNamespace
+	halfOpen map[uintptr]int
+
+	// toDest counts the connections of each namespace to each destination,
+	// see Table.MaxICMPToDestination
+	toDest map[destination[IP]]int
+
+	reaps ProtocolReapStats
+
+	// cache, when set, holds recent lookups, see Table.EnableFlowCache
+	cache atomic.Pointer[flowCache[IP]]
+
+	// QUIC connection IDs tracked by the ALG, and the ID lengths seen
+	quic       map[string]*Conn[IP]
+	quicIDLens [maxQUICConnIDLen + 1]bool
 }